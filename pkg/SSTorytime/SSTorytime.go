@@ -8,6 +8,7 @@
 package SSTorytime
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -37,6 +38,7 @@ import (
 
 const (
 	CREDENTIALS_FILE = ".SSTorytime" // user's home directory
+	EMBEDDED_STORE_ENV = "SST_EMBEDDED_DB" // file path, selects the embedded store instead of postgres
 
 	ERR_ST_OUT_OF_BOUNDS = "Link STtype is out of bounds (must be -3 to +3)"
 	ERR_ILLEGAL_LINK_CLASS = "ILLEGAL LINK CLASS"
@@ -119,7 +121,108 @@ var CLASS_CHANNEL_DESCRIPTION = []string{"","single word ngram","two word ngram"
 
 type PoSST struct {
 
-   DB *sql.DB
+   DB    *sql.DB      // nil when not running over postgres
+   Store GraphStore   // storage backend, see GraphStore below
+   User  string       // whose progress and context to track, see users.go
+   Session string     // separate short term memory within a user, see stm.go
+}
+
+//******************************************************************
+
+type GraphStore interface {
+
+	// The storage backend behind PoSST. The library functions in this
+	// file dispatch to it: the postgres implementation holds the SQL,
+	// the embedded one is pure Go and file backed, for running without
+	// a database server
+
+	Backend() string
+	Prepare()                              // check/create the schema before use
+
+	// Node upsert and retrieval
+
+	UploadNode(n Node)                     // managed NPtr, with link arrays
+	CreateNode(n Node) Node                // managed NPtr, idempotent by name
+	AppendNode(n Node) Node                // auto-numbered NPtr, idempotent
+	AppendLink(nptr NodePtr,lnk Link,sttype int) bool
+	GetNode(nptr NodePtr) (Node,bool)
+	MatchNodes(name,chap string,cn []string,arrows []ArrowPtr,seq bool,limit int) []NodePtr
+	MatchQuery(query *TextQuery,chap string,cn []string,arrows []ArrowPtr,seq bool,limit int) ([]NodePtr,[]float32)
+	MatchChapters(src string) []string
+	DeleteChapter(chapter string) bool       // false if there was nothing to delete
+	MaxCPtr(class int) int                 // -1 if the class is empty
+
+	// Incremental upload, see incremental.go
+
+	GetNodesByText(texts []string) []Node  // raw stored nodes, exact text match
+	GetChapterNodes(chapters []string) []Node
+	CountChapterNodes(ctx context.Context,chapter string) (int,error)
+	GetChapterPageMap(chapters []string) []PageMap
+	ApplyDelta(delta GraphDelta,wait_counter bool) error // all or nothing
+
+	// Graph analytics, see graph_report
+
+	Singletons(sttypes []int,chap string,cn []string) ([]NodePtr,[]NodePtr)
+	LinkedNodes(sttypes []int,chap string,cn []string) []Node // only the sttypes channels
+	Appointments(arrow ArrowPtr,sttype,min int,chap string,cn []string) []Appointment
+
+	// Cone expansion
+
+	FwdConeNodes(start NodePtr,sttype,depth,limit int) []NodePtr
+	FwdConeLinks(start NodePtr,sttype,depth int) []Link
+	FwdPaths(start NodePtr,sttype,depth,limit int) [][]Link
+	EntireConePaths(orientation string,start []NodePtr,depth int,chapter string,context []string,limit int) [][]Link
+	ConstraintConePaths(start []NodePtr,depth int,chapter string,context []string,arrows []ArrowPtr,sttypes []int,limit int) [][]Link
+	ConstrainedFwdLinks(start []NodePtr,chapter string,context []string,sttypes []int,arrows []ArrowPtr,limit int) []Link
+
+	// Page map
+
+	AppendPageMap(line PageMap)
+	GetPageMap(chap string,cn []string,page int) []PageMap
+	GetChaptersByContext(chap string,cn []string,limit int) map[string][]string
+
+	// Arrow and context directories
+
+	ClearArrows()                          // before uploading the whole directory
+	UploadArrow(arrow ArrowDirectory)
+	UploadInverseArrow(plus,minus ArrowPtr)
+	DownloadArrows() ([]ArrowDirectory,map[ArrowPtr]ArrowPtr)
+	UploadContext(context string,ptr ContextPtr) ContextPtr
+	GetContextByName(context string) (string,ContextPtr)
+	GetContextByPtr(ptr ContextPtr) (string,ContextPtr)
+	DownloadContexts() []ContextDirectory
+
+	// Access statistics
+
+	LastSawSection(user,name string)
+	LastSawNPtr(user string,nptr NodePtr,name string)
+	GetLastSeen(user string) []LastSeen
+	GetLastSeenNPtr(user string,nptr NodePtr) LastSeen
+	GetSeenNPtrs(user string,horizon int) []NodePtr
+
+	// Private notes on shared nodes, see users.go
+
+	AddOverlay(ov Overlay) bool
+	GetOverlays(user,chap string) []Overlay
+	GetNodeOverlays(user string,nptr NodePtr) []Overlay
+	GetNodesOverlays(user string,nptrs []NodePtr) map[NodePtr][]Overlay
+	RemoveOverlays(user string,nptr NodePtr) int
+
+	// Spaced repetition, see review.go
+
+	GetReviewCard(user string,nptr NodePtr) (ReviewCard,bool)
+	GetReviewCards(user string) []ReviewCard
+	SaveReviewCard(card ReviewCard)
+
+	// Short term memory of search context, see stm.go
+
+	GetSTM(user,session string) []STMEntry
+	SaveSTM(user,session string,changed []STMEntry,forgotten []string) // upserts
+
+	// Make uploads durable
+
+	Sync()
+	Close()
 }
 
 //******************************************************************
@@ -350,6 +453,11 @@ var (
 	CONTEXT_DIR = make(map[string]ContextPtr)   // Look up long name int referene
 	CONTEXT_TOP ContextPtr
 
+	// The arrow and context directories are shared by concurrent searches,
+	// e.g. in the http_server, so they are read and changed under this lock
+
+	DIRECTORY_MUTEX sync.RWMutex
+
 	PAGE_MAP []PageMap
 
 	NODE_DIRECTORY NodeDirectory  // Internal histo-representations
@@ -392,6 +500,7 @@ type WebPath struct {
 	NPtr    NodePtr
 	Arr     ArrowPtr
 	STindex int
+	Wgt     float32 // link weight, for arrows
 	Line    int     // used for pagemap
 	Name    string
 	Chp     string
@@ -421,6 +530,8 @@ type NodeEvent struct {
         NPtr    NodePtr
 	XYZ     Coords
 	Orbits  [ST_TOP][]Orbit
+	Notes   []string // the user's own overlays on the node
+	Rank    *ContextRank // why it was ordered there, see ranking.go
 }
 
 //******************************************************************
@@ -431,6 +542,7 @@ type WebConePaths struct {
 	Title      string
 	BTWC       []string
 	Paths      [][]WebPath
+	Weights    []float32   // accumulated link weight of each path
 	SuperNodes []string
 }
 
@@ -487,6 +599,37 @@ type LastSeen struct {
 func Open(load_arrows bool) PoSST {
 
 	var sst PoSST
+
+	// An embedded, file-backed store needs no database server
+
+	embedded := os.Getenv(EMBEDDED_STORE_ENV)
+
+	if len(embedded) > 0 {
+		return OpenEmbedded(embedded,load_arrows)
+	}
+
+	sst.DB = ConnectDB()
+
+	sst.Store = NewPostgresStore(sst.DB)
+
+	MemoryInit()
+	Configure(sst,load_arrows)
+
+	NO_NODE_PTR.Class = 0
+	NO_NODE_PTR.CPtr =  -1
+	NONODE.Class = 0
+	NONODE.CPtr = 0
+
+	return sst
+}
+
+// **************************************************************************
+
+func ConnectDB() *sql.DB {
+
+	// Connect to postgres without touching the schema (see also sstadmin)
+
+	var db *sql.DB
 	var err error
 
 	// Replace this with a private file
@@ -508,31 +651,23 @@ func Open(load_arrows bool) PoSST {
 	env := os.Getenv("POSTGRESQL_URI")
 
 	if len(env) == 0 {
-		sst.DB, err = sql.Open("postgres", connect_str)
+		db, err = sql.Open("postgres", connect_str)
 	} else {
-		sst.DB, err = sql.Open("postgres",env)
+		db, err = sql.Open("postgres",env)
 		if err != nil {
 			fmt.Println("Error connecting to the database: ", err)
 			os.Exit(-1)
 		}
 	}
 
-	err = sst.DB.Ping()
+	err = db.Ping()
 	
 	if err != nil {
 		fmt.Println("Error pinging the database: ", err)
 		os.Exit(-1)
 	}
 
-	MemoryInit()
-	Configure(sst,load_arrows)
-
-	NO_NODE_PTR.Class = 0
-	NO_NODE_PTR.CPtr =  -1
-	NONODE.Class = 0
-	NONODE.CPtr = 0
-
-	return sst
+	return db
 }
 
 // **************************************************************************
@@ -651,115 +786,15 @@ func MemoryInit() {
 
 func Configure(sst PoSST,load_arrows bool) {
 
-	// Tmp reset
+	// Make the schema ready (postgres), then load the directories
 
-	if WIPE_DB {
+	sst.Store.Prepare()
 
-		fmt.Println("***********************")
-		fmt.Println("* WIPING DB")
-		fmt.Println("***********************")
-		
-		sst.DB.QueryRow("DROP INDEX sst_nan")
-		sst.DB.QueryRow("DROP INDEX sst_type")
-		sst.DB.QueryRow("DROP INDEX sst_gin")
-		sst.DB.QueryRow("DROP INDEX sst_ungin")
-		sst.DB.QueryRow("DROP INDEX sst_s")
-		sst.DB.QueryRow("DROP INDEX sst_n")
-		sst.DB.QueryRow("DROP INDEX sst_cnt")
-
-		sst.DB.QueryRow("drop function fwdconeaslinks")
-		sst.DB.QueryRow("drop function fwdconeasnodes")
-		sst.DB.QueryRow("drop function fwdpathsaslinks")
-		sst.DB.QueryRow("drop function getfwdlinks")
-		sst.DB.QueryRow("drop function getfwdnodes")
-		sst.DB.QueryRow("drop function getneighboursbytype")
-		sst.DB.QueryRow("drop function getsingletonaslink")
-		sst.DB.QueryRow("drop function AllNCPathsAsLinks")
-		sst.DB.QueryRow("drop function AllSuperNCPathsAsLinks")
-		sst.DB.QueryRow("drop function SumAllNCPaths")
-		sst.DB.QueryRow("drop function GetNCFwdLinks")
-		sst.DB.QueryRow("drop function GetNCCLinks")
-
-		sst.DB.QueryRow("drop function getsingletonaslinkarray")
-		sst.DB.QueryRow("drop function idempinsertnode")
-		sst.DB.QueryRow("drop function sumfwdpaths")
-		sst.DB.QueryRow("drop function match_context")
-		sst.DB.QueryRow("drop function empty_path")
-		sst.DB.QueryRow("drop function match_arrows")
-		sst.DB.QueryRow("drop function ArrowInList")
-		sst.DB.QueryRow("drop function GetNCCStoryStartNodes")
-		sst.DB.QueryRow("drop function GetStoryStartNodes")
-		sst.DB.QueryRow("drop function GetAppointments")
-		sst.DB.QueryRow("drop function UnCmp")
-		sst.DB.QueryRow("drop function DeleteChapter")
-
-		sst.DB.QueryRow("drop function lastsawsection(text)")
-		sst.DB.QueryRow("drop function lastsawnptr(nodeptr)")
-
-		sst.DB.QueryRow("drop type NodePtr")
-		sst.DB.QueryRow("drop type Link")
-		sst.DB.QueryRow("drop type Appointment")
-
-		sst.DB.QueryRow("drop table Node")
-		sst.DB.QueryRow("drop table PageMap")
-		sst.DB.QueryRow("drop table NodeArrowNode")
-		sst.DB.QueryRow("drop table ArrowDirectory")
-		sst.DB.QueryRow("drop table ArrowInverses")
-		sst.DB.QueryRow("drop table ContextDirectory")
-		sst.DB.QueryRow("drop table LastSeen")
-
-	}
-
-	// Create functions, some we use in autocreating index columns
-
-	sst.DB.QueryRow("CREATE EXTENSION unaccent")
-
-	if !CreateType(sst,NODEPTR_TYPE) {
-		fmt.Println("Unable to create type as, ",NODEPTR_TYPE)
-		os.Exit(-1)
-	}
-
-	if !CreateType(sst,LINK_TYPE) {
-		fmt.Println("Unable to create type as, ",LINK_TYPE)
-		os.Exit(-1)
-	}
-
-	if !CreateType(sst,APPOINTMENT_TYPE) {
-		fmt.Println("Unable to create type as, ",APPOINTMENT_TYPE)
-		os.Exit(-1)
-	}
-
-	if !CreateTable(sst,CONTEXT_DIRECTORY_TABLE) {
-		fmt.Println("Unable to create table as, ",CONTEXT_DIRECTORY_TABLE)
-		os.Exit(-1)
-	}
-
-	DefineStoredFunctions(sst)
-
-	if !CreateTable(sst,PAGEMAP_TABLE) {
-		fmt.Println("Unable to create table as, ",PAGEMAP_TABLE)
-		os.Exit(-1)
-	}
-
-	if !CreateTable(sst,NODE_TABLE) {
-		fmt.Println("Unable to create table as, ",NODE_TABLE)
-		os.Exit(-1)
-	}
+	// Cached nodes belong to the last store opened, not this one
 
-	if !CreateTable(sst,ARROW_INVERSES_TABLE) {
-		fmt.Println("Unable to create table as, ",ARROW_INVERSES_TABLE)
-		os.Exit(-1)
-	}
-
-	if !CreateTable(sst,ARROW_DIRECTORY_TABLE) {
-		fmt.Println("Unable to create table as, ",ARROW_DIRECTORY_TABLE)
-		os.Exit(-1)
-	}
-
-	if !CreateTable(sst,LASTSEEN_TABLE) {
-		fmt.Println("Unable to create table as, ",LASTSEEN_TABLE)
-		os.Exit(-1)
-	}
+	MUTEX.Lock()
+	NODE_CACHE = make(map[NodePtr]NodePtr)
+	MUTEX.Unlock()
 
 	DownloadArrowsFromDB(sst)
 	DownloadContextsFromDB(sst)
@@ -771,7 +806,8 @@ func Configure(sst PoSST,load_arrows bool) {
 // **************************************************************************
 
 func Close(sst PoSST) {
-	sst.DB.Close()
+
+	sst.Store.Close()
 }
 
 // **************************************************************************
@@ -780,7 +816,10 @@ func Close(sst PoSST) {
 
 func GetContext(contextptr ContextPtr) string {
 
-	exists := int(contextptr) < len(CONTEXT_DIRECTORY)
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	exists := contextptr >= 0 && int(contextptr) < len(CONTEXT_DIRECTORY)
 
 	if exists {
 		return CONTEXT_DIRECTORY[contextptr].Context
@@ -799,6 +838,9 @@ func RegisterContext(parse_state map[string]bool,context []string) ContextPtr {
 		return 0
 	}
 
+	DIRECTORY_MUTEX.Lock()
+	defer DIRECTORY_MUTEX.Unlock()
+
 	ctxptr,exists := CONTEXT_DIR[ctxstr] 
 
 	if !exists {
@@ -1255,6 +1297,9 @@ func MergeContextLists(one,two []string) ContextPtr {
 
 	// Register the merger of contexts
 
+	DIRECTORY_MUTEX.Lock()
+	defer DIRECTORY_MUTEX.Unlock()
+
 	ctxptr,ok := CONTEXT_DIR[ctxstr]
 
 	if ok {
@@ -1370,6 +1415,9 @@ func InsertArrowDirectory(stname,alias,name,pm string) ArrowPtr {
 
 	var newarrow ArrowDirectory
 
+	DIRECTORY_MUTEX.Lock()
+	defer DIRECTORY_MUTEX.Unlock()
+
 	// Check is already exists - harmless
 
 	prev_alias,a_exists := ARROW_SHORT_DIR[alias]
@@ -1410,10 +1458,82 @@ func InsertInverseArrowDirectory(fwd,bwd ArrowPtr) {
 
 	// Lookup inverse by long name, only need this in search presentation
 
+	DIRECTORY_MUTEX.Lock()
+	defer DIRECTORY_MUTEX.Unlock()
+
 	INVERSE_ARROWS[fwd] = bwd
 	INVERSE_ARROWS[bwd] = fwd
 }
 
+//**************************************************************
+
+func InverseArrow(arrow ArrowPtr) ArrowPtr {
+
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	return INVERSE_ARROWS[arrow]
+}
+
+//**************************************************************
+
+func LookupInverseArrow(arrow ArrowPtr) (ArrowPtr,bool) {
+
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	inv,ok := INVERSE_ARROWS[arrow]
+	return inv,ok
+}
+
+//**************************************************************
+
+func LookupArrowShort(short string) (ArrowPtr,bool) {
+
+	// Memory only, for importers that read SSTconfig without a database
+
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	ptr,ok := ARROW_SHORT_DIR[short]
+	return ptr,ok
+}
+
+//**************************************************************
+
+func LookupArrowLong(long string) (ArrowPtr,bool) {
+
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	ptr,ok := ARROW_LONG_DIR[long]
+	return ptr,ok
+}
+
+//**************************************************************
+
+func ArrowDirectoryEntry(arrow ArrowPtr) ArrowDirectory {
+
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	if arrow >= 0 && int(arrow) < len(ARROW_DIRECTORY) {
+		return ARROW_DIRECTORY[arrow]
+	}
+
+	return ARROW_DIRECTORY[0]
+}
+
+//**************************************************************
+
+func ArrowDirectorySize() int {
+
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	return len(ARROW_DIRECTORY)
+}
+
 //**************************************************************
 // Upload managed N4L graph / Write to database
 //**************************************************************
@@ -1422,7 +1542,7 @@ func GraphToDB(sst PoSST,wait_counter bool) {
 
 	total := len(NODE_DIRECTORY.N1directory) + len(NODE_DIRECTORY.N2directory) + len(NODE_DIRECTORY.N3directory) + len(NODE_DIRECTORY.LT128) + len(NODE_DIRECTORY.LT1024) + len(NODE_DIRECTORY.GT1024) + len(PAGE_MAP)
 
-	fmt.Println("\nStoring primary nodes ...\n")
+	fmt.Print("\nStoring primary nodes ...\n\n")
 
 	for class := N1GRAM; class <= GT1024; class++ {
 
@@ -1473,17 +1593,7 @@ func GraphToDB(sst PoSST,wait_counter bool) {
 
 	fmt.Println("\nStoring Arrows...")
 
-	sst.DB.QueryRow("drop table ArrowDirectory")
-	sst.DB.QueryRow("drop table ArrowInverses")
-
-	if !CreateTable(sst,ARROW_INVERSES_TABLE) {
-		fmt.Println("Unable to create table as, ",ARROW_INVERSES_TABLE)
-		os.Exit(-1)
-	}
-	if !CreateTable(sst,ARROW_DIRECTORY_TABLE) {
-		fmt.Println("Unable to create table as, ",ARROW_DIRECTORY_TABLE)
-		os.Exit(-1)
-	}
+	sst.Store.ClearArrows()
 
 	for arrow := range ARROW_DIRECTORY {
 
@@ -1512,6 +1622,14 @@ func GraphToDB(sst PoSST,wait_counter bool) {
 
 	fmt.Println("Indexing ....")
 
+	sst.Store.Sync()
+	fmt.Println("Finally done!")
+}
+
+// **************************************************************************
+
+func IndexDB(sst PoSST) {
+
 //	sst.DB.QueryRow("CREATE INDEX IF NOT EXISTS sst_type on Node (((NPtr).Chan),L,S)")
 	sst.DB.QueryRow("CREATE INDEX IF NOT EXISTS sst_gin on Node USING GIN (to_tsvector('english',Search))")
 	sst.DB.QueryRow("CREATE INDEX IF NOT EXISTS sst_ungin on Node USING GIN (to_tsvector('english',UnSearch))")
@@ -1520,8 +1638,6 @@ func GraphToDB(sst PoSST,wait_counter bool) {
 	sst.DB.QueryRow("CREATE INDEX IF NOT EXISTS sst_cnt on ContextDirectory USING GIN (Context)")
 	sst.DB.QueryRow("ALTER TABLE Node SET LOGGED")
 	sst.DB.QueryRow("ALTER TABLE PageMap SET LOGGED")
-
-	fmt.Println("Finally done!")
 }
 
 // **************************************************************************
@@ -1655,45 +1771,9 @@ func CreateDBNode(sst PoSST, n Node) Node {
 	// Add node version setting explicit CPtr value, note different function call
 	// We use this function when we ARE managing/counting CPtr values ourselves
 
-	var qstr string
-
         n.L,n.NPtr.Class = StorageClass(n.S)
-	
-	cptr := n.NPtr.CPtr
 
-	es := SQLEscape(n.S)
-	ec := SQLEscape(n.Chap)
-
-	qstr = fmt.Sprintf("SELECT IdempInsertNode(%d,%d,%d,'%s','%s')",n.L,n.NPtr.Class,cptr,es,ec)
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		s := fmt.Sprint("Failed to insert",err)
-		
-		if strings.Contains(s,"duplicate key") {
-		} else {
-			fmt.Println(s,"FAILED \n",qstr,err)
-		}
-		return n
-	}
-
-	var whole string
-	var cl,ch int
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			fmt.Sscanf(whole,"(%d,%d)",&cl,&ch)
-		}
-		
-		n.NPtr.Class = cl
-		n.NPtr.CPtr = ClassedNodePtr(ch)
-		
-		row.Close()
-	}
-
-	return n
+	return sst.Store.CreateNode(n)
 }
 
 // **************************************************************************
@@ -1705,47 +1785,11 @@ func IdempDBAddNode(sst PoSST,n Node) Node {
 	// We use this function when we aren't counting CPtr values
 	// This functon may be deprecated in future
 
-	var qstr string
-
 	// No need to trust the values, ignore/overwrite CPtr
 
         n.L,n.NPtr.Class = StorageClass(n.S)
 
-	es := SQLEscape(n.S)
-	ec := SQLEscape(n.Chap)
-
-	// Wrap BEGIN/END a single transaction
-
-	qstr = fmt.Sprintf("SELECT IdempAppendNode(%d,%d,'%s','%s')",n.L,n.NPtr.Class,es,ec)
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		s := fmt.Sprint("Failed to add node",err)
-		
-		if strings.Contains(s,"duplicate key") {
-		} else {
-			fmt.Println(s,"FAILED \n",qstr,err)
-		}
-		return n
-	}
-
-	var whole string
-	var cl,ch int
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			fmt.Sscanf(whole,"(%d,%d)",&cl,&ch)
-		}
-		
-		n.NPtr.Class = cl
-		n.NPtr.CPtr = ClassedNodePtr(ch)
-		
-		row.Close()
-	}
-
-	return n
+	return sst.Store.AppendNode(n)
 }
 
 // **************************************************************************
@@ -1754,80 +1798,40 @@ func IdempDBAddNode(sst PoSST,n Node) Node {
 
 func UploadNodeToDB(sst PoSST, org Node) {
 
-	const nolink = 999
-
-	qstr := "BEGIN;\n" + FormDBNode(sst,org)
+	sst.Store.UploadNode(org)
+}
 
-	for stindex := 0; stindex < len(org.I); stindex++ {
+// **************************************************************************
 
-		lnkarray := FormatSQLLinkArray(org.I[stindex])
-		sttype := STIndexToSTType(stindex)
-		qstr += AppendDBLinkArrayToNode(sst,org.NPtr,lnkarray,sttype)
-	}
+func UploadArrowToDB(sst PoSST,arrow ArrowPtr) {
 
-	qstr += "\nCOMMIT;"
+	sst.Store.UploadArrow(ARROW_DIRECTORY[arrow])
+}
 
-	row,err := sst.DB.Query(qstr)
+// **************************************************************************
 
-	if err != nil {
-		s := fmt.Sprint("Failed to insert",err)
-		
-		if strings.Contains(s,"duplicate key") {
-		} else {
-			fmt.Println(s,"FAILED \n",qstr,err)
-		}
-		return
-	}
+func UploadInverseArrowToDB(sst PoSST,arrow ArrowPtr) {
 
-	row.Close()
+	sst.Store.UploadInverseArrow(arrow,INVERSE_ARROWS[arrow])
 }
 
 // **************************************************************************
 
-func UploadArrowToDB(sst PoSST,arrow ArrowPtr) {
-
-	staidx := ARROW_DIRECTORY[arrow].STAindex
-	long := SQLEscape(ARROW_DIRECTORY[arrow].Long)
-	short := SQLEscape(ARROW_DIRECTORY[arrow].Short)
+func UploadArrowToDBCommand(arrow ArrowDirectory) string {
 
-	qstr := fmt.Sprintf("INSERT INTO ArrowDirectory (STAindex,Long,Short,ArrPtr) SELECT %d,'%s','%s',%d WHERE NOT EXISTS (SELECT Long,Short,ArrPtr FROM ArrowDirectory WHERE lower(Long) = lower('%s') OR lower(Short) = lower('%s') OR ArrPtr = %d)",staidx,long,short,arrow,long,short,arrow)
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		s := fmt.Sprint("Failed to insert",err)
-		
-		if strings.Contains(s,"duplicate key") {
-		} else {
-			fmt.Println(s,"FAILED \n",qstr,err)
-		}
-		return
-	}
+	staidx := arrow.STAindex
+	long := SQLEscape(arrow.Long)
+	short := SQLEscape(arrow.Short)
+	ptr := arrow.Ptr
 
-	row.Close()
+	return fmt.Sprintf("INSERT INTO ArrowDirectory (STAindex,Long,Short,ArrPtr) SELECT %d,'%s','%s',%d WHERE NOT EXISTS (SELECT Long,Short,ArrPtr FROM ArrowDirectory WHERE lower(Long) = lower('%s') OR lower(Short) = lower('%s') OR ArrPtr = %d)",staidx,long,short,ptr,long,short,ptr)
 }
 
 // **************************************************************************
 
-func UploadInverseArrowToDB(sst PoSST,arrow ArrowPtr) {
+func UploadInverseArrowToDBCommand(plus,minus ArrowPtr) string {
 
-	plus := arrow
-	minus := INVERSE_ARROWS[arrow]
-
-	qstr := fmt.Sprintf("INSERT INTO ArrowInverses (Plus,Minus) SELECT %d,%d WHERE NOT EXISTS (SELECT Plus,Minus FROM ArrowInverses WHERE Plus = %d OR minus = %d)",plus,minus,plus,minus)
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		s := fmt.Sprint("Failed to insert",err)
-		
-		if strings.Contains(s,"duplicate key") {
-		} else {
-			fmt.Println(s,"FAILED \n",qstr,err)
-		}
-		return
-	}
-	row.Close()
+	return fmt.Sprintf("INSERT INTO ArrowInverses (Plus,Minus) SELECT %d,%d WHERE NOT EXISTS (SELECT Plus,Minus FROM ArrowInverses WHERE Plus = %d OR minus = %d)",plus,minus,plus,minus)
 }
 
 // **************************************************************************
@@ -1843,61 +1847,29 @@ func UploadContextsToDB(sst PoSST) {
 
 func UploadContextToDB(sst PoSST,contextstring string,ptr ContextPtr) ContextPtr {
 
-	a := SQLEscape(contextstring)
-	b := ptr
-
-	// Make sure neither a nor b are previously defined
-
-	qstr := fmt.Sprintf("SELECT IdempInsertContext('%s',%d)",a,b)
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("FAILED \n",qstr,err)
-	}
+	return sst.Store.UploadContext(contextstring,ptr)
+}
 
-	var cptr ContextPtr
+//**************************************************************
 
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&cptr)
-		}
-		row.Close()
-	}
+func UploadPageMapEvent(sst PoSST, line PageMap) {
 
-	return cptr
+	sst.Store.AppendPageMap(line)
 }
 
 //**************************************************************
 
-func UploadPageMapEvent(sst PoSST, line PageMap) {
+func UploadPageMapEventCommand(line PageMap) string {
 
 	chap := SQLEscape(line.Chapter)
 
-	qstr := "BEGIN;\n"
-
-	qstr += fmt.Sprintf("INSERT INTO PageMap (Chap,Alias,Ctx,Line) VALUES ('%s','%s',%d,%d);\n",chap,line.Alias,line.Context,line.Line)
+	qstr := fmt.Sprintf("INSERT INTO PageMap (Chap,Alias,Ctx,Line) VALUES ('%s','%s',%d,%d);\n",chap,line.Alias,line.Context,line.Line)
 
 	lnkarray := FormatSQLLinkArray(line.Path)
 
 	qstr += fmt.Sprintf("\nUPDATE PageMap SET Path='%s' WHERE Chap = '%s' AND Line = '%d';",lnkarray,chap,line.Line)
 
-	qstr += "COMMIT;"
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		s := fmt.Sprint("Failed to insert pagemap event",err)
-		
-		if strings.Contains(s,"duplicate key") {
-		} else {
-			fmt.Println(s,"FAILED \n",qstr,err)
-		}
-		row.Close()
-		return
-	}
-
-	row.Close()
+	return qstr
 }
 
 //**************************************************************
@@ -1944,17 +1916,7 @@ func IdempDBAddLink(sst PoSST,from Node,link Link,to Node) {
 
 func AppendDBLinkToNode(sst PoSST, n1ptr NodePtr, lnk Link, sttype int) bool {
 
-	qstr := AppendDBLinkToNodeCommand(sst,n1ptr,lnk,sttype)
-
-	row,err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("Failed to append",err,qstr)
-	       return false
-	}
-
-	row.Close()
-	return true
+	return sst.Store.AppendLink(n1ptr,lnk,sttype)
 }
 
 // **************************************************************************
@@ -2040,7 +2002,7 @@ func CreateType(sst PoSST, defn string) bool {
 
 func CreateTable(sst PoSST,defn string) bool {
 
-	row,err := sst.DB.Query(defn)
+	row,err := sst.DB.Query(TableDefinition(defn))
 	
 	if err != nil {
 		s := fmt.Sprintln("Failed to create a table %.10 ...",defn,err)
@@ -2735,7 +2697,8 @@ func DefineStoredFunctions(sst PoSST) {
 
 	// Matching context strings with fuzzy criteria. The policy/notes expression is db_set
 	// the client/lookup set is user_set - both COULD use AND expressions.
-	// We are looking for sets that overlap for a true result
+	// We are looking for sets that overlap for a true result. Items in user_set
+	// with a leading ! are inhibitors, which veto a match on any part of the db_set
 
 	qstr = "CREATE OR REPLACE FUNCTION match_context(thisctxptr int,user_set text[])\n"+
 		"RETURNS boolean AS $fn$\n" +
@@ -2755,6 +2718,8 @@ func DefineStoredFunctions(sst PoSST) {
 		"   item_us text;\n" +
 		"   ref text;\n" +
 		"   c text;\n"+
+		"   positive text[] = ARRAY[]::text[];\n"+
+		"   negative text[] = ARRAY[]::text[];\n"+
 		"BEGIN \n" +
 
 		// If no constraints at all, then match
@@ -2771,6 +2736,35 @@ func DefineStoredFunctions(sst PoSST) {
 		"SELECT Context INTO ctxstr FROM ContextDirectory WHERE ctxPtr=thisctxptr;" +
 		"db_set = regexp_split_to_array(ctxstr,',');\n" +
 
+		// Separate out the inhibitors, !!exact! excludes the exact term exact!
+
+		"FOREACH item IN ARRAY user_set LOOP\n" +
+		"   IF left(item,1) = '!' AND length(item) > 1 AND NOT (right(item,1) = '!' AND left(item,2) <> '!!') THEN\n" +
+		"      negative = array_append(negative,lower(unaccent(trim(both ' !' from substr(item,2)))));\n" +
+		"   ELSE\n" +
+		"      positive = array_append(positive,item);\n" +
+		"   END IF;\n" +
+		"END LOOP;\n" +
+
+		"IF array_length(negative,1) IS NOT NULL AND array_length(db_set,1) IS NOT NULL THEN\n" +
+		"   FOREACH item_db IN ARRAY db_set LOOP\n" +
+		"      FOREACH c IN ARRAY negative LOOP\n" +
+		"         IF position(c IN lower(unaccent(item_db))) > 0 THEN\n" +
+		"            RETURN false;\n" +
+		"         END IF;\n" +
+		"      END LOOP;\n" +
+		"   END LOOP;\n" +
+		"END IF;\n" +
+
+		// With only inhibitors, everything else matches
+
+		"IF array_length(negative,1) IS NOT NULL THEN\n" +
+		"   IF array_length(positive,1) IS NULL THEN\n" +
+		"      RETURN true;\n" +
+		"   END IF;\n" +
+		"   user_set = positive;\n" +
+		"END IF;\n" +
+
 		// If there is a constraint, but no db membership, then no match
 		"IF array_length(db_set,1) IS NULL AND array_length(user_set,1) IS NOT NULL THEN\n"+
 		"   RETURN false;\n"+
@@ -2860,7 +2854,7 @@ func DefineStoredFunctions(sst PoSST) {
 
 	row.Close()
 
-	// Matching integer ranges
+	// Matching integer ranges, an excluded arrow is given as -ArrowPtr
 
 	qstr = "CREATE OR REPLACE FUNCTION match_arrows(arr int,user_set int[])\n"+
 		"RETURNS boolean AS $fn$\n" +
@@ -2868,9 +2862,15 @@ func DefineStoredFunctions(sst PoSST) {
 		"   IF array_length(user_set,1) IS NULL THEN \n" + // empty arrows
                 "      RETURN true;"+
 		"   END IF;"+
+		"   IF arr > 0 AND -arr = ANY(user_set) THEN \n" + // excluded
+		"      RETURN false;\n" +
+		"   END IF;\n" +
 		"   IF arr = ANY(user_set) THEN \n" + // exact match
 		"      RETURN true;\n" +
 		"   END IF;\n" +
+		"   IF 0 >= ALL(user_set) THEN \n" + // only exclusions
+		"      RETURN true;\n" +
+		"   END IF;\n" +
 		"RETURN false;\n" +
 		"END ;\n" +
 		"$fn$ LANGUAGE plpgsql;\n"
@@ -2883,6 +2883,26 @@ func DefineStoredFunctions(sst PoSST) {
 
 	row.Close()
 
+	// Chapter filter patterns arrive as %chapter%, with a leading ! to exclude
+
+	qstr = "CREATE OR REPLACE FUNCTION match_chapter(chap text,pattern text)\n"+
+		"RETURNS boolean AS $fn$\n" +
+		"BEGIN \n" +
+		"   IF left(pattern,2) = '%!' THEN \n" +
+		"      RETURN NOT lower(chap) LIKE lower('%' || substr(pattern,3));\n" +
+		"   END IF;\n" +
+		"RETURN lower(chap) LIKE lower(pattern);\n" +
+		"END ;\n" +
+		"$fn$ LANGUAGE plpgsql;\n"
+
+	row,err = sst.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("Error defining postgres function:",qstr,err)
+	}
+
+	row.Close()
+
 	// Helper to find arrows by type
 
 	qstr = "CREATE OR REPLACE FUNCTION ArrowInList(arrow int,links Link[])\n"+
@@ -3257,7 +3277,7 @@ func DefineStoredFunctions(sst PoSST) {
 		"         CONTINUE;"+
 		"      END IF;\n"+
 
-		"      IF arrows IS NOT NULL AND array_length(arrows,1) > 0 AND NOT lnk.Arr=ANY(arrows) THEN\n"+
+		"      IF NOT match_arrows(lnk.Arr,arrows) THEN\n"+
 		"         CONTINUE;\n"+
 		"      END IF;\n"+
 
@@ -3368,7 +3388,7 @@ func DefineStoredFunctions(sst PoSST) {
 		"   CASE sttype \n"
 	for st := -EXPRESS; st <= EXPRESS; st++ {
 		qstr += fmt.Sprintf("WHEN %d THEN\n"+
-			"     SELECT %s INTO fwdlinks FROM Node WHERE NOT L=0 AND Nptr=start AND UnCmp(Chap,rm_acc) LIKE lower(chapter) LIMIT maxlimit;\n",st,STTypeDBChannel(st));
+			"     SELECT %s INTO fwdlinks FROM Node WHERE NOT L=0 AND Nptr=start AND match_chapter(UnCmp(Chap,rm_acc),chapter) LIMIT maxlimit;\n",st,STTypeDBChannel(st));
 	}
 	
 	qstr += "ELSE RAISE EXCEPTION 'No such sttype %', sttype;\n" +
@@ -3586,7 +3606,7 @@ func DefineStoredFunctions(sst PoSST) {
 
 	// ************ LAST SEEN **************'
 
-	qstr = "CREATE OR REPLACE FUNCTION LastSawSection(this text)\n"+
+	qstr = "CREATE OR REPLACE FUNCTION LastSawSection(this text,usr text)\n"+
 		"RETURNS bool AS $fn$\n"+
 		"DECLARE \n"+
 		"  prev      timestamp = NOW();\n"+
@@ -3596,15 +3616,15 @@ func DefineStoredFunctions(sst PoSST) {
 		"  nowt      int;\n"+
 		"  f         int = 0;"+
 		"BEGIN\n"+
-		"  SELECT last,EXTRACT(EPOCH FROM NOW()-last),delta,freq INTO prev,deltat,prevdelta,f FROM LastSeen WHERE section=this;\n"+
+		"  SELECT last,EXTRACT(EPOCH FROM NOW()-last),delta,freq INTO prev,deltat,prevdelta,f FROM LastSeen WHERE section=this AND username=usr;\n"+
 		"  IF NOT FOUND THEN\n"+
-		"     INSERT INTO LastSeen (section,first,last,delta,freq,nptr) VALUES (this,NOW(),NOW(),0,1,'(-1,-1)');\n"+
+		"     INSERT INTO LastSeen (section,first,last,delta,freq,nptr,username) VALUES (this,NOW(),NOW(),0,1,'(-1,-1)',usr);\n"+
 		"  ELSE\n"+
 		"     avdeltat = 0.5 * deltat::real + 0.5 * prevdelta::real;\n"+
 		"     f = f + 1;\n"+
 		      // 1 minute dead time
 		"     IF deltat > 60 THEN\n"+
-		"       UPDATE LastSeen SET last=NOW(),delta=avdeltat,freq=f WHERE section = this;\n"+
+		"       UPDATE LastSeen SET last=NOW(),delta=avdeltat,freq=f WHERE section = this AND username = usr;\n"+
 		"     ELSE\n"+
 		"        return false;\n"+
 		"     END IF;\n"+
@@ -3621,7 +3641,7 @@ func DefineStoredFunctions(sst PoSST) {
 	
 	row.Close()
 	
-	qstr = "CREATE OR REPLACE FUNCTION LastSawNPtr(this NodePtr,name text)\n"+
+	qstr = "CREATE OR REPLACE FUNCTION LastSawNPtr(this NodePtr,name text,usr text)\n"+
 		"RETURNS bool AS $fn$\n"+
 		"DECLARE \n"+
 		"  prev      timestamp = NOW();\n"+
@@ -3632,15 +3652,15 @@ func DefineStoredFunctions(sst PoSST) {
 		"  ep        int = 0;"+
 		"  f         int = 0;"+
 		"BEGIN\n"+
-		"  SELECT last,EXTRACT(EPOCH FROM NOW()-last),delta,freq INTO prev,deltat,prevdelta,f FROM LastSeen WHERE nptr=this;\n"+
+		"  SELECT last,EXTRACT(EPOCH FROM NOW()-last),delta,freq INTO prev,deltat,prevdelta,f FROM LastSeen WHERE nptr=this AND username=usr;\n"+
 		"  IF NOT FOUND THEN\n"+
-		"     INSERT INTO LastSeen (section,nptr,first,last,freq,delta) VALUES (name,this,NOW(),NOW(),1,0);\n"+
+		"     INSERT INTO LastSeen (section,nptr,first,last,freq,delta,username) VALUES (name,this,NOW(),NOW(),1,0,usr);\n"+
 		"  ELSE\n"+
 		"     avdeltat = 0.5 * deltat::real + 0.5 * prevdelta::real;\n"+
 		"     f = f + 1;\n"+
 		      // 1 minute dead time
 		"     IF deltat > 60 THEN\n"+
-		"        UPDATE LastSeen SET last=NOW(),delta=avdeltat,freq=f WHERE nptr = this;\n"+
+		"        UPDATE LastSeen SET last=NOW(),delta=avdeltat,freq=f WHERE nptr = this AND username = usr;\n"+
 		"     ELSE\n"+
 		"        return false;\n"+
 		"     END IF;\n"+
@@ -3696,32 +3716,16 @@ func GetDBNodePtrMatchingNCCS(sst PoSST,nm,chap string,cn []string,arrow []Arrow
 
 	// Order by L to favour exact matches
 
-	nm = SQLEscape(nm)
-	chap = SQLEscape(chap)
-
-	qstr := fmt.Sprintf("SELECT NPtr FROM Node WHERE %s ORDER BY L ASC,(CARDINALITY(Ie3)+CARDINALITY(Im3)+CARDINALITY(Il1)) DESC LIMIT %d",NodeWhereString(nm,chap,cn,arrow,seq),limit)
-
-	row, err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("QUERY GetNodePtrMatchingNCC Failed",err,qstr)
-	}
+	return sst.Store.MatchNodes(nm,chap,cn,arrow,seq,limit)
+}
 
-	var whole string
-	var n NodePtr
-	var retval []NodePtr
+// **************************************************************************
 
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			fmt.Sscanf(whole,"(%d,%d)",&n.Class,&n.CPtr)
-			retval = append(retval,n)
-		}
+func GetDBNodePtrsMatchingQuery(sst PoSST,query *TextQuery,chap string,cn []string,arrow []ArrowPtr,seq bool,limit int) ([]NodePtr,[]float32) {
 
-		row.Close()
-	}
+	// Boolean/phrase search on the tsvector, most relevant first
 
-	return retval
+	return sst.Store.MatchQuery(query,chap,cn,arrow,seq,limit)
 }
 
 // **************************************************************************
@@ -3737,16 +3741,7 @@ func NodeWhereString(name,chap string,context []string,arrow []ArrowPtr,seq bool
 	// Chapter first to limit search by block
 
 	if chap != "any" && chap != "" {
-
-		remove_chap_accents,chap_stripped := IsBracketedSearchTerm(chap)
-
-		if remove_chap_accents {
-			chap_search := "%"+chap_stripped+"%"
-			chap_col = fmt.Sprintf("lower(unaccent(Chap)) LIKE lower('%s')",chap_search)
-		} else {
-			chap_search := "%"+chap+"%"
-			chap_col = fmt.Sprintf("lower(Chap) LIKE lower('%s')",chap_search)
-		}
+		chap_col = ChapterMatchSQL("Chap",chap)
 	} else {
 		chap_col = "true"
 	}
@@ -3815,117 +3810,30 @@ func NodeWhereString(name,chap string,context []string,arrow []ArrowPtr,seq bool
 
 func GetDBChaptersMatchingName(sst PoSST,src string) []string {
 
-	var qstr string
-
-	remove_accents,stripped := IsBracketedSearchTerm(SQLEscape(src))
-
-	if remove_accents {
-		search := "%"+stripped+"%"
-		qstr = fmt.Sprintf("SELECT DISTINCT Chap FROM Node WHERE lower(unaccent(Chap)) LIKE lower('%s')",search)
-	} else {
-		search := "%"+src+"%"
-		qstr = fmt.Sprintf("SELECT DISTINCT Chap FROM Node WHERE lower(Chap) LIKE lower('%s')",search)
-	}
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetDBChaptersMatchingName",err)
-	}
-
-	var whole string
-	var chapters = make(map[string]int)
-	var retval []string
+	return sst.Store.MatchChapters(src)
+}
 
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			several := strings.Split(whole,",")
-			
-			for s := range several {
-				chapters[several[s]]++
-			}
-		}
+//**************************************************************
 
-		for c := range chapters {
-			if strings.Contains(c,src) {
-				if len(c) > 0 {
-					retval = append(retval,c)
-				}
-			}
-		}
+func DeleteChapter(sst PoSST,chapter string) bool {
 
-		sort.Strings(retval)
-		row.Close()
-	}
+	// Nodes shared with other chapters only lose the chapter name
 
-	return retval
+	return sst.Store.DeleteChapter(chapter)
 }
 
 // **************************************************************************
 
 func GetDBContextByName(sst PoSST,src string) (string,ContextPtr) {
 
-	var qstr string
-
-	remove_accents,stripped := IsBracketedSearchTerm(src)
-
-	if remove_accents {
-		search := stripped
-		qstr = fmt.Sprintf("SELECT DISTINCT Context,CtxPtr FROM ContextDirectory WHERE unaccent(Context)='%s'",search)
-	} else {
-		search := src
-		qstr = fmt.Sprintf("SELECT DISTINCT Context,CtxPtr FROM ContextDirectory WHERE Context='%s'",search)
-	}
-
-	row, err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("QUERY GetDBContextByName",err)
-	}
-
-	var whole string
-	var ptr int
-
-	// Assume unique match for this, to be fixed elsewhere
-
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&whole,&ptr)
-		}
-		row.Close()
-	}
-
-	return whole,ContextPtr(ptr)
-
+	return sst.Store.GetContextByName(src)
 }
 
 // **************************************************************************
 
 func GetDBContextByPtr(sst PoSST,ptr ContextPtr) (string,ContextPtr) {
 
-	qstr := fmt.Sprintf("SELECT DISTINCT Context,CtxPtr FROM ContextDirectory WHERE CtxPtr=%d",ptr)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetDBContextssByPtr",err)
-	}
-
-	var retctx string
-	var retptr int
-
-	// Assume unique match for this, to be fixed elsewhere
-
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&retctx,&retptr)
-		}
-
-		row.Close()
-	}
-
-	return retctx,ContextPtr(retptr)
+	return sst.Store.GetContextByPtr(ptr)
 }
 
 // **************************************************************************
@@ -3934,12 +3842,26 @@ func GetSTtypesFromArrows(arrows []ArrowPtr) []int {
 
 	var sttypes []int
 
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
 	for a := range arrows {
+
+		if arrows[a] < 0 {  // excluded
+			continue
+		}
+
 		sta := ARROW_DIRECTORY[arrows[a]].STAindex
 		st := STIndexToSTType(sta)
 		sttypes = append(sttypes,st)
 	}
 
+	// Only exclusions leaves every other type
+
+	if sttypes == nil && len(arrows) > 0 {
+		sttypes = []int{-EXPRESS,-CONTAINS,-LEADSTO,NEAR,LEADSTO,CONTAINS,EXPRESS}
+	}
+
 	return sttypes
 }
 
@@ -3947,61 +3869,34 @@ func GetSTtypesFromArrows(arrows []ArrowPtr) []int {
 
 func GetDBNodeByNodePtr(sst PoSST,db_nptr NodePtr) Node {
 
-	im_nptr,cached := NODE_CACHE[db_nptr]
+	cached_node,cached := GetCachedNode(db_nptr)
 
 	if cached {
-		return GetMemoryNodeFromPtr(im_nptr)
+		cached_node.S = ExpandDynamicFunctions(sst,cached_node.S)
+		return cached_node
 	}
 
-	// This ony works if we insert non-null arrays like '[]' during initialization
-	cols := I_MEXPR+","+I_MCONT+","+I_MLEAD+","+I_NEAR +","+I_PLEAD+","+I_PCONT+","+I_PEXPR
-	qstr := fmt.Sprintf("select L,S,Chap,%s from Node where NPtr='(%d,%d)'::NodePtr AND NOT L=0",cols,db_nptr.Class,db_nptr.CPtr)
-
-	row, err := sst.DB.Query(qstr)
-
-	var n Node
-	var count int = 0
+	n,found := sst.Store.GetNode(db_nptr)
 
-	if err != nil {
-		fmt.Println("GetDBNodeByNodePointer Failed:",err)
-		return n
+	if found {
+		CacheNode(n)
 	}
 
-	var whole [ST_TOP]string
-
-	// NB, there seems to be a "bug" in the SQL package, which cannot always populate the links, so try not to
-	//     rely on this and work around when needed using GetEntireCone(any,2..) separately
-
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&n.L,&n.S,&n.Chap,&whole[0],&whole[1],&whole[2],&whole[3],&whole[4],&whole[5],&whole[6])
-
-			for i := 0; i < ST_TOP; i++ {
-				n.I[i] = ParseLinkArray(whole[i])
-			}
-			count++
-		}
+	// Expand any dynamic inbuilt functions each time, not once in the cache
 
-		if count > 1 {
-			fmt.Println("GetDBNodeByNodePtr returned too many matches (multi-model conflict?):",count,"for ptr",db_nptr)
-			os.Exit(-1)
-		}
-
-		// Expand any dynamic inbuilt functions
+	n.NPtr = db_nptr
+	n.S = ExpandDynamicFunctions(sst,n.S)
+	return n
+}
 
-		if strings.HasPrefix(n.S,"Dynamic: ") {
-			n.S = ExpandDynamicFunctions(n.S)
-		}
+// **************************************************************************
 
-		row.Close()
+func GetDBNodeTextByNodePtr(sst PoSST,db_nptr NodePtr) string {
 
-		if !cached {
-			CacheNode(n)
-		}
-	}
+	// The text as stored, without expanding dynamic functions
 
-	n.NPtr = db_nptr
-	return n
+	n,_ := sst.Store.GetNode(db_nptr)
+	return n.S
 }
 
 // **************************************************************************
@@ -4010,12 +3905,8 @@ func GetDBSingletonBySTType(sst PoSST,sttypes []int,chap string,cn []string) ([]
 
 	// Used in graph report, analysis
 
-	var qstr,qwhere string
 	var dim = len(sttypes)
 
-	context := FormatSQLStringArray(cn)
-	chapter := "%"+SQLEscape(chap)+"%"
-
 	if dim == 0 || dim > 4 {
 		fmt.Println("Maximum 4 sttypes in GetDBSingletonBySTType")
 		return nil,nil
@@ -4027,95 +3918,9 @@ func GetDBSingletonBySTType(sst PoSST,sttypes []int,chap string,cn []string) ([]
 			fmt.Println("WARNING! Only give positive STType arguments to GetDBSingletonBySTType as both signs are returned as sources (+) and sinks (-)")
 			return nil,nil
 		}
-
-		stname := STTypeDBChannel(sttypes[st])
-		stinv := STTypeDBChannel(-sttypes[st])
-		qwhere += fmt.Sprintf("(array_length(%s::text[],1) IS NOT NULL AND array_length(%s::text[],1) IS NULL AND match_context((%s)[0].Ctx,%s))",stname,stinv,stname,context)
-		
-		if st != dim-1 {
-			qwhere += " OR "
-		}
-	}
-
-	qstr = fmt.Sprintf("SELECT NPtr FROM Node WHERE lower(Chap) LIKE lower('%s') AND (%s)",chapter,qwhere)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetDBSingletonBySTType Failed",err,"IN",qstr)
-		return nil,nil
-	}
-
-	var src_nptrs,snk_nptrs []NodePtr
-
-	if row != nil {
-		for row.Next() {		
-		
-			var n NodePtr
-			var nstr string
-			
-			err = row.Scan(&nstr)
-		
-			if err != nil {
-				fmt.Println("Error scanning sql data case",dim,"gave error",err,qstr)
-				row.Close()
-				return nil,nil
-			}
-		
-			fmt.Sscanf(nstr,"(%d,%d)",&n.Class,&n.CPtr)
-		
-			src_nptrs = append(src_nptrs,n)
-		}
-		row.Close()
-	}
-
-	// and sinks  -> -
-
-	qwhere = ""
-
-	for st := 0; st < len(sttypes); st++ {
-
-		stname := STTypeDBChannel(-sttypes[st])
-		stinv := STTypeDBChannel(sttypes[st])
-		qwhere += fmt.Sprintf("(array_length(%s::text[],1) IS NOT NULL AND array_length(%s::text[],1) IS NULL AND match_context((%s)[0].Ctx,%s))",stname,stinv,stname,context)
-		
-		if st != dim-1 {
-			qwhere += " OR "
-		}
-	}
-
-	qstr = fmt.Sprintf("SELECT NPtr FROM Node WHERE lower(Chap) LIKE lower('%s') AND (%s)",chapter,qwhere)
-
-	row, err = sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetDBSingletonBySTType 2 Failed",err,"IN",qstr)
-		return nil,nil
-	}
-
-	if row != nil {
-		for row.Next() {		
-		
-			var n NodePtr
-			var nstr string
-			
-			err = row.Scan(&nstr)
-		
-			if err != nil {
-				fmt.Println("Error scanning sql data case",dim,"gave error",err,qstr)
-				row.Close()
-				return nil,nil
-			}
-			
-			fmt.Sscanf(nstr,"(%d,%d)",&n.Class,&n.CPtr)
-			
-			snk_nptrs = append(snk_nptrs,n)
-		}
-		row.Close()
 	}
 
-	return src_nptrs,snk_nptrs
-	
+	return sst.Store.Singletons(sttypes,chap,cn)
 }
 
 // **************************************************************************
@@ -4151,7 +3956,7 @@ func SelectStoriesByArrow(sst PoSST,nodeptrs []NodePtr, arrowptrs []ArrowPtr, st
 
 func GetDBArrowsWithArrowName(sst PoSST,s string) (ArrowPtr,int) {
 
-	if ARROW_DIRECTORY_TOP == 0 {
+	if ArrowDirectorySize() == 0 {
 		DownloadArrowsFromDB(sst)
 	}
 
@@ -4162,6 +3967,9 @@ func GetDBArrowsWithArrowName(sst PoSST,s string) (ArrowPtr,int) {
 		return 0,0
 	}
 
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
 	for a := range ARROW_DIRECTORY {
 		if s == ARROW_DIRECTORY[a].Long || s == ARROW_DIRECTORY[a].Short {
 			sttype := STIndexToSTType(ARROW_DIRECTORY[a].STAindex)
@@ -4179,7 +3987,7 @@ func GetDBArrowsMatchingArrowName(sst PoSST,s string) []ArrowPtr {
 
 	var list []ArrowPtr
 
-	if ARROW_DIRECTORY_TOP == 0 {
+	if ArrowDirectorySize() == 0 {
 		DownloadArrowsFromDB(sst)
 	}
 
@@ -4189,6 +3997,9 @@ func GetDBArrowsMatchingArrowName(sst PoSST,s string) []ArrowPtr {
 		return list
 	}
 
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
 	if trimmed != s {
 		for a := range ARROW_DIRECTORY {
 			if ARROW_DIRECTORY[a].Long==trimmed || ARROW_DIRECTORY[a].Short==trimmed {
@@ -4210,7 +4021,7 @@ func GetDBArrowsMatchingArrowName(sst PoSST,s string) []ArrowPtr {
 
 func GetDBArrowByName(sst PoSST,name string) ArrowPtr {
 
-	if ARROW_DIRECTORY_TOP == 0 {
+	if ArrowDirectorySize() == 0 {
 		DownloadArrowsFromDB(sst)
 	}
 
@@ -4220,6 +4031,9 @@ func GetDBArrowByName(sst PoSST,name string) ArrowPtr {
 		return 0
 	}
 
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
 	ptr, ok := ARROW_SHORT_DIR[name]
 	
 	// If not, then check longname
@@ -4247,11 +4061,14 @@ func GetDBArrowByName(sst PoSST,name string) ArrowPtr {
 
 func GetDBArrowByPtr(sst PoSST,arrowptr ArrowPtr) ArrowDirectory {
 
-	if int(arrowptr) > len(ARROW_DIRECTORY) {
+	if int(arrowptr) > ArrowDirectorySize() {
 		DownloadArrowsFromDB(sst)
 	}
 
-	if int(arrowptr) < len(ARROW_DIRECTORY) {
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
+	if arrowptr >= 0 && int(arrowptr) < len(ARROW_DIRECTORY) {
 		a := ARROW_DIRECTORY[arrowptr]
 		return a
 	} else {
@@ -4270,6 +4087,9 @@ func GetDBArrowBySTType(sst PoSST,sttype int) []ArrowDirectory {
 
 	DownloadArrowsFromDB(sst)
 
+	DIRECTORY_MUTEX.RLock()
+	defer DIRECTORY_MUTEX.RUnlock()
+
 	for a := range ARROW_DIRECTORY {
 		sta := ARROW_DIRECTORY[a].STAindex
 		if STIndexToSTType(sta) == sttype {
@@ -4295,10 +4115,33 @@ func ArrowPtrFromArrowsNames(sst PoSST,arrows []string) ([]ArrowPtr,[]int) {
 
 		// is the entry a number? sttype?
 
-		number, err := strconv.Atoi(arrows[a])
+		// !arrow excludes, and is passed on as -ArrowPtr
+
+		negate,name := IsNegatedTerm(arrows[a])
+
+		number, err := strconv.Atoi(name)
 		notnumber := err != nil
 
-		if notnumber {
+		if negate {
+			if !notnumber && number >= -EXPRESS && number <= EXPRESS {
+				fmt.Println("Can't exclude a whole ST type",number,", exclude the arrows by name instead")
+				continue
+			}
+
+			var arrs []ArrowPtr
+
+			if notnumber {
+				arrs = GetDBArrowsMatchingArrowName(sst,name)
+			} else {
+				arrs = []ArrowPtr{GetDBArrowByPtr(sst,ArrowPtr(number)).Ptr}
+			}
+
+			for _,arrowptr := range arrs {
+				if arrowptr > 0 {
+					arr = append(arr,-arrowptr)
+				}
+			}
+		} else if notnumber {
 			arrs := GetDBArrowsMatchingArrowName(sst,arrows[a])
 			for  ar := range arrs {
 				arrowptr := arrs[ar]
@@ -4344,7 +4187,10 @@ func SolveNodePtrs(sst PoSST,nodenames []string,search SearchParameters,arr []Ar
 	// If we give a precise reference, then that was obviously intended
 
 	for n := range nodeptrs {
-		idempotence[nodeptrs[n]] = true
+		if !idempotence[nodeptrs[n]] {
+			idempotence[nodeptrs[n]] = true
+			result = append(result,nodeptrs[n])
+		}
 	}
 
 	for r := 0; r < len(rest); r++ {
@@ -4353,19 +4199,57 @@ func SolveNodePtrs(sst PoSST,nodenames []string,search SearchParameters,arr []Ar
 
 		nptrs := GetDBNodePtrMatchingNCCS(sst,rest[r],chap,cntx,arr,seq,limit)
 
+		// Keep the order of the lookup, which favours exact matches
+
 		for n := 0; n < len(nptrs); n++ {
-			idempotence[nptrs[n]] = true
+			if !idempotence[nptrs[n]] {
+				idempotence[nptrs[n]] = true
+				result = append(result,nptrs[n])
+			}
 		}
 	}
 
-	// Currently disordered, sort by additional scoring by running context ..
+	return result
+}
+
+//******************************************************************
+
+func SolveQueryNodePtrs(sst PoSST,search SearchParameters,arr []ArrowPtr,limit int) ([]NodePtr,[]float32) {
+
+	// The \query expression, if any, in order of relevance
+
+	if search.Query == "" {
+		return nil,nil
+	}
+
+	query,err := ParseTextQuery(search.Query)
+
+	if err != nil {
+		fmt.Println("Can't use the query:",err)
+		return nil,nil
+	}
+
+	return GetDBNodePtrsMatchingQuery(sst,query,search.Chapter,search.Context,arr,search.Sequence,limit)
+}
+
+//******************************************************************
+
+func MergeNodePtrs(first,second []NodePtr) []NodePtr {
+
+	// Append without repeats, keeping the order
+
+	var already = make(map[NodePtr]bool)
+	var result []NodePtr
 
-	for uniqnptr := range idempotence {
-		result = append(result,uniqnptr)
+	for _,list := range [][]NodePtr{first,second} {
+		for _,nptr := range list {
+			if !already[nptr] {
+				already[nptr] = true
+				result = append(result,nptr)
+			}
+		}
 	}
 
-	sort.Slice(result, ScoreContext)
-
 	return result
 }
 
@@ -4440,54 +4324,9 @@ func ParseLiteralNodePtrs(names []string) ([]NodePtr,[]string) {
 
 func GetDBPageMap(sst PoSST,chap string,cn []string,page int) []PageMap {
 
-	var qstr string
-
 	chap = strings.Trim(chap,"\"")
 
-	context := FormatSQLStringArray(cn)
-	chapter := "%"+chap+"%"
-
-	const hits_per_page = 60
-	offset := (page-1) * hits_per_page;
-
-	qstr = fmt.Sprintf("SELECT DISTINCT Chap,Ctx,Line,Path FROM PageMap\n"+
-		"WHERE match_context(Ctx,%s)=true AND lower(Chap) LIKE lower('%s') ORDER BY Chap,Line OFFSET %d LIMIT %d",context,chapter,offset,hits_per_page)
-
-	row, err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("GetDBPageMap Failed:",err,qstr)
-	}
-
-	var path string
-	var pagemap []PageMap
-	var line int
-	var ctxptr ContextPtr
-
-	if row != nil {
-		for row.Next() {		
-
-			var event PageMap
-
-			err = row.Scan(&chap,&ctxptr,&line,&path)
-
-			if err != nil {
-				fmt.Println("Error reading GetDBPageMap",err)
-			}
-
-			event.Path = ParseMapLinkArray(path)
-
-			event.Chapter = chap
-			event.Context = ctxptr
-			event.Line = line;
-
-			pagemap = append(pagemap,event)
-		}
-
-		row.Close()
-	}
-
-	return pagemap
+	return sst.Store.GetPageMap(chap,cn,page)
 }
 
 // **************************************************************************
@@ -4496,29 +4335,7 @@ func GetDBPageMap(sst PoSST,chap string,cn []string,page int) []PageMap {
 
 func GetFwdConeAsNodes(sst PoSST, start NodePtr, sttype,depth int,limit int) []NodePtr {
 
-	qstr := fmt.Sprintf("select unnest(fwdconeasnodes) from FwdConeAsNodes('(%d,%d)',%d,%d,%d);",start.Class,start.CPtr,sttype,depth,limit)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY to FwdConeAsNodes Failed",err)
-	}
-
-	var whole string
-	var n NodePtr
-	var retval []NodePtr
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			fmt.Sscanf(whole,"(%d,%d)",&n.Class,&n.CPtr)
-			retval = append(retval,n)
-		}
-
-		row.Close()
-	}
-
-	return retval
+	return sst.Store.FwdConeNodes(start,sttype,depth,limit)
 }
 
 // **************************************************************************
@@ -4527,54 +4344,14 @@ func GetFwdConeAsLinks(sst PoSST, start NodePtr, sttype,depth int) []Link {
 
 	// This function may be misleading as it doesn't respect paths, may be deprecated in future
 
-	qstr := fmt.Sprintf("select unnest(fwdconeaslinks) from FwdConeAsLinks('(%d,%d)',%d,%d);",start.Class,start.CPtr,sttype,depth)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY to FwdConeAsLinks Failed",err)
-	}
-
-	var whole string
-	var retval []Link
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			l := ParseSQLLinkString(whole)
-			retval = append(retval,l)
-		}
-
-		row.Close()
-	}
-
-	return retval
+	return sst.Store.FwdConeLinks(start,sttype,depth)
 }
 
 // **************************************************************************
 
 func GetFwdPathsAsLinks(sst PoSST, start NodePtr, sttype,depth int, maxlimit int) ([][]Link,int) {
 
-	qstr := fmt.Sprintf("SELECT FwdPathsAsLinks from FwdPathsAsLinks('(%d,%d)',%d,%d,%d);",start.Class,start.CPtr,sttype,depth,maxlimit)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY to FwdPathsAsLinks Failed",err)
-	}
-
-	var whole string
-	var retval [][]Link
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			retval = ParseLinkPath(whole)
-		}
-
-		row.Close()
-	}
-
+	retval := sst.Store.FwdPaths(start,sttype,depth,maxlimit)
 	return retval,len(retval)
 }
 
@@ -4584,28 +4361,7 @@ func GetEntireConePathsAsLinks(sst PoSST,orientation string,start NodePtr,depth
 
 	// orientation should be "fwd" or "bwd" else "both"
 
-	// Todo: how to limit path search? Usually solutions are small..?
-
-	qstr := fmt.Sprintf("select AllPathsAsLinks from AllPathsAsLinks('(%d,%d)','%s',%d, %d);",
-		start.Class,start.CPtr,orientation,depth,limit)
-
-	row, err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("QUERY to AllPathsAsLinks Failed",err,qstr)
-	}
-
-	var whole string
-	var retval [][]Link
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			retval = ParseLinkPath(whole)
-		}
-
-		row.Close()
-	}
+	retval := sst.Store.EntireConePaths(orientation,[]NodePtr{start},depth,"",nil,limit)
 
 	sort.Slice(retval, func(i,j int) bool {
 		return len(retval[i]) < len(retval[j])
@@ -4621,35 +4377,7 @@ func GetEntireNCConePathsAsLinks(sst PoSST,orientation string,start []NodePtr,de
 	// See also GetConstraintConePathsAsLinks for an interface with arrow matching
 	// orientation should be "fwd" or "bwd" else "both"
 
-	remove_accents,stripped := IsBracketedSearchTerm(chapter)
-	chapter = "%"+stripped+"%"
-	rm_acc := "false"
-
-	if remove_accents {
-		rm_acc = "true"
-	}
-
-	qstr := fmt.Sprintf("select AllNCPathsAsLinks(%s,'%s',%s,%s,'%s',%d,%d);",FormatSQLNodePtrArray(start),chapter,rm_acc,FormatSQLStringArray(context),orientation,depth,limit)
-
-	row, err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("QUERY to AllNCPathsAsLinks Failed",err,qstr)
-		os.Exit(-1)
-	}
-
-	var whole string
-	var retval [][]Link
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			retval = ParseLinkPath(whole)
-		}
-
-		row.Close()
-	}
-
+	retval := sst.Store.EntireConePaths(orientation,start,depth,chapter,context,limit)
 	return retval,len(retval)
 }
 
@@ -4660,41 +4388,7 @@ func GetConstraintConePathsAsLinks(sst PoSST,start []NodePtr,depth int,chapter s
 	// See also GetEntireNCConePathsAsLinks() for a differently optimized interface
 	// orientation should be "fwd" or "bwd" else "both"
 
-	remove_accents,stripped := IsBracketedSearchTerm(chapter)
-	chapter = "%"+stripped+"%"
-	rm_acc := "false"
-
-	if remove_accents {
-		rm_acc = "true"
-	}
-
-	nod := FormatSQLNodePtrArray(start)
-	arr := FormatSQLIntArray(Arrow2Int(arrowptrs))
-	stt := FormatSQLIntArray(sttypes)
-	cnt := FormatSQLStringArray(context)
-
-	qstr := fmt.Sprintf("select ConstraintPathsAsLinks(%s,'%s',%s,%s,%s,%s,%d,%d);",nod,chapter,rm_acc,cnt,arr,stt,depth,limit)
-
-	row, err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("QUERY to ConstraintPathsAsLinks Failed",err,qstr)
-		os.Exit(-1)
-	}
-
-	var whole string
-	var retval [][]Link
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&whole)
-			retval = ParseLinkPath(whole)
-			break
-		}
-
-		row.Close()
-	}
-
+	retval := sst.Store.ConstraintConePaths(start,depth,chapter,context,arrowptrs,sttypes,limit)
 	return retval,len(retval)
 }
 
@@ -4708,85 +4402,73 @@ var MUTEX sync.Mutex
 
 func CacheNode(n Node) {
 
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
+
 	_,already := NODE_CACHE[n.NPtr]
 
 	if !already {
-		MUTEX.Lock()
-		defer MUTEX.Unlock()
 		NODE_CACHE[n.NPtr] = AppendTextToDirectory(n,RunErr)
 	}
 }
 
 // **************************************************************************
 
-func DownloadArrowsFromDB(sst PoSST) {
+func GetCachedNode(db_nptr NodePtr) (Node,bool) {
 
-	// These must be ordered to match in-memory array
+	MUTEX.Lock()
+	defer MUTEX.Unlock()
 
-	qstr := fmt.Sprintf("SELECT STAindex,Long,Short,ArrPtr FROM ArrowDirectory ORDER BY ArrPtr")
+	im_nptr,cached := NODE_CACHE[db_nptr]
 
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY Download Arrows Failed",err)
+	if !cached {
+		return Node{},false
 	}
 
-	ARROW_DIRECTORY = nil
-	ARROW_DIRECTORY_TOP = 0
+	return GetMemoryNodeFromPtr(im_nptr),true
+}
 
-	var staidx int
-	var long string
-	var short string
-	var ptr ArrowPtr
-	var ad ArrowDirectory
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&staidx,&long,&short,&ptr)
-			ad.STAindex = staidx
-			ad.Long = long
-			ad.Short = short
-			ad.Ptr = ptr
-
-			ARROW_DIRECTORY = append(ARROW_DIRECTORY,ad)
-			ARROW_SHORT_DIR[short] = ARROW_DIRECTORY_TOP
-			ARROW_LONG_DIR[long] = ARROW_DIRECTORY_TOP
-
-			if ad.Ptr != ARROW_DIRECTORY_TOP {
-				fmt.Println(ERR_MEMORY_DB_ARROW_MISMATCH,ad,ad.Ptr,ARROW_DIRECTORY_TOP)
-				os.Exit(-1)
-			}
+// **************************************************************************
 
-			ARROW_DIRECTORY_TOP++
-		}
+func DownloadArrowsFromDB(sst PoSST) {
 
-		row.Close()
-	}
+	// These must be ordered to match in-memory array. Read everything first,
+	// so that searches in progress only ever see a complete directory
 
-	// Get Inverses
+	arrows,inverses := sst.Store.DownloadArrows()
+	InstallArrowDirectory(arrows,inverses)
+}
 
-	qstr = fmt.Sprintf("SELECT Plus,Minus FROM ArrowInverses ORDER BY Plus")
+// **************************************************************************
 
-	row, err = sst.DB.Query(qstr)
-	
-	if err != nil {    
-		fmt.Println("QUERY Download Inverses Failed",err)
-	}
+func InstallArrowDirectory(arrows []ArrowDirectory,inverses map[ArrowPtr]ArrowPtr) {
 
-	var plus,minus ArrowPtr
+	DIRECTORY_MUTEX.Lock()
+	defer DIRECTORY_MUTEX.Unlock()
 
-	if row != nil {
-		for row.Next() {		
+	// Start afresh, names left over from another store would shadow these
 
-			err = row.Scan(&plus,&minus)
+	ARROW_DIRECTORY = nil
+	ARROW_DIRECTORY_TOP = 0
+	ARROW_SHORT_DIR = make(map[string]ArrowPtr)
+	ARROW_LONG_DIR = make(map[string]ArrowPtr)
+	INVERSE_ARROWS = make(map[ArrowPtr]ArrowPtr)
 
-			if err != nil {
-				fmt.Println("QUERY Download Arrows Failed",err)
-			}
+	for _,ad := range arrows {
 
-			INVERSE_ARROWS[plus] = minus
+		if ad.Ptr != ARROW_DIRECTORY_TOP {
+			fmt.Println(ERR_MEMORY_DB_ARROW_MISMATCH,ad,ad.Ptr,ARROW_DIRECTORY_TOP)
+			os.Exit(-1)
 		}
-		row.Close()
+
+		ARROW_DIRECTORY = append(ARROW_DIRECTORY,ad)
+		ARROW_SHORT_DIR[ad.Short] = ARROW_DIRECTORY_TOP
+		ARROW_LONG_DIR[ad.Long] = ARROW_DIRECTORY_TOP
+		ARROW_DIRECTORY_TOP++
+	}
+
+	for plus,minus := range inverses {
+		INVERSE_ARROWS[plus] = minus
 	}
 }
 
@@ -4794,40 +4476,30 @@ func DownloadArrowsFromDB(sst PoSST) {
 
 func DownloadContextsFromDB(sst PoSST) {
 
-	qstr := fmt.Sprintf("SELECT Context,CtxPtr FROM ContextDirectory ORDER BY CtxPtr")
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY Download Arrows Failed",err)
-	}
-
-	CONTEXT_DIRECTORY = nil
-	CONTEXT_TOP = 0
+	InstallContextDirectory(sst.Store.DownloadContexts())
+}
 
-	var context string
-	var ptr ContextPtr
+// **************************************************************************
 
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&context,&ptr)
+func InstallContextDirectory(contexts []ContextDirectory) {
 
-			var c ContextDirectory
+	DIRECTORY_MUTEX.Lock()
+	defer DIRECTORY_MUTEX.Unlock()
 
-			c.Context = context
-			c.Ptr = ptr
+	CONTEXT_DIRECTORY = nil
+	CONTEXT_TOP = 0
+	CONTEXT_DIR = make(map[string]ContextPtr)
 
-			if c.Ptr != CONTEXT_TOP {
-				fmt.Println(ERR_MEMORY_DB_CONTEXT_MISMATCH,c,CONTEXT_TOP)
-				os.Exit(-1)
-			}
+	for _,c := range contexts {
 
-			CONTEXT_DIRECTORY = append(CONTEXT_DIRECTORY,c)
-			CONTEXT_DIR[context] = CONTEXT_TOP
-			CONTEXT_TOP++
+		if c.Ptr != CONTEXT_TOP {
+			fmt.Println(ERR_MEMORY_DB_CONTEXT_MISMATCH,c,CONTEXT_TOP)
+			os.Exit(-1)
 		}
 
-		row.Close()
+		CONTEXT_DIRECTORY = append(CONTEXT_DIRECTORY,c)
+		CONTEXT_DIR[c.Context] = CONTEXT_TOP
+		CONTEXT_TOP++
 	}
 }
 
@@ -4838,61 +4510,49 @@ func SynchronizeNPtrs(sst PoSST) {
 	// If we're merging (not recommended) N4L into an existing db, we need to synch
 
 	for channel := N1GRAM; channel <= GT1024; channel++ {
-		
-		qstr := fmt.Sprintf("SELECT max((Nptr).CPtr) FROM Node WHERE (Nptr).Chan=%d",channel)
 
-		row, err := sst.DB.Query(qstr)
-		
-		if err != nil {
-			fmt.Println("QUERY Synchronizing nptrs",err)
-		}
+		ReserveNPtrs(channel,sst.Store.MaxCPtr(channel))
+	}
 
-		var cptr int
+}
 
-		if row != nil {
-			for row.Next() {			
-				err = row.Scan(&cptr)
-			
-				if err != nil {
-					continue // maybe not defined yet
-				}
+// **************************************************************************
 
-				if cptr > 0 {
-
-					var empty Node
-
-					// Remember this for uploading later ..
-					BASE_DB_CHANNEL_STATE[channel] = ClassedNodePtr(cptr)
-
-					for n := 0; n <= cptr; n++ {
-
-						switch channel {
-						case N1GRAM:
-							NODE_DIRECTORY.N1_top++
-							NODE_DIRECTORY.N1directory = append(NODE_DIRECTORY.N1directory,empty)
-						case N2GRAM:
-							NODE_DIRECTORY.N2directory = append(NODE_DIRECTORY.N2directory,empty)
-							NODE_DIRECTORY.N2_top++
-						case N3GRAM:
-							NODE_DIRECTORY.N3directory = append(NODE_DIRECTORY.N3directory,empty)
-							NODE_DIRECTORY.N3_top++
-						case LT128:
-							NODE_DIRECTORY.LT128 = append(NODE_DIRECTORY.LT128,empty)
-							NODE_DIRECTORY.LT128_top++
-						case LT1024:
-							NODE_DIRECTORY.LT1024 = append(NODE_DIRECTORY.LT1024,empty)
-							NODE_DIRECTORY.LT1024_top++
-						case GT1024:
-							NODE_DIRECTORY.GT1024 = append(NODE_DIRECTORY.GT1024,empty)
-							NODE_DIRECTORY.GT1024_top++
-						}
-					}
-				}
+func ReserveNPtrs(channel,cptr int) {
+
+	// cptr is the highest pointer in use, or negative if the channel is empty
+
+	if cptr >= 0 {
+
+		var empty Node
+
+		// Remember this for uploading later, new nodes start above the db range
+		BASE_DB_CHANNEL_STATE[channel] = ClassedNodePtr(cptr+1)
+
+		for n := 0; n <= cptr; n++ {
+
+			switch channel {
+			case N1GRAM:
+				NODE_DIRECTORY.N1_top++
+				NODE_DIRECTORY.N1directory = append(NODE_DIRECTORY.N1directory,empty)
+			case N2GRAM:
+				NODE_DIRECTORY.N2directory = append(NODE_DIRECTORY.N2directory,empty)
+				NODE_DIRECTORY.N2_top++
+			case N3GRAM:
+				NODE_DIRECTORY.N3directory = append(NODE_DIRECTORY.N3directory,empty)
+				NODE_DIRECTORY.N3_top++
+			case LT128:
+				NODE_DIRECTORY.LT128 = append(NODE_DIRECTORY.LT128,empty)
+				NODE_DIRECTORY.LT128_top++
+			case LT1024:
+				NODE_DIRECTORY.LT1024 = append(NODE_DIRECTORY.LT1024,empty)
+				NODE_DIRECTORY.LT1024_top++
+			case GT1024:
+				NODE_DIRECTORY.GT1024 = append(NODE_DIRECTORY.GT1024,empty)
+				NODE_DIRECTORY.GT1024_top++
 			}
-			row.Close()
 		}
 	}
-
 }
 
 // **************************************************************************
@@ -5274,6 +4934,15 @@ func MakeCoordinateDirectory(XChannels []float64, unique [][]NodePtr,maxzlen,nth
 
 func GetPathsAndSymmetries(sst PoSST,start_set,end_set []NodePtr,chapter string,context []string,arrowptrs []ArrowPtr,sttypes []int,mindepth,maxdepth int) [][]Link {
 
+	return GetWeightedPathsAndSymmetries(sst,start_set,end_set,chapter,context,arrowptrs,sttypes,mindepth,maxdepth,NO_MIN_WEIGHT,NO_MAX_WEIGHT)
+}
+
+// **************************************************************************
+
+func GetWeightedPathsAndSymmetries(sst PoSST,start_set,end_set []NodePtr,chapter string,context []string,arrowptrs []ArrowPtr,sttypes []int,mindepth,maxdepth int,minwgt,maxwgt float32) [][]Link {
+
+	// Only links with minwgt <= Wgt <= maxwgt may carry the waves
+
 	var left_paths, right_paths [][]Link
 	var ldepth,rdepth int = 1,1
 	var Lnum,Rnum int
@@ -5298,6 +4967,9 @@ func GetPathsAndSymmetries(sst PoSST,start_set,end_set []NodePtr,chapter string,
 	left_paths,Lnum = GetConstraintConePathsAsLinks(sst,start_set,ldepth,chapter,context,arrowptrs,sttypes,maxdepth)
 	right_paths,Rnum = GetConstraintConePathsAsLinks(sst,end_set,rdepth,chapter,context,adj_arrowptrs,adj_sttypes,maxdepth)
 
+	left_paths = FilterPathsByWeight(left_paths,minwgt,maxwgt)
+	right_paths = FilterPathsByWeight(right_paths,minwgt,maxwgt)
+
 	// Expand waves
 
 	for turn := 0; ldepth < maxdepth && rdepth < maxdepth; turn++ {
@@ -5318,9 +4990,11 @@ func GetPathsAndSymmetries(sst PoSST,start_set,end_set []NodePtr,chapter string,
 
 		if turn % 2 == 0 {
 			left_paths = IncConstraintConeLinks(sst,left_paths,chapter,context,arrowptrs,sttypes,maxdepth)
+			left_paths = FilterPathsByWeight(left_paths,minwgt,maxwgt)
 			ldepth++
 		} else {
 			right_paths = IncConstraintConeLinks(sst,right_paths,chapter,context,adj_arrowptrs,adj_sttypes,maxdepth)
+			right_paths = FilterPathsByWeight(right_paths,minwgt,maxwgt)
 			rdepth++
 		}
 	}
@@ -5377,49 +5051,7 @@ func IncConstraintConeLinks(sst PoSST,cone [][]Link,chapter string ,context []st
 
 func GetConstrainedFwdLinks(sst PoSST,start []NodePtr,chapter string,context []string,sttypes []int,arrows []ArrowPtr,maxlimit int) []Link {
 
-	var ret []Link
-
-	remove_accents,stripped := IsBracketedSearchTerm(chapter)
-	chapter = "%"+stripped+"%"
-	rm_acc := "false"
-
-	if remove_accents {
-		rm_acc = "true"
-	}
-
-	start = append(start,NONODE)
-	excl := FormatSQLNodePtrArray(start)
-	arr := FormatSQLIntArray(Arrow2Int(arrows))
-	cnt := FormatSQLStringArray(context)
-
-	startnode := fmt.Sprintf("(%d,%d)",start[0].Class,start[0].CPtr)
-
-	for _,st := range sttypes { 
-
-		qstr := fmt.Sprintf("select GetConstrainedFwdLinks('%s','%s',%s,%s,%s,%d,%s,%d);",startnode,chapter,rm_acc,cnt,excl,st,arr,maxlimit)
-
-		row, err := sst.DB.Query(qstr)
-		
-		if err != nil {
-			fmt.Println("QUERY to ConstraintPathsAsLinks Failed",err,qstr)
-			return ret
-		}
-		
-		var whole string
-
-		if row != nil {		
-			for row.Next() {		
-				err = row.Scan(&whole)
-				orbit := ParseLinkArray(whole)
-				for _,lnk := range orbit {
-					ret = append(ret,lnk)
-				}
-			}
-			row.Close()
-		}
-	}
-
-	return ret
+	return sst.Store.ConstrainedFwdLinks(start,chapter,context,sttypes,arrows,maxlimit)
 }
 
 // **************************************************************************
@@ -5501,7 +5133,11 @@ func AdjointArrows(arrowptrs []ArrowPtr) []ArrowPtr {
 	var result []ArrowPtr
 
 	for _,a := range arrowptrs {
-		idemp[INVERSE_ARROWS[a]] = true
+		if a < 0 {
+			idemp[-InverseArrow(-a)] = true
+		} else {
+			idemp[InverseArrow(a)] = true
+		}
 	}
 
 	for a := range idemp {
@@ -5743,139 +5379,96 @@ func InNodeSet(list []NodePtr,node NodePtr) bool {
 func GetDBAdjacentNodePtrBySTType(sst PoSST,sttypes []int,chap string,cn []string,transpose bool) ([][]float32,[]NodePtr) {
 
 	// Return a weighted adjacency matrix by nptr, and an index:nptr lookup table
-	// Returns a connected adjacency matrix for the subgraph and a lookup table
-	// A bit memory intensive, but possibly unavoidable
-	
-	var qstr,qwhere,qsearch string
-	var dim = len(sttypes)
+	// Dense, so only for small subgraphs - see GetDBSparseAdjacencyBySTType
 
-	context := FormatSQLStringArray(cn)
-	chapter := "%"+SQLEscape(chap)+"%"
+	adj,nodekey := GetDBSparseAdjacencyBySTType(sst,sttypes,chap,cn,transpose)
 
-	if dim > 4 {
-		fmt.Println("Maximum 4 sttypes in GetDBAdjacentNodePtrBySTType")
+	if nodekey == nil {
 		return nil,nil
 	}
 
-	for st := 0; st < len(sttypes); st++ {
-
-		stname := STTypeDBChannel(sttypes[st])
-		qwhere += fmt.Sprintf("array_length(%s::text[],1) IS NOT NULL AND match_context((%s)[0].Ctx,%s)",stname,stname,context)
-
-		if st != dim-1 {
-			qwhere += " OR "
-		}
-
-		qsearch += "," + stname
+	return SparseToDense(adj),nodekey
+}
 
-	}
+// **************************************************************************
 
-	qstr = fmt.Sprintf("SELECT NPtr%s FROM Node WHERE lower(Chap) LIKE lower('%s') AND (%s)",qsearch,chapter,qwhere)
+func GetDBSparseAdjacencyBySTType(sst PoSST,sttypes []int,chap string,cn []string,transpose bool) (SparseMatrix,[]NodePtr) {
 
-	row, err := sst.DB.Query(qstr)
+	var none SparseMatrix
 
-	if err != nil {
-		fmt.Println("QUERY GetDBAdjacentNodePtrBySTType Failed",err)
-		return nil,nil
+	// Return a connected, weighted adjacency matrix for the subgraph by nptr,
+	// and an index:nptr lookup table. Only the links are kept in memory
+	
+	if len(sttypes) > 4 {
+		fmt.Println("Maximum 4 sttypes in GetDBSparseAdjacencyBySTType")
+		return none,nil
 	}
 
-	var linkstr = make([]string,dim+1)
 	var protoadj = make(map[int][]Link)
 	var lookup = make(map[NodePtr]int)
 	var rowindex int
 	var nodekey []NodePtr
 	var counter int
 
-	if row != nil {
-		for row.Next() {		
-
-			var n NodePtr
-			var nstr string
-
-			switch dim {
-
-			case 1: err = row.Scan(&nstr,&linkstr[0])
-			case 2: err = row.Scan(&nstr,&linkstr[0],&linkstr[1])
-			case 3: err = row.Scan(&nstr,&linkstr[0],&linkstr[1],&linkstr[2])
-			case 4: err = row.Scan(&nstr,&linkstr[0],&linkstr[1],&linkstr[2],&linkstr[3])
-
-			default:
-				fmt.Println("Maximum 4 sttypes in GetDBAdjacentNodePtrBySTType - shouldn't happen")
-				row.Close()
-				return nil,nil
-			}
-
-			if err != nil {
-				fmt.Println("Error scanning sql data case",dim,"gave error",err,qstr)
-				row.Close()
-				return nil,nil
-			}
-
-			fmt.Sscanf(nstr,"(%d,%d)",&n.Class,&n.CPtr)
+	for _,n := range sst.Store.LinkedNodes(sttypes,chap,cn) {
 
-			// idempotently gather nptrs into a map, keeping linked nodes close in order
+		// idempotently gather nptrs into a map, keeping linked nodes close in order
 
-			index,already := lookup[n]
+		index,already := lookup[n.NPtr]
 			
-			if already {
-				rowindex = index
-			} else {
-				rowindex = counter
-				lookup[n] = counter
-				counter++
-				nodekey = append(nodekey,n)
-			}
+		if already {
+			rowindex = index
+		} else {
+			rowindex = counter
+			lookup[n.NPtr] = counter
+			counter++
+			nodekey = append(nodekey,n.NPtr)
+		}
 
-			// Run through the nodes linked and add them now
+		// Run through the nodes linked and add them now
 
-			for lnks := range linkstr {
+		for _,st := range sttypes {
 
-				links := ParseMapLinkArray(linkstr[lnks])
+			links := n.I[STTypeToSTIndex(st)]
 
-				// we have to go through one by one to avoid duplicates
-				// and keep adjacent nodes closer in order
+			// we have to go through one by one to avoid duplicates
+			// and keep adjacent nodes closer in order
 			
-				for l := range links {	
-					_,already := lookup[links[l].Dst]
+			for l := range links {	
+				_,already := lookup[links[l].Dst]
 					
-					if !already {
-						lookup[links[l].Dst] = counter
-						counter++
-						nodekey = append(nodekey,links[l].Dst)
-					}
+				if !already {
+					lookup[links[l].Dst] = counter
+					counter++
+					nodekey = append(nodekey,links[l].Dst)
 				}
-				// Now we have a vector row for each NPtr, with a list of links
-				protoadj[rowindex] = append(protoadj[rowindex],links...)
 			}
+			// Now we have a vector row for each NPtr, with a list of links
+			protoadj[rowindex] = append(protoadj[rowindex],links...)
 		}
-		row.Close()
 	}
 
 	// Now we know the dimension of the square matrix = counter
 	// and an ordered directory vector[index] ->  NPtr, as well as lookup table
 	// So we assemble the adjacency matrix (or its transpose on request)
-	
-	adj := make([][]float32,counter)
 
-	for r := 0; r < counter; r++ {
+	var entries []SparseEntry
 
-		adj[r] = make([]float32,counter)
-
-		row := protoadj[r]
-		
+	for r,row := range protoadj {
 		for l := 0; l < len(row); l++ {
 
 			lnk := row[l]
 			c := lookup[lnk.Dst]
 
 			if transpose {
-				adj[c][r] = lnk.Wgt
+				entries = append(entries,SparseEntry{Row: c, Col: r, Val: lnk.Wgt})
 			} else {
-				adj[r][c] = lnk.Wgt
+				entries = append(entries,SparseEntry{Row: r, Col: c, Val: lnk.Wgt})
 			}
 		}
 	}
-	return adj,nodekey
+
+	return MakeSparseMatrix(counter,entries),nodekey
 }
 
 // **************************************************************************
@@ -6193,14 +5786,22 @@ func AdjointLinkPath(LL []Link) []Link {
 	// len(seq)-1 matches the last node of right join
 	// when we invert, links and destinations are shifted
 
-	var prevarrow ArrowPtr = INVERSE_ARROWS[0]
+	// The weight and context belong to the arrow, so they shift with it
+
+	var prevarrow ArrowPtr = InverseArrow(0)
+	var prevwgt float32 = 1.0
+	var prevctx ContextPtr
 
 	for j := len(LL)-1; j >= 0; j-- {
 
 		var lnk Link = LL[j]
-		lnk.Arr = INVERSE_ARROWS[prevarrow]
+		lnk.Arr = InverseArrow(prevarrow)
+		lnk.Wgt = prevwgt
+		lnk.Ctx = prevctx
 		adjoint = append(adjoint,lnk)
 		prevarrow = LL[j].Arr
+		prevwgt = LL[j].Wgt
+		prevctx = LL[j].Ctx
 	}
 
 	return adjoint
@@ -6246,6 +5847,21 @@ func GetSequenceContainers(sst PoSST,nodeptrs []NodePtr, arrowptrs []ArrowPtr, s
 	// Story search
 
 	var stories []Story
+	var seqarrow ArrowPtr
+
+	// Excluded arrows (negative) can't define the story axis
+
+	for _,a := range arrowptrs {
+		if a > 0 {
+			seqarrow = a
+			break
+		}
+	}
+
+	if seqarrow == 0 {
+		fmt.Println("No sequence arrow to follow, only excluded arrows were given")
+		return nil
+	}
 
 	openings := SelectStoriesByArrow(sst,nodeptrs,arrowptrs,sttypes,limit)
 
@@ -6260,7 +5876,7 @@ func GetSequenceContainers(sst PoSST,nodeptrs []NodePtr, arrowptrs []ArrowPtr, s
 
 		story.Chapter = node.Chap
 
-		axis := GetLongestAxialPath(sst,openings[nth],arrowptrs[0],limit)
+		axis := GetLongestAxialPath(sst,openings[nth],seqarrow,limit)
 
 		directory := AssignStoryCoordinates(axis,nth,len(openings),limit)
 
@@ -6435,7 +6051,7 @@ func GetLongestAxialPath(sst PoSST,nptr NodePtr,arrowptr ArrowPtr,limit int) []L
 
 	var max int = 1
 
-	sttype := STIndexToSTType(ARROW_DIRECTORY[arrowptr].STAindex)
+	sttype := STIndexToSTType(GetDBArrowByPtr(sst,arrowptr).STAindex)
 
 	paths,dim := GetFwdPathsAsLinks(sst,nptr,sttype,limit,limit)
 
@@ -6528,120 +6144,44 @@ func ContextIntentAnalysis(spectrum map[string]int,clusters []string) ([]string,
 
 func UpdateLastSawSection(sst PoSST,name string) {
 
-	s := fmt.Sprintf("select LastSawSection('%s')",name)
-	sst.DB.QueryRow(s)
+	sst.Store.LastSawSection(sst.User,name)
 }
 
 // *********************************************************************
 
 func UpdateLastSawNPtr(sst PoSST,class,cptr int,name string) {
 
-	s := fmt.Sprintf("select LastSawNPtr('(%d,%d)','%s')",class,cptr,name)
-	sst.DB.QueryRow(s)
+	sst.Store.LastSawNPtr(sst.User,NodePtr{Class: class,CPtr: ClassedNodePtr(cptr)},name)
 }
 
 //******************************************************************
 
 func GetLastSawSection(sst PoSST) []LastSeen {
 
-	qstr := fmt.Sprintf("SELECT section,nptr,EXTRACT(EPOCH FROM first),EXTRACT(EPOCH FROM last),freq,delta as pdelta,EXTRACT(EPOCH FROM NOW()-last) as ndelta from Lastseen ORDER BY section")
-
-	row,err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("GetLastSawSection failed\n",qstr,err)
-		return nil
-	}
-
-	var ret []LastSeen
-
-	if row != nil {
-		for row.Next() {		
-			var ls LastSeen
-			var nptrstr string // last because if empty fails
-			var first,last float64
-			err = row.Scan(&ls.Section,&nptrstr,&first,&last,&ls.Freq,&ls.Pdelta,&ls.Ndelta)
-			ls.Last = int64(last)
-			ls.First = int64(first)
-			fmt.Sscanf(nptrstr,"(%d,%d)",&ls.NPtr.Class,&ls.NPtr.CPtr)
-			ret = append(ret,ls)
-		}
-
-		for c := 0; c < len(ret); c++ {
-			ret[c].XYZ = AssignChapterCoordinates(c,len(ret))
-		}
+	ret := sst.Store.GetLastSeen(sst.User)
 
-		row.Close()
+	for c := 0; c < len(ret); c++ {
+		ret[c].XYZ = AssignChapterCoordinates(c,len(ret))
 	}
 
 	return ret
-}
-
-//******************************************************************
-
-func GetLastSawNPtr(sst PoSST, nptr NodePtr) LastSeen {
-
-	var ls LastSeen
-
-	qstr := fmt.Sprintf("SELECT section,EXTRACT(EPOCH FROM first),EXTRACT(EPOCH FROM last),freq,delta as pdelta,EXTRACT(EPOCH FROM NOW()-last) as ndelta from Lastseen WHERE NPTR='(%d,%d)'::NodePtr",nptr.Class,nptr.CPtr)
-
-	row,err := sst.DB.Query(qstr)
-
-	if err != nil {
-		fmt.Println("GetLastSawNPtr failed\n",qstr,err)
-		return ls
-	}
-
-	if row != nil {
-		for row.Next() {
-			var first,last float64
-			err = row.Scan(&ls.Section,&first,&last,&ls.Freq,&ls.Pdelta,&ls.Ndelta)
-			ls.Last = int64(last)
-			ls.First = int64(first)
-		}
+}
 
-		ls.NPtr = nptr
+//******************************************************************
 
-		row.Close()
-	}
+func GetLastSawNPtr(sst PoSST, nptr NodePtr) LastSeen {
 
-	return ls
+	return sst.Store.GetLastSeenNPtr(sst.User,nptr)
 }
 
 // *********************************************************************
 
 func GetNewlySeenNPtrs(sst PoSST,search SearchParameters) map[NodePtr]bool {
 
-	var qstr string
 	var nptrs = make (map[NodePtr]bool)
 
-	switch search.Horizon {
-
-	case RECENT:
-		qstr = fmt.Sprintf("SELECT NPtr FROM LastSeen WHERE last > NOW() - INTERVAL '%d hour'",search.Horizon)
-	case NEVER:
-		qstr = "SELECT NPtr FROM LastSeen"
-	default:
-		return nptrs
-	}
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("Failed to get LastSeen",err)
-	}
-
-	var whole string
-	var nptr NodePtr
-
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&whole)
-			fmt.Sscanf(whole,"(%d,%d)",&nptr.Class,&nptr.CPtr)
-			nptrs[nptr] = true
-		}
-		
-		row.Close()
+	for _,nptr := range sst.Store.GetSeenNPtrs(sst.User,search.Horizon) {
+		nptrs[nptr] = true
 	}
 
 	return nptrs
@@ -6704,6 +6244,8 @@ func UpdateSTMContext(sst PoSST,ambient,key string,now int64,params SearchParame
 
 func AddContext(sst PoSST,ambient,key string,now int64,tokens []string) string {
 
+	var names []string
+
 	for t := range tokens {
 
 		token := tokens[t]
@@ -6729,31 +6271,52 @@ func AddContext(sst PoSST,ambient,key string,now int64,tokens []string) string {
 				continue
 			}
 		}
-		CommitContextToken(token,now,ambient)
+		names = append(names,token)
+	}
+
+	// Each user and session has their own short term memory
+
+	STM_MUTEX.Lock()
+
+	stm := UserSTM(sst)
+
+	for _,token := range names {
+		CommitContextToken(stm,token,now,ambient)
 	}
 
 	var format = make(map[string]int)
+	var forgotten []string
 
-	for fr := range STM_AMB_FRAG {
+	for fr := range stm.Amb {
 
-		if STM_AMB_FRAG[fr].Delta > FORGOTTEN {
-			delete(STM_AMB_FRAG,fr)
+		if Forgotten(stm.Amb[fr],now) {
+			delete(stm.Amb,fr)
+			forgotten = append(forgotten,fr)
 			continue
 		} 
 
 		format[fr]++
 	}
 
-	for fr := range STM_INT_FRAG {
+	for fr := range stm.Int {
 
-		if STM_INT_FRAG[fr].Delta > FORGOTTEN {
-			delete(STM_INT_FRAG,fr)
+		if Forgotten(stm.Int[fr],now) {
+			delete(stm.Int,fr)
+			forgotten = append(forgotten,fr)
 			continue
 		} 
 
 		format[fr]++
 	}
 
+	changed := STMChanges(stm,names)
+
+	STM_MUTEX.Unlock()
+
+	// Only what changed goes to the store, without holding up other users
+
+	SaveSTM(sst,changed,forgotten)
+
 	full_context := List2String(Map2List(format))
 
 	return full_context
@@ -6761,16 +6324,16 @@ func AddContext(sst PoSST,ambient,key string,now int64,tokens []string) string {
 
 // *********************************************************************
 
-func CommitContextToken(token string,now int64,key string) {
+func CommitContextToken(stm *STMState,token string,now int64,key string) {
 	
 	var last,obs History
 	
 	// Check if already known ambient
-	last,already := STM_AMB_FRAG[token]
+	last,already := stm.Amb[token]
 	
 	// if not, then check if already seen
 	if !already {
-		last,already = STM_INT_FRAG[token]
+		last,already = stm.Int[token]
 	}
 	
 	if !already {
@@ -6788,10 +6351,10 @@ func CommitContextToken(token string,now int64,key string) {
 	}
 	
 	if already {
-		delete(STM_INT_FRAG,token)
-		STM_AMB_FRAG[token] = obs
+		delete(stm.Int,token)
+		stm.Amb[token] = obs
 	} else {
-		STM_INT_FRAG[token] = obs
+		stm.Int[token] = obs
 	}
 }
 
@@ -7056,7 +6619,7 @@ func PrintSomeLinkPath(sst PoSST, cone [][]Link, p int, prefix string,chapter st
 		for s := range stpath {
 			fmt.Print(" -(",stpath[s],")-> ")
 		}
-		fmt.Println(". ]\n")
+		fmt.Print(". ]\n\n")
 	}
 }
 
@@ -7076,11 +6639,34 @@ func JSONNodeEvent(sst PoSST, nptr NodePtr,xyz Coords,orbits [ST_TOP][]Orbit) No
 	event.NPtr = nptr
 	event.XYZ = xyz
 	event.Orbits = orbits
+
 	return event
 }
 
 // **************************************************************************
 
+func AddNodeEventNotes(sst PoSST,events []NodeEvent) {
+
+	// The user's overlays for a whole response at once, rather than
+	// a query per node
+
+	var nptrs []NodePtr
+
+	for e := range events {
+		nptrs = append(nptrs,events[e].NPtr)
+	}
+
+	overlays := GetNodesOverlays(sst,nptrs)
+
+	for e := range events {
+		for _,ov := range overlays[events[e].NPtr] {
+			events[e].Notes = append(events[e].Notes,ov.Note)
+		}
+	}
+}
+
+// **************************************************************************
+
 func LinkWebPaths(sst PoSST,cone [][]Link,nth int,chapter string,context []string,swimlanes,limit int) [][]WebPath {
 
 	// This is dealing in good faith with one of swimlanes cones, assigning equal width to all
@@ -7129,6 +6715,7 @@ func LinkWebPaths(sst PoSST,cone [][]Link,nth int,chapter string,context []strin
 				wl.Name = arr.Long
 				wl.Arr = cone[p][l].Arr
 				wl.STindex = arr.STAindex
+				wl.Wgt = cone[p][l].Wgt
 				wl.XYZ = directory[cone[p][l].Dst]
 				path = append(path,wl)
 			}
@@ -7151,80 +6738,13 @@ func LinkWebPaths(sst PoSST,cone [][]Link,nth int,chapter string,context []strin
 
 func GetChaptersByChapContext(sst PoSST,chap string,cn []string,limit int) map[string][]string {
 
-	qstr := ""
-	chap_col := ""
-
 	chap = strings.Trim(chap,"\"")
 
-	if chap != "any" && chap != "" {
-
-		remove_chap_accents,chap_stripped := IsBracketedSearchTerm(chap)
-
-		if remove_chap_accents {
-			chap_search := "%"+chap_stripped+"%"
-			chap_col = fmt.Sprintf("AND lower(unaccent(chap)) LIKE lower('%s')",chap_search)
-		} else {
-			chap_search := "%"+chap+"%"
-			chap_col = fmt.Sprintf("AND lower(chap) LIKE lower('%s')",chap_search)
-		}
-	}
-
 	if chap == "TableOfContents" {
-		chap_col = ""
-	}
-
-	_,cn_stripped := IsBracketedSearchList(cn)
-	context := FormatSQLStringArray(cn_stripped)
-
-	qstr = fmt.Sprintf("SELECT DISTINCT chap,ctx FROM PageMap WHERE match_context(ctx,%s) %s ORDER BY Chap",context,chap_col)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetChaptersByChapContext Failed",err,qstr)
-	}
-
-	var rchap string
-	var rcontext ContextPtr
-	var toc = make(map[string][]string)
-
-	if row != nil {
-		for row.Next() {		
-			err = row.Scan(&rchap,&rcontext)
-
-			// Each chapter can be a comma separated list
-
-			chps := SplitChapters(rchap)
-
-			for c := 0; c < len(chps); c++ {
-
-				if len(toc) == limit {
-					row.Close()
-					return toc
-				}
-
-				rc := chps[c]
-
-				cn := strings.Split(GetContext(rcontext),",")
-				ctx_grp := ""
-
-				for s := 0; s < len(cn); s++ {
-					ctx_grp += cn[s]
-					if s < len(cn)-1 {
-						ctx_grp += ", "
-					}
-				}
-
-				if len(ctx_grp) > 0 {
-					toc[rc] = append(toc[rc],ctx_grp)
-				}
-			}
-		}
-
-		row.Close()
+		chap = ""
 	}
 
-	return toc
+	return sst.Store.GetChaptersByContext(chap,cn,limit)
 }
 
 // **************************************************************************
@@ -7320,47 +6840,14 @@ func GetAppointedNodesByArrow(sst PoSST,arrow ArrowPtr,cn []string,chap string,s
 	// return a map of all the nodes in chap,context that are pointed to by the same type of arrow
         // grouped by arrow
 
-	reverse_arrow := INVERSE_ARROWS[arrow]
+	reverse_arrow := InverseArrow(arrow)
 	arr := GetDBArrowByPtr(sst,reverse_arrow)
 	sttype := STIndexToSTType(arr.STAindex)
 
-	_,cn_stripped := IsBracketedSearchList(cn)
-	context := FormatSQLStringArray(cn_stripped)
-
-	var chap_col,chap_stripped string
-	var remove_chap_accents bool
-
-	if chap != "any" && chap != "" {	
-		remove_chap_accents,chap_stripped = IsBracketedSearchTerm(chap)
-		
-		if remove_chap_accents {
-			chap_col = "%"+chap_stripped+"%"
-		} else {
-			chap_col = "%"+chap+"%"
-		}
-	}
-
-	qstr := fmt.Sprintf("SELECT unnest(GetAppointments(%d,%d,%d,'%s',%s,%v))",int(reverse_arrow),sttype,size,chap_col,context,remove_chap_accents)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetAppointedNodesByArrow Failed",err,qstr)
-	}
-
-	var whole string
-
 	var retval = make(map[ArrowPtr][]Appointment)
-	
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&whole) //arrint,&sttype,&rchap,&rctx,&apex,&arry)
 
-			next := ParseAppointedNodeCluster(whole)
-			retval[next.Arr] = append(retval[next.Arr],next)
-		}
-	
-		row.Close()
+	for _,next := range sst.Store.Appointments(reverse_arrow,sttype,size,chap,cn) {
+		retval[next.Arr] = append(retval[next.Arr],next)
 	}
 
 	return retval
@@ -7373,42 +6860,10 @@ func GetAppointedNodesBySTType(sst PoSST,sttype int,cn []string,chap string,size
 	// return a map of all the nodes in chap,context that are pointed to by the same type of arrow
         // grouped by arrow
 
-	_,cn_stripped := IsBracketedSearchList(cn)
-	context := FormatSQLStringArray(cn_stripped)
-
-	var chap_col,chap_stripped string
-	var remove_chap_accents bool
-
-	if chap != "any" && chap != "" {	
-		remove_chap_accents,chap_stripped = IsBracketedSearchTerm(chap)
-		
-		if remove_chap_accents {
-			chap_col = "%"+chap_stripped+"%"
-		} else {
-			chap_col = "%"+chap+"%"
-		}
-	}
-
-	qstr := fmt.Sprintf("SELECT unnest(GetAppointments(%d,%d,%d,'%s',%s,%v))",-1,sttype,size,chap_col,context,remove_chap_accents)
-
-	row, err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("QUERY GetAppointedNodesByArrow Failed",err,qstr)
-	}
-
-	var whole string
-
 	var retval = make(map[ArrowPtr][]Appointment)
-	
-	if row != nil {
-		for row.Next() {
-			err = row.Scan(&whole) //arrint,&sttype,&rchap,&rctx,&apex,&arry)
 
-			next := ParseAppointedNodeCluster(whole)
-			retval[next.Arr] = append(retval[next.Arr],next)
-		}	
-		row.Close()
+	for _,next := range sst.Store.Appointments(-1,sttype,size,chap,cn) {
+		retval[next.Arr] = append(retval[next.Arr],next)
 	}
 
 	return retval
@@ -7464,7 +6919,7 @@ func ParseAppointedNodeCluster(whole string) Appointment {
 	fmt.Sscanf(l[1],"%d",&next.STType)
 
 	// invert arrow
-	next.Arr = INVERSE_ARROWS[ArrowPtr(arrp)]
+	next.Arr = InverseArrow(ArrowPtr(arrp))
 	next.STType = -next.STType
 
 	next.Chap = l[2]
@@ -7626,7 +7081,12 @@ type SearchParameters struct {
 	Finds    []string
 	Sequence bool
 	Stats    bool
-	Horizon  int
+	Horizon  int     // hours, for \new, \never and \remind
+	Remind   bool    // \remind agenda, see calendar.go
+	Weighted bool    // \weight limits were given
+	MinWgt   float32
+	MaxWgt   float32
+	Query    string  // \query boolean/phrase expression, see text_query.go
 }
 
 // ******************************************************************
@@ -7686,6 +7146,9 @@ const (
 	// What to find in orbit
 	CMD_FINDS = "\\finds"
 	CMD_FINDING = "\\finding"
+	// link weight thresholds
+	CMD_WEIGHT = "\\weight"
+	CMD_QUERY = "\\query"
 	// bounding linear path and parallel arrows
 	CMD_GT = "\\gt"
 	CMD_LT = "\\lt"
@@ -7722,6 +7185,7 @@ func DecodeSearchField(cmd string) SearchParameters {
 		CMD_REMIND,CMD_NEVER,CMD_NEW,
 		CMD_HELP,CMD_HELP_2,
 		CMD_FINDS,CMD_FINDING,
+		CMD_WEIGHT,CMD_QUERY,
         }
 	
 	// parentheses are reserved for unaccenting
@@ -7912,6 +7376,41 @@ func FillInParameters(cmd_parts [][]string,keywords []string) SearchParameters {
 				}
 				continue
 
+			case CMD_WEIGHT:
+				// e.g. \weight >0.5, \weight >= 0.2 <1, \weight 0.5
+				parsed := false
+				for pp := p+1; IsParam(pp,lenp,cmd_parts[c],keywords); pp++ {
+					cond := cmd_parts[c][pp]
+					if strings.Trim(cond,"<>=") == "" && IsParam(pp+1,lenp,cmd_parts[c],keywords) {
+						pp++
+						cond += cmd_parts[c][pp]
+					}
+					var ok bool
+					if param,ok = AddWeightCondition(param,cond); !ok {
+						break
+					}
+					p = pp
+					parsed = true
+				}
+				if !parsed {
+					param = AddOrphan(param,cmd_parts[c][p])
+				}
+				continue
+
+			case CMD_QUERY:
+				// e.g. \query brain and (wave or oscillat*), the rest is one expression
+				var terms []string
+				for pp := p+1; IsParam(pp,lenp,cmd_parts[c],keywords); pp++ {
+					p++
+					terms = append(terms,cmd_parts[c][pp])
+				}
+				if terms == nil {
+					param = AddOrphan(param,cmd_parts[c][p])
+				} else {
+					param.Query = strings.TrimSpace(param.Query+" "+strings.Join(terms," "))
+				}
+				continue
+
 			case CMD_ARROW,CMD_ARROWS:
 				if lenp > p+1 {
 					for pp := p+1; IsParam(pp,lenp,cmd_parts[c],keywords); pp++ {
@@ -8005,6 +7504,18 @@ func FillInParameters(cmd_parts [][]string,keywords []string) SearchParameters {
 			case CMD_NEW:
 				param.Horizon = RECENT
 				continue
+			case CMD_REMIND:
+				// if followed by a number of hours ahead, else could be search term
+				param.Remind = true
+				if lenp > p+1 {
+					var no int = -1
+					fmt.Sscanf(cmd_parts[c][p+1],"%d",&no)
+					if no > 0 {
+						p++
+						param.Horizon = no
+					}
+				}
+				continue
 			case CMD_NEVER:
 				param.Horizon = NEVER
 				continue
@@ -10089,6 +9600,10 @@ func SimilarString(full,like string) bool {
 	// Placeholder
 	// Need to handle pluralisation patterns etc... multi-language
 
+	if negate,term := IsNegatedTerm(like); negate {
+		return !strings.Contains(full,term)
+	}
+
 	if full == like {
 		return true
 	}
@@ -10121,13 +9636,71 @@ func InList(s string, list []string) (int,bool) {
 
 func MatchArrows(arrows []ArrowPtr,arr ArrowPtr) bool {
 
+	// Same as match_arrows(), excluded arrows are given as -ArrowPtr
+
+	only_exclusions := len(arrows) > 0
+
 	for a := range arrows {
+		if arr > 0 && arrows[a] == -arr {
+			return false
+		}
 		if arrows[a] == arr {
 			return true
 		}
+		if arrows[a] > 0 {
+			only_exclusions = false
+		}
 	}
 
-	return false
+	return only_exclusions
+}
+
+//****************************************************************************
+
+func PruneConeByArrows(cone [][]Link,arrows []ArrowPtr) [][]Link {
+
+	// Cut each cone path at its first excluded (negative) arrow. Cones are
+	// still selected by sttype, so positive arrows don't prune anything
+
+	var excluded = make(map[ArrowPtr]bool)
+
+	for _,a := range arrows {
+		if a < 0 {
+			excluded[-a] = true
+		}
+	}
+
+	if len(excluded) == 0 {
+		return cone
+	}
+
+	var retval [][]Link
+	var already = make(map[string]bool)
+
+	for _,path := range cone {
+
+		end := len(path)
+
+		for l := 1; l < len(path); l++ {
+			if excluded[path[l].Arr] {
+				end = l
+				break
+			}
+		}
+
+		if end < 2 {
+			continue
+		}
+
+		key := PathKey(path[:end])
+
+		if !already[key] {
+			already[key] = true
+			retval = append(retval,path[:end])
+		}
+	}
+
+	return retval
 }
 
 //****************************************************************************
@@ -10140,6 +9713,22 @@ func MatchContexts(context1 []string,context2ptr ContextPtr) bool {
 
 	context2 := strings.Split(GetContext(context2ptr),",")
 
+	// !inhibitors veto the match
+
+	context1,inhibit := SplitNegatedTerms(context1)
+
+	for _,c := range inhibit {
+		for _,item := range context2 {
+			if strings.Contains(strings.ToLower(Unaccent(item)),strings.ToLower(Unaccent(strings.Trim(c,"!")))) {
+				return false
+			}
+		}
+	}
+
+	if context1 == nil {
+		return true
+	}
+
 	for c := range context1 {
 
 		if MatchesInContext(context1[c],context2) {
@@ -10459,6 +10048,85 @@ func IsBracketedSearchTerm(src string) (bool,string) {
 
 //****************************************************************************
 
+func IsNegatedTerm(src string) (bool,string) {
+
+	// A leading ! excludes a context, chapter or arrow, e.g. \chapter !drafts,
+	// but !exact! is still an exact match, so exclude that as !!exact!
+
+	s := strings.TrimSpace(src)
+
+	if len(s) < 2 || s[0] != '!' {
+		return false,s
+	}
+
+	if exact,_ := IsExactMatch(s); exact && !strings.HasPrefix(s,"!!") {
+		return false,s
+	}
+
+	return true,strings.TrimSpace(s[1:])
+}
+
+//****************************************************************************
+
+func SplitNegatedTerms(list []string) ([]string,[]string) {
+
+	var include,exclude []string
+
+	for _,item := range list {
+
+		if negate,term := IsNegatedTerm(item); negate {
+			exclude = append(exclude,term)
+		} else {
+			include = append(include,item)
+		}
+	}
+
+	return include,exclude
+}
+
+//****************************************************************************
+
+func ChapterMatchSQL(column,chap string) string {
+
+	// Condition for a \chapter filter: a substring match, (..) for
+	// unaccenting and a leading ! to exclude matching chapters
+
+	negate,chap := IsNegatedTerm(chap)
+	remove_accents,stripped := IsBracketedSearchTerm(chap)
+
+	var cond string
+
+	if remove_accents {
+		cond = fmt.Sprintf("lower(unaccent(%s)) LIKE lower('%%%s%%')",column,stripped)
+	} else {
+		cond = fmt.Sprintf("lower(%s) LIKE lower('%%%s%%')",column,stripped)
+	}
+
+	if negate {
+		return "NOT "+cond
+	}
+
+	return cond
+}
+
+//****************************************************************************
+
+func ChapterPattern(chap string) (bool,string) {
+
+	// The %chapter% pattern for match_chapter() in the stored functions
+
+	negate,chap := IsNegatedTerm(chap)
+	remove_accents,stripped := IsBracketedSearchTerm(chap)
+
+	if negate {
+		return remove_accents,"%!"+stripped+"%"
+	}
+
+	return remove_accents,"%"+stripped+"%"
+}
+
+//****************************************************************************
+
 func IsExactMatch(org string) (bool,string) {
 
 	org = strings.TrimSpace(org)
@@ -10546,78 +10214,7 @@ func ReadToNext(array []rune,pos int,r rune) (string,int) {
 }
 
 //****************************************************************************
-// Allow for simple dynamic content for some approved realtime functions
-//****************************************************************************
-
-func ExpandDynamicFunctions(s string) string {
-
-	if !strings.Contains(s,"{") {
-		return s
-	}
-
-	if !strings.Contains(s,"}") {
-		return s
-	}
-
-	chars := []rune(s[len("Dynamic:"):])
-
-	var news string
-
-	for pos := 0; pos < len(chars); pos++ {
-
-		if chars[pos] != '{' {
-			news += string(chars[pos])
-		} else {
-			newpos,result := EvaluateInBuilt(chars,pos)
-			news += result
-			pos = newpos
-		}
-	}
-
-	return news
-}
-
-//****************************************************************************
-
-func EvaluateInBuilt(chars []rune,pos int) (int,string) {
-
-	var fntext string
-	var endpos int
-
-	for r := pos; chars[r] != '}' && r < len(chars); r++ {
-		fntext += string(chars[r])
-		endpos = r+1
-	}
-
-	fntext = fntext[1:len(fntext)]
-
-	delim := func(c rune) bool {
-		return c == ' ' || c == ',' || c == ';'
-	}
-
-	fn := strings.FieldsFunc(fntext,delim)
-	result := DoInBuiltFunction(fn)
-	return endpos,result
-}
-
-//****************************************************************************
-
-func DoInBuiltFunction(fn []string) string {
-
-	// Placeholder - this needs to support sandboxed read only user functions
-
-	var result string
-
-	switch fn[0] {
-	case "TimeUntil":
-		result = InBuiltTimeUntil(fn)
-	case "TimeSince":
-		result = InBuiltTimeSince(fn)
-	}
-
-	return result
-}
-
+// Dynamic content, see dynamic.go for the approved realtime functions
 //****************************************************************************
 
 func InBuiltTimeUntil(fn []string) string {
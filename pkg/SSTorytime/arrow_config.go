@@ -0,0 +1,185 @@
+//**************************************************************
+//
+// arrow_config.go - reading only the arrow names from SSTconfig,
+// for tools that need to know the arrows without a database
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//**************************************************************
+
+var PAIR_ARROW = regexp.MustCompile(`^\+\s*(.*?)\s*\(([^)]+)\)\s*-\s*(.*?)\s*\(([^)]+)\)`)
+var NEAR_ARROW = regexp.MustCompile(`^([^(]*?)\s*\(([^)]+)\)`)
+
+//**************************************************************
+
+func ReadArrowConfig() {
+
+	// Only the arrow names are needed, so a lighter reading of the
+	// arrows-*.sst files than N4L's, in the same places
+
+	files := []string{"arrows-LT-1.sst","arrows-NR-0.sst","arrows-CN-2.sst","arrows-EP-3.sst"}
+
+	AddMandatoryArrows()
+
+	dir := FindConfigDir()
+
+	if dir == "" {
+		fmt.Println("No SSTconfig directory found, only the built-in arrows are known")
+		return
+	}
+
+	for _,file := range files {
+
+		content,err := os.ReadFile(dir+"/"+file)
+
+		if err != nil {
+			fmt.Println("Unable to read configuration",dir+"/"+file,err)
+			continue
+		}
+
+		section := ""
+
+		for _,line := range strings.Split(string(content),"\n") {
+
+			line = StripConfigComment(line)
+
+			switch {
+
+			case line == "" || strings.HasPrefix(line,"::"):
+				continue
+
+			case strings.HasPrefix(line,"-") && !strings.Contains(line,"("):
+				section = strings.TrimSpace(line[1:])
+
+			case section == "similarity":
+				if m := NEAR_ARROW.FindStringSubmatch(line); m != nil {
+					ptr := InsertArrowDirectory(section,strings.TrimSpace(m[2]),m[1],"both")
+					InsertInverseArrowDirectory(ptr,ptr)
+				}
+
+			default:
+				if m := PAIR_ARROW.FindStringSubmatch(line); m != nil {
+					fwd := InsertArrowDirectory(section,strings.TrimSpace(m[2]),m[1],"+")
+					bwd := InsertArrowDirectory(section,strings.TrimSpace(m[4]),m[3],"-")
+					InsertInverseArrowDirectory(fwd,bwd)
+				}
+			}
+		}
+	}
+}
+
+//**************************************************************
+
+func ReadAnnotationConfig() map[string]string {
+
+	// The markers in SSTconfig/annotations.sst, e.g. % (ref), as
+	// marker -> arrow name
+
+	marks := make(map[string]string)
+
+	dir := FindConfigDir()
+
+	if dir == "" {
+		return marks
+	}
+
+	content,err := os.ReadFile(dir+"/annotations.sst")
+
+	if err != nil {
+		return marks
+	}
+
+	for _,line := range strings.Split(string(content),"\n") {
+
+		line = StripConfigComment(line)
+
+		if line == "" || strings.HasPrefix(line,"-") || strings.HasPrefix(line,"::") {
+			continue
+		}
+
+		if m := NEAR_ARROW.FindStringSubmatch(line); m != nil && strings.TrimSpace(m[1]) != "" {
+			marks[strings.TrimSpace(m[1])] = strings.TrimSpace(m[2])
+		}
+	}
+
+	return marks
+}
+
+//**************************************************************
+
+func FindConfigDir() string {
+
+	// SST_CONFIG_PATH, or an SSTconfig directory nearby, as for N4L
+
+	dir := os.Getenv("SST_CONFIG_PATH")
+
+	if dir == "" {
+		for _,path := range []string{"./SSTconfig","../SSTconfig","../../SSTconfig"} {
+			if info,err := os.Stat(path); err == nil && info.IsDir() {
+				dir = path
+				break
+			}
+		}
+	}
+
+	return dir
+}
+
+//**************************************************************
+
+func AddMandatoryArrows() {
+
+	// The arrows N4L always defines, so that keys don't clash with them
+
+	mandatory := [][3]string{
+		{ "leadsto","empty","void" },
+		{ "contains",CONT_FINDS_S,INV_CONT_FOUND_IN_S },
+		{ "contains",CONT_FRAG_S,INV_CONT_FRAG_IN_S },
+		{ "properties",EXPR_INTENT_S,INV_EXPR_INTENT_S },
+		{ "properties",EXPR_AMBIENT_S,INV_EXPR_AMBIENT_S },
+		{ "leadsto","then","from" },
+		{ "properties","url","isurl" },
+		{ "properties","img","isimg" },
+	}
+
+	long := map[string]string{
+		"empty": "debug", "void": "unbug",
+		CONT_FINDS_S: CONT_FINDS_L, INV_CONT_FOUND_IN_S: INV_CONT_FOUND_IN_L,
+		CONT_FRAG_S: CONT_FRAG_L, INV_CONT_FRAG_IN_S: INV_CONT_FRAG_IN_L,
+		EXPR_INTENT_S: EXPR_INTENT_L, INV_EXPR_INTENT_S: INV_EXPR_INTENT_L,
+		EXPR_AMBIENT_S: EXPR_AMBIENT_L, INV_EXPR_AMBIENT_S: INV_EXPR_AMBIENT_L,
+		"then": "then followed by", "from": "follows on from",
+		"url": "has URL", "isurl": "is a URL for",
+		"img": "has image", "isimg": "is an image for",
+	}
+
+	for _,m := range mandatory {
+		fwd := InsertArrowDirectory(m[0],m[1],long[m[1]],"+")
+		bwd := InsertArrowDirectory(m[0],m[2],long[m[2]],"-")
+		InsertInverseArrowDirectory(fwd,bwd)
+	}
+}
+
+//**************************************************************
+
+func StripConfigComment(line string) string {
+
+	if i := strings.Index(line,"//"); i >= 0 {
+		line = line[:i]
+	}
+
+	if i := strings.Index(line,"#"); i >= 0 {
+		line = line[:i]
+	}
+
+	return strings.TrimSpace(line)
+}
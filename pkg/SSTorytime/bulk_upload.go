@@ -0,0 +1,264 @@
+//**************************************************************
+//
+// Bulk loading of large graphs: COPY into staging tables and a
+// set-based merge, instead of one query per node/link/line
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//**************************************************************
+
+const BULK_UPLOAD_THRESHOLD = 5000 // nodes + page map lines, above which N4L -u uses COPY
+
+//**************************************************************
+
+const NODE_STAGING_TABLE = "CREATE TEMP TABLE NodeStaging " +
+	"( " +
+	"Chan      int,            \n" +
+	"CPtr      int,            \n" +
+	"L         int,            \n" +
+	"S         text,           \n" +
+	"Chap      text,           \n" +
+	"Seq       boolean,        \n" +
+	I_MEXPR+"  Link[],         \n" +
+	I_MCONT+"  Link[],         \n" +
+	I_MLEAD+"  Link[],         \n" +
+	I_NEAR +"  Link[],         \n" +
+	I_PLEAD+"  Link[],         \n" +
+	I_PCONT+"  Link[],         \n" +
+	I_PEXPR+"  Link[]          \n" +
+	") ON COMMIT DROP"
+
+const PAGEMAP_STAGING_TABLE = "CREATE TEMP TABLE PageMapStaging " +
+	"( " +
+	"Chap     Text,  " +
+	"Alias    Text,  " +
+	"Ctx      int,   " +
+	"Line     Int,   " +
+	"Path     Link[] " +
+	") ON COMMIT DROP"
+
+const CONTEXT_STAGING_TABLE = "CREATE TEMP TABLE ContextStaging " +
+	"(    " +
+	"Context text,  " +
+	"CtxPtr  int    " +
+	") ON COMMIT DROP"
+
+//**************************************************************
+
+func GraphSize() int {
+
+	return len(NODE_DIRECTORY.N1directory) + len(NODE_DIRECTORY.N2directory) + len(NODE_DIRECTORY.N3directory) + len(NODE_DIRECTORY.LT128) + len(NODE_DIRECTORY.LT1024) + len(NODE_DIRECTORY.GT1024) + len(PAGE_MAP)
+}
+
+//**************************************************************
+
+func BulkGraphToDB(sst PoSST,wait_counter bool) error {
+
+	// Same result as GraphToDB(), but the whole graph goes in as one
+	// transaction of COPY streams. Only the postgres backend needs this
+
+	if sst.DB == nil {
+		GraphToDB(sst,wait_counter)
+		return nil
+	}
+
+	total := GraphSize() + len(CONTEXT_DIRECTORY)
+
+	tx,err := sst.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	for _,defn := range []string{NODE_STAGING_TABLE,PAGEMAP_STAGING_TABLE,CONTEXT_STAGING_TABLE} {
+		if _,err = tx.Exec(defn); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("creating staging table: %v",err)
+		}
+	}
+
+	// Stream the nodes, starting above any pointers already in the db
+
+	fmt.Println("\nCopying primary nodes ...")
+
+	// COPY quotes its column names, and the unquoted DDL folded them to lower case
+
+	stmt,err := tx.Prepare(pq.CopyIn("nodestaging","chan","cptr","l","s","chap","seq",
+		strings.ToLower(I_MEXPR),strings.ToLower(I_MCONT),strings.ToLower(I_MLEAD),strings.ToLower(I_NEAR),
+		strings.ToLower(I_PLEAD),strings.ToLower(I_PCONT),strings.ToLower(I_PEXPR)))
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	lanes := [][]Node{NODE_DIRECTORY.N1directory,NODE_DIRECTORY.N2directory,NODE_DIRECTORY.N3directory,NODE_DIRECTORY.LT128,NODE_DIRECTORY.LT1024,NODE_DIRECTORY.GT1024}
+
+	for class := N1GRAM; class <= GT1024; class++ {
+
+		lane := lanes[class-N1GRAM]
+
+		for n := int(BASE_DB_CHANNEL_STATE[class]); n < len(lane); n++ {
+
+			org := lane[n]
+
+			if len(org.S) == 0 {
+				continue
+			}
+
+			org.L,_ = StorageClass(org.S)
+
+			var arrays [ST_TOP]string
+
+			for st := range org.I {
+				arrays[st] = FormatSQLLinkArray(org.I[st])
+			}
+
+			_,err = stmt.Exec(class,int(org.NPtr.CPtr),org.L,org.S,org.Chap,org.Seq,
+				arrays[0],arrays[1],arrays[2],arrays[3],arrays[4],arrays[5],arrays[6])
+
+			if err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return fmt.Errorf("copying node %s: %v",org.S,err)
+			}
+
+			Waiting(wait_counter,total)
+		}
+	}
+
+	if err = FlushCopy(stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Contexts
+
+	stmt,err = tx.Prepare(pq.CopyIn("contextstaging","context","ctxptr"))
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _,ctx := range CONTEXT_DIRECTORY {
+
+		if _,err = stmt.Exec(ctx.Context,int(ctx.Ptr)); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return fmt.Errorf("copying context %s: %v",ctx.Context,err)
+		}
+
+		Waiting(wait_counter,total)
+	}
+
+	if err = FlushCopy(stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Page map
+
+	fmt.Println("\nCopying page map...")
+
+	stmt,err = tx.Prepare(pq.CopyIn("pagemapstaging","chap","alias","ctx","line","path"))
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _,line := range PAGE_MAP {
+
+		if _,err = stmt.Exec(line.Chapter,line.Alias,int(line.Context),line.Line,FormatSQLLinkArray(line.Path)); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return fmt.Errorf("copying page map line %d: %v",line.Line,err)
+		}
+
+		Waiting(wait_counter,total)
+	}
+
+	if err = FlushCopy(stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Set-based merge into the real tables, and the (small) arrow directory
+
+	fmt.Println("\nMerging staged data ...")
+
+	cols := I_MEXPR+","+I_MCONT+","+I_MLEAD+","+I_NEAR +","+I_PLEAD+","+I_PCONT+","+I_PEXPR
+
+	var merge = []string{
+
+		fmt.Sprintf("INSERT INTO Node (NPtr,L,S,Chap,Seq,%s) SELECT ROW(s.Chan,s.CPtr)::NodePtr,s.L,s.S,s.Chap,s.Seq,%s FROM NodeStaging s "+
+			"WHERE NOT EXISTS (SELECT 1 FROM Node n WHERE n.NPtr = ROW(s.Chan,s.CPtr)::NodePtr)",cols,cols),
+
+		"INSERT INTO ContextDirectory (Context,CtxPtr) SELECT s.Context,s.CtxPtr FROM ContextStaging s "+
+			"WHERE NOT EXISTS (SELECT 1 FROM ContextDirectory c WHERE c.CtxPtr = s.CtxPtr OR c.Context = s.Context)",
+
+		"INSERT INTO PageMap (Chap,Alias,Ctx,Line,Path) SELECT Chap,Alias,Ctx,Line,Path FROM PageMapStaging",
+
+		"DROP TABLE IF EXISTS ArrowDirectory",
+		"DROP TABLE IF EXISTS ArrowInverses",
+		TableDefinition(ARROW_INVERSES_TABLE),
+		TableDefinition(ARROW_DIRECTORY_TABLE),
+	}
+
+	DIRECTORY_MUTEX.RLock()
+
+	for _,arrow := range ARROW_DIRECTORY {
+		merge = append(merge,UploadArrowToDBCommand(arrow))
+	}
+
+	for plus,minus := range INVERSE_ARROWS {
+		merge = append(merge,UploadInverseArrowToDBCommand(plus,minus))
+	}
+
+	DIRECTORY_MUTEX.RUnlock()
+
+	for _,cmd := range merge {
+		if _,err = tx.Exec(cmd); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v in %s",err,cmd)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Println("Indexing ....")
+
+	IndexDB(sst)
+
+	fmt.Println("Finally done!")
+	return nil
+}
+
+//**************************************************************
+
+func FlushCopy(stmt *sql.Stmt) error {
+
+	// An empty Exec ends the COPY stream
+
+	_,err := stmt.Exec()
+
+	if err != nil {
+		stmt.Close()
+		return err
+	}
+
+	return stmt.Close()
+}
@@ -0,0 +1,758 @@
+//**************************************************************
+//
+// calendar.go - notes tagged with semantic time contexts, such as
+// :: Monday, Hr10 :: or :: September.Day26 :: in reminders.n4l,
+// as recurring events, an agenda and iCalendar (.ics)
+//
+// The tags are those generated by DoNowt for "now", so a note is
+// due when its context matches the time. Recurrence follows from
+// which tags are present:
+//
+//   Monday, Tuesday         every week on those days
+//   Day1                    every month on the first
+//   Day26.September         every year on that date
+//   August | September      every year, for the whole months
+//   N_Spring                every year, for the season's months
+//   Yr2026                  limits any of these to one year
+//   Hr10, Min30, Morning    the time of day, else all day
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//**************************************************************
+
+const (
+	EXPORT_ICS = "ics"
+	REMIND_CHAPTER = "reminders"
+	REMIND_HORIZON = 7*24   // hours ahead shown by \remind
+	REMIND_MAX_REPEATS = 100
+	RECUR_SEARCH_DAYS = 4*366+1 // long enough to find a Day29.February
+)
+
+//**************************************************************
+
+type Recurrence struct {
+
+	Weekdays []time.Weekday
+	Months   []time.Month
+	Day      int            // day of the month, 0 for any
+	Year     int            // 0 for every year
+	Hour     int            // first hour, -1 for all day
+	EndHour  int            // last hour tagged
+	Minute   int
+}
+
+//**************************************************************
+
+type CalendarEvent struct {
+
+	NPtr    NodePtr
+	Text    string
+	Chapter string
+	Context string
+	Line    int
+	Rule    Recurrence
+}
+
+//**************************************************************
+
+type AgendaItem struct {
+
+	NPtr    NodePtr
+	Text    string
+	Chapter string
+	Context string
+	Recurs  string
+	Start   time.Time
+	End     time.Time
+	AllDay  bool
+}
+
+//**************************************************************
+// Parsing time tags
+//**************************************************************
+
+func ParseTimeTags(context string) (Recurrence,bool) {
+
+	// Contexts are stored as comma separated alternatives, each
+	// of which may join tags with '.', e.g. "Hr10,Hr11,Monday".
+	// Returns false if there are no time tags, e.g. "any"
+
+	var rule Recurrence
+	var timed bool
+
+	rule.Hour = -1
+
+	for _,term := range strings.Split(context,",") {
+		for _,tag := range strings.Split(term,".") {
+
+			tag = strings.TrimSpace(tag)
+
+			if rule.addTag(tag) {
+				timed = true
+			}
+		}
+	}
+
+	if !timed {
+		return rule,false
+	}
+
+	// A year alone means the whole year
+
+	if rule.Year > 0 && rule.Months == nil && rule.Weekdays == nil && rule.Day == 0 && rule.Hour < 0 {
+		for m := time.January; m <= time.December; m++ {
+			rule.Months = append(rule.Months,m)
+		}
+	}
+
+	return rule,true
+}
+
+//**************************************************************
+
+func (rule *Recurrence) addTag(tag string) bool {
+
+	if n,ok := TimeTagNumber(tag,"Day"); ok && n >= 1 && n <= 31 {
+		rule.Day = n
+		return true
+	}
+
+	if n,ok := TimeTagNumber(tag,"Yr"); ok {
+		rule.Year = n
+		return true
+	}
+
+	if n,ok := TimeTagNumber(tag,"Hr"); ok && n >= 0 && n < 24 {
+		rule.addHours(n,n)
+		return true
+	}
+
+	if n,ok := TimeTagNumber(tag,"Min"); ok && n >= 0 && n < 60 {
+		rule.Minute = n
+		return true
+	}
+
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(tag,d.String()) {
+			rule.Weekdays = append(rule.Weekdays,d)
+			return true
+		}
+	}
+
+	for m := time.January; m <= time.December; m++ {
+		if strings.EqualFold(tag,m.String()) {
+			rule.addMonth(m)
+			return true
+		}
+	}
+
+	// Seasons cover three months, by hemisphere
+
+	season := false
+
+	for m := time.January; m <= time.December; m++ {
+		n_season,s_season := Season(m.String())
+		if strings.EqualFold(tag,n_season) || strings.EqualFold(tag,s_season) {
+			rule.addMonth(m)
+			season = true
+		}
+	}
+
+	if season {
+		return true
+	}
+
+	for s,shift := range GR_SHIFT_TEXT {
+		if strings.EqualFold(tag,shift) {
+			rule.addHours(s*HOURS_PER_SHIFT,(s+1)*HOURS_PER_SHIFT-1)
+			return true
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func TimeTagNumber(tag,prefix string) (int,bool) {
+
+	// Day26 -> 26, also Min30_35 -> 30 as from DoNowt
+
+	if !strings.HasPrefix(tag,prefix) || len(tag) == len(prefix) {
+		return 0,false
+	}
+
+	digits := tag[len(prefix):]
+
+	if u := strings.IndexByte(digits,'_'); u > 0 {
+		digits = digits[:u]
+	}
+
+	n,err := strconv.Atoi(digits)
+
+	return n,err == nil
+}
+
+//**************************************************************
+
+func (rule *Recurrence) addHours(first,last int) {
+
+	if rule.Hour < 0 || first < rule.Hour {
+		rule.Hour = first
+	}
+
+	if last > rule.EndHour {
+		rule.EndHour = last
+	}
+}
+
+//**************************************************************
+
+func (rule *Recurrence) addMonth(m time.Month) {
+
+	for _,have := range rule.Months {
+		if have == m {
+			return
+		}
+	}
+
+	rule.Months = append(rule.Months,m)
+	sort.Slice(rule.Months,func(i,j int) bool { return rule.Months[i] < rule.Months[j] })
+}
+
+//**************************************************************
+// Occurrences
+//**************************************************************
+
+func (rule Recurrence) IsBlock() bool {
+
+	// Months or seasons without a day or time last the whole month
+
+	return rule.Months != nil && rule.Day == 0 && rule.Weekdays == nil && rule.Hour < 0
+}
+
+//**************************************************************
+
+func (rule Recurrence) inMonth(t time.Time) bool {
+
+	if rule.Year > 0 && t.Year() != rule.Year {
+		return false
+	}
+
+	if rule.Months == nil {
+		return true
+	}
+
+	for _,m := range rule.Months {
+		if m == t.Month() {
+			return true
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (rule Recurrence) Matches(day time.Time) bool {
+
+	if !rule.inMonth(day) {
+		return false
+	}
+
+	if rule.Day > 0 && day.Day() != rule.Day {
+		return false
+	}
+
+	if rule.Weekdays == nil {
+		return true
+	}
+
+	for _,d := range rule.Weekdays {
+		if d == day.Weekday() {
+			return true
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (rule Recurrence) onDay(day time.Time) (time.Time,time.Time) {
+
+	if rule.Hour < 0 {
+		return day,day.AddDate(0,0,1)
+	}
+
+	start := time.Date(day.Year(),day.Month(),day.Day(),rule.Hour,rule.Minute,0,0,day.Location())
+	end := time.Date(day.Year(),day.Month(),day.Day(),rule.EndHour+1,0,0,0,day.Location())
+
+	return start,end
+}
+
+//**************************************************************
+
+func (rule Recurrence) inBlock(month time.Time) (time.Time,time.Time) {
+
+	// Consecutive months, e.g. a season, make one block
+
+	start := month
+	end := month.AddDate(0,1,0)
+
+	for i := 0; i < 11 && rule.inMonth(start.AddDate(0,-1,0)); i++ {
+		start = start.AddDate(0,-1,0)
+	}
+
+	for i := 0; i < 11 && rule.inMonth(end); i++ {
+		end = end.AddDate(0,1,0)
+	}
+
+	return start,end
+}
+
+//**************************************************************
+
+func (rule Recurrence) NextOccurrence(after time.Time) (time.Time,time.Time,bool) {
+
+	// The first occurrence that has not ended by the given time,
+	// so one in progress is included
+
+	loc := after.Location()
+
+	if rule.IsBlock() {
+
+		first := time.Date(after.Year(),after.Month(),1,0,0,0,0,loc)
+
+		for m := 0; m < 25; m++ {
+
+			month := first.AddDate(0,m,0)
+
+			if !rule.inMonth(month) {
+				continue
+			}
+
+			start,end := rule.inBlock(month)
+
+			if end.After(after) {
+				return start,end,true
+			}
+		}
+
+		return after,after,false
+	}
+
+	first := time.Date(after.Year(),after.Month(),after.Day(),0,0,0,0,loc)
+
+	for i := 0; i < RECUR_SEARCH_DAYS; i++ {
+
+		day := first.AddDate(0,0,i)
+
+		if rule.Year > 0 && day.Year() > rule.Year {
+			break
+		}
+
+		if !rule.Matches(day) {
+			continue
+		}
+
+		start,end := rule.onDay(day)
+
+		if end.After(after) {
+			return start,end,true
+		}
+	}
+
+	return after,after,false
+}
+
+//**************************************************************
+
+func (rule Recurrence) Once() bool {
+
+	return rule.Year > 0 && rule.Day > 0 && len(rule.Months) == 1
+}
+
+//**************************************************************
+
+func (rule Recurrence) String() string {
+
+	var s string
+
+	var months []string
+
+	for _,m := range rule.Months {
+		months = append(months,m.String())
+	}
+
+	in := strings.Join(months,", ")
+
+	if n := len(months); n == 12 {
+		in = ""
+	} else if n > 1 {
+		in = strings.Join(months[:n-1],", ") + " and " + months[n-1]
+	}
+
+	if rule.Year > 0 {
+		in = strings.TrimSpace(in + fmt.Sprintf(" %d",rule.Year))
+	}
+
+	switch {
+	case rule.Once():
+		s = fmt.Sprintf("on %d %s",rule.Day,in)
+	case rule.IsBlock() && rule.Year > 0:
+		s = "in " + in
+	case rule.IsBlock() && in == "":
+		s = "all year"
+	case rule.IsBlock():
+		s = "every year in " + in
+	case rule.Day > 0 && rule.Months != nil && rule.Weekdays == nil:
+		s = fmt.Sprintf("every year on %d %s",rule.Day,in)
+	default:
+		s = "every day"
+
+		if rule.Weekdays != nil {
+			var days []string
+			for _,d := range rule.Weekdays {
+				days = append(days,d.String())
+			}
+			s = "every " + strings.Join(days," and ")
+		}
+
+		if rule.Day > 0 {
+			if rule.Weekdays == nil {
+				s = "every month"
+			}
+			s += fmt.Sprintf(" on day %d",rule.Day)
+		}
+
+		if in != "" {
+			s += " in " + in
+		}
+	}
+
+	if rule.Hour >= 0 {
+		if rule.EndHour > rule.Hour {
+			s += fmt.Sprintf(", %02d:%02d-%02d:00",rule.Hour,rule.Minute,rule.EndHour+1)
+		} else {
+			s += fmt.Sprintf(", at %02d:%02d",rule.Hour,rule.Minute)
+		}
+	}
+
+	return s
+}
+
+//**************************************************************
+// Agenda
+//**************************************************************
+
+func GetDBCalendarEvents(sst PoSST,chapter string,context []string) []CalendarEvent {
+
+	// Every note in the chapter whose context has time tags
+
+	var events []CalendarEvent
+
+	for page := 1; ; page++ {
+
+		notes := GetDBPageMap(sst,chapter,context,page)
+
+		if len(notes) == 0 {
+			break
+		}
+
+		for _,note := range notes {
+
+			if len(note.Path) == 0 {
+				continue
+			}
+
+			ctx := GetContext(note.Context)
+			rule,timed := ParseTimeTags(ctx)
+
+			if !timed {
+				continue
+			}
+
+			var event CalendarEvent
+
+			event.NPtr = note.Path[0].Dst
+			event.Text = GetDBNodeByNodePtr(sst,event.NPtr).S
+			event.Chapter = note.Chapter
+			event.Context = ctx
+			event.Line = note.Line
+			event.Rule = rule
+
+			events = append(events,event)
+		}
+	}
+
+	return events
+}
+
+//**************************************************************
+
+func Agenda(events []CalendarEvent,now time.Time,horizon time.Duration) []AgendaItem {
+
+	// Occurrences that are in progress or start within the horizon
+
+	var agenda []AgendaItem
+
+	until := now.Add(horizon)
+
+	for _,event := range events {
+
+		after := now
+
+		for n := 0; n < REMIND_MAX_REPEATS; n++ {
+
+			start,end,ok := event.Rule.NextOccurrence(after)
+
+			if !ok || !start.Before(until) {
+				break
+			}
+
+			var item AgendaItem
+
+			item.NPtr = event.NPtr
+			item.Text = event.Text
+			item.Chapter = event.Chapter
+			item.Context = event.Context
+			item.Recurs = event.Rule.String()
+			item.Start = start
+			item.End = end
+			item.AllDay = event.Rule.Hour < 0
+
+			agenda = append(agenda,item)
+			after = end
+		}
+	}
+
+	sort.SliceStable(agenda,func(i,j int) bool {
+		return agenda[i].Start.Before(agenda[j].Start)
+	})
+
+	return agenda
+}
+
+//**************************************************************
+
+func GetDBAgenda(sst PoSST,search SearchParameters,now time.Time) []AgendaItem {
+
+	// \remind [hours] [\chapter name] [\context tags]
+
+	horizon := search.Horizon
+
+	if horizon <= 0 {
+		horizon = REMIND_HORIZON
+	}
+
+	events := GetDBCalendarEvents(sst,RemindChapter(search),search.Context)
+
+	return Agenda(events,now,time.Duration(horizon) * time.Hour)
+}
+
+//**************************************************************
+
+func RemindChapter(search SearchParameters) string {
+
+	if search.Chapter == "" {
+		return REMIND_CHAPTER
+	}
+
+	return search.Chapter
+}
+
+//**************************************************************
+// iCalendar, RFC 5545
+//**************************************************************
+
+func (rule Recurrence) RRule() string {
+
+	if rule.Once() {
+		return ""
+	}
+
+	var parts []string
+
+	switch {
+	case rule.IsBlock() || (rule.Day > 0 && rule.Months != nil):
+		parts = append(parts,"FREQ=YEARLY")
+	case rule.Day > 0:
+		parts = append(parts,"FREQ=MONTHLY")
+	case rule.Weekdays != nil:
+		parts = append(parts,"FREQ=WEEKLY")
+	default:
+		parts = append(parts,"FREQ=DAILY")
+	}
+
+	if rule.Months != nil && !rule.IsBlock() {
+		var months []string
+		for _,m := range rule.Months {
+			months = append(months,fmt.Sprint(int(m)))
+		}
+		parts = append(parts,"BYMONTH="+strings.Join(months,","))
+	}
+
+	if rule.Day > 0 {
+		parts = append(parts,fmt.Sprintf("BYMONTHDAY=%d",rule.Day))
+	}
+
+	if rule.Weekdays != nil {
+		var days []string
+		for _,d := range rule.Weekdays {
+			days = append(days,strings.ToUpper(d.String()[:2]))
+		}
+		parts = append(parts,"BYDAY="+strings.Join(days,","))
+	}
+
+	// UNTIL has the same value type as DTSTART, a DATE for all-day events
+
+	if rule.Year > 0 && rule.Hour < 0 {
+		parts = append(parts,fmt.Sprintf("UNTIL=%04d1231",rule.Year))
+	} else if rule.Year > 0 {
+		parts = append(parts,fmt.Sprintf("UNTIL=%04d1231T235959",rule.Year))
+	}
+
+	return strings.Join(parts,";")
+}
+
+//**************************************************************
+
+func ICalendar(events []CalendarEvent,now time.Time) string {
+
+	// Times are floating, i.e. local to whoever reads the calendar,
+	// as the tags are. Dynamic: text is expanded as of now
+
+	var out strings.Builder
+
+	out.WriteString("BEGIN:VCALENDAR\r\n")
+	out.WriteString("VERSION:2.0\r\n")
+	out.WriteString("PRODID:-//SSTorytime//reminders//EN\r\n")
+	out.WriteString("CALSCALE:GREGORIAN\r\n")
+
+	stamp := now.UTC().Format("20060102T150405Z")
+
+	for _,event := range events {
+
+		for b,first := range event.Rule.icsStarts(now) {
+
+			start,end,ok := event.Rule.NextOccurrence(first)
+
+			if !ok {
+				continue
+			}
+
+			out.WriteString("BEGIN:VEVENT\r\n")
+			out.WriteString(fmt.Sprintf("UID:%d.%d.%d.%d@sstorytime\r\n",event.NPtr.Class,event.NPtr.CPtr,event.Line,b))
+			out.WriteString("DTSTAMP:"+stamp+"\r\n")
+
+			if event.Rule.Hour < 0 {
+				out.WriteString("DTSTART;VALUE=DATE:"+start.Format("20060102")+"\r\n")
+				out.WriteString("DTEND;VALUE=DATE:"+end.Format("20060102")+"\r\n")
+			} else {
+				out.WriteString("DTSTART:"+start.Format("20060102T150405")+"\r\n")
+				out.WriteString("DTEND:"+end.Format("20060102T150405")+"\r\n")
+			}
+
+			if rrule := event.Rule.RRule(); rrule != "" {
+				out.WriteString("RRULE:"+rrule+"\r\n")
+			}
+
+			ICSLine(&out,"SUMMARY:"+ICSText(event.Text))
+			ICSLine(&out,"CATEGORIES:"+ICSText(event.Chapter))
+			ICSLine(&out,"DESCRIPTION:"+ICSText(event.Context+" - "+event.Rule.String()))
+			out.WriteString("END:VEVENT\r\n")
+		}
+	}
+
+	out.WriteString("END:VCALENDAR\r\n")
+
+	return out.String()
+}
+
+//**************************************************************
+
+func (rule Recurrence) icsStarts(now time.Time) []time.Time {
+
+	// A block of months repeats as a span, so separate blocks,
+	// e.g. January | July, need an event each
+
+	if !rule.IsBlock() {
+		return []time.Time{now}
+	}
+
+	var starts []time.Time
+
+	first := time.Date(now.Year(),now.Month(),1,0,0,0,0,now.Location())
+	var last time.Time
+
+	for m := 0; m < 12; m++ {
+
+		month := first.AddDate(0,m,0)
+
+		if !rule.inMonth(month) {
+			continue
+		}
+
+		start,end := rule.inBlock(month)
+
+		if start.Equal(last) {
+			continue
+		}
+
+		last = start
+
+		if end.After(now) {
+			starts = append(starts,month)
+		}
+	}
+
+	return starts
+}
+
+//**************************************************************
+
+func ICSText(s string) string {
+
+	s = strings.ReplaceAll(s,"\\","\\\\")
+	s = strings.ReplaceAll(s,";","\\;")
+	s = strings.ReplaceAll(s,",","\\,")
+	s = strings.ReplaceAll(s,"\n","\\n")
+
+	return strings.TrimSpace(s)
+}
+
+//**************************************************************
+
+func ICSLine(out *strings.Builder,line string) {
+
+	// Lines longer than 75 octets are folded. The space that starts
+	// each continuation line counts, leaving 74 for the text
+
+	fold := 75
+
+	for len(line) > fold {
+
+		cut := fold
+
+		for cut > 0 && (line[cut] & 0xC0) == 0x80 {
+			cut--   // don't split a UTF-8 character
+		}
+
+		out.WriteString(line[:cut]+"\r\n ")
+		line = line[cut:]
+		fold = 74
+	}
+
+	out.WriteString(line+"\r\n")
+}
@@ -0,0 +1,174 @@
+//**************************************************************
+//
+// concurrent_test.go - the same searches from many goroutines at
+// once, as the http_server does for simultaneous requests, must
+// agree with a single threaded run. Run with go test -race to
+// check the library's shared state. Uses the embedded store, so
+// no database is needed
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+//**************************************************************
+
+const (
+	TEST_WORKERS = 16
+	TEST_ROUNDS = 10
+)
+
+//**************************************************************
+
+func TestConcurrentSearch(t *testing.T) {
+
+	sst := OpenDoorsGraph(t)
+	defer Close(sst)
+
+	expected := DoorsSearch(sst)
+
+	if expected == "" {
+		t.Fatal("no paths found in the test graph")
+	}
+
+	var wg sync.WaitGroup
+	var failures = make(chan string,TEST_WORKERS*TEST_ROUNDS)
+
+	for w := 0; w < TEST_WORKERS; w++ {
+
+		wg.Add(1)
+
+		go func(w int) {
+
+			defer wg.Done()
+
+			// One user per worker, as the server does per request
+
+			usst := ForUser(sst,fmt.Sprintf("tester%d",w))
+
+			for r := 0; r < TEST_ROUNDS; r++ {
+
+				if got := DoorsSearch(usst); got != expected {
+					failures <- fmt.Sprintf("worker %d round %d:\n got %s\n expected %s",w,r,got,expected)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(failures)
+
+	for f := range failures {
+		t.Error(f)
+	}
+}
+
+//**************************************************************
+
+func OpenDoorsGraph(t *testing.T) PoSST {
+
+	// The doors.n4l example, built with the API
+
+	t.Helper()
+
+	sst := OpenEmbedded(filepath.Join(t.TempDir(),"graph.gob"),true)
+
+	ReadArrowConfig()
+
+	for arrow := range ARROW_DIRECTORY {
+		UploadArrowToDB(sst,ArrowPtr(arrow))
+	}
+
+	for arrow := range INVERSE_ARROWS {
+		UploadInverseArrowToDB(sst,ArrowPtr(arrow))
+	}
+
+	const chap = "multi slit interference"
+
+	context := []string{"physics","connectivity","path example"}
+
+	links := [][2]string{
+		{"start","door"},{"start","port"},{"start","hole"},{"start","gate"},
+		{"door","passage"},{"door","road"},{"door","river"},
+		{"port","river"},{"port","tram"},
+		{"hole","tram"},
+		{"gate","tram"},{"gate","bike"},
+		{"passage","target 1"},{"road","target 2"},
+		{"river","target 3"},{"tram","target 3"},{"bike","target 3"},
+	}
+
+	// As in N4L, an empty link makes each node findable by context
+
+	var empty Link
+	empty.Arr = 0
+	empty.Wgt = 1
+	empty.Ctx = TryContext(sst,context)
+
+	nodes := make(map[string]Node)
+
+	vertex := func(name string) Node {
+		n,ok := nodes[name]
+		if !ok {
+			n = Vertex(sst,name,chap)
+			AppendDBLinkToNode(sst,n.NPtr,empty,LEADSTO)
+			nodes[name] = n
+		}
+		return n
+	}
+
+	for _,l := range links {
+		Edge(sst,vertex(l[0]),"fwd",vertex(l[1]),context,1.0)
+	}
+
+	sst.Store.Sync()
+
+	return sst
+}
+
+//**************************************************************
+
+func DoorsSearch(sst PoSST) string {
+
+	search := DecodeSearchField("\\from start \\to target 1")
+
+	// The short term memory is kept per user
+
+	ambient,key,now := GetTimeContext()
+	UpdateSTMContext(sst,ambient,key,now,search)
+
+	// Refreshes the arrow directory from the store
+
+	GetDBArrowBySTType(sst,LEADSTO)
+
+	arrowptrs,sttypes := ArrowPtrFromArrowsNames(sst,search.Arrows)
+
+	left := SolveNodePtrs(sst,search.From,search,arrowptrs,10)
+	right := SolveNodePtrs(sst,search.To,search,arrowptrs,10)
+
+	if left == nil || right == nil {
+		return ""
+	}
+
+	cone,_ := GetEntireNCConePathsAsLinks(sst,"fwd",left,4,"",nil,30)
+	paths := GetPathsAndSymmetries(sst,left,right,"",nil,arrowptrs,sttypes,1,6)
+
+	var nodes = make(map[string]bool)
+	var arrows = make(map[string]bool)
+
+	for _,path := range cone {
+		for _,lnk := range path {
+			nodes[GetDBNodeByNodePtr(sst,lnk.Dst).S] = true
+			arr := GetDBArrowByPtr(sst,lnk.Arr)
+			inv := GetDBArrowByPtr(sst,InverseArrow(lnk.Arr))
+			arrows[arr.Long+"/"+inv.Long+"/"+GetContext(lnk.Ctx)] = true
+		}
+	}
+
+	return fmt.Sprintf("%d cone paths, %d nodes, %d arrows, %d paths start -> target 1",len(cone),len(nodes),len(arrows),len(paths))
+}
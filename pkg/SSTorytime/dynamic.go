@@ -0,0 +1,386 @@
+//**************************************************************
+//
+// dynamic.go - functions evaluated in "Dynamic: " node text,
+// e.g. Dynamic: {Count chapter reminders} notes to read
+// (see docs/dynamic_functions.md)
+//
+// Applications may register their own functions by name. Only
+// functions on the allowlist run, each with a time limit, and
+// they must only read - the text is expanded whenever a node is
+// fetched, by every tool and by the http_server
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//**************************************************************
+
+type DynamicFunction func(ctx context.Context,sst PoSST,args []string) (string,error) // ctx is done at the time limit
+
+//**************************************************************
+
+const (
+	DYNAMIC_PREFIX = "Dynamic: "
+	DYNAMIC_CONFIG_FILE = "dynamic.sst" // in SSTconfig
+	DYNAMIC_DEFAULT_TIMEOUT = 500 * time.Millisecond
+)
+
+// Without a configuration, only functions that read the clock or the graph
+
+var DYNAMIC_DEFAULT_ALLOW = []string{"TimeUntil","TimeSince","Count","NodeLinkCount"}
+
+var (
+	DYNAMIC_FUNCTIONS = make(map[string]DynamicFunction)
+	DYNAMIC_ALLOW = make(map[string]bool)
+	DYNAMIC_TIMEOUT = DYNAMIC_DEFAULT_TIMEOUT
+	DYNAMIC_MUTEX sync.RWMutex
+	DYNAMIC_CONFIG sync.Once
+)
+
+//**************************************************************
+
+func init() {
+
+	RegisterDynamicFunction("TimeUntil",func(ctx context.Context,sst PoSST,args []string) (string,error) {
+		return InBuiltTimeUntil(args),nil
+	})
+
+	RegisterDynamicFunction("TimeSince",func(ctx context.Context,sst PoSST,args []string) (string,error) {
+		return InBuiltTimeSince(args),nil
+	})
+
+	RegisterDynamicFunction("Count",InBuiltCount)
+	RegisterDynamicFunction("NodeLinkCount",InBuiltNodeLinkCount)
+	RegisterDynamicFunction("Env",InBuiltEnv)
+	RegisterDynamicFunction("FileStat",InBuiltFileStat)
+}
+
+//**************************************************************
+
+func RegisterDynamicFunction(name string,fn DynamicFunction) {
+
+	// Registering does not allow a function to run, see AllowDynamicFunctions
+
+	DYNAMIC_MUTEX.Lock()
+	defer DYNAMIC_MUTEX.Unlock()
+
+	DYNAMIC_FUNCTIONS[name] = fn
+}
+
+//**************************************************************
+
+func AllowDynamicFunctions(names ...string) {
+
+	// Replaces the allowlist, and any read from SSTconfig
+
+	DYNAMIC_CONFIG.Do(func(){})
+
+	DYNAMIC_MUTEX.Lock()
+	defer DYNAMIC_MUTEX.Unlock()
+
+	DYNAMIC_ALLOW = make(map[string]bool)
+
+	for _,name := range names {
+		DYNAMIC_ALLOW[name] = true
+	}
+}
+
+//**************************************************************
+
+func SetDynamicTimeout(timeout time.Duration) {
+
+	DYNAMIC_MUTEX.Lock()
+	defer DYNAMIC_MUTEX.Unlock()
+
+	DYNAMIC_TIMEOUT = timeout
+}
+
+//**************************************************************
+
+func ReadDynamicConfig() {
+
+	// SSTconfig/dynamic.sst lists the functions allowed to run, one per line,
+	// and optionally "timeout 500ms". Without it, DYNAMIC_DEFAULT_ALLOW
+
+	var allow []string
+	var timeout = DYNAMIC_DEFAULT_TIMEOUT
+
+	dir := FindConfigDir()
+	content,err := os.ReadFile(dir+"/"+DYNAMIC_CONFIG_FILE)
+
+	if dir == "" || err != nil {
+		allow = DYNAMIC_DEFAULT_ALLOW
+	} else {
+		for _,line := range strings.Split(string(content),"\n") {
+
+			line = strings.TrimSpace(line)
+
+			if c := strings.Index(line,"//"); c >= 0 {
+				line = strings.TrimSpace(line[:c])
+			}
+
+			if line == "" || line[0] == '-' || line[0] == '#' {
+				continue
+			}
+
+			fields := strings.Fields(line)
+
+			if fields[0] == "timeout" && len(fields) == 2 {
+				t,err := time.ParseDuration(fields[1])
+
+				if err != nil {
+					fmt.Println("Bad timeout in",DYNAMIC_CONFIG_FILE,line,err)
+					continue
+				}
+
+				timeout = t
+				continue
+			}
+
+			allow = append(allow,fields[0])
+		}
+	}
+
+	DYNAMIC_MUTEX.Lock()
+	defer DYNAMIC_MUTEX.Unlock()
+
+	DYNAMIC_ALLOW = make(map[string]bool)
+
+	for _,name := range allow {
+		DYNAMIC_ALLOW[name] = true
+	}
+
+	DYNAMIC_TIMEOUT = timeout
+}
+
+//****************************************************************************
+
+func ExpandDynamicFunctions(sst PoSST,s string) string {
+
+	if !strings.HasPrefix(s,DYNAMIC_PREFIX) {
+		return s
+	}
+
+	if !strings.Contains(s,"{") || !strings.Contains(s,"}") {
+		return s
+	}
+
+	chars := []rune(s[len("Dynamic:"):])
+
+	var news string
+
+	for pos := 0; pos < len(chars); pos++ {
+
+		if chars[pos] != '{' {
+			news += string(chars[pos])
+		} else {
+			newpos,result := EvaluateInBuilt(sst,chars,pos)
+			news += result
+			pos = newpos
+		}
+	}
+
+	return news
+}
+
+//****************************************************************************
+
+func EvaluateInBuilt(sst PoSST,chars []rune,pos int) (int,string) {
+
+	// Returns the position of the closing brace and the value
+
+	end := pos
+
+	for end < len(chars) && chars[end] != '}' {
+		end++
+	}
+
+	if end == len(chars) {
+		return end,string(chars[pos:])
+	}
+
+	fn := SplitDynamicArgs(string(chars[pos+1:end]))
+
+	if len(fn) == 0 {
+		return end,""
+	}
+
+	return end,DoInBuiltFunction(sst,fn)
+}
+
+//****************************************************************************
+
+func SplitDynamicArgs(s string) []string {
+
+	// Arguments are separated by spaces, commas or semicolons,
+	// except inside "quotes" for names with spaces
+
+	var args []string
+	var arg []rune
+	var quoted,was_quoted bool
+
+	for _,r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			was_quoted = true
+		case !quoted && (r == ' ' || r == ',' || r == ';'):
+			if len(arg) > 0 || was_quoted {
+				args = append(args,string(arg))
+			}
+			arg = nil
+			was_quoted = false
+		default:
+			arg = append(arg,r)
+		}
+	}
+
+	if len(arg) > 0 || was_quoted {
+		args = append(args,string(arg))
+	}
+
+	return args
+}
+
+//****************************************************************************
+
+func DoInBuiltFunction(sst PoSST,fn []string) string {
+
+	// Unknown or disallowed functions are left as written
+
+	DYNAMIC_CONFIG.Do(ReadDynamicConfig)
+
+	DYNAMIC_MUTEX.RLock()
+	function,known := DYNAMIC_FUNCTIONS[fn[0]]
+	allowed := DYNAMIC_ALLOW[fn[0]]
+	timeout := DYNAMIC_TIMEOUT
+	DYNAMIC_MUTEX.RUnlock()
+
+	if !known || !allowed {
+		return "{"+strings.Join(fn," ")+"}"
+	}
+
+	type answer struct {
+		value string
+		err error
+	}
+
+	// The function is told to stop when the time is up
+
+	ctx,cancel := context.WithTimeout(context.Background(),timeout)
+	defer cancel()
+
+	done := make(chan answer,1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				done <- answer{"",fmt.Errorf("%v",r)}
+			}
+		}()
+
+		value,err := function(ctx,sst,fn[1:])
+		done <- answer{value,err}
+	}()
+
+	select {
+	case a := <-done:
+		if a.err != nil {
+			return fmt.Sprintf("[%s: %v]",fn[0],a.err)
+		}
+		return a.value
+
+	case <-ctx.Done():
+		return fmt.Sprintf("[%s: no answer within %v]",fn[0],timeout)
+	}
+}
+
+//****************************************************************************
+// Read only functions available to allow
+//****************************************************************************
+
+func InBuiltCount(ctx context.Context,sst PoSST,args []string) (string,error) {
+
+	// {Count chapter name of chapter}
+
+	if len(args) < 2 || args[0] != "chapter" {
+		return "",fmt.Errorf("use {Count chapter name}")
+	}
+
+	chapter := strings.Join(args[1:]," ")
+
+	count,err := CountDBChapterNodes(ctx,sst,chapter)
+
+	if err != nil {
+		return "",err
+	}
+
+	return fmt.Sprint(count),nil
+}
+
+//****************************************************************************
+
+func InBuiltNodeLinkCount(ctx context.Context,sst PoSST,args []string) (string,error) {
+
+	// {NodeLinkCount "node text"}, all links from nodes with exactly this text
+
+	if len(args) != 1 {
+		return "",fmt.Errorf("use {NodeLinkCount \"node text\"}")
+	}
+
+	var count int
+
+	for _,n := range GetDBNodesByText(sst,args) {
+		for st := range n.I {
+			for _,lnk := range n.I[st] {
+				if lnk.Arr != 0 {
+					count++
+				}
+			}
+		}
+	}
+
+	return fmt.Sprint(count),nil
+}
+
+//****************************************************************************
+
+func InBuiltEnv(ctx context.Context,sst PoSST,args []string) (string,error) {
+
+	// {Env VARIABLE}, from the environment of the program serving the text
+
+	if len(args) != 1 {
+		return "",fmt.Errorf("use {Env VARIABLE}")
+	}
+
+	return os.Getenv(args[0]),nil
+}
+
+//****************************************************************************
+
+func InBuiltFileStat(ctx context.Context,sst PoSST,args []string) (string,error) {
+
+	// {FileStat path}, size and time of last change
+
+	if len(args) != 1 {
+		return "",fmt.Errorf("use {FileStat path}")
+	}
+
+	info,err := os.Stat(args[0])
+
+	if err != nil {
+		return "",err
+	}
+
+	return fmt.Sprintf("%d bytes, changed %s",info.Size(),info.ModTime().Format("2 Jan 2006 15:04")),nil
+}
@@ -0,0 +1,2341 @@
+//**************************************************************
+//
+// Embedded, in-process implementation of the GraphStore interface
+// (pure Go, file backed, for laptops and CI without postgres)
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+//**************************************************************
+
+const (
+	EMBEDDED_AUTOSAVE = 5 * time.Second // throttle for writes outside bulk upload
+	EMBEDDED_PAGE_HITS = 60             // same as GetDBPageMap
+	LASTSEEN_DEADTIME = 60              // seconds, same as LastSawSection()
+
+	PATHS_ALL = 0 // path expansion limits, see sumPaths()
+	PATHS_FWD = 1
+	PATHS_NC  = 2
+)
+
+//**************************************************************
+
+type EmbeddedStore struct {
+
+	Path  string
+
+	mutex sync.RWMutex
+	dirty bool
+	saved time.Time
+	data  EmbeddedGraph
+	names map[string]NodePtr // exact text lookup, rebuilt on load
+}
+
+//**************************************************************
+
+type EmbeddedGraph struct {
+
+	// This is what gets written to the file
+
+	Nodes    [GT1024+1][]Node // indexed by CPtr, L == 0 is an unused slot
+	PageMap  []PageMap
+	Arrows   []ArrowDirectory
+	Inverses map[ArrowPtr]ArrowPtr
+	Contexts []ContextDirectory
+	Sections map[string]LastSeen
+	Seen     map[NodePtr]LastSeen
+	Users    map[string]UserProgress // the same for users other than DEFAULT_USER
+	Overlays []Overlay
+	Reviews  map[string]map[NodePtr]ReviewCard // by user
+	STM      map[string][]STMEntry // by STMKey(user,session)
+}
+
+//**************************************************************
+
+type UserProgress struct {
+
+	Sections map[string]LastSeen
+	Seen     map[NodePtr]LastSeen
+}
+
+//**************************************************************
+
+func OpenEmbedded(path string,load_arrows bool) PoSST {
+
+	var sst PoSST
+
+	store,err := NewEmbeddedStore(path)
+
+	if err != nil {
+		fmt.Println("Error opening the embedded store: ",err)
+		os.Exit(-1)
+	}
+
+	sst.Store = store
+
+	MemoryInit()
+	Configure(sst,load_arrows)
+
+	NO_NODE_PTR.Class = 0
+	NO_NODE_PTR.CPtr =  -1
+	NONODE.Class = 0
+	NONODE.CPtr = 0
+
+	return sst
+}
+
+//**************************************************************
+
+func NewEmbeddedStore(path string) (*EmbeddedStore,error) {
+
+	var es EmbeddedStore
+
+	es.Path = path
+	es.data.Inverses = make(map[ArrowPtr]ArrowPtr)
+	es.data.Sections = make(map[string]LastSeen)
+	es.data.Seen = make(map[NodePtr]LastSeen)
+	es.data.Users = make(map[string]UserProgress)
+	es.data.Reviews = make(map[string]map[NodePtr]ReviewCard)
+	es.data.STM = make(map[string][]STMEntry)
+	es.names = make(map[string]NodePtr)
+
+	fd,err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return &es,nil
+	}
+
+	if err != nil {
+		return nil,err
+	}
+
+	defer fd.Close()
+
+	err = gob.NewDecoder(fd).Decode(&es.data)
+
+	if err != nil {
+		return nil,fmt.Errorf("%s is not a readable graph file: %v",path,err)
+	}
+
+	if es.data.Inverses == nil {
+		es.data.Inverses = make(map[ArrowPtr]ArrowPtr)
+	}
+	if es.data.Sections == nil {
+		es.data.Sections = make(map[string]LastSeen)
+	}
+	if es.data.Seen == nil {
+		es.data.Seen = make(map[NodePtr]LastSeen)
+	}
+	if es.data.Users == nil {
+		es.data.Users = make(map[string]UserProgress)
+	}
+	if es.data.Reviews == nil {
+		es.data.Reviews = make(map[string]map[NodePtr]ReviewCard)
+	}
+	if es.data.STM == nil {
+		es.data.STM = make(map[string][]STMEntry)
+	}
+
+	for class := range es.data.Nodes {
+		for _,n := range es.data.Nodes[class] {
+			if n.L > 0 {
+				es.names[n.S] = n.NPtr
+			}
+		}
+	}
+
+	es.saved = time.Now()
+	return &es,nil
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) Backend() string {
+	return "embedded"
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) Prepare() {
+
+	// Nothing to set up, the file is read in NewEmbeddedStore
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) save() {
+
+	// Atomic replacement, so a crash never leaves half a graph
+
+	if !es.dirty {
+		return
+	}
+
+	tmp,err := os.CreateTemp(filepath.Dir(es.Path),filepath.Base(es.Path)+".*")
+
+	if err != nil {
+		fmt.Println("Unable to save embedded store",es.Path,err)
+		return
+	}
+
+	err = gob.NewEncoder(tmp).Encode(&es.data)
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	tmp.Close()
+
+	if err == nil {
+		err = os.Rename(tmp.Name(),es.Path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Println("Unable to save embedded store",es.Path,err)
+		return
+	}
+
+	es.dirty = false
+	es.saved = time.Now()
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) autosave() {
+
+	if time.Since(es.saved) > EMBEDDED_AUTOSAVE {
+		es.save()
+	}
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) Sync() {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.save()
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) Close() {
+	es.Sync()
+}
+
+//**************************************************************
+// Nodes
+//**************************************************************
+
+func (es *EmbeddedStore) node(nptr NodePtr) *Node {
+
+	if nptr.Class < N1GRAM || nptr.Class > GT1024 {
+		return nil
+	}
+
+	lane := es.data.Nodes[nptr.Class]
+
+	if nptr.CPtr < 0 || int(nptr.CPtr) >= len(lane) || lane[nptr.CPtr].L == 0 {
+		return nil
+	}
+
+	return &lane[nptr.CPtr]
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) put(n Node) {
+
+	lane := es.data.Nodes[n.NPtr.Class]
+
+	for int(n.NPtr.CPtr) >= len(lane) {
+		lane = append(lane,Node{})
+	}
+
+	lane[n.NPtr.CPtr] = n
+	es.data.Nodes[n.NPtr.Class] = lane
+	es.names[n.S] = n.NPtr
+	es.dirty = true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) UploadNode(n Node) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	n.L,_ = StorageClass(n.S)
+
+	if n.NPtr.Class < N1GRAM || n.NPtr.Class > GT1024 {
+		fmt.Println("Node has no storage class",n.S,n.NPtr)
+		return
+	}
+
+	var stored Node
+
+	stored.L = n.L
+	stored.S = n.S
+	stored.Seq = n.Seq
+	stored.Chap = n.Chap
+	stored.NPtr = n.NPtr
+
+	for st := range n.I {
+		if len(n.I[st]) > 0 {
+			stored.I[st] = append([]Link{},n.I[st]...)
+		}
+	}
+
+	es.put(stored)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) AppendNode(n Node) Node {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// Same semantics as IdempAppendNode(), exact name match
+
+	nptr,exists := es.names[n.S]
+
+	if exists {
+		n.NPtr = nptr
+		return n
+	}
+
+	var fresh Node
+
+	fresh.L,fresh.NPtr.Class = StorageClass(n.S)
+	fresh.S = n.S
+	fresh.Chap = n.Chap
+	fresh.Seq = n.Seq
+	fresh.NPtr.CPtr = ClassedNodePtr(es.maxCPtr(fresh.NPtr.Class) + 1)
+
+	es.put(fresh)
+	es.autosave()
+
+	n.L = fresh.L
+	n.NPtr = fresh.NPtr
+	return n
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) CreateNode(n Node) Node {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// Same semantics as IdempInsertNode(), the caller manages the CPtr
+
+	nptr,exists := es.names[n.S]
+
+	if exists {
+		n.NPtr = nptr
+		return n
+	}
+
+	if n.NPtr.Class < N1GRAM || n.NPtr.Class > GT1024 {
+		fmt.Println("Node has no storage class",n.S,n.NPtr)
+		return n
+	}
+
+	var fresh Node
+
+	fresh.L = n.L
+	fresh.S = n.S
+	fresh.Chap = n.Chap
+	fresh.Seq = n.Seq
+	fresh.NPtr = n.NPtr
+
+	es.put(fresh)
+	es.autosave()
+
+	return n
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) AppendLink(nptr NodePtr,lnk Link,sttype int) bool {
+
+	if sttype < -EXPRESS || sttype > EXPRESS {
+		fmt.Println(ERR_ST_OUT_OF_BOUNDS,sttype)
+		os.Exit(-1)
+	}
+
+	if nptr == lnk.Dst {
+		return false
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	n := es.node(nptr)
+
+	if n == nil {
+		return false
+	}
+
+	stindex := STTypeToSTIndex(sttype)
+
+	for _,existing := range n.I[stindex] {
+		if existing == lnk {
+			return true
+		}
+	}
+
+	n.I[stindex] = append(n.I[stindex],lnk)
+	es.dirty = true
+	es.autosave()
+	return true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetNode(nptr NodePtr) (Node,bool) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var ret Node
+
+	n := es.node(nptr)
+
+	if n == nil {
+		return ret,false
+	}
+
+	ret = *n
+
+	// Empty channels stay nil, as when parsed from postgres
+
+	for st := range n.I {
+		if len(n.I[st]) > 0 {
+			ret.I[st] = append([]Link{},n.I[st]...)
+		}
+	}
+
+	return ret,true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) maxCPtr(class int) int {
+
+	lane := es.data.Nodes[class]
+
+	for c := len(lane)-1; c >= 0; c-- {
+		if lane[c].L > 0 {
+			return c
+		}
+	}
+
+	return -1
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) MaxCPtr(class int) int {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+	return es.maxCPtr(class)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) MatchNodes(name,chap string,cn []string,arrows []ArrowPtr,seq bool,limit int) []NodePtr {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	// Mirror NodeWhereString() and NCC_match() in Go
+
+	outer_exact_match,nopling := IsExactMatch(name)
+	remove_name_accents,nobrack := IsBracketedSearchTerm(nopling)
+	inner_exact_match,bare_name := IsExactMatch(nobrack)
+
+	is_exact_match := outer_exact_match || inner_exact_match
+	bare_name = strings.ReplaceAll(bare_name,"''","'")
+
+	_,cn_stripped := IsBracketedSearchList(cn)
+	sttypes := GetSTtypesFromArrows(arrows)
+
+	var hits []*Node
+
+	for class := N1GRAM; class <= GT1024; class++ {
+
+		for c := range es.data.Nodes[class] {
+
+			n := &es.data.Nodes[class][c]
+
+			if n.L == 0 {
+				continue
+			}
+
+			if !MatchChapterPattern(n.Chap,chap) {
+				continue
+			}
+
+			if !strings.HasPrefix(bare_name,"/") && strings.HasPrefix(n.S,"/") {
+				continue
+			}
+
+			if seq && !n.Seq {
+				continue
+			}
+
+			lower := strings.ToLower(n.S)
+
+			if is_exact_match {
+				if lower != bare_name {
+					continue
+				}
+			} else if IsStringFragment(bare_name) {
+				if name != "any" && name != "%%" && !strings.Contains(lower,strings.ToLower(bare_name)) {
+					continue
+				}
+			} else if name != "any" && name != "%%" {
+				if remove_name_accents {
+					lower = Unaccent(lower)
+				}
+				if !MatchTextQuery(lower,bare_name) {
+					continue
+				}
+			}
+
+			if !es.nccMatch(n,cn_stripped,arrows,sttypes) {
+				continue
+			}
+
+			hits = append(hits,n)
+		}
+	}
+
+	// Order by L to favour exact matches
+
+	sort.SliceStable(hits, func(i,j int) bool {
+		if hits[i].L != hits[j].L {
+			return hits[i].L < hits[j].L
+		}
+		ci := len(hits[i].I[ST_ZERO+EXPRESS]) + len(hits[i].I[ST_ZERO-EXPRESS]) + len(hits[i].I[ST_ZERO+LEADSTO])
+		cj := len(hits[j].I[ST_ZERO+EXPRESS]) + len(hits[j].I[ST_ZERO-EXPRESS]) + len(hits[j].I[ST_ZERO+LEADSTO])
+		return ci > cj
+	})
+
+	var retval []NodePtr
+
+	for _,n := range hits {
+		if len(retval) >= limit {
+			break
+		}
+		retval = append(retval,n.NPtr)
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) MatchQuery(query *TextQuery,chap string,cn []string,arrows []ArrowPtr,seq bool,limit int) ([]NodePtr,[]float32) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	// Mirror GetDBNodePtrsMatchingQuery(), ranked like ts_rank()
+
+	_,cn_stripped := IsBracketedSearchList(cn)
+	sttypes := GetSTtypesFromArrows(arrows)
+
+	type hit struct {
+		node *Node
+		rank float32
+	}
+
+	var hits []hit
+
+	for class := N1GRAM; class <= GT1024; class++ {
+
+		for c := range es.data.Nodes[class] {
+
+			n := &es.data.Nodes[class][c]
+
+			if n.L == 0 || (seq && !n.Seq) || !MatchChapterPattern(n.Chap,chap) {
+				continue
+			}
+
+			words := TextQueryWords(n.S)
+
+			if !query.Match(words) || !es.nccMatch(n,cn_stripped,arrows,sttypes) {
+				continue
+			}
+
+			hits = append(hits,hit{n,query.Rank(words)})
+		}
+	}
+
+	sort.SliceStable(hits, func(i,j int) bool {
+		if hits[i].rank != hits[j].rank {
+			return hits[i].rank > hits[j].rank
+		}
+		return hits[i].node.L < hits[j].node.L
+	})
+
+	var retval []NodePtr
+	var ranks []float32
+
+	for _,h := range hits {
+		if len(retval) >= limit {
+			break
+		}
+		retval = append(retval,h.node.NPtr)
+		ranks = append(ranks,h.rank)
+	}
+
+	return retval,ranks
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) nccMatch(n *Node,context []string,arrows []ArrowPtr,sttypes []int) bool {
+
+	// If there are no arrows, we only need to look for the Node context on the "empty" arrow 0
+
+	if len(arrows) == 0 {
+		for _,lnk := range n.I[ST_ZERO+LEADSTO] {
+			if lnk.Arr == 0 && es.matchContext(lnk.Ctx,context) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _,st := range sttypes {
+		for _,lnk := range n.I[STTypeToSTIndex(st)] {
+			if MatchArrows(arrows,lnk.Arr) && es.matchContext(lnk.Ctx,context) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) contextString(ptr ContextPtr) (string,bool) {
+
+	for _,c := range es.data.Contexts {
+		if c.Ptr == ptr {
+			return c.Context,true
+		}
+	}
+
+	return "",false
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) matchContext(ptr ContextPtr,user_set []string) bool {
+
+	if len(user_set) == 0 {
+		return true
+	}
+
+	ctxstr,found := es.contextString(ptr)
+
+	if !found {
+		include,_ := SplitNegatedTerms(user_set)
+		return len(include) == 0
+	}
+
+	return MatchContextSet(ctxstr,user_set)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) MatchChapters(src string) []string {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var chapters = make(map[string]int)
+	var retval []string
+
+	for class := range es.data.Nodes {
+		for _,n := range es.data.Nodes[class] {
+			if n.L > 0 && MatchChapterPattern(n.Chap,src) {
+				for _,c := range strings.Split(n.Chap,",") {
+					chapters[c]++
+				}
+			}
+		}
+	}
+
+	for c := range chapters {
+		if len(c) > 0 && strings.Contains(c,src) {
+			retval = append(retval,c)
+		}
+	}
+
+	sort.Strings(retval)
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) DeleteChapter(chapter string) bool {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// Same outcome as the DeleteChapter() plpgsql, plus the chapter's page map
+
+	var deleted = make(map[NodePtr]bool)
+	var found bool
+
+	for class := range es.data.Nodes {
+		for i := range es.data.Nodes[class] {
+
+			n := &es.data.Nodes[class][i]
+
+			if n.L == 0 {
+				continue
+			}
+
+			var others []string
+			var mine bool
+
+			for _,c := range SplitChapters(n.Chap) {
+				if c == chapter {
+					mine = true
+				} else {
+					others = append(others,c)
+				}
+			}
+
+			if !mine {
+				continue
+			}
+
+			found = true
+
+			if len(others) > 0 {
+				n.Chap = strings.Join(others,",")
+			} else {
+				deleted[n.NPtr] = true
+			}
+		}
+	}
+
+	if !found {
+		return false
+	}
+
+	for class := range es.data.Nodes {
+		for i := range es.data.Nodes[class] {
+
+			n := &es.data.Nodes[class][i]
+
+			if deleted[n.NPtr] {
+				delete(es.names,n.S)
+				*n = Node{}
+				continue
+			}
+
+			for st := range n.I {
+
+				var kept []Link
+
+				for _,lnk := range n.I[st] {
+					if !deleted[lnk.Dst] {
+						kept = append(kept,lnk)
+					}
+				}
+
+				n.I[st] = kept
+			}
+		}
+	}
+
+	var pagemap []PageMap
+
+	for _,line := range es.data.PageMap {
+		if line.Chapter != chapter {
+			pagemap = append(pagemap,line)
+		}
+	}
+
+	es.data.PageMap = pagemap
+	es.dirty = true
+	es.save()
+
+	return true
+}
+
+//**************************************************************
+// Incremental upload
+//**************************************************************
+
+func (es *EmbeddedStore) GetNodesByText(texts []string) []Node {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []Node
+
+	for _,s := range texts {
+		if nptr,found := es.names[s]; found {
+			if n := es.node(nptr); n != nil {
+				retval = append(retval,*n)
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetChapterNodes(chapters []string) []Node {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []Node
+	var wanted = make(map[string]bool)
+
+	for _,c := range chapters {
+		wanted[c] = true
+	}
+
+	for class := range es.data.Nodes {
+		for _,n := range es.data.Nodes[class] {
+			if n.L == 0 {
+				continue
+			}
+			for _,c := range SplitChapters(n.Chap) {
+				if wanted[c] {
+					retval = append(retval,n)
+					break
+				}
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) CountChapterNodes(ctx context.Context,chapter string) (int,error) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var count int
+
+	for class := range es.data.Nodes {
+
+		if err := ctx.Err(); err != nil {
+			return count,err
+		}
+
+		for _,n := range es.data.Nodes[class] {
+			if n.L == 0 {
+				continue
+			}
+			for _,c := range SplitChapters(n.Chap) {
+				if c == chapter {
+					count++
+					break
+				}
+			}
+		}
+	}
+
+	return count,nil
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetChapterPageMap(chapters []string) []PageMap {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []PageMap
+	var wanted = make(map[string]bool)
+
+	for _,c := range chapters {
+		wanted[c] = true
+	}
+
+	for _,line := range es.data.PageMap {
+		if wanted[line.Chapter] {
+			retval = append(retval,line)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) ApplyDelta(delta GraphDelta,wait_counter bool) error {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// Check everything first, so that a failure changes nothing
+
+	for _,n := range delta.AddNodes {
+		if n.NPtr.Class < N1GRAM || n.NPtr.Class > GT1024 {
+			return fmt.Errorf("node %s has no storage class",n.S)
+		}
+		if es.node(n.NPtr) != nil {
+			return fmt.Errorf("node pointer %v for %s is already in use",n.NPtr,n.S)
+		}
+	}
+
+	for _,arrow := range delta.Arrows {
+		es.uploadArrow(arrow)
+	}
+
+	for plus,minus := range delta.Inverses {
+		es.uploadInverseArrow(plus,minus)
+	}
+
+	for _,ctx := range delta.Contexts {
+		es.uploadContext(ctx.Context,ctx.Ptr)
+	}
+
+	for _,old := range delta.DelNodes {
+
+		for st := range old.I {
+			for _,lnk := range old.I[st] {
+				if n := es.node(lnk.Dst); n != nil {
+					n.I[STTypeToSTIndex(-STIndexToSTType(st))] = removeLinksTo(n.I[STTypeToSTIndex(-STIndexToSTType(st))],old.NPtr)
+				}
+			}
+		}
+
+		if n := es.node(old.NPtr); n != nil {
+			delete(es.names,n.S)
+			*n = Node{}
+		}
+	}
+
+	for _,n := range delta.AddNodes {
+
+		var fresh Node
+
+		fresh.L,_ = StorageClass(n.S)
+		fresh.S = n.S
+		fresh.Chap = n.Chap
+		fresh.Seq = n.Seq
+		fresh.NPtr = n.NPtr
+
+		for st := range n.I {
+			if len(n.I[st]) > 0 {
+				fresh.I[st] = append([]Link{},n.I[st]...)
+			}
+		}
+
+		es.put(fresh)
+	}
+
+	for _,upd := range delta.UpdNodes {
+		if n := es.node(upd.NPtr); n != nil {
+			n.Chap = upd.Chap
+			n.Seq = upd.Seq
+		}
+	}
+
+	for _,dl := range delta.DelLinks {
+		if n := es.node(dl.From); n != nil {
+			var kept []Link
+			for _,lnk := range n.I[dl.STindex] {
+				if !(lnk.Arr == dl.Lnk.Arr && lnk.Ctx == dl.Lnk.Ctx && lnk.Dst == dl.Lnk.Dst) {
+					kept = append(kept,lnk)
+				}
+			}
+			n.I[dl.STindex] = kept
+		}
+	}
+
+	for _,dl := range delta.AddLinks {
+		if n := es.node(dl.From); n != nil && !HasLink(n.I[dl.STindex],dl.Lnk) {
+			n.I[dl.STindex] = append(n.I[dl.STindex],dl.Lnk)
+		}
+	}
+
+	var dropped = make(map[string]bool)
+
+	for _,line := range delta.DelPages {
+		dropped[fmt.Sprintf("%s/%d",line.Chapter,line.Line)] = true
+	}
+
+	var pagemap []PageMap
+
+	for _,line := range es.data.PageMap {
+		if !dropped[fmt.Sprintf("%s/%d",line.Chapter,line.Line)] {
+			pagemap = append(pagemap,line)
+		}
+	}
+
+	for _,line := range delta.AddPages {
+		line.Path = append([]Link{},line.Path...)
+		pagemap = append(pagemap,line)
+	}
+
+	es.data.PageMap = pagemap
+	es.dirty = true
+	es.save()
+
+	return nil
+}
+
+//**************************************************************
+
+func removeLinksTo(list []Link,dst NodePtr) []Link {
+
+	var kept []Link
+
+	for _,lnk := range list {
+		if lnk.Dst != dst {
+			kept = append(kept,lnk)
+		}
+	}
+
+	return kept
+}
+
+//**************************************************************
+// Graph analytics
+//**************************************************************
+
+func (es *EmbeddedStore) Singletons(sttypes []int,chap string,cn []string) ([]NodePtr,[]NodePtr) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	// Sources have links of a type but none of its inverse, sinks the opposite
+
+	var src_nptrs,snk_nptrs []NodePtr
+
+	singleton := func(n *Node,st int) bool {
+
+		lnks := arrowLinks(n.I[STTypeToSTIndex(st)])
+		inv := arrowLinks(n.I[STTypeToSTIndex(-st)])
+
+		return len(lnks) > 0 && len(inv) == 0 && es.matchContext(lnks[0].Ctx,cn)
+	}
+
+	for class := range es.data.Nodes {
+		for i := range es.data.Nodes[class] {
+
+			n := &es.data.Nodes[class][i]
+
+			if n.L == 0 || !MatchChapterPattern(n.Chap,chap) {
+				continue
+			}
+
+			var src,snk bool
+
+			for _,st := range sttypes {
+				src = src || singleton(n,st)
+				snk = snk || singleton(n,-st)
+			}
+
+			if src {
+				src_nptrs = append(src_nptrs,n.NPtr)
+			}
+
+			if snk {
+				snk_nptrs = append(snk_nptrs,n.NPtr)
+			}
+		}
+	}
+
+	return src_nptrs,snk_nptrs
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) LinkedNodes(sttypes []int,chap string,cn []string) []Node {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []Node
+
+	for class := range es.data.Nodes {
+		for _,n := range es.data.Nodes[class] {
+
+			if n.L == 0 || !MatchChapterPattern(n.Chap,chap) {
+				continue
+			}
+
+			var linked Node
+			var found bool
+
+			linked.NPtr = n.NPtr
+
+			for _,st := range sttypes {
+
+				lnks := arrowLinks(n.I[STTypeToSTIndex(st)])
+
+				if len(lnks) > 0 && es.matchContext(lnks[0].Ctx,cn) {
+					found = true
+				}
+			}
+
+			if !found {
+				continue
+			}
+
+			for _,st := range sttypes {
+				linked.I[STTypeToSTIndex(st)] = arrowLinks(n.I[STTypeToSTIndex(st)])
+			}
+
+			retval = append(retval,linked)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) Appointments(arrow ArrowPtr,sttype,min int,chap string,cn []string) []Appointment {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	// Port of GetAppointments(), nodes pointed to by at least min links
+	// of the same arrow (arrow < 0 for any arrow of the sttype), returned
+	// from the point of view of the appointed node as ParseAppointedNodeCluster does
+
+	_,cn_stripped := IsBracketedSearchList(cn)
+
+	var retval []Appointment
+
+	for class := range es.data.Nodes {
+		for _,n := range es.data.Nodes[class] {
+
+			if n.L == 0 || !MatchChapterPattern(n.Chap,chap) {
+				continue
+			}
+
+			var app Appointment
+
+			app.NTo = n.NPtr
+			app.Chap = n.Chap
+			app.Arr = arrow
+
+			for _,lnk := range arrowLinks(n.I[STTypeToSTIndex(sttype)]) {
+
+				if arrow > 0 && lnk.Arr != arrow {
+					continue
+				}
+
+				if !es.matchContext(lnk.Ctx,cn_stripped) {
+					continue
+				}
+
+				if arrow < 0 {
+					app.Arr = lnk.Arr
+				}
+
+				if app.Ctx == nil {
+					ctxstr,_ := es.contextString(lnk.Ctx)
+					app.Ctx = strings.Split(ctxstr,",")
+				}
+
+				app.NFrom = append(app.NFrom,lnk.Dst)
+			}
+
+			if len(app.NFrom) > 0 && len(app.NFrom) >= min {
+				app.Arr = InverseArrow(app.Arr)
+				app.STType = -sttype
+				retval = append(retval,app)
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func arrowLinks(lnks []Link) []Link {
+
+	// Without the empty arrow that records the node's context
+
+	var retval []Link
+
+	for _,lnk := range lnks {
+		if lnk.Arr != 0 {
+			retval = append(retval,lnk)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+// Cones, ported from the plpgsql Sum*Paths functions
+//**************************************************************
+
+func (es *EmbeddedStore) FwdConeNodes(start NodePtr,sttype,depth,limit int) []NodePtr {
+
+	var retval []NodePtr
+	var already = make(map[NodePtr]bool)
+
+	for _,path := range es.FwdPaths(start,sttype,depth,limit) {
+		for _,lnk := range path {
+			if !already[lnk.Dst] {
+				already[lnk.Dst] = true
+				retval = append(retval,lnk.Dst)
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) FwdConeLinks(start NodePtr,sttype,depth int) []Link {
+
+	var retval []Link
+	var already = make(map[NodePtr]bool)
+
+	for _,path := range es.FwdPaths(start,sttype,depth,CAUSAL_CONE_MAXLIMIT) {
+		for _,lnk := range path {
+			if !already[lnk.Dst] {
+				already[lnk.Dst] = true
+				retval = append(retval,lnk)
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) FwdPaths(start NodePtr,sttype,depth,limit int) [][]Link {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	neighbours := func(from NodePtr,exclude map[NodePtr]bool) []Link {
+		return es.fwdLinks(from,"",nil,nil,[]int{sttype},exclude)
+	}
+
+	exclude := map[NodePtr]bool{start: true}
+
+	return es.sumPaths([]Link{SingletonLink(start)},1,depth,exclude,limit,PATHS_FWD,neighbours)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) EntireConePaths(orientation string,start []NodePtr,depth int,chapter string,context []string,limit int) [][]Link {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var sttypes []int
+
+	switch orientation {
+	case "bwd":
+		sttypes = []int{-EXPRESS,-CONTAINS,-LEADSTO,NEAR}
+	case "fwd":
+		sttypes = []int{NEAR,LEADSTO,CONTAINS,EXPRESS}
+	default:
+		sttypes = []int{-EXPRESS,-CONTAINS,-LEADSTO,NEAR,LEADSTO,CONTAINS,EXPRESS}
+	}
+
+	neighbours := func(from NodePtr,exclude map[NodePtr]bool) []Link {
+		return es.fwdLinks(from,chapter,context,nil,sttypes,exclude)
+	}
+
+	// Unfiltered cones (GetEntireConePathsAsLinks) use the looser limits of SumAllPaths
+
+	mode := PATHS_NC
+
+	if chapter == "" && len(context) == 0 {
+		mode = PATHS_ALL
+	}
+
+	return es.rootPaths(start,depth,limit,mode,neighbours)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) ConstraintConePaths(start []NodePtr,depth int,chapter string,context []string,arrows []ArrowPtr,sttypes []int,limit int) [][]Link {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	if len(sttypes) == 0 {
+		sttypes = []int{-EXPRESS,-CONTAINS,-LEADSTO,NEAR,LEADSTO,CONTAINS,EXPRESS}
+	}
+
+	neighbours := func(from NodePtr,exclude map[NodePtr]bool) []Link {
+		return es.fwdLinks(from,chapter,context,arrows,sttypes,exclude)
+	}
+
+	return es.rootPaths(start,depth,limit,PATHS_NC,neighbours)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) ConstrainedFwdLinks(start []NodePtr,chapter string,context []string,sttypes []int,arrows []ArrowPtr,limit int) []Link {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	if len(start) == 0 {
+		return nil
+	}
+
+	var exclude = map[NodePtr]bool{NONODE: true}
+
+	for _,s := range start {
+		exclude[s] = true
+	}
+
+	return es.fwdLinks(start[0],chapter,context,arrows,sttypes,exclude)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) rootPaths(start []NodePtr,depth,limit,mode int,neighbours func(NodePtr,map[NodePtr]bool) []Link) [][]Link {
+
+	var retval [][]Link
+
+	for _,root := range start {
+
+		var exclude = make(map[NodePtr]bool)
+
+		for _,s := range start {
+			exclude[s] = true
+		}
+
+		paths := es.sumPaths([]Link{SingletonLink(root)},1,depth,exclude,limit,mode,neighbours)
+		retval = append(retval,paths...)
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) sumPaths(path []Link,depth,maxdepth int,exclude map[NodePtr]bool,maxlimit int,mode int,neighbours func(NodePtr,map[NodePtr]bool) []Link) [][]Link {
+
+	// Depth first, the exclusion list is passed by value as in plpgsql.
+	// The modes reproduce the slightly different limits of SumAllPaths,
+	// SumFwdPaths and SumAllNCPaths/SumConstraintPaths
+
+	if depth >= maxdepth {
+		return [][]Link{path}
+	}
+
+	fwdlinks := neighbours(path[len(path)-1].Dst,exclude)
+
+	// limit recursion explosions
+
+	horizon := maxlimit
+
+	if mode != PATHS_ALL {
+
+		horizon = maxlimit - len(fwdlinks)
+
+		if horizon < 0 {
+			horizon = 0
+			maxdepth = depth + 1
+		}
+	}
+
+	var retval [][]Link
+	var count int
+
+	local := make(map[NodePtr]bool,len(exclude))
+
+	for n := range exclude {
+		local[n] = true
+	}
+
+	for _,lnk := range fwdlinks {
+
+		if mode == PATHS_ALL && count > maxlimit {
+			return retval
+		}
+
+		if local[lnk.Dst] {
+			continue
+		}
+
+		local[lnk.Dst] = true
+
+		switch mode {
+		case PATHS_FWD:
+			if count >= maxlimit {
+				return append(retval,path)
+			}
+		case PATHS_NC:
+			if count > maxlimit {
+				retval = append(retval,path)
+				continue
+			}
+		}
+
+		count++
+
+		tot_path := append(append([]Link{},path...),lnk)
+
+		branch := make(map[NodePtr]bool,len(local))
+
+		for n := range local {
+			branch[n] = true
+		}
+
+		appendix := es.sumPaths(tot_path,depth+1,maxdepth,branch,horizon,mode,neighbours)
+
+		if appendix != nil {
+			retval = append(retval,appendix...)
+			if mode != PATHS_ALL {
+				for _,p := range appendix {
+					count += len(p)-1
+				}
+			}
+		} else {
+			retval = append(retval,tot_path)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) fwdLinks(from NodePtr,chapter string,context []string,arrows []ArrowPtr,sttypes []int,exclude map[NodePtr]bool) []Link {
+
+	// Port of GetConstrainedFwdLinks/GetNCFwdLinks: the chapter applies to the
+	// node we are leaving, the context and arrows to the links themselves
+
+	var retval []Link
+
+	n := es.node(from)
+
+	if n == nil {
+		return nil
+	}
+
+	if !MatchChapterPattern(n.Chap,chapter) {
+		return nil
+	}
+
+	for _,st := range sttypes {
+		for _,lnk := range n.I[STTypeToSTIndex(st)] {
+
+			if lnk.Arr == 0 {
+				continue
+			}
+
+			if len(arrows) > 0 && !MatchArrows(arrows,lnk.Arr) {
+				continue
+			}
+
+			if !es.matchContext(lnk.Ctx,context) {
+				continue
+			}
+
+			if !exclude[lnk.Dst] {
+				retval = append(retval,lnk)
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+// Page map
+//**************************************************************
+
+func (es *EmbeddedStore) AppendPageMap(line PageMap) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	line.Path = append([]Link{},line.Path...)
+	es.data.PageMap = append(es.data.PageMap,line)
+	es.dirty = true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetPageMap(chap string,cn []string,page int) []PageMap {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var selection []PageMap
+
+	for _,line := range es.data.PageMap {
+
+		if !strings.Contains(strings.ToLower(line.Chapter),strings.ToLower(chap)) {
+			continue
+		}
+
+		if !es.matchContext(line.Context,cn) {
+			continue
+		}
+
+		line.Alias = ""
+		selection = append(selection,line)
+	}
+
+	sort.SliceStable(selection, func(i,j int) bool {
+		if selection[i].Chapter != selection[j].Chapter {
+			return selection[i].Chapter < selection[j].Chapter
+		}
+		return selection[i].Line < selection[j].Line
+	})
+
+	offset := (page-1) * EMBEDDED_PAGE_HITS
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset >= len(selection) {
+		return nil
+	}
+
+	end := offset + EMBEDDED_PAGE_HITS
+
+	if end > len(selection) {
+		end = len(selection)
+	}
+
+	return selection[offset:end]
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetChaptersByContext(chap string,cn []string,limit int) map[string][]string {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var toc = make(map[string][]string)
+	var already = make(map[string]bool)
+
+	_,cn_stripped := IsBracketedSearchList(cn)
+
+	lines := append([]PageMap{},es.data.PageMap...)
+
+	sort.SliceStable(lines, func(i,j int) bool {
+		return lines[i].Chapter < lines[j].Chapter
+	})
+
+	for _,line := range lines {
+
+		key := fmt.Sprintf("%s/%d",line.Chapter,line.Context)
+
+		if already[key] {
+			continue
+		}
+
+		already[key] = true
+
+		if chap != "any" && chap != "" && !MatchChapterPattern(line.Chapter,chap) {
+			continue
+		}
+
+		if !es.matchContext(line.Context,cn_stripped) {
+			continue
+		}
+
+		ctxstr,_ := es.contextString(line.Context)
+
+		for _,rc := range SplitChapters(line.Chapter) {
+
+			if len(toc) == limit {
+				return toc
+			}
+
+			ctx_grp := strings.Join(strings.Split(ctxstr,","),", ")
+
+			if len(ctx_grp) > 0 {
+				toc[rc] = append(toc[rc],ctx_grp)
+			}
+		}
+	}
+
+	return toc
+}
+
+//**************************************************************
+// Arrow and context directories
+//**************************************************************
+
+func (es *EmbeddedStore) UploadArrow(arrow ArrowDirectory) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.uploadArrow(arrow)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) ClearArrows() {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	es.data.Arrows = nil
+	es.data.Inverses = make(map[ArrowPtr]ArrowPtr)
+	es.dirty = true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) uploadArrow(arrow ArrowDirectory) {
+
+	for _,a := range es.data.Arrows {
+		if strings.EqualFold(a.Long,arrow.Long) || strings.EqualFold(a.Short,arrow.Short) || a.Ptr == arrow.Ptr {
+			return
+		}
+	}
+
+	es.data.Arrows = append(es.data.Arrows,arrow)
+
+	sort.Slice(es.data.Arrows, func(i,j int) bool {
+		return es.data.Arrows[i].Ptr < es.data.Arrows[j].Ptr
+	})
+
+	es.dirty = true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) UploadInverseArrow(plus,minus ArrowPtr) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.uploadInverseArrow(plus,minus)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) uploadInverseArrow(plus,minus ArrowPtr) {
+
+	for p,m := range es.data.Inverses {
+		if p == plus || m == minus {
+			return
+		}
+	}
+
+	es.data.Inverses[plus] = minus
+	es.dirty = true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) DownloadArrows() ([]ArrowDirectory,map[ArrowPtr]ArrowPtr) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var inverses = make(map[ArrowPtr]ArrowPtr)
+
+	for plus,minus := range es.data.Inverses {
+		inverses[plus] = minus
+	}
+
+	return append([]ArrowDirectory{},es.data.Arrows...),inverses
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) UploadContext(context string,ptr ContextPtr) ContextPtr {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	ptr = es.uploadContext(context,ptr)
+	es.autosave()
+	return ptr
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) uploadContext(context string,ptr ContextPtr) ContextPtr {
+
+	// Same semantics as IdempInsertContext()
+
+	for _,c := range es.data.Contexts {
+		if c.Context == context || (ptr != -1 && c.Ptr == ptr) {
+			return c.Ptr
+		}
+	}
+
+	if ptr == -1 {
+		ptr = 0
+		for _,c := range es.data.Contexts {
+			if c.Ptr >= ptr {
+				ptr = c.Ptr + 1
+			}
+		}
+	}
+
+	es.data.Contexts = append(es.data.Contexts,ContextDirectory{Context: context,Ptr: ptr})
+
+	sort.Slice(es.data.Contexts, func(i,j int) bool {
+		return es.data.Contexts[i].Ptr < es.data.Contexts[j].Ptr
+	})
+
+	es.dirty = true
+	return ptr
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetContextByName(context string) (string,ContextPtr) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	remove_accents,stripped := IsBracketedSearchTerm(context)
+
+	for _,c := range es.data.Contexts {
+		if remove_accents && Unaccent(c.Context) == stripped || c.Context == context {
+			return c.Context,c.Ptr
+		}
+	}
+
+	return "",0
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetContextByPtr(ptr ContextPtr) (string,ContextPtr) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	ctxstr,found := es.contextString(ptr)
+
+	if !found {
+		return "",0
+	}
+
+	return ctxstr,ptr
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) DownloadContexts() []ContextDirectory {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	return append([]ContextDirectory{},es.data.Contexts...)
+}
+
+//**************************************************************
+// Access statistics
+//**************************************************************
+
+func SawAgain(ls LastSeen,now int64) (LastSeen,bool) {
+
+	// Running average of access intervals, with a dead time to
+	// avoid counting a burst of clicks as separate visits
+
+	deltat := now - ls.Last
+
+	if deltat <= LASTSEEN_DEADTIME {
+		return ls,false
+	}
+
+	ls.Pdelta = 0.5 * float64(deltat) + 0.5 * ls.Pdelta
+	ls.Freq++
+	ls.Last = now
+
+	return ls,true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) progress(user string,create bool) UserProgress {
+
+	// Caller holds the lock, a write lock if create
+
+	if user == DEFAULT_USER {
+		return UserProgress{ Sections: es.data.Sections, Seen: es.data.Seen }
+	}
+
+	up,found := es.data.Users[user]
+
+	if !found && create {
+		up.Sections = make(map[string]LastSeen)
+		up.Seen = make(map[NodePtr]LastSeen)
+		es.data.Users[user] = up
+	}
+
+	return up
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) LastSawSection(user,name string) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	up := es.progress(user,true)
+	now := time.Now().Unix()
+	ls,found := up.Sections[name]
+
+	if !found {
+		ls.Section = name
+		ls.First = now
+		ls.Last = now
+		ls.Freq = 1
+		ls.NPtr = NodePtr{Class: -1,CPtr: -1}
+	} else {
+		var changed bool
+		if ls,changed = SawAgain(ls,now); !changed {
+			return
+		}
+	}
+
+	up.Sections[name] = ls
+	es.dirty = true
+	es.autosave()
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) LastSawNPtr(user string,nptr NodePtr,name string) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	up := es.progress(user,true)
+	now := time.Now().Unix()
+	ls,found := up.Seen[nptr]
+
+	if !found {
+		ls.Section = name
+		ls.First = now
+		ls.Last = now
+		ls.Freq = 1
+		ls.NPtr = nptr
+	} else {
+		var changed bool
+		if ls,changed = SawAgain(ls,now); !changed {
+			return
+		}
+	}
+
+	up.Seen[nptr] = ls
+	es.dirty = true
+	es.autosave()
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetLastSeen(user string) []LastSeen {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var ret []LastSeen
+
+	up := es.progress(user,false)
+	now := time.Now().Unix()
+
+	for _,ls := range up.Sections {
+		ls.Ndelta = float64(now - ls.Last)
+		ret = append(ret,ls)
+	}
+
+	for _,ls := range up.Seen {
+		ls.Ndelta = float64(now - ls.Last)
+		ret = append(ret,ls)
+	}
+
+	sort.SliceStable(ret, func(i,j int) bool {
+		return ret[i].Section < ret[j].Section
+	})
+
+	return ret
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetLastSeenNPtr(user string,nptr NodePtr) LastSeen {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	ls := es.progress(user,false).Seen[nptr]
+	ls.NPtr = nptr
+
+	if ls.Last > 0 {
+		ls.Ndelta = float64(time.Now().Unix() - ls.Last)
+	}
+
+	return ls
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetSeenNPtrs(user string,horizon int) []NodePtr {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []NodePtr
+
+	since := time.Now().Add(-time.Duration(horizon) * time.Hour).Unix()
+
+	for nptr,ls := range es.progress(user,false).Seen {
+		if horizon == NEVER || ls.Last > since {
+			retval = append(retval,nptr)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+// Overlays
+//**************************************************************
+
+func (es *EmbeddedStore) AddOverlay(ov Overlay) bool {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	es.data.Overlays = append(es.data.Overlays,ov)
+	es.dirty = true
+	es.autosave()
+	return true
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetOverlays(user,chap string) []Overlay {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []Overlay
+
+	for _,ov := range es.data.Overlays {
+		if ov.User == user && MatchChapterPattern(ov.Chap,chap) {
+			retval = append(retval,ov)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetNodeOverlays(user string,nptr NodePtr) []Overlay {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []Overlay
+
+	for _,ov := range es.data.Overlays {
+		if ov.User == user && ov.NPtr == nptr {
+			retval = append(retval,ov)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetNodesOverlays(user string,nptrs []NodePtr) map[NodePtr][]Overlay {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var wanted = make(map[NodePtr]bool)
+
+	for _,nptr := range nptrs {
+		wanted[nptr] = true
+	}
+
+	var retval = make(map[NodePtr][]Overlay)
+
+	for _,ov := range es.data.Overlays {
+		if ov.User == user && wanted[ov.NPtr] {
+			retval[ov.NPtr] = append(retval[ov.NPtr],ov)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) RemoveOverlays(user string,nptr NodePtr) int {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	var keep []Overlay
+
+	for _,ov := range es.data.Overlays {
+		if ov.User != user || ov.NPtr != nptr {
+			keep = append(keep,ov)
+		}
+	}
+
+	removed := len(es.data.Overlays) - len(keep)
+
+	if removed > 0 {
+		es.data.Overlays = keep
+		es.dirty = true
+		es.autosave()
+	}
+
+	return removed
+}
+
+//**************************************************************
+// Review
+//**************************************************************
+
+func (es *EmbeddedStore) GetReviewCard(user string,nptr NodePtr) (ReviewCard,bool) {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	card,found := es.data.Reviews[user][nptr]
+	return card,found
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) GetReviewCards(user string) []ReviewCard {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	var retval []ReviewCard
+
+	for _,card := range es.data.Reviews[user] {
+		retval = append(retval,card)
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) SaveReviewCard(card ReviewCard) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if es.data.Reviews[card.User] == nil {
+		es.data.Reviews[card.User] = make(map[NodePtr]ReviewCard)
+	}
+
+	es.data.Reviews[card.User][card.NPtr] = card
+	es.dirty = true
+	es.autosave()
+}
+
+//**************************************************************
+// Short term memory
+//**************************************************************
+
+func (es *EmbeddedStore) GetSTM(user,session string) []STMEntry {
+
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+
+	return append([]STMEntry(nil),es.data.STM[STMKey(user,session)]...)
+}
+
+//**************************************************************
+
+func (es *EmbeddedStore) SaveSTM(user,session string,changed []STMEntry,forgotten []string) {
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	key := STMKey(user,session)
+
+	var update = make(map[string]STMEntry)
+	var drop = make(map[string]bool)
+
+	for _,e := range changed {
+		update[e.Token] = e
+	}
+
+	for _,token := range forgotten {
+		drop[token] = true
+	}
+
+	var entries []STMEntry
+
+	for _,e := range es.data.STM[key] {
+
+		if drop[e.Token] {
+			continue
+		}
+
+		if u,ok := update[e.Token]; ok {
+			e = u
+			delete(update,e.Token)
+		}
+
+		entries = append(entries,e)
+	}
+
+	for _,e := range changed {
+		if _,ok := update[e.Token]; ok {
+			entries = append(entries,e)
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(es.data.STM,key)
+	} else {
+		es.data.STM[key] = entries
+	}
+
+	es.dirty = true
+	es.autosave()
+}
+
+//**************************************************************
+// Go versions of the plpgsql matching helpers
+//**************************************************************
+
+func SingletonLink(start NodePtr) Link {
+
+	// Same as GetSingletonAsLink(), an empty link pointing to the start
+
+	var lnk Link
+	lnk.Wgt = 1.0
+	lnk.Dst = start
+	return lnk
+}
+
+//**************************************************************
+
+func Unaccent(s string) string {
+
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+	result,_,err := transform.String(t,s)
+
+	if err != nil {
+		return s
+	}
+
+	return result
+}
+
+//**************************************************************
+
+func MatchChapterPattern(chap,search string) bool {
+
+	// Equivalent of lower(Chap) LIKE lower('%search%'), with (..) for unaccenting
+
+	search = strings.Trim(search,"%")
+
+	if search == "" || search == "any" {
+		return true
+	}
+
+	if negate,term := IsNegatedTerm(search); negate {
+		return !MatchChapterPattern(chap,term)
+	}
+
+	remove_accents,stripped := IsBracketedSearchTerm(search)
+	stripped = strings.ReplaceAll(stripped,"''","'")
+
+	if remove_accents {
+		return strings.Contains(strings.ToLower(Unaccent(chap)),strings.ToLower(Unaccent(stripped)))
+	}
+
+	return strings.Contains(strings.ToLower(chap),strings.ToLower(stripped))
+}
+
+//**************************************************************
+
+func MatchContextSet(ctxstr string,user_set []string) bool {
+
+	// Port of match_context(): the db_set is the stored context
+	// expression, the user_set is the client lookup. Dots denote AND
+
+	if len(user_set) == 0 || user_set[0] == "" {
+		return true
+	}
+
+	db_set := strings.Split(ctxstr,",")
+
+	// Inhibitors (!ctx) veto a match on any part of the db_set
+
+	user_set,inhibit := SplitNegatedTerms(user_set)
+
+	for _,item_db := range db_set {
+		for _,c := range inhibit {
+			if strings.Contains(strings.ToLower(Unaccent(item_db)),strings.ToLower(Unaccent(strings.Trim(c,"!")))) {
+				return false
+			}
+		}
+	}
+
+	if len(user_set) == 0 {
+		return true
+	}
+
+	for _,item_db := range db_set {
+		for _,item_us := range user_set {
+			if item_db == item_us {
+				return true
+			}
+		}
+	}
+
+	var notes,client,or_list []string
+
+	for _,item := range db_set {
+		notes = append(notes,strings.ToLower(Unaccent(item)))
+	}
+
+	for _,item := range user_set {
+		client = append(client,strings.ToLower(Unaccent(item)))
+	}
+
+	for _,item := range notes {
+
+		and_list := strings.Split(item,".")
+
+		if len(and_list) > 1 {
+
+			and_result := 0
+
+			for _,ref := range and_list {
+				for _,c := range client {
+					if ref == c {
+						and_result++
+					}
+				}
+			}
+
+			if and_result == len(and_list) {
+				return true
+			}
+		} else {
+			or_list = append(or_list,item)
+		}
+	}
+
+	for _,ref := range or_list {
+		for _,c := range client {
+			if strings.Contains(ref,c) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func MatchTextQuery(text,query string) bool {
+
+	// A small stand-in for to_tsquery() matching: | is OR, & is AND,
+	// ! negates, :* is a prefix match. No stemming beyond plurals
+
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	has := func(term string) bool {
+
+		prefix := strings.HasSuffix(term,":*")
+		term = strings.TrimSuffix(term,":*")
+
+		for _,w := range words {
+			if w == term || strings.TrimSuffix(w,"s") == strings.TrimSuffix(term,"s") {
+				return true
+			}
+			if prefix && strings.HasPrefix(w,term) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _,alternative := range strings.Split(query,"|") {
+
+		matched := true
+
+		for _,term := range strings.FieldsFunc(alternative, func(r rune) bool { return r == '&' || r == ' ' }) {
+
+			term = strings.ToLower(strings.Trim(term,"()'"))
+
+			if term == "" {
+				continue
+			}
+
+			if strings.HasPrefix(term,"!") {
+				if has(strings.TrimPrefix(term,"!")) {
+					matched = false
+				}
+			} else if !has(term) {
+				matched = false
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,442 @@
+//**************************************************************
+//
+// Graph export: chapters, cones and path solutions as GraphML,
+// GEXF or Graphviz DOT, for drawing and analysis in other tools
+//
+// Each link is stored in both directions, so an exported graph
+// keeps only the forward (positive ST type) half of each pair.
+// Arrow names, ST types, contexts and weights become attributes
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//**************************************************************
+
+const (
+	EXPORT_GRAPHML = "graphml"
+	EXPORT_GEXF = "gexf"
+	EXPORT_DOT = "dot"
+)
+
+//**************************************************************
+
+type ExportNode struct {
+
+	NPtr NodePtr
+	Text string
+	Chap string
+}
+
+//**************************************************************
+
+type ExportEdge struct {
+
+	From    NodePtr
+	To      NodePtr
+	Arrow   string   // long name
+	Short   string
+	STType  int
+	Context string
+	Weight  float32
+}
+
+//**************************************************************
+
+type ExportGraph struct {
+
+	Title string
+	Nodes []ExportNode
+	Edges []ExportEdge
+}
+
+//**************************************************************
+
+type graphExporter struct {
+
+	sst   PoSST
+	graph ExportGraph
+	nodes map[NodePtr]bool
+	edges map[ExportEdge]bool
+}
+
+//**************************************************************
+
+func newGraphExporter(sst PoSST,title string) *graphExporter {
+
+	var ge graphExporter
+
+	ge.sst = sst
+	ge.graph.Title = title
+	ge.nodes = make(map[NodePtr]bool)
+	ge.edges = make(map[ExportEdge]bool)
+
+	return &ge
+}
+
+//**************************************************************
+
+func ExportChapter(sst PoSST,chapter string,context []string,limit int) ExportGraph {
+
+	// The nodes of a chapter, their links in either direction and
+	// the nodes at the other ends
+
+	ge := newGraphExporter(sst,chapter)
+
+	nptrs := GetDBNodePtrMatchingNCCS(sst,"any",chapter,context,nil,false,limit)
+
+	for _,nptr := range nptrs {
+
+		node := GetDBNodeByNodePtr(sst,nptr)
+		ge.node(nptr)
+
+		for st := 0; st < ST_TOP; st++ {
+			for _,lnk := range node.I[st] {
+				if MatchContexts(context,lnk.Ctx) {
+					ge.link(nptr,lnk)
+				}
+			}
+		}
+	}
+
+	return ge.done()
+}
+
+//**************************************************************
+
+func ExportPaths(sst PoSST,title string,paths [][]Link) ExportGraph {
+
+	// A cone from GetEntireNCConePathsAsLinks or path solutions
+	// from GetPathsAndSymmetries. Each path starts with its root,
+	// and link l joins path[l-1] to path[l]
+
+	ge := newGraphExporter(sst,title)
+
+	for _,path := range paths {
+
+		if len(path) > 0 {
+			ge.node(path[0].Dst)
+		}
+
+		for l := 1; l < len(path); l++ {
+			ge.link(path[l-1].Dst,path[l])
+		}
+	}
+
+	return ge.done()
+}
+
+//**************************************************************
+
+func ExportSearchGraph(sst PoSST,search SearchParameters,nodeptrs,leftptrs,rightptrs []NodePtr,arrowptrs []ArrowPtr,sttype []int) (ExportGraph,bool) {
+
+	// The graph for a search, choosing between chapter, path
+	// solution and cone as searchN4L does. False if the search
+	// is none of these
+
+	name := search.Name != nil || search.Query != ""
+	from := search.From != nil
+	to := search.To != nil
+	chapter := search.Chapter != ""
+	context := search.Context != nil
+
+	minlimit,maxlimit := MinMaxPolicy(search)
+	minwgt,maxwgt := WeightPolicy(search)
+
+	switch {
+
+	case (context || chapter) && !name && !(from || to):
+		return ExportChapter(sst,search.Chapter,search.Context,maxlimit),true
+
+	case from && to:
+		solutions := GetWeightedPaths(sst,leftptrs,rightptrs,search.Chapter,search.Context,arrowptrs,sttype,minlimit,maxlimit,minwgt,maxwgt)
+		return ExportPaths(sst,fmt.Sprintf("paths from %s to %s",strings.Join(search.From,", "),strings.Join(search.To,", ")),solutions),true
+
+	case name || from || to:
+		start := nodeptrs
+
+		if start == nil {
+			start = leftptrs
+		}
+
+		if start == nil {
+			start = rightptrs
+		}
+
+		var names []string
+
+		for _,nptr := range start {
+			names = append(names,GetDBNodeByNodePtr(sst,nptr).S)
+		}
+
+		cone,_ := GetEntireNCConePathsAsLinks(sst,"both",start,maxlimit,search.Chapter,search.Context,CAUSAL_CONE_MAXLIMIT)
+		cone = PruneConeByWeight(cone,minwgt,maxwgt)
+		cone = PruneConeByArrows(cone,arrowptrs)
+		return ExportPaths(sst,"cone from "+strings.Join(names,", "),cone),true
+	}
+
+	return ExportGraph{},false
+}
+
+//**************************************************************
+
+func (ge *graphExporter) node(nptr NodePtr) {
+
+	if ge.nodes[nptr] {
+		return
+	}
+
+	ge.nodes[nptr] = true
+
+	node := GetDBNodeByNodePtr(ge.sst,nptr)
+	ge.graph.Nodes = append(ge.graph.Nodes,ExportNode{NPtr: nptr, Text: node.S, Chap: node.Chap})
+}
+
+//**************************************************************
+
+func (ge *graphExporter) link(from NodePtr,lnk Link) {
+
+	// Arrow 0 only records context membership
+
+	if lnk.Arr == 0 {
+		return
+	}
+
+	to := lnk.Dst
+	arr := lnk.Arr
+	sttype := STIndexToSTType(GetDBArrowByPtr(ge.sst,arr).STAindex)
+
+	// Turn inverse links around, and give NEAR links one order
+
+	if sttype < 0 {
+		arr = InverseArrow(arr)
+		from,to = to,from
+		sttype = -sttype
+	}
+
+	if sttype == NEAR && NodePtrLess(to,from) {
+		from,to = to,from
+	}
+
+	adir := GetDBArrowByPtr(ge.sst,arr)
+	ctx,_ := GetDBContextByPtr(ge.sst,lnk.Ctx)
+
+	edge := ExportEdge{From: from, To: to, Arrow: adir.Long, Short: adir.Short, STType: sttype, Context: ctx, Weight: lnk.Wgt}
+
+	if ge.edges[edge] {
+		return
+	}
+
+	ge.edges[edge] = true
+	ge.node(from)
+	ge.node(to)
+	ge.graph.Edges = append(ge.graph.Edges,edge)
+}
+
+//**************************************************************
+
+func (ge *graphExporter) done() ExportGraph {
+
+	// Stable output, so that exports can be compared
+
+	sort.Slice(ge.graph.Nodes,func(i,j int) bool {
+		return NodePtrLess(ge.graph.Nodes[i].NPtr,ge.graph.Nodes[j].NPtr)
+	})
+
+	return ge.graph
+}
+
+//**************************************************************
+
+func FormatGraph(g ExportGraph,format string) (string,error) {
+
+	switch strings.ToLower(format) {
+	case EXPORT_GRAPHML:
+		return GraphToGraphML(g),nil
+	case EXPORT_GEXF:
+		return GraphToGEXF(g),nil
+	case EXPORT_DOT,"gv","graphviz":
+		return GraphToDOT(g),nil
+	}
+
+	return "",fmt.Errorf("unknown graph format \"%s\", use %s, %s or %s",format,EXPORT_GRAPHML,EXPORT_GEXF,EXPORT_DOT)
+}
+
+//**************************************************************
+
+func GraphFormatMIME(format string) string {
+
+	switch strings.ToLower(format) {
+	case EXPORT_GRAPHML:
+		return "application/graphml+xml"
+	case EXPORT_GEXF:
+		return "application/gexf+xml"
+	}
+
+	return "text/vnd.graphviz"
+}
+
+//**************************************************************
+
+func GraphToGraphML(g ExportGraph) string {
+
+	var out strings.Builder
+
+	out.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	out.WriteString("<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+	out.WriteString("  <key id=\"label\" for=\"node\" attr.name=\"label\" attr.type=\"string\"/>\n")
+	out.WriteString("  <key id=\"chapter\" for=\"node\" attr.name=\"chapter\" attr.type=\"string\"/>\n")
+	out.WriteString("  <key id=\"arrow\" for=\"edge\" attr.name=\"arrow\" attr.type=\"string\"/>\n")
+	out.WriteString("  <key id=\"short\" for=\"edge\" attr.name=\"short\" attr.type=\"string\"/>\n")
+	out.WriteString("  <key id=\"sttype\" for=\"edge\" attr.name=\"sttype\" attr.type=\"int\"/>\n")
+	out.WriteString("  <key id=\"stname\" for=\"edge\" attr.name=\"stname\" attr.type=\"string\"/>\n")
+	out.WriteString("  <key id=\"context\" for=\"edge\" attr.name=\"context\" attr.type=\"string\"/>\n")
+	out.WriteString("  <key id=\"weight\" for=\"edge\" attr.name=\"weight\" attr.type=\"float\"/>\n")
+	out.WriteString(fmt.Sprintf("  <graph id=\"%s\" edgedefault=\"directed\">\n",XMLText(g.Title)))
+
+	for _,n := range g.Nodes {
+		out.WriteString(fmt.Sprintf("    <node id=\"%s\">\n",ExportNodeID(n.NPtr)))
+		out.WriteString(fmt.Sprintf("      <data key=\"label\">%s</data>\n",XMLText(n.Text)))
+		out.WriteString(fmt.Sprintf("      <data key=\"chapter\">%s</data>\n",XMLText(n.Chap)))
+		out.WriteString("    </node>\n")
+	}
+
+	for i,e := range g.Edges {
+
+		directed := ""
+
+		if e.STType == NEAR {
+			directed = " directed=\"false\""
+		}
+
+		out.WriteString(fmt.Sprintf("    <edge id=\"e%d\" source=\"%s\" target=\"%s\"%s>\n",i,ExportNodeID(e.From),ExportNodeID(e.To),directed))
+		out.WriteString(fmt.Sprintf("      <data key=\"arrow\">%s</data>\n",XMLText(e.Arrow)))
+		out.WriteString(fmt.Sprintf("      <data key=\"short\">%s</data>\n",XMLText(e.Short)))
+		out.WriteString(fmt.Sprintf("      <data key=\"sttype\">%d</data>\n",e.STType))
+		out.WriteString(fmt.Sprintf("      <data key=\"stname\">%s</data>\n",XMLText(STTypeName(e.STType))))
+		out.WriteString(fmt.Sprintf("      <data key=\"context\">%s</data>\n",XMLText(e.Context)))
+		out.WriteString(fmt.Sprintf("      <data key=\"weight\">%g</data>\n",e.Weight))
+		out.WriteString("    </edge>\n")
+	}
+
+	out.WriteString("  </graph>\n</graphml>\n")
+
+	return out.String()
+}
+
+//**************************************************************
+
+func GraphToGEXF(g ExportGraph) string {
+
+	var out strings.Builder
+
+	out.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	out.WriteString("<gexf xmlns=\"http://www.gexf.net/1.2draft\" version=\"1.2\">\n")
+	out.WriteString(fmt.Sprintf("  <meta>\n    <creator>SSTorytime</creator>\n    <description>%s</description>\n  </meta>\n",XMLText(g.Title)))
+	out.WriteString("  <graph mode=\"static\" defaultedgetype=\"directed\">\n")
+	out.WriteString("    <attributes class=\"node\">\n")
+	out.WriteString("      <attribute id=\"0\" title=\"chapter\" type=\"string\"/>\n")
+	out.WriteString("    </attributes>\n")
+	out.WriteString("    <attributes class=\"edge\">\n")
+	out.WriteString("      <attribute id=\"0\" title=\"short\" type=\"string\"/>\n")
+	out.WriteString("      <attribute id=\"1\" title=\"sttype\" type=\"integer\"/>\n")
+	out.WriteString("      <attribute id=\"2\" title=\"stname\" type=\"string\"/>\n")
+	out.WriteString("      <attribute id=\"3\" title=\"context\" type=\"string\"/>\n")
+	out.WriteString("    </attributes>\n")
+	out.WriteString("    <nodes>\n")
+
+	for _,n := range g.Nodes {
+		out.WriteString(fmt.Sprintf("      <node id=\"%s\" label=\"%s\">\n",ExportNodeID(n.NPtr),XMLText(n.Text)))
+		out.WriteString(fmt.Sprintf("        <attvalues><attvalue for=\"0\" value=\"%s\"/></attvalues>\n",XMLText(n.Chap)))
+		out.WriteString("      </node>\n")
+	}
+
+	out.WriteString("    </nodes>\n")
+	out.WriteString("    <edges>\n")
+
+	for i,e := range g.Edges {
+
+		edgetype := ""
+
+		if e.STType == NEAR {
+			edgetype = " type=\"undirected\""
+		}
+
+		out.WriteString(fmt.Sprintf("      <edge id=\"%d\" source=\"%s\" target=\"%s\" label=\"%s\" weight=\"%g\"%s>\n",i,ExportNodeID(e.From),ExportNodeID(e.To),XMLText(e.Arrow),e.Weight,edgetype))
+		out.WriteString("        <attvalues>\n")
+		out.WriteString(fmt.Sprintf("          <attvalue for=\"0\" value=\"%s\"/>\n",XMLText(e.Short)))
+		out.WriteString(fmt.Sprintf("          <attvalue for=\"1\" value=\"%d\"/>\n",e.STType))
+		out.WriteString(fmt.Sprintf("          <attvalue for=\"2\" value=\"%s\"/>\n",XMLText(STTypeName(e.STType))))
+		out.WriteString(fmt.Sprintf("          <attvalue for=\"3\" value=\"%s\"/>\n",XMLText(e.Context)))
+		out.WriteString("        </attvalues>\n")
+		out.WriteString("      </edge>\n")
+	}
+
+	out.WriteString("    </edges>\n  </graph>\n</gexf>\n")
+
+	return out.String()
+}
+
+//**************************************************************
+
+func GraphToDOT(g ExportGraph) string {
+
+	var out strings.Builder
+
+	out.WriteString(fmt.Sprintf("digraph %s {\n",DOTString(g.Title)))
+
+	for _,n := range g.Nodes {
+		out.WriteString(fmt.Sprintf("  %s [label=%s, chapter=%s];\n",DOTString(ExportNodeID(n.NPtr)),DOTString(n.Text),DOTString(n.Chap)))
+	}
+
+	for _,e := range g.Edges {
+
+		dir := ""
+
+		if e.STType == NEAR {
+			dir = ", dir=none"
+		}
+
+		out.WriteString(fmt.Sprintf("  %s -> %s [label=%s, short=%s, sttype=%d, stname=%s, context=%s, linkweight=%g%s];\n",
+			DOTString(ExportNodeID(e.From)),DOTString(ExportNodeID(e.To)),DOTString(e.Arrow),DOTString(e.Short),
+			e.STType,DOTString(STTypeName(e.STType)),DOTString(e.Context),e.Weight,dir))
+	}
+
+	out.WriteString("}\n")
+
+	return out.String()
+}
+
+//**************************************************************
+
+func ExportNodeID(nptr NodePtr) string {
+
+	return fmt.Sprintf("n%d_%d",nptr.Class,nptr.CPtr)
+}
+
+//**************************************************************
+
+func XMLText(s string) string {
+
+	var out strings.Builder
+	xml.EscapeText(&out,[]byte(s))
+	return out.String()
+}
+
+//**************************************************************
+
+func DOTString(s string) string {
+
+	s = strings.ReplaceAll(s,"\\","\\\\")
+	s = strings.ReplaceAll(s,"\"","\\\"")
+	s = strings.ReplaceAll(s,"\n","\\n")
+
+	return "\""+s+"\""
+}
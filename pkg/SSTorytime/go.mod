@@ -3,3 +3,5 @@ module SSTorytime
 go 1.24.2
 
 require github.com/lib/pq v1.10.9
+
+require golang.org/x/text v0.24.0
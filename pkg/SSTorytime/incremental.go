@@ -0,0 +1,452 @@
+//**************************************************************
+//
+// Incremental upload: compare the N4L memory graph with what the
+// database holds for the same chapters, and apply only the
+// difference in a single transaction
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+)
+
+//**************************************************************
+
+type GraphDelta struct {
+
+	Chapters []string         // chapters being (re)uploaded
+
+	AddNodes []Node           // new nodes, including their links
+	UpdNodes []Node           // existing nodes whose Chap/Seq changed
+	DelNodes []Node           // nodes that no longer belong to any chapter, with old links
+
+	AddLinks []DeltaLink
+	DelLinks []DeltaLink
+
+	AddPages []PageMap
+	DelPages []PageMap        // only Chapter and Line are significant
+
+	Arrows   []ArrowDirectory // idempotent, the whole directory
+	Inverses map[ArrowPtr]ArrowPtr
+	Contexts []ContextDirectory
+}
+
+//**************************************************************
+
+type DeltaLink struct {
+
+	From    NodePtr
+	STindex int
+	Lnk     Link
+}
+
+//**************************************************************
+
+const DELTA_TEXT_BATCH = 500 // names per lookup query
+
+//**************************************************************
+
+func IncrementalGraphToDB(sst PoSST,wait_counter bool) bool {
+
+	// Upload the memory graph, replacing only what changed in the chapters it mentions
+
+	fmt.Println("\nComparing with stored chapters ...")
+
+	delta := ComputeGraphDelta(sst)
+
+	fmt.Println("   Chapters :",strings.Join(delta.Chapters,", "))
+	fmt.Println("   Nodes    : +",len(delta.AddNodes),"-",len(delta.DelNodes),"~",len(delta.UpdNodes))
+	fmt.Println("   Links    : +",len(delta.AddLinks),"-",len(delta.DelLinks))
+	fmt.Println("   Page map : +",len(delta.AddPages),"-",len(delta.DelPages))
+
+	err := ApplyGraphDelta(sst,delta,wait_counter)
+
+	if err != nil {
+		fmt.Println("\nUpload failed, nothing was changed:",err)
+		return false
+	}
+
+	sst.Store.Sync()
+
+	fmt.Println("\nFinally done!")
+	return true
+}
+
+//**************************************************************
+
+func ComputeGraphDelta(sst PoSST) GraphDelta {
+
+	var delta GraphDelta
+
+	memnodes := GetMemoryNodes()
+	delta.Chapters = GetMemoryChapters()
+
+	var affected = make(map[string]bool)
+
+	for _,chap := range delta.Chapters {
+		affected[chap] = true
+	}
+
+	// Nodes are identified by their text, so find the stored versions of
+	// everything we know, whichever chapter it was filed under
+
+	var texts []string
+
+	for _,n := range memnodes {
+		texts = append(texts,n.S)
+	}
+
+	var stored = make(map[NodePtr]Node)
+	var bytext = make(map[string]NodePtr)
+
+	for _,n := range GetDBNodesByText(sst,texts) {
+		stored[n.NPtr] = n
+		bytext[n.S] = n.NPtr
+	}
+
+	var in_chapter = make(map[NodePtr]bool)
+
+	for _,n := range GetDBChapterNodes(sst,delta.Chapters) {
+		stored[n.NPtr] = n
+		in_chapter[n.NPtr] = true
+	}
+
+	// Memory pointers were reserved above the db range, so unmatched ones are safe to keep
+
+	var remap = make(map[NodePtr]NodePtr)
+
+	for _,n := range memnodes {
+		dbptr,found := bytext[n.S]
+		if found {
+			remap[n.NPtr] = dbptr
+		} else {
+			remap[n.NPtr] = n.NPtr
+		}
+	}
+
+	mapptr := func(nptr NodePtr) NodePtr {
+		if to,ok := remap[nptr]; ok {
+			return to
+		}
+		return nptr
+	}
+
+	// The scope for link removal is every node that belongs to these chapters, before or after
+
+	var scope = make(map[NodePtr]bool)
+	var wanted = make(map[NodePtr]bool)
+
+	for nptr := range in_chapter {
+		scope[nptr] = true
+	}
+
+	for _,n := range memnodes {
+		scope[remap[n.NPtr]] = true
+		wanted[remap[n.NPtr]] = true
+	}
+
+	for _,m := range memnodes {
+
+		var n Node
+
+		n.S = m.S
+		n.Seq = m.Seq
+		n.NPtr = remap[m.NPtr]
+		n.L,_ = StorageClass(m.S)
+
+		for st := range m.I {
+			for _,lnk := range m.I[st] {
+				lnk.Dst = mapptr(lnk.Dst)
+				if lnk.Dst != n.NPtr {
+					n.I[st] = append(n.I[st],lnk)
+				}
+			}
+		}
+
+		old,exists := stored[n.NPtr]
+
+		if !exists {
+			n.Chap = m.Chap
+			delta.AddNodes = append(delta.AddNodes,n)
+			continue
+		}
+
+		// Keep chapters that belong to other uploads
+
+		var chaps []string
+
+		for _,c := range SplitChapters(old.Chap) {
+			if !affected[c] {
+				chaps = append(chaps,c)
+			}
+		}
+
+		chaps = append(chaps,SplitChapters(m.Chap)...)
+		n.Chap = strings.Join(chaps,",")
+
+		if n.Chap != old.Chap || n.Seq != old.Seq {
+			delta.UpdNodes = append(delta.UpdNodes,n)
+		}
+
+		for st := range n.I {
+
+			for _,lnk := range n.I[st] {
+				if !HasLink(old.I[st],lnk) {
+					delta.AddLinks = append(delta.AddLinks,DeltaLink{From: n.NPtr,STindex: st,Lnk: lnk})
+				}
+			}
+
+			for _,lnk := range old.I[st] {
+				if scope[lnk.Dst] && !HasLink(n.I[st],lnk) {
+					delta.DelLinks = append(delta.DelLinks,DeltaLink{From: n.NPtr,STindex: st,Lnk: lnk})
+				}
+			}
+		}
+	}
+
+	// Nodes that were in these chapters but have disappeared from the source
+
+	for nptr := range in_chapter {
+
+		if wanted[nptr] {
+			continue
+		}
+
+		old := stored[nptr]
+
+		var chaps []string
+
+		for _,c := range SplitChapters(old.Chap) {
+			if !affected[c] {
+				chaps = append(chaps,c)
+			}
+		}
+
+		if len(chaps) == 0 {
+			delta.DelNodes = append(delta.DelNodes,old)
+			continue
+		}
+
+		upd := old
+		upd.Chap = strings.Join(chaps,",")
+		delta.UpdNodes = append(delta.UpdNodes,upd)
+
+		for st := range old.I {
+			for _,lnk := range old.I[st] {
+				if wanted[lnk.Dst] {
+					delta.DelLinks = append(delta.DelLinks,DeltaLink{From: nptr,STindex: st,Lnk: lnk})
+				}
+			}
+		}
+	}
+
+	// Page map, compared line by line
+
+	var oldpages = make(map[string]PageMap)
+	var newpages = make(map[string]bool)
+
+	for _,line := range GetDBChapterPageMap(sst,delta.Chapters) {
+		oldpages[fmt.Sprintf("%s/%d",line.Chapter,line.Line)] = line
+	}
+
+	for _,line := range PAGE_MAP {
+
+		var event PageMap
+
+		event = line
+		event.Path = nil
+
+		for _,lnk := range line.Path {
+			lnk.Dst = mapptr(lnk.Dst)
+			event.Path = append(event.Path,lnk)
+		}
+
+		key := fmt.Sprintf("%s/%d",event.Chapter,event.Line)
+		newpages[key] = true
+
+		old,exists := oldpages[key]
+
+		if exists && SamePageMapLine(old,event) {
+			continue
+		}
+
+		if exists {
+			delta.DelPages = append(delta.DelPages,old)
+		}
+
+		delta.AddPages = append(delta.AddPages,event)
+	}
+
+	for key,old := range oldpages {
+		if !newpages[key] {
+			delta.DelPages = append(delta.DelPages,old)
+		}
+	}
+
+	// Directories are merged idempotently
+
+	DIRECTORY_MUTEX.RLock()
+
+	delta.Arrows = append(delta.Arrows,ARROW_DIRECTORY...)
+	delta.Contexts = append(delta.Contexts,CONTEXT_DIRECTORY...)
+	delta.Inverses = make(map[ArrowPtr]ArrowPtr)
+
+	for plus,minus := range INVERSE_ARROWS {
+		delta.Inverses[plus] = minus
+	}
+
+	DIRECTORY_MUTEX.RUnlock()
+
+	return delta
+}
+
+//**************************************************************
+
+func ApplyGraphDelta(sst PoSST,delta GraphDelta,wait_counter bool) error {
+
+	// All or nothing
+
+	return sst.Store.ApplyDelta(delta,wait_counter)
+}
+
+//**************************************************************
+
+func HasLink(list []Link,lnk Link) bool {
+
+	// Weights go through a %f round trip in the db, so don't compare exactly
+
+	for _,l := range list {
+		if l.Arr == lnk.Arr && l.Ctx == lnk.Ctx && l.Dst == lnk.Dst && math.Abs(float64(l.Wgt-lnk.Wgt)) < 1e-5 {
+			return true
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func SamePageMapLine(a,b PageMap) bool {
+
+	if a.Chapter != b.Chapter || a.Line != b.Line || a.Alias != b.Alias || a.Context != b.Context || len(a.Path) != len(b.Path) {
+		return false
+	}
+
+	for i := range a.Path {
+		if !HasLink(a.Path[i:i+1],b.Path[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func GetMemoryNodes() []Node {
+
+	// Everything parsed into the node directory, skipping reserved db slots
+
+	var retval []Node
+
+	for _,lane := range [][]Node{NODE_DIRECTORY.N1directory,NODE_DIRECTORY.N2directory,NODE_DIRECTORY.N3directory,NODE_DIRECTORY.LT128,NODE_DIRECTORY.LT1024,NODE_DIRECTORY.GT1024} {
+		for _,n := range lane {
+			if len(n.S) > 0 {
+				retval = append(retval,n)
+			}
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func GetMemoryChapters() []string {
+
+	var already = make(map[string]bool)
+	var retval []string
+
+	for _,n := range GetMemoryNodes() {
+		for _,c := range SplitChapters(n.Chap) {
+			if len(c) > 0 && !already[c] {
+				already[c] = true
+				retval = append(retval,c)
+			}
+		}
+	}
+
+	for _,line := range PAGE_MAP {
+		if len(line.Chapter) > 0 && !already[line.Chapter] {
+			already[line.Chapter] = true
+			retval = append(retval,line.Chapter)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func GetDBNodesByText(sst PoSST,texts []string) []Node {
+
+	return sst.Store.GetNodesByText(texts)
+}
+
+//**************************************************************
+
+func GetDBChapterNodes(sst PoSST,chapters []string) []Node {
+
+	return sst.Store.GetChapterNodes(chapters)
+}
+
+//**************************************************************
+
+func CountDBChapterNodes(ctx context.Context,sst PoSST,chapter string) (int,error) {
+
+	// Counted by the store, gives up when ctx is done
+
+	return sst.Store.CountChapterNodes(ctx,chapter)
+}
+
+//**************************************************************
+
+func GetDBChapterPageMap(sst PoSST,chapters []string) []PageMap {
+
+	return sst.Store.GetChapterPageMap(chapters)
+}
+
+//**************************************************************
+
+func RemoveDBLinkFromNodeCommand(nptr NodePtr,lnk Link,sttype int) string {
+
+	// Match on everything except the weight, which doesn't survive the %f round trip exactly
+
+	link_table := STTypeDBChannel(sttype)
+
+	return fmt.Sprintf("UPDATE Node SET %s=ARRAY(SELECT l FROM unnest(%s) AS l WHERE NOT ((l).Arr=%d AND (l).Ctx=%d AND (l).Dst='(%d,%d)'::NodePtr)) WHERE NPtr='(%d,%d)'::NodePtr",
+		link_table,
+		link_table,
+		lnk.Arr,
+		lnk.Ctx,
+		lnk.Dst.Class,lnk.Dst.CPtr,
+		nptr.Class,nptr.CPtr)
+}
+
+//**************************************************************
+
+func RemoveDBLinksToNodeCommand(nptr NodePtr,dst NodePtr,sttype int) string {
+
+	link_table := STTypeDBChannel(sttype)
+
+	return fmt.Sprintf("UPDATE Node SET %s=ARRAY(SELECT l FROM unnest(%s) AS l WHERE NOT (l).Dst='(%d,%d)'::NodePtr) WHERE NPtr='(%d,%d)'::NodePtr",
+		link_table,
+		link_table,
+		dst.Class,dst.CPtr,
+		nptr.Class,nptr.CPtr)
+}
@@ -0,0 +1,526 @@
+//**************************************************************
+//
+// JSON import: transcribing JSON documents into SST
+//
+// A JSON document is a tree of objects and arrays. Objects become
+// nodes, arrays become containers of their elements. In the naive
+// schema each key is a property arrow, declared in SSTconfig or
+// made up, as in examples/json_example_2.n4l. In the collapsed
+// form, a key and its value are a single item "key = value"
+// contained in its object, so no new arrows are needed, as in
+// examples/json_example_3.n4l
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+//**************************************************************
+
+const (
+	JSON_NAIVE = iota // keys become property arrows
+	JSON_COLLAPSED    // "key = value" items inside their object
+)
+
+const (
+	JSON_NULL = iota
+	JSON_SCALAR
+	JSON_OBJECT
+	JSON_ARRAY
+)
+
+//**************************************************************
+
+type JSONValue struct {
+
+	Kind  int
+	Text  string      // scalars, as written
+	Keys  []string    // objects, in document order
+	Items []JSONValue // object values or array elements
+}
+
+//**************************************************************
+
+type jsonImporter struct {
+
+	imp   *GraphImport
+	mode  int
+	order bool
+	names map[string]bool // node names given to objects and arrays
+	taken map[string]bool // new arrow short names
+}
+
+//**************************************************************
+
+func ParseJSON(text []byte) (JSONValue,error) {
+
+	// Keep the keys in order, unlike encoding/json maps
+
+	dec := json.NewDecoder(strings.NewReader(string(text)))
+	dec.UseNumber()
+
+	v,err := parseJSONValue(dec)
+
+	if err != nil {
+		return v,err
+	}
+
+	if _,err = dec.Token(); err != io.EOF {
+		return v,fmt.Errorf("unexpected data after the JSON document")
+	}
+
+	return v,nil
+}
+
+//**************************************************************
+
+func parseJSONValue(dec *json.Decoder) (JSONValue,error) {
+
+	var v JSONValue
+
+	tok,err := dec.Token()
+
+	if err != nil {
+		return v,err
+	}
+
+	switch t := tok.(type) {
+
+	case json.Delim:
+
+		if t == '{' {
+			v.Kind = JSON_OBJECT
+
+			for dec.More() {
+
+				key,err := dec.Token()
+
+				if err != nil {
+					return v,err
+				}
+
+				item,err := parseJSONValue(dec)
+
+				if err != nil {
+					return v,err
+				}
+
+				v.Keys = append(v.Keys,key.(string))
+				v.Items = append(v.Items,item)
+			}
+		} else {
+			v.Kind = JSON_ARRAY
+
+			for dec.More() {
+
+				item,err := parseJSONValue(dec)
+
+				if err != nil {
+					return v,err
+				}
+
+				v.Items = append(v.Items,item)
+			}
+		}
+
+		_,err = dec.Token() // closing delimiter
+		return v,err
+
+	case nil:
+		v.Kind = JSON_NULL
+
+	case string:
+		v.Kind = JSON_SCALAR
+		v.Text = t
+
+	case json.Number:
+		v.Kind = JSON_SCALAR
+		v.Text = t.String()
+
+	case bool:
+		v.Kind = JSON_SCALAR
+		v.Text = fmt.Sprint(t)
+	}
+
+	return v,nil
+}
+
+//**************************************************************
+
+func ImportJSON(doc JSONValue,title string,mode int,order bool) GraphImport {
+
+	// The document's own name or title field names the top node,
+	// otherwise title. With order, array elements are also joined
+	// in sequence by (then)
+
+	var imp GraphImport
+
+	imp.Origin = "JSON"
+	imp.Using = make(map[string]string)
+
+	ji := jsonImporter{ imp: &imp, mode: mode, order: order, names: make(map[string]bool), taken: make(map[string]bool) }
+
+	if doc.Kind == JSON_OBJECT {
+		for i,key := range doc.Keys {
+			if text := JSONItemText(doc.Items[i].Text); JSONNameKey(key) && doc.Items[i].Kind == JSON_SCALAR && text != "" {
+				title = text
+			}
+		}
+	}
+
+	ji.names[title] = true
+
+	switch doc.Kind {
+	case JSON_OBJECT:
+		ji.object(title,doc)
+	case JSON_ARRAY:
+		ji.members(title,"item",doc)
+	}
+
+	// Only the arrows that links ended up using, e.g. not those of
+	// keys whose values were all empty
+
+	used := make(map[string]bool)
+
+	for _,lnk := range imp.Links {
+		used[lnk.Arrow] = true
+	}
+
+	var arrows []*ImportArrow
+
+	for _,a := range imp.Arrows {
+		if used[a.Short] {
+			arrows = append(arrows,a)
+		}
+	}
+
+	imp.Arrows = arrows
+
+	return imp
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) object(name string,v JSONValue) {
+
+	for i,key := range v.Keys {
+
+		item := v.Items[i]
+
+		switch item.Kind {
+
+		case JSON_SCALAR:
+			if ji.mode == JSON_COLLAPSED {
+				ji.link(name,ji.contains(),JSONKeyValue(key,item.Text))
+			} else {
+				value := JSONItemText(item.Text)
+
+				// N4L refuses a link from the object to itself, so
+				// another key with the object's label is written
+				// out in full
+
+				if value == name {
+					if JSONNameKey(key) {
+						continue
+					}
+					value = JSONKeyValue(key,item.Text)
+				}
+
+				ji.link(name,ji.arrow(key),value)
+			}
+
+		case JSON_OBJECT:
+			if len(item.Keys) == 0 {
+				continue
+			}
+			child := ji.unique(JSONTitle(key)+" for "+name)
+			ji.link(name,ji.keyArrow(key),child)
+			ji.object(child,item)
+
+		case JSON_ARRAY:
+			ji.array(name,key,item)
+		}
+	}
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) array(parent,key string,v JSONValue) {
+
+	if len(v.Items) == 0 {
+		return
+	}
+
+	// Collapsed lists of values are just more "key = value" items
+
+	if ji.mode == JSON_COLLAPSED && JSONAllScalar(v) {
+		for _,item := range v.Items {
+			if item.Kind == JSON_SCALAR {
+				ji.link(parent,ji.contains(),JSONKeyValue(JSONSingular(key),item.Text))
+			}
+		}
+		return
+	}
+
+	container := ji.unique(JSONTitle(key)+" for "+parent)
+	ji.link(parent,ji.keyArrow(key),container)
+	ji.members(container,key,v)
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) members(container,key string,v JSONValue) {
+
+	var previous string
+
+	for i,item := range v.Items {
+
+		if item.Kind == JSON_NULL {
+			continue
+		}
+
+		member := JSONItemText(item.Text)
+
+		if item.Kind != JSON_SCALAR {
+			member = ji.unique(fmt.Sprintf("%s %d",JSONTitle(JSONSingular(key)),i+1))
+		}
+
+		ji.link(container,ji.contains(),member)
+
+		if ji.order && previous != "" {
+			ji.link(previous,ji.standard("leadsto","then","then followed by","from","follows on from"),member)
+		}
+
+		previous = member
+
+		switch item.Kind {
+		case JSON_OBJECT:
+			ji.object(member,item)
+		case JSON_ARRAY:
+			ji.members(member,key,item)
+		}
+	}
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) link(from,arrow,to string) {
+
+	if from == "" || to == "" || from == to {
+		return
+	}
+
+	ji.imp.Links = append(ji.imp.Links,ImportLink{From: from, To: to, Arrow: arrow, Weight: 1})
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) unique(name string) string {
+
+	// Objects and arrays need names of their own, or they would
+	// merge with others of the same name
+
+	candidate := name
+
+	for n := 2; ji.names[candidate]; n++ {
+		candidate = fmt.Sprintf("%s (%d)",name,n)
+	}
+
+	ji.names[candidate] = true
+
+	return candidate
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) keyArrow(key string) string {
+
+	if ji.mode == JSON_COLLAPSED {
+		return ji.contains()
+	}
+
+	return ji.arrow(key)
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) contains() string {
+
+	return ji.standard("contains","contain","contains","belong","belongs to")
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) standard(section,short,long,invshort,invlong string) string {
+
+	// A well known arrow, by either of its names
+
+	if ptr,ok := LookupArrowLong(long); ok {
+		return ArrowDirectoryEntry(ptr).Short
+	}
+
+	if ptr,ok := LookupArrowShort(short); ok {
+		return ArrowDirectoryEntry(ptr).Short
+	}
+
+	if using,ok := ji.imp.Using[long]; ok {
+		return using
+	}
+
+	sttype := EXPRESS
+
+	switch section {
+	case "leadsto":
+		sttype = LEADSTO
+	case "contains":
+		sttype = CONTAINS
+	}
+
+	short = UnusedArrowShortName(short,ji.taken)
+	invshort = UnusedArrowShortName(invshort,ji.taken)
+
+	ji.imp.Arrows = append(ji.imp.Arrows,&ImportArrow{STType: sttype, Long: long, Short: short, InvLong: invlong, InvShort: invshort})
+	ji.imp.Using[long] = short
+
+	return short
+}
+
+//**************************************************************
+
+func (ji *jsonImporter) arrow(key string) string {
+
+	// A declared arrow whose short name is the key, e.g. (email), or
+	// whose long name is "has key", otherwise a new property
+
+	if short,ok := ji.imp.Using[key]; ok {
+		return short
+	}
+
+	// Brackets and commas would be misread in SSTconfig
+
+	words := SplitCamelCase(strings.Map(func(r rune) rune {
+		if strings.ContainsRune("(),",r) {
+			return ' '
+		}
+		return r
+	},key))
+
+	phrase := strings.Join(words," ")
+
+	candidates := []string{ key, strings.ToLower(key), ArrowShortName(phrase), strings.Join(words,"") }
+
+	for _,c := range candidates {
+		if ptr,ok := LookupArrowShort(c); ok {
+			ji.imp.Using[key] = ArrowDirectoryEntry(ptr).Short
+			return ji.imp.Using[key]
+		}
+	}
+
+	for _,long := range []string{ phrase,"has "+phrase } {
+		if ptr,ok := LookupArrowLong(long); ok {
+			ji.imp.Using[key] = ArrowDirectoryEntry(ptr).Short
+			return ji.imp.Using[key]
+		}
+	}
+
+	if phrase == "" {
+		phrase = "value"
+	}
+
+	long := "has "+phrase
+	short := UnusedArrowShortName(ArrowShortName(phrase),ji.taken)
+	invlong := InverseArrowName(long)
+	invshort := UnusedArrowShortName(short+"-of",ji.taken)
+
+	ji.imp.Arrows = append(ji.imp.Arrows,&ImportArrow{STType: EXPRESS, Long: long, Short: short, InvLong: invlong, InvShort: invshort})
+	ji.imp.Using[key] = short
+
+	return short
+}
+
+//**************************************************************
+
+func JSONItemText(s string) string {
+
+	return strings.Join(strings.Fields(s)," ")
+}
+
+//**************************************************************
+
+func JSONKeyValue(key,value string) string {
+
+	value = JSONItemText(value)
+
+	if value == "" {
+		return ""
+	}
+
+	return strings.Join(SplitCamelCase(key)," ")+" = "+value
+}
+
+//**************************************************************
+
+func JSONNameKey(key string) bool {
+
+	switch strings.ToLower(key) {
+	case "name","title","label":
+		return true
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func JSONAllScalar(v JSONValue) bool {
+
+	for _,item := range v.Items {
+		if item.Kind == JSON_OBJECT || item.Kind == JSON_ARRAY {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func JSONTitle(key string) string {
+
+	// users -> Users, page_number -> Page number
+
+	phrase := []rune(strings.Join(SplitCamelCase(key)," "))
+
+	if len(phrase) == 0 {
+		return "Item"
+	}
+
+	phrase[0] = unicode.ToUpper(phrase[0])
+
+	return string(phrase)
+}
+
+//**************************************************************
+
+func JSONSingular(key string) string {
+
+	// Good enough for naming the elements of a list
+
+	switch {
+	case strings.HasSuffix(key,"ies") && len(key) > 4:
+		return key[:len(key)-3]+"y"
+	case strings.HasSuffix(key,"ss"):
+		return key
+	case strings.HasSuffix(key,"s") && len(key) > 3:
+		return key[:len(key)-1]
+	}
+
+	return key
+}
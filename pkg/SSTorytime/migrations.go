@@ -0,0 +1,305 @@
+//**************************************************************
+//
+// Versioned schema migrations for the postgres backend
+//
+// Types and stored functions are (re)defined on every open, as
+// before. Tables evolve through the ordered list below, and each
+// step is recorded in SchemaVersion so that an old database can
+// be brought up to date with "sstadmin migrate"
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+//**************************************************************
+
+const SCHEMA_VERSION_TABLE = "CREATE TABLE IF NOT EXISTS SchemaVersion " +
+	"(    " +
+	"Version int primary key," +
+	"Name    text," +
+	"Applied timestamp" +
+	")"
+
+const SCHEMA_LOCK = 4711       // pg_advisory_xact_lock key, serializes concurrent migrations
+const LOGGED_TABLES_ENV = "SST_LOGGED_TABLES"
+
+//**************************************************************
+
+type Migration struct {
+
+	Version int
+	Name    string
+	SQL     []string
+}
+
+//**************************************************************
+
+var MIGRATIONS = []Migration{
+
+	{ 1, "baseline tables", []string{
+		CONTEXT_DIRECTORY_TABLE,
+		PAGEMAP_TABLE,
+		NODE_TABLE,
+		ARROW_INVERSES_TABLE,
+		ARROW_DIRECTORY_TABLE,
+		LASTSEEN_TABLE,
+	}},
+
+	{ 2, "story sequence flag on nodes", []string{
+		"ALTER TABLE Node ADD COLUMN IF NOT EXISTS Seq boolean",
+	}},
+
+	{ 3, "accent-insensitive text search on nodes", []string{
+		"ALTER TABLE Node ADD COLUMN IF NOT EXISTS UnSearch TSVECTOR GENERATED ALWAYS AS (to_tsvector('english',sst_unaccent(S))) STORED",
+	}},
+
+	{ 4, "per-user progress tracking and overlays", []string{
+		"ALTER TABLE LastSeen ADD COLUMN IF NOT EXISTS Username text NOT NULL DEFAULT ''",
+		USER_OVERLAY_TABLE,
+		"CREATE INDEX IF NOT EXISTS useroverlay_username ON UserOverlay (Username)",
+	}},
+
+	{ 5, "spaced repetition review cards", []string{
+		REVIEW_TABLE,
+	}},
+
+	{ 6, "short term memory per user and session", []string{
+		STM_TABLE,
+	}},
+}
+
+//**************************************************************
+
+var LOGGED_TABLES bool = len(os.Getenv(LOGGED_TABLES_ENV)) > 0
+
+//**************************************************************
+
+func LatestSchemaVersion() int {
+
+	return MIGRATIONS[len(MIGRATIONS)-1].Version
+}
+
+//**************************************************************
+
+func TableDefinition(defn string) string {
+
+	// The tables are UNLOGGED by default, as the db is mostly a cache of
+	// the N4L sources. Durable deployments can ask for write-ahead logging
+
+	if LOGGED_TABLES {
+		return strings.Replace(defn,"CREATE UNLOGGED TABLE","CREATE TABLE",1)
+	}
+
+	return defn
+}
+
+//**************************************************************
+
+func SchemaTableExists(sst PoSST,table string) bool {
+
+	var exists bool
+
+	row := sst.DB.QueryRow("SELECT to_regclass($1) IS NOT NULL",strings.ToLower(table))
+
+	if err := row.Scan(&exists); err != nil {
+		fmt.Println("Unable to look for table",table,err)
+		return false
+	}
+
+	return exists
+}
+
+//**************************************************************
+
+func GetSchemaVersion(sst PoSST) int {
+
+	// 0 means no migrations recorded: either an empty database, or
+	// one created before schema versioning
+
+	if !SchemaTableExists(sst,"SchemaVersion") {
+		return 0
+	}
+
+	var version int
+
+	row := sst.DB.QueryRow("SELECT coalesce(max(Version),0) FROM SchemaVersion")
+
+	if err := row.Scan(&version); err != nil {
+		fmt.Println("Unable to read the schema version",err)
+		return 0
+	}
+
+	return version
+}
+
+//**************************************************************
+
+func GetAppliedMigrations(sst PoSST) map[int]time.Time {
+
+	var applied = make(map[int]time.Time)
+
+	if !SchemaTableExists(sst,"SchemaVersion") {
+		return applied
+	}
+
+	rows,err := sst.DB.Query("SELECT Version,Applied FROM SchemaVersion")
+
+	if err != nil {
+		fmt.Println("Unable to read the schema history",err)
+		return applied
+	}
+
+	for rows.Next() {
+
+		var version int
+		var when time.Time
+
+		if err = rows.Scan(&version,&when); err != nil {
+			fmt.Println("Bad schema history row",err)
+			continue
+		}
+
+		applied[version] = when
+	}
+
+	rows.Close()
+	return applied
+}
+
+//**************************************************************
+
+func SchemaIsCurrent(sst PoSST) (bool,string) {
+
+	// An empty database can simply be created at the latest version
+
+	version := GetSchemaVersion(sst)
+	latest := LatestSchemaVersion()
+
+	switch {
+	case version == latest:
+		return true,""
+
+	case version > latest:
+		return false,fmt.Sprintf("The database schema is at version %d, newer than this software (%d). Please upgrade.",version,latest)
+
+	case version == 0 && !SchemaTableExists(sst,"Node"):
+		return true,""
+	}
+
+	return false,fmt.Sprintf("The database schema is at version %d, but this software needs version %d. Run \"sstadmin migrate\" first.",version,latest)
+}
+
+//**************************************************************
+
+func DefineTypes(sst PoSST) error {
+
+	sst.DB.QueryRow("CREATE EXTENSION unaccent")
+
+	for _,defn := range []string{NODEPTR_TYPE,LINK_TYPE,APPOINTMENT_TYPE} {
+		if !CreateType(sst,defn) {
+			return fmt.Errorf("unable to create type as %s",defn)
+		}
+	}
+
+	return nil
+}
+
+//**************************************************************
+
+func MigrateDB(sst PoSST) error {
+
+	// Bring the schema up to the latest version, one transaction per step
+
+	if sst.DB == nil {
+		return nil
+	}
+
+	if err := DefineTypes(sst); err != nil {
+		return err
+	}
+
+	// Functions first, some are used in autocreating index columns
+
+	DefineStoredFunctions(sst)
+
+	if !CreateTable(sst,SCHEMA_VERSION_TABLE) {
+		return fmt.Errorf("unable to create table as %s",SCHEMA_VERSION_TABLE)
+	}
+
+	for _,m := range MIGRATIONS {
+
+		if err := ApplyMigration(sst,m); err != nil {
+			return fmt.Errorf("migration %d (%s): %v",m.Version,m.Name,err)
+		}
+	}
+
+	if LOGGED_TABLES {
+		return SetTablesLogged(sst)
+	}
+
+	return nil
+}
+
+//**************************************************************
+
+func ApplyMigration(sst PoSST,m Migration) error {
+
+	tx,err := sst.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if _,err = tx.Exec("SELECT pg_advisory_xact_lock($1)",SCHEMA_LOCK); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Another process may have got here first
+
+	var done bool
+
+	if err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM SchemaVersion WHERE Version=$1)",m.Version).Scan(&done); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if done {
+		return tx.Rollback()
+	}
+
+	for _,cmd := range m.SQL {
+		if _,err = tx.Exec(TableDefinition(cmd)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v in %s",err,cmd)
+		}
+	}
+
+	if _,err = tx.Exec("INSERT INTO SchemaVersion (Version,Name,Applied) VALUES ($1,$2,now())",m.Version,m.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//**************************************************************
+
+func SetTablesLogged(sst PoSST) error {
+
+	for _,table := range []string{"Node","PageMap","ArrowDirectory","ArrowInverses"} {
+
+		if _,err := sst.DB.Exec("ALTER TABLE "+table+" SET LOGGED"); err != nil {
+			return fmt.Errorf("unable to set %s logged: %v",table,err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+//**************************************************************
+//
+// annotations.go - markers like %word inside an item, which
+// link the item to word by an arrow named in SSTconfig
+//
+//**************************************************************
+
+package n4l
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//**************************************************************
+
+func (p *parser) stripAnnotations(fulltext string) string {
+
+	var protected bool = false
+	var deloused []rune
+	var runes = []rune(fulltext)
+
+	for r := 0; r < len(runes); r++ {
+
+		if runes[r] == '"' {
+			protected = !protected
+		}
+
+		if !protected {
+			skip,_ := p.embeddedSymbol(runes,r)
+			if skip > 0 {
+				r += skip-1
+				continue
+			}
+		}
+
+		deloused = append(deloused,runes[r])
+	}
+
+	return string(deloused)
+}
+
+//**************************************************************
+
+func (p *parser) annotations(annotated string, start int) []*Annotation {
+
+	var protected bool = false
+	var found []*Annotation
+
+	runes := []rune(annotated)
+
+	for r := 0; r < len(runes); r++ {
+
+		if runes[r] == '"' {
+			protected = !protected
+			continue
+		}
+
+		if protected {
+			continue
+		}
+
+		skip,symb := p.embeddedSymbol(runes,r)
+
+		if skip == 0 {
+			continue
+		}
+
+		word := p.extractWord(runes,r+skip,start)
+
+		if len(word) <= WORD_MISTAKE_LEN {
+			err := fmt.Sprintf("%s \"%s\"  after annotation %s, len %d",ERR_SHORT_WORD,word,symb,skip)
+			p.error(start,err,true)
+		}
+
+		r += skip-1
+
+		if word == "" {
+			p.error(start,ERR_MISSING_ITEM_SOMEWHERE+" (adding link)",false)
+			continue
+		}
+
+		found = append(found,&Annotation{Mark: symb, Arrow: p.config.Annotations[symb], Word: p.stripAnnotations(word), Raw: word})
+	}
+
+	return found
+}
+
+//**************************************************************
+
+func (p *parser) embeddedSymbol(runetext []rune,offset int) (int,string) {
+
+	// Return the length in runes of the longest marker at offset
+
+	if offset >= len(runetext) {
+		return 0,"end of string"
+	}
+
+	var found_len int
+	var found string
+
+	for an := range p.config.Annotations {
+
+		uni := []rune(an)
+		match := runetext[offset] == uni[0]
+
+		for r := 0; r < len(uni) && r+offset < len(runetext); r++ {
+
+			if uni[r] != runetext[offset+r] {
+				match = false
+				continue
+			}
+
+			if offset+r >= len(runetext)-1 {
+				match = false
+				continue
+			}
+
+			// No space between marker and text
+			if offset+r+1 < len(runetext) && unicode.IsSpace(runetext[offset+r+1]) {
+				match = false
+				continue
+			}
+		}
+
+		// There might still be another longer greedy match
+
+		if match && len(uni) > found_len {
+			found = an
+			found_len = len(uni)
+		}
+	}
+
+	if len(found) > 0 {
+		return found_len,found
+	}
+
+	return 0,"UNKNOWN SYMBOL"
+}
+
+//**************************************************************
+
+func (p *parser) extractWord(runetext []rune,offset int,start int) string {
+
+	var protected bool = false
+	var word []rune
+	var pair_quote string
+
+	for r := offset; r < len(runetext); r++ {
+
+		if runetext[r] == '"' || runetext[r] == '\'' {
+			protected = !protected
+			pair_quote = string(runetext[r]) + " "
+			continue
+		}
+
+		if !protected && !unicode.IsLetter(runetext[r]) {
+			return strings.Trim(strings.TrimSpace(string(word)),pair_quote)
+		}
+
+		word = append(word,runetext[r])
+	}
+
+	sword := strings.Trim(strings.TrimSpace(string(word)),pair_quote)
+
+	if len(sword) <= WORD_MISTAKE_LEN {
+		p.error(start,ERR_SHORT_WORD+"\""+sword+"\"",true)
+	}
+
+	return sword
+}
@@ -0,0 +1,186 @@
+//**************************************************************
+//
+// ast.go - the structure of an N4L file, as read by Parse
+//
+// A file has one chapter (the first - name), divided into blocks
+// by context changes (:: ::, +:: ::, -:: ::). A block holds lines,
+// a line holds items joined by links. Dittos and $alias.n references
+// are resolved to the items they stand for, and annotations are
+// separated from the text they mark
+//
+//**************************************************************
+
+package n4l
+
+import (
+	"fmt"
+)
+
+//**************************************************************
+
+type Pos struct {
+
+	Offset int // bytes from the start of the input
+	Line   int // from 1
+	Col    int // from 1, in runes
+}
+
+//**************************************************************
+
+type File struct {
+
+	Name     string
+	Contexts []*Block // context changes before the first chapter, without lines
+	Chapters []*Chapter
+	Aliases  []*Alias
+	Comments []*Comment
+	Errors   []*Error
+}
+
+//**************************************************************
+
+type Chapter struct {
+
+	Pos    Pos
+	Name   string // empty if items came before any - chapter
+	Blocks []*Block
+}
+
+//**************************************************************
+
+type Block struct {
+
+	Pos        Pos
+	Op         byte     // '=' for ::, '+' for +::, '-' for -::, 0 at the start of a chapter
+	Expression string   // as written between the colons
+	Context    []string // in force afterwards, sorted
+	Sequence   bool     // in _sequence_ mode afterwards
+	Lines      []*Line
+}
+
+//**************************************************************
+
+type Line struct {
+
+	Pos   Pos
+	End   Pos
+	Alias string // the @alias labelling this line, if any
+	Items []*Item
+	Links []*Link
+}
+
+//**************************************************************
+
+type Item struct {
+
+	Pos   Pos
+	End   Pos
+	Text  string // the node's text, without annotations
+	Raw   string // with annotations, after resolving Ref
+	Ref   string // " or $alias.n if the item repeats an earlier one
+	Quote rune   // the quote character, if the item was quoted
+	Annotations []*Annotation
+}
+
+//**************************************************************
+
+type Annotation struct {
+
+	Mark  string // e.g. %
+	Arrow string // from the annotation configuration
+	Word  string // the word it marks, itself without annotations
+	Raw   string // the word as written
+}
+
+//**************************************************************
+
+type Link struct {
+
+	Pos      Pos
+	End      Pos
+	From     *Item
+	To       *Item
+	Arrow    string   // short or long name, as written
+	Weight   float32
+	Context  []string // extra context given inside the brackets
+	Sequence bool     // an implicit (then) in _sequence_ mode
+	Start    bool     // From is the first of its sequence
+}
+
+//**************************************************************
+
+type Alias struct {
+
+	Pos   Pos
+	Name  string
+	Items []*Item // $name.1 is Items[0]
+}
+
+//**************************************************************
+
+type Comment struct {
+
+	Pos  Pos
+	Text string // including the # or //
+}
+
+//**************************************************************
+
+type Error struct {
+
+	Pos     Pos
+	Msg     string
+	Warning bool // N4L carries on after these
+}
+
+//**************************************************************
+
+func (e *Error) Error() string {
+
+	return fmt.Sprintf("line %d: %s",e.Pos.Line,e.Msg)
+}
+
+//**************************************************************
+
+func (f *File) Failed() bool {
+
+	// Were there errors that would stop N4L?
+
+	for _,e := range f.Errors {
+		if !e.Warning {
+			return true
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (f *File) Alias(name string) *Alias {
+
+	for _,a := range f.Aliases {
+		if a.Name == name {
+			return a
+		}
+	}
+
+	return nil
+}
+
+//**************************************************************
+
+func (f *File) Lines() []*Line {
+
+	// All the lines, in order
+
+	var lines []*Line
+
+	for _,ch := range f.Chapters {
+		for _,b := range ch.Blocks {
+			lines = append(lines,b.Lines...)
+		}
+	}
+
+	return lines
+}
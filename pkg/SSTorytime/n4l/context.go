@@ -0,0 +1,255 @@
+//**************************************************************
+//
+// context.go - context expressions :: a, b.c ::
+//
+//**************************************************************
+
+package n4l
+
+import (
+	"regexp"
+	"strings"
+)
+
+//**************************************************************
+
+var (
+	OR_SEPARATORS = regexp.MustCompile("[|,]+")
+	AND_SEPARATORS = regexp.MustCompile("[&]+")
+	AND_DOTS = regexp.MustCompile("[.]+")
+)
+
+//**************************************************************
+
+func (p *parser) contextChange(token string, op byte, start int) {
+
+	expression := ExtractContextExpression(token)
+
+	switch op {
+	case '=':
+		p.state = ROLE_CONTEXT
+	case '+':
+		p.state = ROLE_CONTEXT_ADD
+	case '-':
+		p.state = ROLE_CONTEXT_SUBTRACT
+	}
+
+	p.checkSequenceMode(expression,op)
+
+	if len(expression) == 0 {
+		p.newBlock(op,"",start)
+		return
+	}
+
+	p.contextEval(expression,op,start)
+}
+
+//**************************************************************
+
+func (p *parser) checkSequenceMode(context string, op byte) {
+
+	if !strings.Contains(context,"_sequence_") {
+		return
+	}
+
+	switch op {
+	case '=','+':
+		p.sequence = true
+		p.seqstart = true
+		p.last = nil
+
+	case '-':
+		p.sequence = false
+		p.seqstart = false
+	}
+}
+
+//**************************************************************
+
+func (p *parser) contextEval(s string, op byte, start int) {
+
+	expr := CleanExpression(s)
+
+	or_parts := SplitWithParensIntact(expr,'|')
+
+	if strings.Contains(s,"(") {
+		p.error(start,WARN_INADVISABLE_CONTEXT_EXPRESSION,true)
+	}
+
+	switch op {
+
+	case '=':
+		p.context = make(map[string]bool)
+		p.modContext(or_parts,'+')
+	default:
+		p.modContext(or_parts,op)
+	}
+
+	p.checkSection(start)
+	p.newBlock(op,s,start)
+}
+
+//**************************************************************
+
+func (p *parser) modContext(list []string, op byte) {
+
+	for _,frag := range list {
+
+		frag = strings.TrimSpace(frag)
+
+		if len(frag) == 0 {
+			continue
+		}
+
+		switch op {
+		case '+':
+			p.context[frag] = true
+
+		case '-': // to remove, we also need to look at children
+			for cand := range p.context {
+				for _,part := range SplitWithParensIntact(cand,'.') {
+					if strings.Contains(part,frag) {
+						delete(p.context,cand)
+					}
+				}
+			}
+		}
+	}
+}
+
+//**************************************************************
+
+func ExtractContextExpression(token string) string {
+
+	var expression string
+
+	s := strings.Split(token, ":")
+
+	for i := 1; i < len(s); i++ {
+		if len(s[i]) > 1 {
+			expression = strings.TrimSpace(s[i])
+			break
+		}
+	}
+
+	return expression
+}
+
+//**************************************************************
+
+func CleanExpression(s string) string {
+
+	s = TrimParen(s)
+	s = OR_SEPARATORS.ReplaceAllString(s,"|")
+	s = AND_SEPARATORS.ReplaceAllString(s,".")
+	s = AND_DOTS.ReplaceAllString(s,".")
+
+	return s
+}
+
+//**************************************************************
+
+func SplitWithParensIntact(expr string,split_ch rune) []string {
+
+	var token string = ""
+	var set []string
+
+	runes := []rune(expr)
+
+	for c := 0; c < len(runes); c++ {
+
+		switch runes[c] {
+
+		case split_ch:
+			set = append(set,token)
+			token = ""
+
+		case '(':
+			subtoken,offset := Paren(runes,c)
+			if offset < 0 {
+				token += string(runes[c:])
+				c = len(runes)
+				continue
+			}
+			token += subtoken
+			c = offset-1
+
+		default:
+			token += string(runes[c])
+		}
+	}
+
+	if len(token) > 0 {
+		set = append(set,token)
+	}
+
+	return set
+}
+
+//**************************************************************
+
+func Paren(s []rune, offset int) (string,int) {
+
+	var level int = 0
+
+	for c := offset; c < len(s); c++ {
+
+		if s[c] == '(' {
+			level++
+			continue
+		}
+
+		if s[c] == ')' {
+			level--
+			if level == 0 {
+				token := s[offset:c+1]
+				return string(token), c+1
+			}
+		}
+	}
+
+	return "bad expression", -1
+}
+
+//**************************************************************
+
+func TrimParen(s string) string {
+
+	var level int = 0
+	var trim = true
+
+	if len(s) == 0 {
+		return s
+	}
+
+	s = strings.TrimSpace(s)
+
+	if s[0] != '(' {
+		return s
+	}
+
+	for c := 0; c < len(s); c++ {
+
+		if s[c] == '(' {
+			level++
+			continue
+		}
+
+		if level == 0 && c < len(s)-1 {
+			trim = false
+		}
+
+		if s[c] == ')' {
+			level--
+
+			if level == 0 && c == len(s)-1 {
+				if trim {
+					return s[1:len(s)-1]
+				}
+				return s
+			}
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,338 @@
+//**************************************************************
+//
+// lexer.go - splitting N4L text into tokens, as N4L always has
+//
+//**************************************************************
+
+package n4l
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//**************************************************************
+
+const (
+	ALPHATEXT = 'x' // read a plain text item
+	NON_ASCII_LQUOTE = '“'
+	NON_ASCII_RQUOTE = '”'
+	BOM = '\ufeff'
+)
+
+const (
+	TOKEN_TEXT = iota
+	TOKEN_QUOTED
+	TOKEN_DITTO
+)
+
+//**************************************************************
+
+func (p *parser) skipWhiteSpace(pos int) int {
+
+	src := p.src
+
+	for ; pos < len(src) && IsWhiteSpace(src[pos],src[pos]); pos++ {
+
+		if src[pos] == '\n' {
+			p.endLine(pos)
+			continue
+		}
+
+		if src[pos] == '#' || (src[pos] == '/' && p.at(pos+1) == '/') {
+
+			start := pos
+
+			for ; pos < len(src) && src[pos] != '\n'; pos++ {
+			}
+
+			p.file.Comments = append(p.file.Comments,&Comment{Pos: p.pos(start), Text: strings.TrimSpace(string(src[start:pos]))})
+			p.endLine(pos)
+		}
+	}
+
+	return pos
+}
+
+//**************************************************************
+
+func (p *parser) getToken(pos int) (string,int,int) {
+
+	// Handle concatenation of words/lines and separation of types,
+	// returning the token, its kind and the position after it
+
+	var token string
+
+	src := p.src
+	start := pos
+
+	switch src[pos] {
+
+	case '+','-': // could be +:: or -:: or -section
+
+		if p.at(pos+1) == ':' {
+			token,pos,_ = p.readToLast(pos,':')
+		} else {
+			token,pos,_ = p.readToLast(pos,ALPHATEXT)
+		}
+
+	case ':':
+		token,pos,_ = p.readToLast(pos,':')
+
+	case '(':
+		token,pos,_ = p.readToLast(pos,')')
+
+	case ')':
+		p.error(pos,ERR_STRAY_PAREN+" at "+p.near(pos),false)
+		return "",TOKEN_TEXT,pos+1
+
+	case '"','\'':
+
+		quote := src[pos]
+
+		if p.isBackReference(pos) {
+			return "\"",TOKEN_DITTO,pos+1
+		}
+
+		if quote == '"' && pos+2 < len(src) && IsWhiteSpace(src[pos+1],src[pos+2]) {
+			p.error(pos,ERR_ILLEGAL_QUOTED_STRING_OR_REF,false)
+			token,pos,_ = p.readToLast(pos+1,ALPHATEXT)
+			return token,TOKEN_TEXT,pos
+		}
+
+		raw,end,ok := p.readRaw(pos,quote)
+
+		if !ok {
+
+			// Quote the token as read, untrimmed, as N4L always has
+
+			p.error(start,fmt.Sprintf("%s starting at line %d (found token %s)",ERR_MISMATCH_QUOTE,p.pos(start).Line,raw),false)
+
+			// Carry on as if it were plain text
+
+			token,pos,_ = p.readToLast(start+1,ALPHATEXT)
+			return token,TOKEN_TEXT,pos
+		}
+
+		token,pos = strings.TrimSpace(raw),end
+		p.quote = quote
+		strip := strings.Split(token,string(quote))
+		return strip[1],TOKEN_QUOTED,pos
+
+	case '@':
+		token,pos,_ = p.readToLast(pos,' ')
+
+	default: // a text item that could end with any of the above
+		token,pos,_ = p.readToLast(pos,ALPHATEXT)
+	}
+
+	return token,TOKEN_TEXT,pos
+}
+
+//**************************************************************
+
+func (p *parser) readToLast(pos int, stop rune) (string,int,bool) {
+
+	raw,pos,ok := p.readRaw(pos,stop)
+
+	return strings.TrimSpace(raw),pos,ok
+}
+
+//**************************************************************
+
+func (p *parser) readRaw(pos int, stop rune) (string,int,bool) {
+
+	// Read until we find a terminator for this kind of token
+	// determined by "stop" signal - watch out for embedded quotes
+
+	var cpy []rune
+
+	src := p.src
+
+	for ; p.collect(pos,stop,cpy) && pos < len(src); pos++ {
+
+		cpy = append(cpy,src[pos])
+
+		// if there's an embedded " quote, treat quoted section as a single character
+
+		if pos+1 < len(src) && src[pos] == '"' {
+			for q := pos+1; q < len(src); q++ {
+				cpy = append(cpy,src[q])
+				if src[q] == '"' {
+					pos = q
+					break
+				}
+			}
+		}
+	}
+
+	ok := !IsQuote(stop) || (pos > 0 && src[pos-1] == stop)
+
+	return string(cpy),pos,ok
+}
+
+//**************************************************************
+
+func (p *parser) collect(pos int, stop rune, cpy []rune) bool {
+
+	// Generalize the stop-condition for for-loop accumulating runes
+	// when we receive the "stop" rune signal, that's the end by policy
+
+	src := p.src
+
+	// Quoted strings are tricky, especially when they start in the middle of another string
+
+	if IsQuote(stop) {
+
+		is_end := pos+1 >= len(src) || IsWhiteSpace(src[pos],src[pos+1])
+
+		return !(src[pos-1] == stop && is_end)
+	}
+
+	// nothing unquoted can exceed a line length
+
+	if pos >= len(src) || src[pos] == '\n' {
+		return false
+	}
+
+	// ordinary text strings are signalled by ALPHATEXT policy
+
+	if stop == ALPHATEXT {
+		return p.isGeneralString(pos)
+	}
+
+	// a ::: cluster is special, we don't care how many
+
+	if stop != ':' {
+		return !p.lastSpecialChar(pos,stop)
+	}
+
+	var groups int = 0
+
+	for r := 1; r < len(cpy)-1; r++ {
+
+		if cpy[r] != ':' && cpy[r-1] == ':' {
+			groups++
+		}
+
+		if cpy[r] != '"' && cpy[r-1] == '"' {
+			groups++
+		}
+	}
+
+	if groups > 1 {
+		return !p.lastSpecialChar(pos,stop)
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func (p *parser) isGeneralString(pos int) bool {
+
+	// Plain text should terminate like this, but
+	// beware of quotes inside
+
+	switch p.src[pos] {
+
+	case ')','(','#','\n':
+		return false
+
+	case '/':
+		if p.at(pos+1) == '/' {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func (p *parser) lastSpecialChar(pos int, stop rune) bool {
+
+	src := p.src
+
+	if src[pos] == '\n' {
+		if stop != '"' {
+			return true
+		}
+	}
+
+	if src[pos] == '@' {
+		return false
+	}
+
+	if pos > 0 && src[pos-1] == stop && src[pos] != stop {
+		return true
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (p *parser) isBackReference(pos int) bool {
+
+	// Any non-whitespace before \n or ( means it's not a back reference
+
+	src := p.src
+
+	for pos++; pos < len(src); pos++ {
+
+		if src[pos] == '(' || src[pos] == '\n' || src[pos] == '#' {
+			return true
+		}
+
+		if !unicode.IsSpace(src[pos]) {
+			return false
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (p *parser) at(pos int) rune {
+
+	if pos < 0 || pos >= len(p.src) {
+		return 0
+	}
+
+	return p.src[pos]
+}
+
+//**************************************************************
+
+func (p *parser) near(pos int) string {
+
+	before := max(pos-20,0)
+	after := min(pos+20,len(p.src))
+
+	return fmt.Sprintf("position %d near '...%s...'",pos,string(p.src[before:after]))
+}
+
+//**************************************************************
+
+func IsWhiteSpace(r,rn rune) bool {
+
+	// Comments count as white space. Between tokens, this is called
+	// with r twice, so (as N4L has always had it) a lone / is too
+
+	return unicode.IsSpace(r) || r == '#' || r == '/' && rn == '/'
+}
+
+//**************************************************************
+
+func IsQuote(r rune) bool {
+
+	switch r {
+	case '"','\'',NON_ASCII_LQUOTE,NON_ASCII_RQUOTE:
+		return true
+	}
+
+	return false
+}
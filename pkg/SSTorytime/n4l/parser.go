@@ -0,0 +1,753 @@
+//**************************************************************
+//
+// parser.go - the N4L grammar, from tokens to the AST
+//
+// Each call to Parse has its own parser, so files can be read
+// concurrently. Errors are collected in File.Errors rather than
+// stopping the parse, so that a file is read as far as possible
+//
+//**************************************************************
+
+package n4l
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//**************************************************************
+
+const (
+	ROLE_EVENT = 1
+	ROLE_RELATION = 2
+	ROLE_SECTION = 3
+	ROLE_CONTEXT = 4
+	ROLE_CONTEXT_ADD = 5
+	ROLE_CONTEXT_SUBTRACT = 6
+	ROLE_BLANK_LINE = 7
+	ROLE_LINE_ALIAS = 8
+	ROLE_LOOKUP = 9
+
+	WORD_MISTAKE_LEN = 2 // a string shorter than this is probably a mistake
+
+	SEQUENCE_RELN = "then"
+
+	WARN_NOTE_TO_SELF = "WARNING: Found a possible note to self in the text"
+	WARN_INADVISABLE_CONTEXT_EXPRESSION = "WARNING: Inadvisably complex/parenthetic context expression - simplify?"
+	WARN_CHAPTER_CLASS_MIXUP="WARNING: possible space between class cancellation -:: <class> :: ambiguous chapter name, in: "
+	ERR_CHAPTER_COMMA="You shouldn't use commas in the chapter title (ambiguous separator): "
+
+	ERR_MISSING_EVENT = "Missing item? Dangling section, relation, or context"
+	ERR_MISSING_SECTION = "Declarations outside a section or chapter"
+	ERR_NO_SUCH_ALIAS = "No such alias or \" reference exists to fill in - aborting"
+	ERR_MISSING_ITEM_SOMEWHERE = "Missing item, empty string, perhaps a missing ditto or variable reference"
+	ERR_MISSING_ITEM_RELN = "Missing item or double relation"
+	ERR_MISMATCH_QUOTE = "Apparent missing or mismatch in ', \" or ( )"
+	ERR_BAD_LABEL_OR_REF = "Badly formed label or reference (@label becomes $label.n) in "
+	ERR_ILLEGAL_QUOTED_STRING_OR_REF = "WARNING: Something wrong, bad quoted string or mistaken back reference. Double-quoted strings should not have a space after leading quote, as it can be confused with \" ditto symbol"
+	ERR_BAD_ALIAS_REFERENCE = "Alias references start from $name.1"
+	ERR_ARROW_SELFLOOP = "Arrow's origin points to itself"
+	ERR_NEGATIVE_WEIGHT = "Arrow relation has a negative weight, which is disallowed. Use a NOT relation if you want to signify inhibition: "
+	ERR_TOO_MANY_WEIGHTS = "More than one weight value in the arrow relation "
+	ERR_NO_SUCH_ARROW = "No such arrow has been declared in the configuration: "
+	ERR_STRAY_PAREN="Stray ) in an event/item - illegal character"
+	ERR_MISSING_LINE_LABEL_IN_REFERENCE="Missing a line label in reference, should be in the form $label.n"
+	ERR_SHORT_WORD="Short word, possible mistake or mistaken annotation (try spaces around symbol): "
+)
+
+//**************************************************************
+
+type Config struct {
+
+	Annotations map[string]string // marker -> arrow, from SSTconfig
+	Arrows func(name string) bool // if set, reject links with arrows it doesn't know
+}
+
+//**************************************************************
+
+type parser struct {
+
+	file    *File
+	config  Config
+	src     []rune
+	offsets []int // byte offset of each rune
+	starts  []int // rune index of each line start
+
+	chapter *Chapter
+	block   *Block
+	line    *Line
+	state   int
+
+	this     []*Item // items on this line so far
+	prev     []*Item // items on the last line that had any
+	pending  *Link   // a relation waiting for its item
+	alias    *Alias  // the alias for this line
+	aliases  map[string]*Alias
+	context  map[string]bool
+	sequence bool
+	seqstart bool
+	last     *Item // last item in a sequence
+	quote    rune
+
+	section_reported bool
+}
+
+//**************************************************************
+
+func Parse(name string, r io.Reader, config Config) (*File,error) {
+
+	data,err := io.ReadAll(r)
+
+	if err != nil {
+		return nil,err
+	}
+
+	p := newParser(name,data,config)
+	p.parse()
+
+	return p.file,nil
+}
+
+//**************************************************************
+
+func ParseFile(filename string, config Config) (*File,error) {
+
+	f,err := os.Open(filename)
+
+	if err != nil {
+		return nil,err
+	}
+
+	defer f.Close()
+
+	return Parse(filename,f,config)
+}
+
+//**************************************************************
+
+func newParser(name string, data []byte, config Config) *parser {
+
+	p := &parser{
+		file:    &File{Name: name},
+		config:  config,
+		starts:  []int{0},
+		aliases: make(map[string]*Alias),
+		context: map[string]bool{"any": true},
+		state:   ROLE_BLANK_LINE,
+	}
+
+	for i := 0; i < len(data); {
+
+		r,size := utf8.DecodeRune(data[i:])
+
+		// clean unicode nonsense
+
+		switch r {
+		case NON_ASCII_LQUOTE,NON_ASCII_RQUOTE:
+			r = '"'
+		}
+
+		p.offsets = append(p.offsets,i)
+		p.src = append(p.src,r)
+
+		if r == '\n' {
+			p.starts = append(p.starts,len(p.src))
+		}
+
+		i += size
+	}
+
+	p.offsets = append(p.offsets,len(data))
+
+	return p
+}
+
+//**************************************************************
+
+func (p *parser) parse() {
+
+	pos := 0
+
+	// Skip a unicode header, needed for text editors
+
+	if len(p.src) > 0 && p.src[0] == BOM {
+		pos++
+	}
+
+	for pos < len(p.src) {
+
+		pos = p.skipWhiteSpace(pos)
+
+		if pos >= len(p.src) {
+			break
+		}
+
+		start := pos
+		token,kind,next := p.getToken(pos)
+		pos = next
+
+		p.classify(token,kind,start,pos)
+	}
+
+	p.endLine(len(p.src))
+}
+
+//**************************************************************
+
+func (p *parser) classify(token string, kind int, start,end int) {
+
+	if len(token) == 0 {
+		return
+	}
+
+	switch kind {
+
+	case TOKEN_DITTO:
+		p.ditto(start,end)
+		return
+
+	case TOKEN_QUOTED:
+		item := p.newItem(token,start,end)
+		item.Quote = p.quote
+		p.addItem(item,true)
+		return
+	}
+
+	switch token[0] {
+
+	case ':':
+		p.contextChange(token,'=',start)
+
+	case '+':
+		p.contextChange(token,'+',start)
+
+	case '-':
+		if strings.HasSuffix(token,":") {
+			p.contextChange(token,'-',start)
+		} else if p.chapter == nil || p.chapter.Name == "" {
+			p.state = ROLE_SECTION
+			section := strings.TrimSpace(token[1:])
+			if section != "" {
+				p.checkChapter(section,start)
+				p.newChapter(section,start)
+			}
+		} else {
+			// The line starts with a -, but it's not a new chapter
+			p.addItem(p.newItem(token,start,end),true)
+		}
+
+	case '(':
+		if p.state == ROLE_RELATION {
+			p.error(start,ERR_MISSING_ITEM_RELN,false)
+		}
+		p.pending = p.relation(token,start,end)
+		p.state = ROLE_RELATION
+
+	case '@':
+		p.lineAlias(strings.TrimSpace(token),start)
+
+	case '$':
+		actual := p.reference(token,start)
+		item := p.newItem(actual,start,end)
+		if actual != token {
+			item.Ref = token
+		}
+		p.addItem(item,false)
+		p.state = ROLE_LOOKUP
+
+	default:
+		p.addItem(p.newItem(token,start,end),true)
+	}
+}
+
+//**************************************************************
+
+func (p *parser) addItem(item *Item, store bool) {
+
+	p.this = append(p.this,item)
+
+	if !p.assess(item) {
+		p.this = p.this[:len(p.this)-1]
+		p.state = ROLE_EVENT
+		return
+	}
+
+	if item.Text != item.Raw {
+		item.Annotations = p.annotations(item.Raw,p.index(item.Pos))
+	}
+
+	if store && p.alias != nil {
+		p.alias.Items = append(p.alias.Items,item)
+	}
+
+	p.state = ROLE_EVENT
+}
+
+//**************************************************************
+
+func (p *parser) assess(item *Item) bool {
+
+	// Decide what an item means from what came before it,
+	// and whether it belongs on the line
+
+	start := p.index(item.Pos)
+
+	switch p.state {
+
+	case ROLE_RELATION:
+
+		line := p.currentLine(start)
+		line.Items = append(line.Items,item)
+
+		if len(p.this) < 2 {
+			p.error(start,ERR_MISSING_ITEM_SOMEWHERE,false)
+			return true
+		}
+
+		link := p.pending
+		link.From = p.this[len(p.this)-2]
+		link.To = item
+
+		if link.From.Raw == item.Raw {
+			p.error(start,ERR_ARROW_SELFLOOP,false)
+		}
+
+		line.Links = append(line.Links,link)
+		p.pending = nil
+		p.checkSection(start)
+
+	case ROLE_CONTEXT:
+		p.contextEval(item.Raw,'=',start)
+		return false
+
+	case ROLE_CONTEXT_ADD:
+		p.contextEval(item.Raw,'+',start)
+		return false
+
+	case ROLE_CONTEXT_SUBTRACT:
+		p.contextEval(item.Raw,'-',start)
+		return false
+
+	case ROLE_SECTION:
+		p.checkChapter(item.Raw,start)
+
+		if p.chapter != nil && p.chapter.Name != "" {
+			p.chapter.Name = item.Raw
+		} else {
+			p.newChapter(item.Raw,start)
+		}
+		return false
+
+	default:
+		p.checkSection(start)
+
+		if p.noteToSelf(item.Raw) {
+			p.error(start,WARN_NOTE_TO_SELF+" ("+item.Raw+")",true)
+		}
+
+		line := p.currentLine(start)
+		line.Items = append(line.Items,item)
+
+		p.linkUpStorySequence(item)
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func (p *parser) ditto(start,end int) {
+
+	prev := p.lookupAlias(p.prev,"\"",len(p.this)+1,start)
+
+	item := p.newItem(prev,start,end)
+	item.Ref = "\""
+
+	p.addItem(item,true)
+}
+
+//**************************************************************
+
+func (p *parser) reference(token string, start int) string {
+
+	// split $alias.n into (alias string,n int)
+
+	if !strings.Contains(token,".") {
+		// just a dollar amount
+		return token
+	}
+
+	var contig string
+	fmt.Sscanf(token,"%s",&contig)
+
+	if len(contig) == 1 || contig == "$$" {
+		return token
+	}
+
+	split := strings.Split(token[1:],".")
+
+	if len(split) < 2 {
+		p.error(start,ERR_MISSING_LINE_LABEL_IN_REFERENCE,false)
+		return token
+	}
+
+	name := strings.TrimSpace(split[0])
+
+	var number int = 0
+	fmt.Sscanf(split[1],"%d",&number)
+
+	if number < 1 {
+		p.error(start,ERR_BAD_ALIAS_REFERENCE,false)
+		return token
+	}
+
+	var items []*Item
+
+	switch name {
+	case "PREV":
+		items = p.prev
+	case "THIS":
+		items = p.this
+	default:
+		if alias,ok := p.aliases[name]; ok {
+			items = alias.Items
+		}
+	}
+
+	return p.lookupAlias(items,token,number,start)
+}
+
+//**************************************************************
+
+func (p *parser) lookupAlias(items []*Item, ref string, counter int, start int) string {
+
+	if counter > len(items) {
+		p.error(start,ERR_NO_SUCH_ALIAS,false)
+		return ref
+	}
+
+	return items[counter-1].Raw
+}
+
+//**************************************************************
+
+func (p *parser) lineAlias(token string, start int) {
+
+	var contig string
+	fmt.Sscanf(token,"%s",&contig)
+
+	p.state = ROLE_LINE_ALIAS
+
+	if len(contig) == 1 {
+		p.error(start,ERR_BAD_LABEL_OR_REF+token,false)
+		return
+	}
+
+	name := token[1:]
+
+	alias,ok := p.aliases[name]
+
+	if !ok {
+		alias = &Alias{Pos: p.pos(start), Name: name}
+		p.aliases[name] = alias
+		p.file.Aliases = append(p.file.Aliases,alias)
+	}
+
+	p.alias = alias
+	p.currentLine(start).Alias = name
+}
+
+//**************************************************************
+
+func (p *parser) relation(token string, start,end int) *Link {
+
+	// (arrow) or (arrow, weight, context...)
+
+	var weightcount int
+
+	link := &Link{Pos: p.pos(start), End: p.pos(end), Weight: 1}
+
+	name := token[1:]
+
+	if strings.HasSuffix(name,")") {
+		name = name[:len(name)-1]
+	} else {
+		p.error(start,ERR_MISMATCH_QUOTE+" in "+token,false)
+	}
+
+	reln := strings.Split(name,",")
+	name = strings.TrimSpace(reln[0])
+
+	// look at any comma separated notes after the arrow name
+
+	for _,note := range reln[1:] {
+
+		note = strings.TrimSpace(note)
+
+		v,err := strconv.ParseFloat(note,32)
+
+		if err != nil {
+			link.Context = append(link.Context,note)
+			continue
+		}
+
+		if v < 0 {
+			p.error(start,ERR_NEGATIVE_WEIGHT+token,false)
+		}
+
+		if weightcount >= 1 {
+			p.error(start,ERR_TOO_MANY_WEIGHTS+token,false)
+		}
+
+		link.Weight = float32(v)
+		weightcount++
+	}
+
+	if p.config.Arrows != nil && !p.config.Arrows(name) {
+		p.error(start,ERR_NO_SUCH_ARROW+"("+name+")",false)
+	}
+
+	link.Arrow = name
+	return link
+}
+
+//**************************************************************
+
+func (p *parser) linkUpStorySequence(item *Item) {
+
+	// Join together a sequence of items using default "(then)",
+	// from the first item of one line to the first of the next
+
+	if !p.sequence || (p.last != nil && item.Raw == p.last.Raw) {
+		return
+	}
+
+	if len(p.this) == 1 && p.last != nil {
+
+		link := &Link{
+			Pos:      item.Pos,
+			End:      item.Pos,
+			From:     p.last,
+			To:       item,
+			Arrow:    SEQUENCE_RELN,
+			Weight:   1,
+			Sequence: true,
+			Start:    p.seqstart,
+		}
+
+		p.seqstart = false
+		p.line.Links = append(p.line.Links,link)
+	}
+
+	p.last = item
+}
+
+//**************************************************************
+
+func (p *parser) checkChapter(name string, start int) {
+
+	if name[0] == ':' {
+		p.error(start,WARN_CHAPTER_CLASS_MIXUP+name,false)
+	}
+
+	if strings.Contains(name,",") {
+		p.error(start,ERR_CHAPTER_COMMA+name,false)
+	}
+
+	p.sequence = false
+	p.seqstart = false
+}
+
+//**************************************************************
+
+func (p *parser) checkSection(start int) {
+
+	if p.chapter != nil && p.chapter.Name != "" {
+		return
+	}
+
+	if !p.section_reported {
+		p.error(start,ERR_MISSING_SECTION,false)
+		p.section_reported = true
+	}
+}
+
+//**************************************************************
+
+func (p *parser) noteToSelf(s string) bool {
+
+	if len(s) <= 2 * WORD_MISTAKE_LEN {
+		return false
+	}
+
+	const intentionality_threshold = 50
+
+	if (len(s) > intentionality_threshold) && s[len(s)-1] == '.' {
+		return false
+	}
+
+	for _, r := range s {
+
+		if !unicode.IsUpper(r) && (unicode.IsLetter(r) || unicode.IsNumber(r)) {
+			return false
+		}
+	}
+
+	// Don't repeat the same message for multi-line dittos
+
+	if len(p.this) > 0 && len(p.prev) > 0 {
+		if p.this[0].Raw == p.prev[0].Raw {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func (p *parser) endLine(pos int) {
+
+	// At each newline, check the line was complete and keep
+	// its items for dittos on the next line
+
+	if p.dangler() {
+		p.error(pos,ERR_MISSING_EVENT,true)
+	}
+
+	if p.line != nil {
+		p.line.End = p.pos(pos)
+	}
+
+	if p.state != ROLE_BLANK_LINE && p.this != nil {
+		p.prev = p.this
+	}
+
+	p.this = nil
+	p.pending = nil
+	p.alias = nil
+	p.line = nil
+	p.state = ROLE_BLANK_LINE
+}
+
+//**************************************************************
+
+func (p *parser) dangler() bool {
+
+	switch p.state {
+
+	case ROLE_RELATION,ROLE_LINE_ALIAS:
+		return true
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (p *parser) newChapter(name string, start int) {
+
+	p.chapter = &Chapter{Pos: p.pos(start), Name: name}
+	p.file.Chapters = append(p.file.Chapters,p.chapter)
+	p.newBlock(0,"",start)
+}
+
+//**************************************************************
+
+func (p *parser) newBlock(op byte, expression string, start int) {
+
+	var context []string
+
+	for c := range p.context {
+		context = append(context,c)
+	}
+
+	sort.Strings(context)
+
+	block := &Block{
+		Pos:        p.pos(start),
+		Op:         op,
+		Expression: expression,
+		Context:    context,
+		Sequence:   p.sequence,
+	}
+
+	// Contexts set before the chapter are carried into its first block
+
+	if p.chapter == nil {
+		p.file.Contexts = append(p.file.Contexts,block)
+		return
+	}
+
+	p.block = block
+	p.chapter.Blocks = append(p.chapter.Blocks,p.block)
+	p.line = nil
+}
+
+//**************************************************************
+
+func (p *parser) currentLine(start int) *Line {
+
+	if p.line != nil {
+		return p.line
+	}
+
+	if p.chapter == nil {
+		p.newChapter("",start)
+	}
+
+	p.line = &Line{Pos: p.pos(start)}
+	p.block.Lines = append(p.block.Lines,p.line)
+
+	return p.line
+}
+
+//**************************************************************
+
+func (p *parser) newItem(raw string, start,end int) *Item {
+
+	item := &Item{
+		Pos: p.pos(start),
+		End: p.pos(end),
+		Raw: raw,
+	}
+
+	item.Text = p.stripAnnotations(raw)
+
+	return item
+}
+
+//**************************************************************
+
+func (p *parser) pos(i int) Pos {
+
+	if i > len(p.src) {
+		i = len(p.src)
+	}
+
+	line := sort.Search(len(p.starts),func(k int) bool { return p.starts[k] > i })
+
+	return Pos{Offset: p.offsets[i], Line: line, Col: i-p.starts[line-1]+1}
+}
+
+//**************************************************************
+
+func (p *parser) index(pos Pos) int {
+
+	// The rune index of a position we made
+
+	return p.starts[pos.Line-1]+pos.Col-1
+}
+
+//**************************************************************
+
+func (p *parser) error(pos int, msg string, warning bool) {
+
+	p.file.Errors = append(p.file.Errors,&Error{Pos: p.pos(pos), Msg: msg, Warning: warning})
+}
@@ -0,0 +1,128 @@
+//**************************************************************
+//
+// parser_test.go - the tests/*.in fixtures parsed from many
+// goroutines at once must fail or pass as their names say, with
+// the same errors as a single threaded run. Run with go test
+// -race to check that parsers share no state
+//
+//**************************************************************
+
+package n4l_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	SST "SSTorytime"
+	"SSTorytime/n4l"
+)
+
+//**************************************************************
+
+const (
+	TEST_WORKERS = 8
+	TEST_ROUNDS = 5
+)
+
+//**************************************************************
+
+func TestConcurrentParse(t *testing.T) {
+
+	config := FixtureConfig(t)
+
+	fixtures,_ := filepath.Glob("../../../tests/*_*.in")
+
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures found in tests/")
+	}
+
+	expected := make(map[string]string)
+
+	for _,f := range fixtures {
+
+		failed,errors := ParseFixture(f,config)
+
+		if want := strings.HasPrefix(filepath.Base(f),"fail_"); failed != want {
+			t.Errorf("%s: failed %v, expected %v\n%s",filepath.Base(f),failed,want,errors)
+		}
+
+		expected[f] = errors
+	}
+
+	var wg sync.WaitGroup
+	var failures = make(chan string,TEST_WORKERS*TEST_ROUNDS*len(fixtures))
+
+	for w := 0; w < TEST_WORKERS; w++ {
+
+		wg.Add(1)
+
+		go func(w int) {
+
+			defer wg.Done()
+
+			for r := 0; r < TEST_ROUNDS; r++ {
+
+				// Each worker starts at a different fixture
+
+				for i := range fixtures {
+
+					f := fixtures[(i+w)%len(fixtures)]
+
+					if _,got := ParseFixture(f,config); got != expected[f] {
+						failures <- fmt.Sprintf("worker %d round %d %s:\n got %s\n expected %s",w,r,filepath.Base(f),got,expected[f])
+					}
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(failures)
+
+	for f := range failures {
+		t.Error(f)
+	}
+}
+
+//**************************************************************
+
+func FixtureConfig(t *testing.T) n4l.Config {
+
+	// The arrows and annotations from the repository's SSTconfig, as N4L
+
+	t.Helper()
+
+	t.Setenv("SST_CONFIG_PATH","../../../SSTconfig")
+
+	SST.ReadArrowConfig()
+
+	known := func(name string) bool {
+		_,short := SST.ARROW_SHORT_DIR[name]
+		_,long := SST.ARROW_LONG_DIR[name]
+		return short || long
+	}
+
+	return n4l.Config{Annotations: SST.ReadAnnotationConfig(), Arrows: known}
+}
+
+//**************************************************************
+
+func ParseFixture(filename string, config n4l.Config) (bool,string) {
+
+	file,err := n4l.ParseFile(filename,config)
+
+	if err != nil {
+		return true,err.Error()
+	}
+
+	var errors []string
+
+	for _,e := range file.Errors {
+		errors = append(errors,e.Error())
+	}
+
+	return file.Failed(),strings.Join(errors,"\n")
+}
@@ -0,0 +1,762 @@
+//**************************************************************
+//
+// Reconstruct N4L notes for a chapter from the database
+//
+// Where N4L uploaded the chapter, the PageMap remembers each line
+// of the notes: its alias, its context and the links it made, in
+// order. Those lines are written back first, with _sequence_ mode
+// wherever consecutive lines are joined by (then). Any link not
+// accounted for (added through the API, or by annotations) is
+// listed afterwards, node by node, under its own context.
+// Annotations are written back as markers in their items
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"SSTorytime/n4l"
+)
+
+//**************************************************************
+
+type n4lLinkKey struct {
+
+	From NodePtr
+	Arr  ArrowPtr
+	To   NodePtr
+}
+
+//**************************************************************
+
+type n4lLine struct {
+
+	Alias   string
+	Context []string
+	Line    int
+	Text    string
+	First   NodePtr
+	Last    NodePtr
+}
+
+//**************************************************************
+
+type n4lWriter struct {
+
+	sst      PoSST
+	out      strings.Builder
+	nodes    map[NodePtr]Node
+	texts    map[NodePtr]string
+	written  map[NodePtr]bool
+	covered  map[n4lLinkKey]bool
+	marks    map[ArrowPtr]string // annotation markers, by arrow
+	config   n4l.Config          // to read an annotated item back
+	context  []string
+	sequence bool
+}
+
+//**************************************************************
+
+func ChapterToN4L(sst PoSST,chapter string,limit int) string {
+
+	w := n4lWriter{
+		sst:     sst,
+		nodes:   make(map[NodePtr]Node),
+		texts:   make(map[NodePtr]string),
+		written: make(map[NodePtr]bool),
+		covered: make(map[n4lLinkKey]bool),
+		context: []string{"any"},  // as N4L starts every file
+	}
+
+	w.out.WriteString(fmt.Sprintf("- %s\n",chapter))
+
+	// Nodes as stored, whether or not they were given a context
+
+	nodes := GetDBChapterNodes(sst,[]string{chapter})
+
+	sort.Slice(nodes,func(i,j int) bool { return NodePtrLess(nodes[i].NPtr,nodes[j].NPtr) })
+
+	if len(nodes) > limit {
+		nodes = nodes[:limit]
+	}
+
+	var nptrs []NodePtr
+
+	for _,node := range nodes {
+		w.nodes[node.NPtr] = node
+		w.texts[node.NPtr] = node.S
+		nptrs = append(nptrs,node.NPtr)
+	}
+
+	// Markers go back into the items before they are written
+
+	w.annotationMarks()
+	w.annotate(nptrs)
+
+	// The lines N4L remembered, in the order they were written
+
+	var lines []n4lLine
+
+	for _,page := range GetDBChapterPageMap(sst,[]string{chapter}) {
+		if line,ok := w.pageLine(page); ok {
+			lines = append(lines,line)
+		}
+	}
+
+	// (then) joins the first item of one line to the first of the next
+
+	joined := make([]bool,len(lines)+1)
+
+	if then,ok := LookupArrowShort("then"); ok {
+		for j := 1; j < len(lines); j++ {
+			key := n4lLinkKey{From: lines[j-1].First, Arr: then, To: lines[j].First}
+
+			// unless the lines say so themselves
+
+			if key.From != key.To && !w.covered[key] && w.holds(key.From,Link{Arr: then, Dst: key.To}) {
+				joined[j] = true
+				w.covered[key] = true
+			}
+		}
+	}
+
+	for j,line := range lines {
+
+		switch {
+		case joined[j] || (w.sequence && line.First == lines[j-1].First):
+			w.setContext(line.Context,false,false)
+		case joined[j+1]:
+			w.setContext(line.Context,true,false)
+		default:
+			w.setContext(line.Context,false,w.sequence)
+		}
+
+		if j == 0 || line.Line-lines[j-1].Line > 1 {
+			w.paragraph()
+		}
+
+		if line.Alias != "" {
+			w.out.WriteString("@"+line.Alias+" ")
+		}
+
+		w.out.WriteString(line.Text+"\n")
+	}
+
+	if w.sequence {
+		w.setContext(w.context,false,true)
+	}
+
+	// Whatever the lines don't account for, node by node
+
+	w.remainder(nptrs)
+
+	var single []string
+
+	for _,nptr := range nptrs {
+		if !w.written[nptr] {
+			single = append(single,N4LItem(w.text(nptr)))
+		}
+	}
+
+	if len(single) > 0 {
+		w.paragraph()
+		w.out.WriteString(strings.Join(single,"\n")+"\n")
+	}
+
+	return strings.TrimRight(w.out.String(),"\n")+"\n"
+}
+
+//**************************************************************
+
+func (w *n4lWriter) pageLine(page PageMap) (n4lLine,bool) {
+
+	// The path only records where each link goes. Links made by
+	// annotations are in it too, so follow the longest chain of
+	// links from the first item, leaving the others for the node
+	// by node listing
+
+	var line n4lLine
+
+	if len(page.Path) == 0 {
+		return line,false
+	}
+
+	ctx,_ := GetDBContextByPtr(w.sst,page.Context)
+
+	line.Alias = page.Alias
+	line.Context = ContextTerms(ctx)
+	line.Line = page.Line
+	line.First = page.Path[0].Dst
+	line.Last = line.First
+
+	path := page.Path
+	extra := make([][]string,len(path))
+	usable := make([]bool,len(path))
+
+	for i := 1; i < len(path); i++ {
+		lctx,_ := GetDBContextByPtr(w.sst,path[i].Ctx)
+		extra[i],usable[i] = ContextExtra(line.Context,ContextTerms(lctx))
+	}
+
+	type step struct {
+		i    int
+		last NodePtr
+	}
+
+	memo := make(map[step]int)
+
+	var longest func(i int,last NodePtr) int
+
+	longest = func(i int,last NodePtr) int {
+
+		if i == len(path) {
+			return 0
+		}
+
+		if n,ok := memo[step{i,last}]; ok {
+			return n
+		}
+
+		n := longest(i+1,last)
+
+		if usable[i] && path[i].Dst != last && w.follows(last,path[i]) {
+			n = max(n,1+longest(i+1,path[i].Dst))
+		}
+
+		memo[step{i,last}] = n
+		return n
+	}
+
+	text := []string{N4LItem(w.text(line.First))}
+	w.written[line.First] = true
+
+	for i := 1; i < len(path); i++ {
+
+		lnk := path[i]
+
+		if !usable[i] || lnk.Dst == line.Last || !w.follows(line.Last,lnk) {
+			continue
+		}
+
+		if 1+longest(i+1,lnk.Dst) < longest(i+1,line.Last) {
+			continue
+		}
+
+		text = append(text,N4LArrow(w.sst,lnk.Arr,lnk.Wgt,extra[i]),N4LItem(w.text(lnk.Dst)))
+
+		key,_ := w.forward(line.Last,lnk)
+		w.covered[key] = true
+
+		w.written[lnk.Dst] = true
+		line.Last = lnk.Dst
+	}
+
+	line.Text = strings.Join(text," ")
+	return line,true
+}
+
+//**************************************************************
+
+func (w *n4lWriter) holds(nptr NodePtr,lnk Link) bool {
+
+	// There is only one link for each arrow between two nodes,
+	// as contexts are merged
+
+	for _,l := range w.node(nptr).I[GetDBArrowByPtr(w.sst,lnk.Arr).STAindex] {
+		if l.Arr == lnk.Arr && l.Dst == lnk.Dst {
+			return true
+		}
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func (w *n4lWriter) follows(nptr NodePtr,lnk Link) bool {
+
+	// A link an annotation makes is left to the marker
+
+	key,_ := w.forward(nptr,lnk)
+
+	return w.holds(nptr,lnk) && !w.covered[key]
+}
+
+//**************************************************************
+
+func (w *n4lWriter) remainder(nptrs []NodePtr) {
+
+	// Each link is stored at both ends. Closures can add "any" to
+	// one half, so keep only the contexts the halves agree on
+
+	found := make(map[n4lLinkKey][]string)
+	weight := make(map[n4lLinkKey]float32)
+
+	for _,nptr := range nptrs {
+
+		node := w.node(nptr)
+
+		for st := 0; st < ST_TOP; st++ {
+			for _,lnk := range node.I[st] {
+
+				// Arrow 0 only records context membership, and links
+				// without weight or context were completed by N4L from
+				// the closures in SSTconfig, as they will be again
+
+				if lnk.Arr == 0 || (lnk.Wgt == 0 && lnk.Ctx == 0) {
+					continue
+				}
+
+				key,wgt := w.forward(nptr,lnk)
+
+				if w.covered[key] {
+					continue
+				}
+
+				ctx,_ := GetDBContextByPtr(w.sst,lnk.Ctx)
+				terms := ContextTerms(ctx)
+
+				if half,ok := found[key]; ok {
+					terms = ContextCommon(half,terms)
+				}
+
+				found[key] = terms
+				weight[key] = wgt
+			}
+		}
+	}
+
+	bycontext := make(map[string][]n4lLinkKey)
+
+	for key,terms := range found {
+		ctx := strings.Join(terms,",")
+		bycontext[ctx] = append(bycontext[ctx],key)
+	}
+
+	var contexts []string
+
+	for ctx := range bycontext {
+		contexts = append(contexts,ctx)
+	}
+
+	sort.Strings(contexts)
+
+	for _,ctx := range contexts {
+
+		keys := bycontext[ctx]
+
+		sort.Slice(keys,func(i,j int) bool {
+			if keys[i].From != keys[j].From {
+				return NodePtrLess(keys[i].From,keys[j].From)
+			}
+			if keys[i].Arr != keys[j].Arr {
+				return keys[i].Arr < keys[j].Arr
+			}
+			return NodePtrLess(keys[i].To,keys[j].To)
+		})
+
+		w.setContext(ContextTerms(ctx),false,false)
+		w.paragraph()
+
+		for k,key := range keys {
+
+			from := N4LItem(w.text(key.From))
+
+			if k > 0 && keys[k-1].From == key.From {
+				from = "\""
+			}
+
+			w.out.WriteString(fmt.Sprintf("%s %s %s\n",from,N4LArrow(w.sst,key.Arr,weight[key],nil),N4LItem(w.text(key.To))))
+
+			w.written[key.From] = true
+			w.written[key.To] = true
+		}
+	}
+}
+
+//**************************************************************
+
+func (w *n4lWriter) annotationMarks() {
+
+	w.marks = make(map[ArrowPtr]string)
+	w.config = n4l.Config{Annotations: ReadAnnotationConfig()}
+
+	for mark,name := range w.config.Annotations {
+
+		ptr,ok := LookupArrowShort(name)
+
+		if !ok {
+			ptr,ok = LookupArrowLong(name)
+		}
+
+		if ok {
+			w.marks[ptr] = mark
+		}
+	}
+}
+
+//**************************************************************
+
+func (w *n4lWriter) annotate(nptrs []NodePtr) {
+
+	// N4L stores an item without its markers, and links it to each
+	// marked word. Put a marker back before its word wherever N4L
+	// would read the same text and links from the item, otherwise
+	// the link is listed with the rest. A link from an item to
+	// itself, as %CNCF in the item CNCF makes, can only be marked.
+	// The words are looked up without their own markers
+
+	annotated := make(map[NodePtr]string)
+
+	for _,nptr := range nptrs {
+
+		node := w.node(nptr)
+		text := w.text(nptr)
+
+		var marked []n4lLinkKey
+		var words []string
+
+		for st := 0; st < ST_TOP; st++ {
+			for _,lnk := range node.I[st] {
+
+				key,wgt := w.forward(nptr,lnk)
+				mark,ok := w.marks[key.Arr]
+
+				if !ok || key.From != nptr || wgt != 1 || w.covered[key] {
+					continue
+				}
+
+				want := append(slices.Clone(words),mark+" "+w.text(key.To))
+
+				if annotated,ok := w.mark(node.S,text,mark,w.text(key.To),want); ok {
+					text = annotated
+					words = want
+					marked = append(marked,key)
+					w.covered[key] = true
+				}
+			}
+		}
+
+		annotated[nptr] = text
+
+		for _,key := range marked {
+			w.written[key.To] = true
+		}
+	}
+
+	for nptr,text := range annotated {
+		w.texts[nptr] = text
+	}
+}
+
+//**************************************************************
+
+func (w *n4lWriter) mark(stored,text,mark,word string,want []string) (string,bool) {
+
+	// Try the marker before each place the word appears, or before
+	// the quote around it
+
+	for i := 0; i < len(text); i++ {
+
+		if !strings.HasPrefix(text[i:],word) {
+			continue
+		}
+
+		at := []int{i}
+
+		if i > 0 && (text[i-1] == '"' || text[i-1] == '\'') {
+			at = []int{i-1,i}
+		}
+
+		for _,pos := range at {
+
+			annotated := text[:pos]+mark+text[pos:]
+
+			if w.readsAs(annotated,stored,want) {
+				return annotated,true
+			}
+		}
+	}
+
+	return text,false
+}
+
+//**************************************************************
+
+func (w *n4lWriter) readsAs(text,stored string,want []string) bool {
+
+	// Would N4L read the item back as the stored text, annotated
+	// with exactly these marked words?
+
+	file,err := n4l.Parse("annotation",strings.NewReader("- annotation\n\n"+N4LItem(text)+"\n"),w.config)
+
+	if err != nil || file.Failed() || len(file.Lines()) != 1 || len(file.Lines()[0].Items) != 1 {
+		return false
+	}
+
+	item := file.Lines()[0].Items[0]
+
+	var got []string
+
+	for _,a := range item.Annotations {
+		got = append(got,a.Mark+" "+a.Word)
+	}
+
+	slices.Sort(got)
+	want = slices.Sorted(slices.Values(want))
+
+	return item.Text == stored && slices.Equal(got,want)
+}
+
+//**************************************************************
+
+func (w *n4lWriter) setContext(context []string,sequence,stop bool) {
+
+	// Change to the context of the next line, starting or ending
+	// _sequence_ mode, and adding to what is there where possible.
+	// An empty :: :: keeps what was there, so an empty context has
+	// to be taken away term by term
+
+	var change []string
+
+	if stop {
+		change = append(change," -:: _sequence_ ::")
+		w.sequence = false
+	}
+
+	added,whole := ContextExtra(w.context,context)
+
+	switch {
+	case sequence && whole:
+		change = append(change," +:: "+strings.Join(append([]string{"_sequence_"},added...),", ")+" ::")
+
+	case sequence && len(context) > 0:
+		change = append(change," :: "+strings.Join(append([]string{"_sequence_"},context...),", ")+" ::")
+
+	case sequence:
+		change = append(change," -:: "+strings.Join(w.context,", ")+" ::"," +:: _sequence_ ::")
+
+	case whole && len(added) == 0:
+
+	case whole:
+		change = append(change," +:: "+strings.Join(added,", ")+" ::")
+
+	case len(context) > 0:
+		change = append(change," :: "+strings.Join(context,", ")+" ::")
+
+	default:
+		change = append(change," -:: "+strings.Join(w.context,", ")+" ::")
+	}
+
+	if sequence {
+		w.sequence = true
+	}
+
+	w.context = context
+
+	if len(change) > 0 {
+		w.out.WriteString("\n"+strings.Join(change,"\n")+"\n\n")
+	}
+}
+
+//**************************************************************
+
+func (w *n4lWriter) paragraph() {
+
+	if !strings.HasSuffix(w.out.String(),"\n\n") {
+		w.out.WriteString("\n")
+	}
+}
+
+//**************************************************************
+
+func (w *n4lWriter) node(nptr NodePtr) Node {
+
+	node,ok := w.nodes[nptr]
+
+	if !ok {
+		node = GetDBNodeByNodePtr(w.sst,nptr)
+		w.nodes[nptr] = node
+	}
+
+	return node
+}
+
+//**************************************************************
+
+func (w *n4lWriter) text(nptr NodePtr) string {
+
+	// Dynamic functions are written as they are, not as they were last evaluated
+
+	text,ok := w.texts[nptr]
+
+	if !ok {
+		text = GetDBNodeTextByNodePtr(w.sst,nptr)
+		w.texts[nptr] = text
+	}
+
+	return text
+}
+
+//**************************************************************
+
+func (w *n4lWriter) forward(from NodePtr,lnk Link) (n4lLinkKey,float32) {
+
+	// Turn inverse links around, and give NEAR links one order
+
+	key := n4lLinkKey{From: from, Arr: lnk.Arr, To: lnk.Dst}
+	sttype := STIndexToSTType(GetDBArrowByPtr(w.sst,lnk.Arr).STAindex)
+
+	if sttype < 0 {
+		key = n4lLinkKey{From: lnk.Dst, Arr: InverseArrow(lnk.Arr), To: from}
+	}
+
+	if sttype == NEAR && NodePtrLess(key.To,key.From) {
+		key.From,key.To = key.To,key.From
+	}
+
+	return key,lnk.Wgt
+}
+
+//**************************************************************
+
+func ContextTerms(ctx string) []string {
+
+	// The terms of a stored context string, sorted
+
+	var terms []string
+	seen := make(map[string]bool)
+
+	for _,c := range strings.Split(ctx,",") {
+
+		c = strings.TrimSpace(c)
+
+		if c != "" && !seen[c] {
+			terms = append(terms,c)
+			seen[c] = true
+		}
+	}
+
+	sort.Strings(terms)
+	return terms
+}
+
+//**************************************************************
+
+func ContextExtra(context,link []string) ([]string,bool) {
+
+	// The terms a link has beyond the context it was written in,
+	// or false if it is missing some of them
+
+	have := make(map[string]bool)
+
+	for _,c := range link {
+		have[c] = true
+	}
+
+	for _,c := range context {
+		if !have[c] {
+			return nil,false
+		}
+		delete(have,c)
+	}
+
+	var extra []string
+
+	for _,c := range link {
+		if have[c] {
+			extra = append(extra,c)
+		}
+	}
+
+	return extra,true
+}
+
+//**************************************************************
+
+func ContextCommon(a,b []string) []string {
+
+	var common []string
+
+	have := make(map[string]bool)
+
+	for _,c := range b {
+		have[c] = true
+	}
+
+	for _,c := range a {
+		if have[c] {
+			common = append(common,c)
+		}
+	}
+
+	return common
+}
+
+//**************************************************************
+
+func N4LItem(s string) string {
+
+	// Plain text can stand as it is, anything else is quoted
+
+	if N4LPlainText(s) {
+		return s
+	}
+
+	return N4LQuote(s)
+}
+
+//**************************************************************
+
+func N4LPlainText(s string) bool {
+
+	// Would N4L read this back as one item without quotes? Pairs
+	// of double quotes inside the text protect what they enclose
+
+	runes := []rune(s)
+
+	if s == "" || s != strings.TrimSpace(s) || strings.ContainsRune("+-:()@$\"'#/\u201c\u201d",runes[0]) {
+		return false
+	}
+
+	var quoted bool
+
+	for r := range runes {
+
+		switch {
+		case runes[r] == '"':
+			quoted = !quoted
+
+		case quoted:
+
+		case strings.ContainsRune("()#\n",runes[r]):
+			return false
+
+		case runes[r] == '/' && r+1 < len(runes) && runes[r+1] == '/':
+			return false
+		}
+	}
+
+	return !quoted
+}
+
+//**************************************************************
+
+func N4LArrow(sst PoSST,arr ArrowPtr,wgt float32,context []string) string {
+
+	parts := []string{GetDBArrowByPtr(sst,arr).Short}
+
+	if wgt != 1 {
+		parts = append(parts,strconv.FormatFloat(float64(wgt),'g',-1,32))
+	}
+
+	parts = append(parts,context...)
+
+	return "("+strings.Join(parts,", ")+")"
+}
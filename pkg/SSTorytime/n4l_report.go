@@ -0,0 +1,33 @@
+//**************************************************************
+//
+// What the n4l parser finds in a file, for editors: errors,
+// chapters, aliases and arrows, as the N4Llsp language server
+// reports them
+//
+//**************************************************************
+
+package SSTorytime
+
+//**************************************************************
+
+const (
+	N4L_REPORT_ERROR = "error"
+	N4L_REPORT_WARNING = "warning"
+	N4L_REPORT_CHAPTER = "chapter"
+	N4L_REPORT_ALIAS = "alias"
+	N4L_REPORT_ARROW = "arrow"
+)
+
+//**************************************************************
+
+type N4LReport struct {
+
+	Kind    string
+	File    string `json:",omitempty"`
+	Line    int    `json:",omitempty"` // from 1, as in N4L messages
+	Name    string `json:",omitempty"` // chapter, alias or arrow short name
+	Text    string `json:",omitempty"` // message, or arrow long name
+	STType  int    `json:",omitempty"`
+	InvName string `json:",omitempty"` // inverse arrow short name
+	InvText string `json:",omitempty"` // inverse arrow long name
+}
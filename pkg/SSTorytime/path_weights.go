@@ -0,0 +1,541 @@
+//**************************************************************
+//
+// Link weights in path and cone searches
+//
+// Every Link carries a weight (default 1.0). Searches can be
+// restricted to links within a weight range, and paths ranked
+// by their accumulated weight, e.g. to model cost or confidence
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//**************************************************************
+
+const (
+	NO_MIN_WEIGHT = -math.MaxFloat32
+	NO_MAX_WEIGHT = math.MaxFloat32
+
+	LIGHTEST_PATH_MAXNODES = 10000 // give up the shortest path search after settling this many (node,hops) states
+)
+
+//******************************************************************
+
+func AddWeightCondition(param SearchParameters,cond string) (SearchParameters,bool) {
+
+	// Parse one \weight condition: >x, >=x, <x, <=x, =x, or a bare x meaning at least x
+
+	cond = strings.TrimSpace(cond)
+	value := strings.TrimLeft(cond,"<>=")
+	op := cond[:len(cond)-len(value)]
+
+	wgt,err := strconv.ParseFloat(value,32)
+
+	if err != nil {
+		return param,false
+	}
+
+	val := float32(wgt)
+	minwgt,maxwgt := WeightPolicy(param)
+
+	switch op {
+	case ">":
+		minwgt = math.Nextafter32(val,NO_MAX_WEIGHT)
+	case ">=","=>","":
+		minwgt = val
+	case "<":
+		maxwgt = math.Nextafter32(val,NO_MIN_WEIGHT)
+	case "<=","=<":
+		maxwgt = val
+	case "=","==":
+		minwgt = val
+		maxwgt = val
+	default:
+		return param,false
+	}
+
+	param.Weighted = true
+	param.MinWgt = minwgt
+	param.MaxWgt = maxwgt
+
+	return param,true
+}
+
+//******************************************************************
+
+func WeightPolicy(search SearchParameters) (float32,float32) {
+
+	if !search.Weighted {
+		return NO_MIN_WEIGHT,NO_MAX_WEIGHT
+	}
+
+	if search.MinWgt > search.MaxWgt {
+		fmt.Println("\nWARNING: minimum link weight greater than maximum weight!")
+		fmt.Println("Weight: min =",search.MinWgt,", max =",search.MaxWgt)
+	}
+
+	return search.MinWgt,search.MaxWgt
+}
+
+//******************************************************************
+
+func LinkWithinWeights(lnk Link,minwgt,maxwgt float32) bool {
+
+	return lnk.Wgt >= minwgt && lnk.Wgt <= maxwgt
+}
+
+//******************************************************************
+
+func PathWithinWeights(path []Link,minwgt,maxwgt float32) bool {
+
+	// The first link is only a placeholder for the start node
+
+	for l := 1; l < len(path); l++ {
+		if !LinkWithinWeights(path[l],minwgt,maxwgt) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//******************************************************************
+
+func FilterPathsByWeight(paths [][]Link,minwgt,maxwgt float32) [][]Link {
+
+	// Drop whole paths containing a link outside the range
+
+	if minwgt == NO_MIN_WEIGHT && maxwgt == NO_MAX_WEIGHT {
+		return paths
+	}
+
+	var retval [][]Link
+
+	for _,path := range paths {
+		if PathWithinWeights(path,minwgt,maxwgt) {
+			retval = append(retval,path)
+		}
+	}
+
+	return retval
+}
+
+//******************************************************************
+
+func PruneConeByWeight(cone [][]Link,minwgt,maxwgt float32) [][]Link {
+
+	// Cut each cone path at its first link outside the range, keeping
+	// the part of the cone that is still reachable
+
+	if minwgt == NO_MIN_WEIGHT && maxwgt == NO_MAX_WEIGHT {
+		return cone
+	}
+
+	var retval [][]Link
+	var already = make(map[string]bool)
+
+	for _,path := range cone {
+
+		end := len(path)
+
+		for l := 1; l < len(path); l++ {
+			if !LinkWithinWeights(path[l],minwgt,maxwgt) {
+				end = l
+				break
+			}
+		}
+
+		if end < 2 {
+			continue
+		}
+
+		key := PathKey(path[:end])
+
+		if !already[key] {
+			already[key] = true
+			retval = append(retval,path[:end])
+		}
+	}
+
+	return retval
+}
+
+//******************************************************************
+
+func PathKey(path []Link) string {
+
+	// Identify a path by its nodes and arrows, ignoring the start placeholder
+
+	if len(path) == 0 {
+		return ""
+	}
+
+	key := fmt.Sprint(path[0].Dst)
+
+	for l := 1; l < len(path); l++ {
+		key += fmt.Sprint(path[l].Arr,path[l].Dst)
+	}
+
+	return key
+}
+
+//******************************************************************
+
+func PathWeight(path []Link) float32 {
+
+	var sum float32
+
+	for l := 1; l < len(path); l++ {
+		sum += path[l].Wgt
+	}
+
+	return sum
+}
+
+//******************************************************************
+
+func SortPathsByWeight(paths [][]Link) {
+
+	// Lightest first, then shortest, otherwise keep the solver's order
+
+	sort.SliceStable(paths,func(i,j int) bool {
+
+		wi := PathWeight(paths[i])
+		wj := PathWeight(paths[j])
+
+		if wi != wj {
+			return wi < wj
+		}
+
+		return len(paths[i]) < len(paths[j])
+	})
+}
+
+//******************************************************************
+
+func PathWeights(paths [][]Link) []float32 {
+
+	var retval []float32
+
+	for _,path := range paths {
+		retval = append(retval,PathWeight(path))
+	}
+
+	return retval
+}
+
+//******************************************************************
+
+func TallyWeightedPath(sst PoSST,path []Link,share float64,between map[string]float64) map[string]float64 {
+
+	// As TallyPath(), but the path counts by its share of the solutions.
+	// A node counts once per path, so no fraction can exceed 1
+
+	var seen = make(map[NodePtr]bool)
+
+	for leg := range path {
+
+		if seen[path[leg].Dst] {
+			continue
+		}
+
+		seen[path[leg].Dst] = true
+		n := GetDBNodeByNodePtr(sst,path[leg].Dst)
+		between[n.S] += share
+	}
+
+	return between
+}
+
+//******************************************************************
+
+func PathShares(paths [][]Link) []float64 {
+
+	// Lighter paths count for more, by inverse cost, and the shares
+	// sum to 1. A path of no cost (e.g. a single node) is the lightest
+	// possible, so such paths share everything between them
+
+	var shares = make([]float64,len(paths))
+	var sum float64
+	var free int
+
+	for p := range paths {
+		if PathWeight(paths[p]) <= 0 {
+			free++
+		}
+	}
+
+	for p := range paths {
+
+		cost := float64(PathWeight(paths[p]))
+
+		if free > 0 {
+			if cost <= 0 {
+				shares[p] = 1
+			}
+		} else {
+			shares[p] = 1 / cost
+		}
+
+		sum += shares[p]
+	}
+
+	for p := range shares {
+		shares[p] /= sum
+	}
+
+	return shares
+}
+
+//******************************************************************
+
+func WeightedBetweenNessCentrality(sst PoSST,solutions [][]Link) []string {
+
+	// As BetweenNessCentrality(), when asked to mind link weights
+
+	var betweenness = make(map[string]float64)
+
+	shares := PathShares(solutions)
+
+	for s := 0; s < len(solutions); s++ {
+		betweenness = TallyWeightedPath(sst,solutions[s],shares[s],betweenness)
+	}
+
+	var inv = make(map[float64][]string)
+ 	var order []float64
+
+	for key := range betweenness {
+		inv[betweenness[key]] = append(inv[betweenness[key]],key)
+	}
+
+	for key := range inv {
+		order = append(order,key)
+	}
+
+	sort.Float64s(order)
+
+	var retval []string
+	var betw string
+
+	for key := len(order)-1; key >= 0; key-- {
+
+		betw = fmt.Sprintf("%.2f : ",order[key])
+
+		for el := 0; el < len(inv[order[key]]); el++ {
+
+			betw += fmt.Sprintf("%s",inv[order[key]][el])
+			if el < len(inv[order[key]])-1 {
+				betw += ", "
+			}
+		}
+
+		retval =  append(retval,betw)
+	}
+	return retval
+}
+
+//******************************************************************
+
+func GetLightestPath(sst PoSST,start_set,end_set []NodePtr,chapter string,context []string,arrowptrs []ArrowPtr,sttypes []int,maxdepth int,minwgt,maxwgt float32) []Link {
+
+	// Dijkstra's shortest path by accumulated weight, at most maxdepth
+	// links long. Negative weights can't be ordered this way, so skip them.
+	// A node reached in fewer hops can still go further, so the search
+	// state is (node,hops) rather than the node alone
+
+	if len(start_set) == 0 || len(end_set) == 0 {
+		return nil
+	}
+
+	if sttypes == nil || len(sttypes)== 0 {
+		sttypes = []int{1,2,3,0,-1,-2,-3}
+	}
+
+	var target = make(map[NodePtr]bool)
+
+	for _,n := range end_set {
+		target[n] = true
+	}
+
+	var dist = make(map[FrontierState]float32)
+	var via = make(map[FrontierState]Link)
+	var from = make(map[FrontierState]FrontierState)
+	var fewest = make(map[NodePtr]int)
+	var fwdlinks = make(map[NodePtr][]Link)
+	var settled int
+	var frontier WeightFrontier
+
+	for _,n := range start_set {
+		begin := FrontierState{NPtr: n, Hops: 0}
+		dist[begin] = 0
+		heap.Push(&frontier,FrontierNode{State: begin, Dist: 0})
+	}
+
+	for frontier.Len() > 0 && settled < LIGHTEST_PATH_MAXNODES {
+
+		// Closest state, skipping stale entries. A node already settled in
+		// as few hops was reached no heavier, and can go at least as far
+
+		next := heap.Pop(&frontier).(FrontierNode)
+		here := next.State
+
+		if next.Dist > dist[here] {
+			continue
+		}
+
+		if hops,done := fewest[here.NPtr]; done && hops <= here.Hops {
+			continue
+		}
+
+		fewest[here.NPtr] = here.Hops
+		settled++
+
+		if target[here.NPtr] {
+			return LightestPathTo(here,via,from)
+		}
+
+		if here.Hops >= maxdepth {
+			continue
+		}
+
+		links,cached := fwdlinks[here.NPtr]
+
+		if !cached {
+			links = GetConstrainedFwdLinks(sst,[]NodePtr{here.NPtr},chapter,context,sttypes,arrowptrs,CAUSAL_CONE_MAXLIMIT)
+			fwdlinks[here.NPtr] = links
+		}
+
+		for _,lnk := range links {
+
+			if lnk.Wgt < 0 || !LinkWithinWeights(lnk,minwgt,maxwgt) {
+				continue
+			}
+
+			there := FrontierState{NPtr: lnk.Dst, Hops: here.Hops+1}
+
+			if hops,done := fewest[there.NPtr]; done && hops <= there.Hops {
+				continue
+			}
+
+			d := dist[here] + lnk.Wgt
+			prev,seen := dist[there]
+
+			if !seen || d < prev {
+				dist[there] = d
+				via[there] = lnk
+				from[there] = here
+				heap.Push(&frontier,FrontierNode{State: there, Dist: d})
+			}
+		}
+	}
+
+	return nil
+}
+
+//******************************************************************
+
+type FrontierState struct {
+
+	NPtr NodePtr
+	Hops int
+}
+
+type FrontierNode struct {
+
+	State FrontierState
+	Dist  float32
+}
+
+type WeightFrontier []FrontierNode
+
+// container/heap interface, closest first
+
+func (f WeightFrontier) Len() int           { return len(f) }
+func (f WeightFrontier) Less(i,j int) bool  { return f[i].Dist < f[j].Dist }
+func (f WeightFrontier) Swap(i,j int)       { f[i],f[j] = f[j],f[i] }
+func (f *WeightFrontier) Push(x any)        { *f = append(*f,x.(FrontierNode)) }
+
+func (f *WeightFrontier) Pop() any {
+
+	old := *f
+	last := old[len(old)-1]
+	*f = old[:len(old)-1]
+	return last
+}
+
+//******************************************************************
+
+func LightestPathTo(end FrontierState,via map[FrontierState]Link,from map[FrontierState]FrontierState) []Link {
+
+	// Unwind the predecessor chain into the usual path format
+
+	var reversed []Link
+
+	here := end
+
+	for {
+		lnk,ok := via[here]
+
+		if !ok {
+			break
+		}
+
+		reversed = append(reversed,lnk)
+		here = from[here]
+	}
+
+	path := []Link{SingletonLink(here.NPtr)}
+
+	for l := len(reversed)-1; l >= 0; l-- {
+		path = append(path,reversed[l])
+	}
+
+	return path
+}
+
+//******************************************************************
+
+func GetWeightedPaths(sst PoSST,start_set,end_set []NodePtr,chapter string,context []string,arrowptrs []ArrowPtr,sttypes []int,mindepth,maxdepth int,minwgt,maxwgt float32) [][]Link {
+
+	// Path solutions within the weight range, lightest first. When a
+	// \weight was asked for, make sure the weighted shortest path is
+	// among them (WeightPolicy gives no bounds otherwise)
+
+	solutions := GetWeightedPathsAndSymmetries(sst,start_set,end_set,chapter,context,arrowptrs,sttypes,mindepth,maxdepth,minwgt,maxwgt)
+
+	if minwgt == NO_MIN_WEIGHT && maxwgt == NO_MAX_WEIGHT {
+		SortPathsByWeight(solutions)
+		return solutions
+	}
+
+	lightest := GetLightestPath(sst,start_set,end_set,chapter,context,arrowptrs,sttypes,maxdepth,minwgt,maxwgt)
+
+	if lightest != nil {
+
+		key := PathKey(lightest)
+		found := false
+
+		for _,path := range solutions {
+			if PathKey(path) == key {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			solutions = append(solutions,lightest)
+		}
+	}
+
+	SortPathsByWeight(solutions)
+	return solutions
+}
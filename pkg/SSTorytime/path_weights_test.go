@@ -0,0 +1,214 @@
+//**************************************************************
+//
+// path_weights_test.go - the lightest path must respect the hop
+// limit, even when a lighter but longer route reaches a node on
+// the way first, and betweenness counts paths by inverse cost
+// only when asked. Same graph as tests/pass_32.in, on the
+// embedded store so no database is needed
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//**************************************************************
+
+func TestLightestPathHopLimit(t *testing.T) {
+
+	sst,nodes := OpenRoutesGraph(t)
+	defer Close(sst)
+
+	start := []NodePtr{nodes["start"].NPtr}
+	end := []NodePtr{nodes["end"].NPtr}
+
+	expected := map[int]string{
+		0: "",
+		1: "start end (10)",
+		2: "start c end (6)",
+		3: "start c end (6)",
+		4: "start a b c end (4)",
+		6: "start a b c end (4)",
+	}
+
+	for maxdepth,want := range expected {
+
+		path := GetLightestPath(sst,start,end,"",nil,nil,nil,maxdepth,NO_MIN_WEIGHT,NO_MAX_WEIGHT)
+
+		if got := RouteString(nodes,path); got != want {
+			t.Errorf("maxdepth %d: got %q, expected %q",maxdepth,got,want)
+		}
+	}
+
+	// Under a weight constraint, the light route is the only one left
+
+	path := GetLightestPath(sst,start,end,"",nil,nil,nil,4,NO_MIN_WEIGHT,2)
+
+	if got := RouteString(nodes,path); got != "start a b c end (4)" {
+		t.Errorf("max weight 2: got %q",got)
+	}
+
+	path = GetLightestPath(sst,start,end,"",nil,nil,nil,3,NO_MIN_WEIGHT,2)
+
+	if got := RouteString(nodes,path); got != "" {
+		t.Errorf("max weight 2 within 3 hops: got %q, expected no path",got)
+	}
+}
+
+//**************************************************************
+
+func TestBetweenNessCentralityWeights(t *testing.T) {
+
+	sst,nodes := OpenRoutesGraph(t)
+	defer Close(sst)
+
+	start := []NodePtr{nodes["start"].NPtr}
+	end := []NodePtr{nodes["end"].NPtr}
+
+	// The three routes, of weight 10, 6 and 4
+
+	var solutions [][]Link
+
+	for _,maxdepth := range []int{1,2,4} {
+		solutions = append(solutions,GetLightestPath(sst,start,end,"",nil,nil,nil,maxdepth,NO_MIN_WEIGHT,NO_MAX_WEIGHT))
+	}
+
+	// Unweighted, each path counts once
+
+	expected := []string{"1.00 : end, start","0.67 : c","0.33 : a, b"}
+
+	if got := SortedBetweenness(BetweenNessCentrality(sst,solutions)); !SameStrings(got,expected) {
+		t.Errorf("unweighted: got %q, expected %q",got,expected)
+	}
+
+	// Weighted, by inverse cost 1/10 : 1/6 : 1/4
+
+	expected = []string{"1.00 : end, start","0.81 : c","0.48 : a, b"}
+
+	if got := SortedBetweenness(WeightedBetweenNessCentrality(sst,solutions)); !SameStrings(got,expected) {
+		t.Errorf("weighted: got %q, expected %q",got,expected)
+	}
+
+	// A single node path costs nothing, so it takes the whole count
+
+	solutions = append(solutions,[]Link{{Dst: nodes["start"].NPtr}})
+
+	expected = []string{"1.00 : start","0.00 : a, b, c, end"}
+
+	if got := SortedBetweenness(WeightedBetweenNessCentrality(sst,solutions)); !SameStrings(got,expected) {
+		t.Errorf("single node: got %q, expected %q",got,expected)
+	}
+}
+
+//**************************************************************
+
+func SortedBetweenness(betw []string) []string {
+
+	// Nodes with equal centrality come in map order
+
+	for i := range betw {
+		parts := strings.SplitN(betw[i]," : ",2)
+		names := strings.Split(parts[1],", ")
+		sort.Strings(names)
+		betw[i] = parts[0] + " : " + strings.Join(names,", ")
+	}
+
+	return betw
+}
+
+//**************************************************************
+
+func SameStrings(a,b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func OpenRoutesGraph(t *testing.T) (PoSST,map[string]Node) {
+
+	// A light long route and heavy short ones from start to end
+
+	t.Helper()
+
+	sst := OpenEmbedded(filepath.Join(t.TempDir(),"graph.gob"),true)
+
+	ReadArrowConfig()
+
+	for arrow := range ARROW_DIRECTORY {
+		UploadArrowToDB(sst,ArrowPtr(arrow))
+	}
+
+	for arrow := range INVERSE_ARROWS {
+		UploadInverseArrowToDB(sst,ArrowPtr(arrow))
+	}
+
+	const chap = "weighted routes"
+
+	context := []string{"path example"}
+
+	links := []struct {
+		from,to string
+		wgt float32
+	}{
+		{"start","a",1},{"a","b",1},{"b","c",1},{"c","end",1},
+		{"start","c",5},
+		{"start","end",10},
+	}
+
+	nodes := make(map[string]Node)
+
+	for _,l := range links {
+		for _,name := range []string{l.from,l.to} {
+			if _,ok := nodes[name]; !ok {
+				nodes[name] = Vertex(sst,name,chap)
+			}
+		}
+		Edge(sst,nodes[l.from],"fwd",nodes[l.to],context,l.wgt)
+	}
+
+	sst.Store.Sync()
+
+	return sst,nodes
+}
+
+//**************************************************************
+
+func RouteString(nodes map[string]Node,path []Link) string {
+
+	// Name the nodes from the graph as built
+
+	if len(path) == 0 {
+		return ""
+	}
+
+	var names = make(map[NodePtr]string)
+
+	for name,n := range nodes {
+		names[n.NPtr] = name
+	}
+
+	var route []string
+
+	for _,lnk := range path {
+		route = append(route,names[lnk.Dst])
+	}
+
+	return fmt.Sprintf("%s (%g)",strings.Join(route," "),PathWeight(path))
+}
@@ -0,0 +1,1928 @@
+//**************************************************************
+//
+// Postgres implementation of the GraphStore interface. The SQL
+// lives here, the plpgsql functions it calls are defined in
+// SSTorytime.go (DefineStoredFunctions) and migrations.go
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+//**************************************************************
+
+type PostgresStore struct {
+
+	DB *sql.DB
+}
+
+//**************************************************************
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+
+	var pg PostgresStore
+	pg.DB = db
+	return &pg
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) sst() PoSST {
+
+	// For the schema helpers that take a PoSST, e.g. CreateTable
+
+	var sst PoSST
+	sst.DB = pg.DB
+	sst.Store = pg
+	return sst
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) Backend() string {
+	return "postgres"
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) Prepare() {
+
+	sst := pg.sst()
+
+	// Tmp reset
+
+	if WIPE_DB {
+
+		fmt.Println("***********************")
+		fmt.Println("* WIPING DB")
+		fmt.Println("***********************")
+		
+		pg.DB.QueryRow("DROP INDEX sst_nan")
+		pg.DB.QueryRow("DROP INDEX sst_type")
+		pg.DB.QueryRow("DROP INDEX sst_gin")
+		pg.DB.QueryRow("DROP INDEX sst_ungin")
+		pg.DB.QueryRow("DROP INDEX sst_s")
+		pg.DB.QueryRow("DROP INDEX sst_n")
+		pg.DB.QueryRow("DROP INDEX sst_cnt")
+
+		pg.DB.QueryRow("drop function fwdconeaslinks")
+		pg.DB.QueryRow("drop function fwdconeasnodes")
+		pg.DB.QueryRow("drop function fwdpathsaslinks")
+		pg.DB.QueryRow("drop function getfwdlinks")
+		pg.DB.QueryRow("drop function getfwdnodes")
+		pg.DB.QueryRow("drop function getneighboursbytype")
+		pg.DB.QueryRow("drop function getsingletonaslink")
+		pg.DB.QueryRow("drop function AllNCPathsAsLinks")
+		pg.DB.QueryRow("drop function AllSuperNCPathsAsLinks")
+		pg.DB.QueryRow("drop function SumAllNCPaths")
+		pg.DB.QueryRow("drop function GetNCFwdLinks")
+		pg.DB.QueryRow("drop function GetNCCLinks")
+
+		pg.DB.QueryRow("drop function getsingletonaslinkarray")
+		pg.DB.QueryRow("drop function idempinsertnode")
+		pg.DB.QueryRow("drop function sumfwdpaths")
+		pg.DB.QueryRow("drop function match_context")
+		pg.DB.QueryRow("drop function empty_path")
+		pg.DB.QueryRow("drop function match_arrows")
+		pg.DB.QueryRow("drop function match_chapter")
+		pg.DB.QueryRow("drop function ArrowInList")
+		pg.DB.QueryRow("drop function GetNCCStoryStartNodes")
+		pg.DB.QueryRow("drop function GetStoryStartNodes")
+		pg.DB.QueryRow("drop function GetAppointments")
+		pg.DB.QueryRow("drop function UnCmp")
+		pg.DB.QueryRow("drop function DeleteChapter")
+
+		pg.DB.QueryRow("drop function lastsawsection(text)")
+		pg.DB.QueryRow("drop function lastsawnptr(nodeptr)")
+		pg.DB.QueryRow("drop function lastsawsection(text,text)")
+		pg.DB.QueryRow("drop function lastsawnptr(nodeptr,text,text)")
+
+		pg.DB.QueryRow("drop type NodePtr")
+		pg.DB.QueryRow("drop type Link")
+		pg.DB.QueryRow("drop type Appointment")
+
+		pg.DB.QueryRow("drop table Node")
+		pg.DB.QueryRow("drop table PageMap")
+		pg.DB.QueryRow("drop table NodeArrowNode")
+		pg.DB.QueryRow("drop table ArrowDirectory")
+		pg.DB.QueryRow("drop table ArrowInverses")
+		pg.DB.QueryRow("drop table ContextDirectory")
+		pg.DB.QueryRow("drop table LastSeen")
+		pg.DB.QueryRow("drop table UserOverlay")
+		pg.DB.QueryRow("drop table Review")
+		pg.DB.QueryRow("drop table STM")
+		pg.DB.QueryRow("drop table SchemaVersion")
+	}
+
+	// Refuse to work on a schema we don't understand, see migrations.go
+
+	if current,why := SchemaIsCurrent(sst); !current {
+		fmt.Println(why)
+		os.Exit(-1)
+	}
+
+	if err := MigrateDB(sst); err != nil {
+		fmt.Println("Unable to configure the database schema:",err)
+		os.Exit(-1)
+	}
+}
+
+//**************************************************************
+// Nodes
+//**************************************************************
+
+func (pg *PostgresStore) UploadNode(org Node) {
+
+	const nolink = 999
+
+	qstr := "BEGIN;\n" + FormDBNode(pg.sst(),org)
+
+	for stindex := 0; stindex < len(org.I); stindex++ {
+
+		lnkarray := FormatSQLLinkArray(org.I[stindex])
+		sttype := STIndexToSTType(stindex)
+		qstr += AppendDBLinkArrayToNode(pg.sst(),org.NPtr,lnkarray,sttype)
+	}
+
+	qstr += "\nCOMMIT;"
+
+	row,err := pg.DB.Query(qstr)
+
+	if err != nil {
+		s := fmt.Sprint("Failed to insert",err)
+		
+		if strings.Contains(s,"duplicate key") {
+		} else {
+			fmt.Println(s,"FAILED \n",qstr,err)
+		}
+		return
+	}
+
+	row.Close()
+}
+//**************************************************************
+
+func (pg *PostgresStore) CreateNode(n Node) Node {
+
+	// Add node version setting explicit CPtr value, note different function call
+	// We use this function when we ARE managing/counting CPtr values ourselves
+
+	var qstr string
+
+        n.L,n.NPtr.Class = StorageClass(n.S)
+	
+	cptr := n.NPtr.CPtr
+
+	es := SQLEscape(n.S)
+	ec := SQLEscape(n.Chap)
+
+	qstr = fmt.Sprintf("SELECT IdempInsertNode(%d,%d,%d,'%s','%s')",n.L,n.NPtr.Class,cptr,es,ec)
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		s := fmt.Sprint("Failed to insert",err)
+		
+		if strings.Contains(s,"duplicate key") {
+		} else {
+			fmt.Println(s,"FAILED \n",qstr,err)
+		}
+		return n
+	}
+
+	var whole string
+	var cl,ch int
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			fmt.Sscanf(whole,"(%d,%d)",&cl,&ch)
+		}
+		
+		n.NPtr.Class = cl
+		n.NPtr.CPtr = ClassedNodePtr(ch)
+		
+		row.Close()
+	}
+
+	return n
+}
+//**************************************************************
+
+func (pg *PostgresStore) AppendNode(n Node) Node {
+
+	// We use this function when we aren't counting CPtr values
+	// This functon may be deprecated in future
+
+	var qstr string
+
+	// No need to trust the values, ignore/overwrite CPtr
+
+        n.L,n.NPtr.Class = StorageClass(n.S)
+
+	es := SQLEscape(n.S)
+	ec := SQLEscape(n.Chap)
+
+	// Wrap BEGIN/END a single transaction
+
+	qstr = fmt.Sprintf("SELECT IdempAppendNode(%d,%d,'%s','%s')",n.L,n.NPtr.Class,es,ec)
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		s := fmt.Sprint("Failed to add node",err)
+		
+		if strings.Contains(s,"duplicate key") {
+		} else {
+			fmt.Println(s,"FAILED \n",qstr,err)
+		}
+		return n
+	}
+
+	var whole string
+	var cl,ch int
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			fmt.Sscanf(whole,"(%d,%d)",&cl,&ch)
+		}
+		
+		n.NPtr.Class = cl
+		n.NPtr.CPtr = ClassedNodePtr(ch)
+		
+		row.Close()
+	}
+
+	return n
+}
+//**************************************************************
+
+func (pg *PostgresStore) AppendLink(n1ptr NodePtr,lnk Link,sttype int) bool {
+
+	qstr := AppendDBLinkToNodeCommand(pg.sst(),n1ptr,lnk,sttype)
+
+	row,err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("Failed to append",err,qstr)
+	       return false
+	}
+
+	row.Close()
+	return true
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetNode(db_nptr NodePtr) (Node,bool) {
+
+	// This ony works if we insert non-null arrays like '[]' during initialization
+	cols := I_MEXPR+","+I_MCONT+","+I_MLEAD+","+I_NEAR +","+I_PLEAD+","+I_PCONT+","+I_PEXPR
+	qstr := fmt.Sprintf("select L,S,Chap,%s from Node where NPtr='(%d,%d)'::NodePtr AND NOT L=0",cols,db_nptr.Class,db_nptr.CPtr)
+
+	row, err := pg.DB.Query(qstr)
+
+	var n Node
+	var count int = 0
+
+	if err != nil {
+		fmt.Println("GetDBNodeByNodePointer Failed:",err)
+		return n,false
+	}
+
+	var whole [ST_TOP]string
+
+	// NB, there seems to be a "bug" in the SQL package, which cannot always populate the links, so try not to
+	//     rely on this and work around when needed using GetEntireCone(any,2..) separately
+
+	for row.Next() {
+		err = row.Scan(&n.L,&n.S,&n.Chap,&whole[0],&whole[1],&whole[2],&whole[3],&whole[4],&whole[5],&whole[6])
+
+		for i := 0; i < ST_TOP; i++ {
+			n.I[i] = ParseLinkArray(whole[i])
+		}
+		count++
+	}
+
+	if count > 1 {
+		fmt.Println("GetDBNodeByNodePtr returned too many matches (multi-model conflict?):",count,"for ptr",db_nptr)
+		os.Exit(-1)
+	}
+
+	row.Close()
+
+	n.NPtr = db_nptr
+	return n,count > 0
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) MatchNodes(nm,chap string,cn []string,arrow []ArrowPtr,seq bool,limit int) []NodePtr {
+
+	// Order by L to favour exact matches
+
+	nm = SQLEscape(nm)
+	chap = SQLEscape(chap)
+
+	qstr := fmt.Sprintf("SELECT NPtr FROM Node WHERE %s ORDER BY L ASC,(CARDINALITY(Ie3)+CARDINALITY(Im3)+CARDINALITY(Il1)) DESC LIMIT %d",NodeWhereString(nm,chap,cn,arrow,seq),limit)
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("QUERY GetNodePtrMatchingNCC Failed",err,qstr)
+	}
+
+	var whole string
+	var n NodePtr
+	var retval []NodePtr
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			fmt.Sscanf(whole,"(%d,%d)",&n.Class,&n.CPtr)
+			retval = append(retval,n)
+		}
+
+		row.Close()
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) MatchQuery(query *TextQuery,chap string,cn []string,arrow []ArrowPtr,seq bool,limit int) ([]NodePtr,[]float32) {
+
+	// Boolean/phrase search on the tsvector, most relevant first
+
+	chap = SQLEscape(chap)
+	tsq := query.TSQuery()
+
+	qstr := fmt.Sprintf("SELECT NPtr,ts_rank(Search,q,%d) AS rank FROM Node,to_tsquery('english','%s') q WHERE Search @@ q AND %s ORDER BY rank DESC,L ASC LIMIT %d",TS_RANK_NORM,tsq,NodeWhereString("any",chap,cn,arrow,seq),limit)
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("QUERY GetDBNodePtrsMatchingQuery Failed",err,qstr)
+	}
+
+	var whole string
+	var n NodePtr
+	var rank float32
+	var retval []NodePtr
+	var ranks []float32
+
+	if row != nil {
+		for row.Next() {
+			err = row.Scan(&whole,&rank)
+			fmt.Sscanf(whole,"(%d,%d)",&n.Class,&n.CPtr)
+			retval = append(retval,n)
+			ranks = append(ranks,rank)
+		}
+
+		row.Close()
+	}
+
+	return retval,ranks
+}
+//**************************************************************
+
+func (pg *PostgresStore) MatchChapters(src string) []string {
+
+	var qstr string
+
+	remove_accents,stripped := IsBracketedSearchTerm(SQLEscape(src))
+
+	if remove_accents {
+		search := "%"+stripped+"%"
+		qstr = fmt.Sprintf("SELECT DISTINCT Chap FROM Node WHERE lower(unaccent(Chap)) LIKE lower('%s')",search)
+	} else {
+		search := "%"+src+"%"
+		qstr = fmt.Sprintf("SELECT DISTINCT Chap FROM Node WHERE lower(Chap) LIKE lower('%s')",search)
+	}
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY GetDBChaptersMatchingName",err)
+	}
+
+	var whole string
+	var chapters = make(map[string]int)
+	var retval []string
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			several := strings.Split(whole,",")
+			
+			for s := range several {
+				chapters[several[s]]++
+			}
+		}
+
+		for c := range chapters {
+			if strings.Contains(c,src) {
+				if len(c) > 0 {
+					retval = append(retval,c)
+				}
+			}
+		}
+
+		sort.Strings(retval)
+		row.Close()
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) DeleteChapter(chapter string) bool {
+
+	qstr := fmt.Sprintf("select DeleteChapter('%s')",SQLEscape(chapter))
+
+	var deleted bool
+
+	err := pg.DB.QueryRow(qstr).Scan(&deleted)
+
+	if err != nil {
+		fmt.Println("Error running deletechapter function:",qstr,err)
+		return false
+	}
+
+	return deleted
+}
+//**************************************************************
+
+func (pg *PostgresStore) MaxCPtr(class int) int {
+
+	var cptr sql.NullInt64
+
+	qstr := fmt.Sprintf("SELECT max((Nptr).CPtr) FROM Node WHERE (Nptr).Chan=%d",class)
+
+	row := pg.DB.QueryRow(qstr)
+	row.Scan(&cptr)
+
+	if !cptr.Valid {
+		return -1
+	}
+
+	return int(cptr.Int64)
+}
+
+//**************************************************************
+// Incremental upload
+//**************************************************************
+
+func (pg *PostgresStore) GetNodesByText(texts []string) []Node {
+
+	var retval []Node
+
+	for start := 0; start < len(texts); start += DELTA_TEXT_BATCH {
+
+		end := start + DELTA_TEXT_BATCH
+
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		var list []string
+
+		for _,s := range texts[start:end] {
+			list = append(list,"'"+SQLEscape(s)+"'")
+		}
+
+		qstr := fmt.Sprintf("WHERE S IN (%s)",strings.Join(list,","))
+		retval = append(retval,pg.rawNodes(qstr)...)
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetChapterNodes(chapters []string) []Node {
+
+	var retval []Node
+	var already = make(map[NodePtr]bool)
+
+	for _,chap := range chapters {
+
+		qstr := fmt.Sprintf("WHERE Chap LIKE '%%%s%%'",SQLEscape(chap))
+
+		// LIKE is only a pre-filter, the chapter has to match a whole element
+
+		for _,n := range pg.rawNodes(qstr) {
+			for _,c := range SplitChapters(n.Chap) {
+				if c == chap && !already[n.NPtr] {
+					already[n.NPtr] = true
+					retval = append(retval,n)
+				}
+			}
+		}
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) CountChapterNodes(ctx context.Context,chapter string) (int,error) {
+
+	// Chapters split as in SplitChapters(), at commas not followed by a space
+
+	var count int
+
+	qstr := "SELECT count(*) FROM Node WHERE strpos(Chap,$1) > 0 AND $1 = ANY(regexp_split_to_array(Chap,',(?=[^ ])'))"
+
+	err := pg.DB.QueryRowContext(ctx,qstr,chapter).Scan(&count)
+
+	return count,err
+}
+//**************************************************************
+
+func (pg *PostgresStore) rawNodes(where string) []Node {
+
+	// Nodes exactly as stored, without dynamic expansion or caching
+
+	cols := I_MEXPR+","+I_MCONT+","+I_MLEAD+","+I_NEAR +","+I_PLEAD+","+I_PCONT+","+I_PEXPR
+	qstr := fmt.Sprintf("SELECT NPtr,L,S,Chap,Seq,%s FROM Node %s",cols,where)
+
+	row,err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("GetDBRawNodes Failed:",err)
+		return nil
+	}
+
+	var retval []Node
+
+	for row.Next() {
+
+		var n Node
+		var nptr string
+		var chap sql.NullString
+		var seq sql.NullBool
+		var whole [ST_TOP]sql.NullString
+
+		err = row.Scan(&nptr,&n.L,&n.S,&chap,&seq,&whole[0],&whole[1],&whole[2],&whole[3],&whole[4],&whole[5],&whole[6])
+
+		if err != nil {
+			fmt.Println("Error reading GetDBRawNodes",err)
+			continue
+		}
+
+		fmt.Sscanf(nptr,"(%d,%d)",&n.NPtr.Class,&n.NPtr.CPtr)
+		n.Chap = chap.String
+		n.Seq = seq.Bool
+
+		for i := 0; i < ST_TOP; i++ {
+			n.I[i] = ParseLinkArray(whole[i].String)
+		}
+
+		retval = append(retval,n)
+	}
+
+	row.Close()
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetChapterPageMap(chapters []string) []PageMap {
+
+	var retval []PageMap
+
+	for _,chap := range chapters {
+
+		qstr := fmt.Sprintf("SELECT Chap,Alias,Ctx,Line,Path FROM PageMap WHERE Chap='%s' ORDER BY Line",SQLEscape(chap))
+
+		row,err := pg.DB.Query(qstr)
+
+		if err != nil {
+			fmt.Println("GetDBChapterPageMap Failed:",err)
+			continue
+		}
+
+		for row.Next() {
+
+			var event PageMap
+			var alias,path sql.NullString
+
+			err = row.Scan(&event.Chapter,&alias,&event.Context,&event.Line,&path)
+
+			if err != nil {
+				fmt.Println("Error reading GetDBChapterPageMap",err)
+				continue
+			}
+
+			event.Alias = alias.String
+			event.Path = ParseLinkArray(path.String)
+			retval = append(retval,event)
+		}
+
+		row.Close()
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) ApplyDelta(delta GraphDelta,wait_counter bool) error {
+
+	var commands []string
+
+	for _,arrow := range delta.Arrows {
+		commands = append(commands,UploadArrowToDBCommand(arrow))
+	}
+
+	for plus,minus := range delta.Inverses {
+		commands = append(commands,UploadInverseArrowToDBCommand(plus,minus))
+	}
+
+	for _,ctx := range delta.Contexts {
+		commands = append(commands,fmt.Sprintf("SELECT IdempInsertContext('%s',%d)",SQLEscape(ctx.Context),ctx.Ptr))
+	}
+
+	for _,n := range delta.DelNodes {
+
+		for st := range n.I {
+			for _,lnk := range n.I[st] {
+				commands = append(commands,RemoveDBLinksToNodeCommand(lnk.Dst,n.NPtr,-STIndexToSTType(st)))
+			}
+		}
+
+		commands = append(commands,fmt.Sprintf("DELETE FROM Node WHERE NPtr='(%d,%d)'::NodePtr",n.NPtr.Class,n.NPtr.CPtr))
+	}
+
+	for _,n := range delta.AddNodes {
+
+		cmd := FormDBNode(pg.sst(),n)
+
+		for stindex := 0; stindex < len(n.I); stindex++ {
+			lnkarray := FormatSQLLinkArray(n.I[stindex])
+			cmd += AppendDBLinkArrayToNode(pg.sst(),n.NPtr,lnkarray,STIndexToSTType(stindex))
+		}
+
+		commands = append(commands,cmd)
+	}
+
+	for _,n := range delta.UpdNodes {
+		commands = append(commands,fmt.Sprintf("UPDATE Node SET Chap='%s',Seq=%t WHERE NPtr='(%d,%d)'::NodePtr",SQLEscape(n.Chap),n.Seq,n.NPtr.Class,n.NPtr.CPtr))
+	}
+
+	for _,dl := range delta.DelLinks {
+		commands = append(commands,RemoveDBLinkFromNodeCommand(dl.From,dl.Lnk,STIndexToSTType(dl.STindex)))
+	}
+
+	for _,dl := range delta.AddLinks {
+		commands = append(commands,AppendDBLinkToNodeCommand(pg.sst(),dl.From,dl.Lnk,STIndexToSTType(dl.STindex)))
+	}
+
+	for _,line := range delta.DelPages {
+		commands = append(commands,fmt.Sprintf("DELETE FROM PageMap WHERE Chap='%s' AND Line=%d",SQLEscape(line.Chapter),line.Line))
+	}
+
+	for _,line := range delta.AddPages {
+		commands = append(commands,UploadPageMapEventCommand(line))
+	}
+
+	tx,err := pg.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	for _,cmd := range commands {
+
+		if len(cmd) == 0 {
+			continue
+		}
+
+		_,err = tx.Exec(cmd)
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v in %s",err,cmd)
+		}
+
+		Waiting(wait_counter,len(commands))
+	}
+
+	return tx.Commit()
+}
+//**************************************************************
+// Analytics
+//**************************************************************
+
+func (pg *PostgresStore) Singletons(sttypes []int,chap string,cn []string) ([]NodePtr,[]NodePtr) {
+
+	var qstr,qwhere string
+	var dim = len(sttypes)
+
+	context := FormatSQLStringArray(cn)
+	chapter := ChapterMatchSQL("Chap",SQLEscape(chap))
+
+	for st := 0; st < len(sttypes); st++ {
+
+		stname := STTypeDBChannel(sttypes[st])
+		stinv := STTypeDBChannel(-sttypes[st])
+		qwhere += fmt.Sprintf("(array_length(%s::text[],1) IS NOT NULL AND array_length(%s::text[],1) IS NULL AND match_context((%s)[0].Ctx,%s))",stname,stinv,stname,context)
+		
+		if st != dim-1 {
+			qwhere += " OR "
+		}
+	}
+
+	qstr = fmt.Sprintf("SELECT NPtr FROM Node WHERE %s AND (%s)",chapter,qwhere)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY GetDBSingletonBySTType Failed",err,"IN",qstr)
+		return nil,nil
+	}
+
+	var src_nptrs,snk_nptrs []NodePtr
+
+	for row.Next() {		
+		
+		var n NodePtr
+		var nstr string
+			
+		err = row.Scan(&nstr)
+		
+		if err != nil {
+			fmt.Println("Error scanning sql data case",dim,"gave error",err,qstr)
+			row.Close()
+			return nil,nil
+		}
+		
+		fmt.Sscanf(nstr,"(%d,%d)",&n.Class,&n.CPtr)
+		
+		src_nptrs = append(src_nptrs,n)
+	}
+
+	row.Close()
+
+	// and sinks  -> -
+
+	qwhere = ""
+
+	for st := 0; st < len(sttypes); st++ {
+
+		stname := STTypeDBChannel(-sttypes[st])
+		stinv := STTypeDBChannel(sttypes[st])
+		qwhere += fmt.Sprintf("(array_length(%s::text[],1) IS NOT NULL AND array_length(%s::text[],1) IS NULL AND match_context((%s)[0].Ctx,%s))",stname,stinv,stname,context)
+		
+		if st != dim-1 {
+			qwhere += " OR "
+		}
+	}
+
+	qstr = fmt.Sprintf("SELECT NPtr FROM Node WHERE %s AND (%s)",chapter,qwhere)
+
+	row, err = pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY GetDBSingletonBySTType 2 Failed",err,"IN",qstr)
+		return nil,nil
+	}
+
+	for row.Next() {		
+		
+		var n NodePtr
+		var nstr string
+			
+		err = row.Scan(&nstr)
+		
+		if err != nil {
+			fmt.Println("Error scanning sql data case",dim,"gave error",err,qstr)
+			row.Close()
+			return nil,nil
+		}
+			
+		fmt.Sscanf(nstr,"(%d,%d)",&n.Class,&n.CPtr)
+			
+		snk_nptrs = append(snk_nptrs,n)
+	}
+
+	row.Close()
+
+	return src_nptrs,snk_nptrs
+}
+//**************************************************************
+
+func (pg *PostgresStore) LinkedNodes(sttypes []int,chap string,cn []string) []Node {
+
+	// Nodes with links of these types, only those link channels are filled in
+
+	var qstr,qwhere,qsearch string
+	var dim = len(sttypes)
+
+	context := FormatSQLStringArray(cn)
+	chapter := ChapterMatchSQL("Chap",SQLEscape(chap))
+
+	for st := 0; st < len(sttypes); st++ {
+
+		stname := STTypeDBChannel(sttypes[st])
+		qwhere += fmt.Sprintf("array_length(%s::text[],1) IS NOT NULL AND match_context((%s)[0].Ctx,%s)",stname,stname,context)
+
+		if st != dim-1 {
+			qwhere += " OR "
+		}
+
+		qsearch += "," + stname
+
+	}
+
+	qstr = fmt.Sprintf("SELECT NPtr%s FROM Node WHERE %s AND (%s)",qsearch,chapter,qwhere)
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("QUERY GetDBSparseAdjacencyBySTType Failed",err)
+		return nil
+	}
+
+	var linkstr = make([]string,dim)
+	var retval []Node
+
+	for row.Next() {		
+
+		var n Node
+		var nstr string
+
+		switch dim {
+
+		case 1: err = row.Scan(&nstr,&linkstr[0])
+		case 2: err = row.Scan(&nstr,&linkstr[0],&linkstr[1])
+		case 3: err = row.Scan(&nstr,&linkstr[0],&linkstr[1],&linkstr[2])
+		case 4: err = row.Scan(&nstr,&linkstr[0],&linkstr[1],&linkstr[2],&linkstr[3])
+
+		default:
+			fmt.Println("Maximum 4 sttypes in GetDBSparseAdjacencyBySTType - shouldn't happen")
+			row.Close()
+			return nil
+		}
+
+		if err != nil {
+			fmt.Println("Error scanning sql data case",dim,"gave error",err,qstr)
+			row.Close()
+			return nil
+		}
+
+		fmt.Sscanf(nstr,"(%d,%d)",&n.NPtr.Class,&n.NPtr.CPtr)
+
+		for st := range sttypes {
+			n.I[STTypeToSTIndex(sttypes[st])] = ParseMapLinkArray(linkstr[st])
+		}
+
+		retval = append(retval,n)
+	}
+
+	row.Close()
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) Appointments(arrow ArrowPtr,sttype,min int,chap string,cn []string) []Appointment {
+
+	_,cn_stripped := IsBracketedSearchList(cn)
+	context := FormatSQLStringArray(cn_stripped)
+
+	var chap_col,chap_stripped string
+	var remove_chap_accents bool
+
+	if chap != "any" && chap != "" {	
+		remove_chap_accents,chap_stripped = IsBracketedSearchTerm(chap)
+		
+		if remove_chap_accents {
+			chap_col = "%"+chap_stripped+"%"
+		} else {
+			chap_col = "%"+chap+"%"
+		}
+	}
+
+	qstr := fmt.Sprintf("SELECT unnest(GetAppointments(%d,%d,%d,'%s',%s,%v))",int(arrow),sttype,min,chap_col,context,remove_chap_accents)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY GetAppointedNodesByArrow Failed",err,qstr)
+		return nil
+	}
+
+	var whole string
+	var retval []Appointment
+
+	for row.Next() {
+		err = row.Scan(&whole)
+		retval = append(retval,ParseAppointedNodeCluster(whole))
+	}
+
+	row.Close()
+
+	return retval
+}
+//**************************************************************
+// Cones
+//**************************************************************
+
+func (pg *PostgresStore) FwdConeNodes(start NodePtr,sttype,depth,limit int) []NodePtr {
+
+	qstr := fmt.Sprintf("select unnest(fwdconeasnodes) from FwdConeAsNodes('(%d,%d)',%d,%d,%d);",start.Class,start.CPtr,sttype,depth,limit)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY to FwdConeAsNodes Failed",err)
+	}
+
+	var whole string
+	var n NodePtr
+	var retval []NodePtr
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			fmt.Sscanf(whole,"(%d,%d)",&n.Class,&n.CPtr)
+			retval = append(retval,n)
+		}
+
+		row.Close()
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) FwdConeLinks(start NodePtr,sttype,depth int) []Link {
+
+	qstr := fmt.Sprintf("select unnest(fwdconeaslinks) from FwdConeAsLinks('(%d,%d)',%d,%d);",start.Class,start.CPtr,sttype,depth)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY to FwdConeAsLinks Failed",err)
+	}
+
+	var whole string
+	var retval []Link
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			l := ParseSQLLinkString(whole)
+			retval = append(retval,l)
+		}
+
+		row.Close()
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) FwdPaths(start NodePtr,sttype,depth,maxlimit int) [][]Link {
+
+	qstr := fmt.Sprintf("SELECT FwdPathsAsLinks from FwdPathsAsLinks('(%d,%d)',%d,%d,%d);",start.Class,start.CPtr,sttype,depth,maxlimit)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY to FwdPathsAsLinks Failed",err)
+	}
+
+	var whole string
+	var retval [][]Link
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			retval = ParseLinkPath(whole)
+		}
+
+		row.Close()
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) EntireConePaths(orientation string,start []NodePtr,depth int,chapter string,context []string,limit int) [][]Link {
+
+	var qstr string
+
+	if len(start) == 1 && chapter == "" && len(context) == 0 {
+
+		// Todo: how to limit path search? Usually solutions are small..?
+
+		qstr = fmt.Sprintf("select AllPathsAsLinks from AllPathsAsLinks('(%d,%d)','%s',%d, %d);",
+			start[0].Class,start[0].CPtr,orientation,depth,limit)
+
+	} else {
+		remove_accents,chapter := ChapterPattern(chapter)
+		rm_acc := "false"
+
+		if remove_accents {
+			rm_acc = "true"
+		}
+
+		qstr = fmt.Sprintf("select AllNCPathsAsLinks(%s,'%s',%s,%s,'%s',%d,%d);",FormatSQLNodePtrArray(start),chapter,rm_acc,FormatSQLStringArray(context),orientation,depth,limit)
+	}
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("QUERY to AllPathsAsLinks Failed",err,qstr)
+		os.Exit(-1)
+	}
+
+	var whole string
+	var retval [][]Link
+
+	for row.Next() {
+		err = row.Scan(&whole)
+		retval = ParseLinkPath(whole)
+	}
+
+	row.Close()
+
+	return retval
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) ConstraintConePaths(start []NodePtr,depth int,chapter string,context []string,arrowptrs []ArrowPtr,sttypes []int,limit int) [][]Link {
+
+	remove_accents,chapter := ChapterPattern(chapter)
+	rm_acc := "false"
+
+	if remove_accents {
+		rm_acc = "true"
+	}
+
+	nod := FormatSQLNodePtrArray(start)
+	arr := FormatSQLIntArray(Arrow2Int(arrowptrs))
+	stt := FormatSQLIntArray(sttypes)
+	cnt := FormatSQLStringArray(context)
+
+	qstr := fmt.Sprintf("select ConstraintPathsAsLinks(%s,'%s',%s,%s,%s,%s,%d,%d);",nod,chapter,rm_acc,cnt,arr,stt,depth,limit)
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("QUERY to ConstraintPathsAsLinks Failed",err,qstr)
+		os.Exit(-1)
+	}
+
+	var whole string
+	var retval [][]Link
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&whole)
+			retval = ParseLinkPath(whole)
+			break
+		}
+
+		row.Close()
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) ConstrainedFwdLinks(start []NodePtr,chapter string,context []string,sttypes []int,arrows []ArrowPtr,maxlimit int) []Link {
+
+	var ret []Link
+
+	remove_accents,chapter := ChapterPattern(chapter)
+	rm_acc := "false"
+
+	if remove_accents {
+		rm_acc = "true"
+	}
+
+	start = append(start,NONODE)
+	excl := FormatSQLNodePtrArray(start)
+	arr := FormatSQLIntArray(Arrow2Int(arrows))
+	cnt := FormatSQLStringArray(context)
+
+	startnode := fmt.Sprintf("(%d,%d)",start[0].Class,start[0].CPtr)
+
+	for _,st := range sttypes { 
+
+		qstr := fmt.Sprintf("select GetConstrainedFwdLinks('%s','%s',%s,%s,%s,%d,%s,%d);",startnode,chapter,rm_acc,cnt,excl,st,arr,maxlimit)
+
+		row, err := pg.DB.Query(qstr)
+		
+		if err != nil {
+			fmt.Println("QUERY to ConstraintPathsAsLinks Failed",err,qstr)
+			return ret
+		}
+		
+		var whole string
+
+		if row != nil {		
+			for row.Next() {		
+				err = row.Scan(&whole)
+				orbit := ParseLinkArray(whole)
+				for _,lnk := range orbit {
+					ret = append(ret,lnk)
+				}
+			}
+			row.Close()
+		}
+	}
+
+	return ret
+}
+//**************************************************************
+// Page map
+//**************************************************************
+
+func (pg *PostgresStore) AppendPageMap(line PageMap) {
+
+	qstr := "BEGIN;\n" + UploadPageMapEventCommand(line) + "COMMIT;"
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		s := fmt.Sprint("Failed to insert pagemap event",err)
+		
+		if strings.Contains(s,"duplicate key") {
+		} else {
+			fmt.Println(s,"FAILED \n",qstr,err)
+		}
+		row.Close()
+		return
+	}
+
+	row.Close()
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetPageMap(chap string,cn []string,page int) []PageMap {
+
+	var qstr string
+
+	context := FormatSQLStringArray(cn)
+	chapter := ChapterMatchSQL("Chap",chap)
+
+	const hits_per_page = 60
+	offset := (page-1) * hits_per_page;
+
+	qstr = fmt.Sprintf("SELECT DISTINCT Chap,Ctx,Line,Path FROM PageMap\n"+
+		"WHERE match_context(Ctx,%s)=true AND %s ORDER BY Chap,Line OFFSET %d LIMIT %d",context,chapter,offset,hits_per_page)
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("GetDBPageMap Failed:",err,qstr)
+	}
+
+	var path string
+	var pagemap []PageMap
+	var line int
+	var ctxptr ContextPtr
+
+	if row != nil {
+		for row.Next() {		
+
+			var event PageMap
+
+			err = row.Scan(&chap,&ctxptr,&line,&path)
+
+			if err != nil {
+				fmt.Println("Error reading GetDBPageMap",err)
+			}
+
+			event.Path = ParseMapLinkArray(path)
+
+			event.Chapter = chap
+			event.Context = ctxptr
+			event.Line = line;
+
+			pagemap = append(pagemap,event)
+		}
+
+		row.Close()
+	}
+
+	return pagemap
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetChaptersByContext(chap string,cn []string,limit int) map[string][]string {
+
+	chap_col := ""
+
+	if chap != "any" && chap != "" {
+		chap_col = "AND "+ChapterMatchSQL("chap",chap)
+	}
+
+	_,cn_stripped := IsBracketedSearchList(cn)
+	context := FormatSQLStringArray(cn_stripped)
+
+	qstr := fmt.Sprintf("SELECT DISTINCT chap,ctx FROM PageMap WHERE match_context(ctx,%s) %s ORDER BY Chap",context,chap_col)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY GetChaptersByChapContext Failed",err,qstr)
+	}
+
+	var rchap string
+	var rcontext ContextPtr
+	var toc = make(map[string][]string)
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&rchap,&rcontext)
+
+			// Each chapter can be a comma separated list
+
+			chps := SplitChapters(rchap)
+
+			for c := 0; c < len(chps); c++ {
+
+				if len(toc) == limit {
+					row.Close()
+					return toc
+				}
+
+				rc := chps[c]
+
+				cn := strings.Split(GetContext(rcontext),",")
+				ctx_grp := ""
+
+				for s := 0; s < len(cn); s++ {
+					ctx_grp += cn[s]
+					if s < len(cn)-1 {
+						ctx_grp += ", "
+					}
+				}
+
+				if len(ctx_grp) > 0 {
+					toc[rc] = append(toc[rc],ctx_grp)
+				}
+			}
+		}
+
+		row.Close()
+	}
+
+	return toc
+}
+//**************************************************************
+// Directories
+//**************************************************************
+
+func (pg *PostgresStore) ClearArrows() {
+
+	// The whole directory is uploaded again, see GraphToDB
+
+	pg.DB.QueryRow("drop table ArrowDirectory")
+	pg.DB.QueryRow("drop table ArrowInverses")
+
+	if !CreateTable(pg.sst(),ARROW_INVERSES_TABLE) {
+		fmt.Println("Unable to create table as, ",ARROW_INVERSES_TABLE)
+		os.Exit(-1)
+	}
+	if !CreateTable(pg.sst(),ARROW_DIRECTORY_TABLE) {
+		fmt.Println("Unable to create table as, ",ARROW_DIRECTORY_TABLE)
+		os.Exit(-1)
+	}
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) UploadArrow(arrow ArrowDirectory) {
+
+	qstr := UploadArrowToDBCommand(arrow)
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		s := fmt.Sprint("Failed to insert",err)
+		
+		if strings.Contains(s,"duplicate key") {
+		} else {
+			fmt.Println(s,"FAILED \n",qstr,err)
+		}
+		return
+	}
+
+	row.Close()
+}
+//**************************************************************
+
+func (pg *PostgresStore) UploadInverseArrow(plus,minus ArrowPtr) {
+
+	qstr := UploadInverseArrowToDBCommand(plus,minus)
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		s := fmt.Sprint("Failed to insert",err)
+		
+		if strings.Contains(s,"duplicate key") {
+		} else {
+			fmt.Println(s,"FAILED \n",qstr,err)
+		}
+		return
+	}
+	row.Close()
+}
+//**************************************************************
+
+func (pg *PostgresStore) DownloadArrows() ([]ArrowDirectory,map[ArrowPtr]ArrowPtr) {
+
+	var arrows []ArrowDirectory
+	var inverses = make(map[ArrowPtr]ArrowPtr)
+
+	qstr := fmt.Sprintf("SELECT STAindex,Long,Short,ArrPtr FROM ArrowDirectory ORDER BY ArrPtr")
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY Download Arrows Failed",err)
+	}
+
+	var staidx int
+	var long string
+	var short string
+	var ptr ArrowPtr
+	var ad ArrowDirectory
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&staidx,&long,&short,&ptr)
+			ad.STAindex = staidx
+			ad.Long = long
+			ad.Short = short
+			ad.Ptr = ptr
+
+			arrows = append(arrows,ad)
+		}
+
+		row.Close()
+	}
+
+	// Get Inverses
+
+	qstr = fmt.Sprintf("SELECT Plus,Minus FROM ArrowInverses ORDER BY Plus")
+
+	row, err = pg.DB.Query(qstr)
+	
+	if err != nil {    
+		fmt.Println("QUERY Download Inverses Failed",err)
+	}
+
+	var plus,minus ArrowPtr
+
+	if row != nil {
+		for row.Next() {		
+
+			err = row.Scan(&plus,&minus)
+
+			if err != nil {
+				fmt.Println("QUERY Download Arrows Failed",err)
+			}
+
+			inverses[plus] = minus
+		}
+		row.Close()
+	}
+
+	return arrows,inverses
+}
+//**************************************************************
+
+func (pg *PostgresStore) UploadContext(contextstring string,ptr ContextPtr) ContextPtr {
+
+	a := SQLEscape(contextstring)
+	b := ptr
+
+	// Make sure neither a nor b are previously defined
+
+	qstr := fmt.Sprintf("SELECT IdempInsertContext('%s',%d)",a,b)
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("FAILED \n",qstr,err)
+	}
+
+	var cptr ContextPtr
+
+	if row != nil {
+		for row.Next() {
+			err = row.Scan(&cptr)
+		}
+		row.Close()
+	}
+
+	return cptr
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetContextByName(src string) (string,ContextPtr) {
+
+	var qstr string
+
+	remove_accents,stripped := IsBracketedSearchTerm(src)
+
+	if remove_accents {
+		search := stripped
+		qstr = fmt.Sprintf("SELECT DISTINCT Context,CtxPtr FROM ContextDirectory WHERE unaccent(Context)='%s'",search)
+	} else {
+		search := src
+		qstr = fmt.Sprintf("SELECT DISTINCT Context,CtxPtr FROM ContextDirectory WHERE Context='%s'",search)
+	}
+
+	row, err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("QUERY GetDBContextByName",err)
+	}
+
+	var whole string
+	var ptr int
+
+	// Assume unique match for this, to be fixed elsewhere
+
+	if row != nil {
+		for row.Next() {
+			err = row.Scan(&whole,&ptr)
+		}
+		row.Close()
+	}
+
+	return whole,ContextPtr(ptr)
+
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetContextByPtr(ptr ContextPtr) (string,ContextPtr) {
+
+	qstr := fmt.Sprintf("SELECT DISTINCT Context,CtxPtr FROM ContextDirectory WHERE CtxPtr=%d",ptr)
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY GetDBContextssByPtr",err)
+	}
+
+	var retctx string
+	var retptr int
+
+	// Assume unique match for this, to be fixed elsewhere
+
+	if row != nil {
+		for row.Next() {
+			err = row.Scan(&retctx,&retptr)
+		}
+
+		row.Close()
+	}
+
+	return retctx,ContextPtr(retptr)
+}
+//**************************************************************
+
+func (pg *PostgresStore) DownloadContexts() []ContextDirectory {
+
+	var contexts []ContextDirectory
+
+	qstr := fmt.Sprintf("SELECT Context,CtxPtr FROM ContextDirectory ORDER BY CtxPtr")
+
+	row, err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("QUERY Download Arrows Failed",err)
+	}
+
+	var context string
+	var ptr ContextPtr
+
+	if row != nil {
+		for row.Next() {		
+			err = row.Scan(&context,&ptr)
+
+			var c ContextDirectory
+
+			c.Context = context
+			c.Ptr = ptr
+
+			contexts = append(contexts,c)
+		}
+
+		row.Close()
+	}
+
+	return contexts
+}
+//**************************************************************
+// Access statistics
+//**************************************************************
+
+func (pg *PostgresStore) LastSawSection(user,name string) {
+
+	s := fmt.Sprintf("select LastSawSection('%s','%s')",SQLEscape(name),SQLEscape(user))
+	pg.DB.QueryRow(s)
+}
+//**************************************************************
+
+func (pg *PostgresStore) LastSawNPtr(user string,nptr NodePtr,name string) {
+
+	s := fmt.Sprintf("select LastSawNPtr('(%d,%d)','%s','%s')",nptr.Class,nptr.CPtr,SQLEscape(name),SQLEscape(user))
+	pg.DB.QueryRow(s)
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) GetLastSeen(user string) []LastSeen {
+
+	qstr := fmt.Sprintf("SELECT section,nptr,EXTRACT(EPOCH FROM first),EXTRACT(EPOCH FROM last),freq,delta as pdelta,EXTRACT(EPOCH FROM NOW()-last) as ndelta from Lastseen WHERE username='%s' ORDER BY section",SQLEscape(user))
+
+	row,err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("GetLastSawSection failed\n",qstr,err)
+		return nil
+	}
+
+	var ret []LastSeen
+
+	if row != nil {
+		for row.Next() {		
+			var ls LastSeen
+			var nptrstr string // last because if empty fails
+			var first,last float64
+			err = row.Scan(&ls.Section,&nptrstr,&first,&last,&ls.Freq,&ls.Pdelta,&ls.Ndelta)
+			ls.Last = int64(last)
+			ls.First = int64(first)
+			fmt.Sscanf(nptrstr,"(%d,%d)",&ls.NPtr.Class,&ls.NPtr.CPtr)
+			ret = append(ret,ls)
+		}
+
+		row.Close()
+	}
+
+	return ret
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetLastSeenNPtr(user string,nptr NodePtr) LastSeen {
+
+	var ls LastSeen
+
+	qstr := fmt.Sprintf("SELECT section,EXTRACT(EPOCH FROM first),EXTRACT(EPOCH FROM last),freq,delta as pdelta,EXTRACT(EPOCH FROM NOW()-last) as ndelta from Lastseen WHERE NPTR='(%d,%d)'::NodePtr AND username='%s'",nptr.Class,nptr.CPtr,SQLEscape(user))
+
+	row,err := pg.DB.Query(qstr)
+
+	if err != nil {
+		fmt.Println("GetLastSawNPtr failed\n",qstr,err)
+		return ls
+	}
+
+	if row != nil {
+		for row.Next() {
+			var first,last float64
+			err = row.Scan(&ls.Section,&first,&last,&ls.Freq,&ls.Pdelta,&ls.Ndelta)
+			ls.Last = int64(last)
+			ls.First = int64(first)
+		}
+
+		ls.NPtr = nptr
+
+		row.Close()
+	}
+
+	return ls
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetSeenNPtrs(user string,horizon int) []NodePtr {
+
+	var qstr string
+	var nptrs []NodePtr
+
+	switch horizon {
+
+	case RECENT:
+		qstr = fmt.Sprintf("SELECT NPtr FROM LastSeen WHERE last > NOW() - INTERVAL '%d hour' AND username='%s'",horizon,SQLEscape(user))
+	case NEVER:
+		qstr = fmt.Sprintf("SELECT NPtr FROM LastSeen WHERE username='%s'",SQLEscape(user))
+	default:
+		return nptrs
+	}
+
+	row,err := pg.DB.Query(qstr)
+	
+	if err != nil {
+		fmt.Println("Failed to get LastSeen",err)
+	}
+
+	var whole string
+	var nptr NodePtr
+
+	if row != nil {
+		for row.Next() {
+			err = row.Scan(&whole)
+			fmt.Sscanf(whole,"(%d,%d)",&nptr.Class,&nptr.CPtr)
+			nptrs = append(nptrs,nptr)
+		}
+		
+		row.Close()
+	}
+
+	return nptrs
+}
+//**************************************************************
+// Overlays
+//**************************************************************
+
+func (pg *PostgresStore) AddOverlay(ov Overlay) bool {
+
+	qstr := fmt.Sprintf("INSERT INTO UserOverlay (Username,NPtr,Chap,Note,Added) VALUES ($1,'(%d,%d)'::NodePtr,$2,$3,NOW())",ov.NPtr.Class,ov.NPtr.CPtr)
+
+	_,err := pg.DB.Exec(qstr,ov.User,ov.Chap,ov.Note)
+
+	if err != nil {
+		fmt.Println("Failed to add overlay",err)
+		return false
+	}
+
+	return true
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetOverlays(user,chap string) []Overlay {
+
+	chap_col := "true"
+
+	if chap != "" && chap != "any" && chap != "%%" {
+		chap_col = ChapterMatchSQL("Chap",SQLEscape(chap))
+	}
+
+	qstr := fmt.Sprintf("SELECT NPtr,Chap,Note,EXTRACT(EPOCH FROM Added) FROM UserOverlay WHERE Username=$1 AND %s ORDER BY Added",chap_col)
+
+	return pg.queryOverlays(qstr,user)
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetNodeOverlays(user string,nptr NodePtr) []Overlay {
+
+	qstr := fmt.Sprintf("SELECT NPtr,Chap,Note,EXTRACT(EPOCH FROM Added) FROM UserOverlay WHERE Username=$1 AND NPtr='(%d,%d)'::NodePtr ORDER BY Added",nptr.Class,nptr.CPtr)
+
+	return pg.queryOverlays(qstr,user)
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetNodesOverlays(user string,nptrs []NodePtr) map[NodePtr][]Overlay {
+
+	var retval = make(map[NodePtr][]Overlay)
+
+	if len(nptrs) == 0 {
+		return retval
+	}
+
+	qstr := fmt.Sprintf("SELECT NPtr,Chap,Note,EXTRACT(EPOCH FROM Added) FROM UserOverlay WHERE Username=$1 AND NPtr = ANY(%s::NodePtr[]) ORDER BY Added",FormatSQLNodePtrArray(nptrs))
+
+	for _,ov := range pg.queryOverlays(qstr,user) {
+		retval[ov.NPtr] = append(retval[ov.NPtr],ov)
+	}
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) queryOverlays(qstr string,user string) []Overlay {
+
+	row,err := pg.DB.Query(qstr,user)
+
+	if err != nil {
+		fmt.Println("QueryOverlays failed",qstr,err)
+		return nil
+	}
+
+	var retval []Overlay
+
+	for row.Next() {
+
+		var ov Overlay
+		var whole string
+		var added float64
+
+		err = row.Scan(&whole,&ov.Chap,&ov.Note,&added)
+
+		if err != nil {
+			fmt.Println("QueryOverlays scan failed",err)
+			continue
+		}
+
+		fmt.Sscanf(whole,"(%d,%d)",&ov.NPtr.Class,&ov.NPtr.CPtr)
+		ov.User = user
+		ov.Added = int64(added)
+		retval = append(retval,ov)
+	}
+
+	row.Close()
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) RemoveOverlays(user string,nptr NodePtr) int {
+
+	qstr := fmt.Sprintf("DELETE FROM UserOverlay WHERE Username=$1 AND NPtr='(%d,%d)'::NodePtr",nptr.Class,nptr.CPtr)
+
+	result,err := pg.DB.Exec(qstr,user)
+
+	if err != nil {
+		fmt.Println("Failed to remove overlays",err)
+		return 0
+	}
+
+	count,_ := result.RowsAffected()
+
+	return int(count)
+}
+//**************************************************************
+// Review
+//**************************************************************
+
+func (pg *PostgresStore) GetReviewCard(user string,nptr NodePtr) (ReviewCard,bool) {
+
+	qstr := fmt.Sprintf("SELECT NPtr,Chap,Ease,Days,Reps,Lapses,EXTRACT(EPOCH FROM Due),EXTRACT(EPOCH FROM Last) FROM Review WHERE Username=$1 AND NPtr='(%d,%d)'::NodePtr",nptr.Class,nptr.CPtr)
+
+	cards := pg.queryReviewCards(qstr,user)
+
+	if len(cards) == 0 {
+		return ReviewCard{},false
+	}
+
+	return cards[0],true
+}
+//**************************************************************
+
+func (pg *PostgresStore) GetReviewCards(user string) []ReviewCard {
+
+	qstr := "SELECT NPtr,Chap,Ease,Days,Reps,Lapses,EXTRACT(EPOCH FROM Due),EXTRACT(EPOCH FROM Last) FROM Review WHERE Username=$1"
+
+	return pg.queryReviewCards(qstr,user)
+}
+//**************************************************************
+
+func (pg *PostgresStore) queryReviewCards(qstr,user string) []ReviewCard {
+
+	row,err := pg.DB.Query(qstr,user)
+
+	if err != nil {
+		fmt.Println("QueryReviewCards failed",qstr,err)
+		return nil
+	}
+
+	var retval []ReviewCard
+
+	for row.Next() {
+
+		var card ReviewCard
+		var whole string
+		var due,last float64
+
+		err = row.Scan(&whole,&card.Chap,&card.Ease,&card.Days,&card.Reps,&card.Lapses,&due,&last)
+
+		if err != nil {
+			fmt.Println("QueryReviewCards scan failed",err)
+			continue
+		}
+
+		fmt.Sscanf(whole,"(%d,%d)",&card.NPtr.Class,&card.NPtr.CPtr)
+		card.User = user
+		card.Due = int64(due)
+		card.Last = int64(last)
+		retval = append(retval,card)
+	}
+
+	row.Close()
+
+	return retval
+}
+//**************************************************************
+
+func (pg *PostgresStore) SaveReviewCard(card ReviewCard) {
+
+	qstr := fmt.Sprintf("INSERT INTO Review (Username,NPtr,Chap,Ease,Days,Reps,Lapses,Due,Last) "+
+		"VALUES ($1,'(%d,%d)'::NodePtr,$2,$3,$4,$5,$6,to_timestamp($7),to_timestamp($8)) "+
+		"ON CONFLICT (Username,NPtr) DO UPDATE SET Chap=EXCLUDED.Chap,Ease=EXCLUDED.Ease,Days=EXCLUDED.Days,"+
+		"Reps=EXCLUDED.Reps,Lapses=EXCLUDED.Lapses,Due=EXCLUDED.Due,Last=EXCLUDED.Last",card.NPtr.Class,card.NPtr.CPtr)
+
+	_,err := pg.DB.Exec(qstr,card.User,card.Chap,card.Ease,card.Days,card.Reps,card.Lapses,card.Due,card.Last)
+
+	if err != nil {
+		fmt.Println("Failed to save review card",err)
+	}
+}
+//**************************************************************
+// Short term memory
+//**************************************************************
+
+func (pg *PostgresStore) GetSTM(user,session string) []STMEntry {
+
+	qstr := "SELECT Token,Intent,Freq,EXTRACT(EPOCH FROM Last),Delta,Slot FROM STM WHERE Username=$1 AND Session=$2"
+
+	row,err := pg.DB.Query(qstr,user,session)
+
+	if err != nil {
+		fmt.Println("LoadSTM failed",err)
+		return nil
+	}
+
+	var entries []STMEntry
+
+	for row.Next() {
+
+		var e STMEntry
+		var last float64
+
+		err = row.Scan(&e.Token,&e.Intent,&e.Freq,&last,&e.Delta,&e.Time)
+
+		if err != nil {
+			fmt.Println("LoadSTM scan failed",err)
+			continue
+		}
+
+		e.Last = int64(last)
+		entries = append(entries,e)
+	}
+
+	row.Close()
+
+	return entries
+}
+//**************************************************************
+
+func (pg *PostgresStore) SaveSTM(user,session string,changed []STMEntry,forgotten []string) {
+
+	tx,err := pg.DB.Begin()
+
+	if err != nil {
+		fmt.Println("SaveSTM failed",err)
+		return
+	}
+
+	for _,e := range changed {
+
+		_,err = tx.Exec("INSERT INTO STM (Username,Session,Token,Intent,Freq,Last,Delta,Slot) "+
+			"VALUES ($1,$2,$3,$4,$5,to_timestamp($6),$7,$8) "+
+			"ON CONFLICT (Username,Session,Token) DO UPDATE SET "+
+			"Intent=EXCLUDED.Intent,Freq=EXCLUDED.Freq,Last=EXCLUDED.Last,Delta=EXCLUDED.Delta,Slot=EXCLUDED.Slot",
+			user,session,e.Token,e.Intent,e.Freq,e.Last,e.Delta,e.Time)
+
+		if err != nil {
+			break
+		}
+	}
+
+	for _,token := range forgotten {
+
+		if err != nil {
+			break
+		}
+
+		_,err = tx.Exec("DELETE FROM STM WHERE Username=$1 AND Session=$2 AND Token=$3",user,session,token)
+	}
+
+	if err != nil {
+		fmt.Println("SaveSTM failed",err)
+		tx.Rollback()
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		fmt.Println("SaveSTM commit failed",err)
+	}
+}
+//**************************************************************
+
+func (pg *PostgresStore) Sync() {
+
+	IndexDB(pg.sst())
+}
+
+//**************************************************************
+
+func (pg *PostgresStore) Close() {
+	pg.DB.Close()
+}
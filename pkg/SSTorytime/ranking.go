@@ -0,0 +1,203 @@
+//**************************************************************
+//
+// ranking.go - ordering search matches by how well they fit the
+// situation, i.e. the overlap between each node's context and
+// the user's short term memory (see stm.go) and the time now
+//
+// The STM keeps the intentional (exceptional) and ambient
+// (repeated) fragments of recent searches, as in the research
+// on ContextIntentAnalysis. An intended fragment says more about
+// what the user is looking for, so it weighs more than an ambient
+// one, and the time tags of DoNowt weigh least. A fragment fades
+// to half its weight as it approaches being forgotten. Matches
+// that score the same keep the order of the lookup
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+//**************************************************************
+
+const (
+	RANK_INTENT = 2.0
+	RANK_AMBIENT = 1.0
+	RANK_NOW = 0.5
+)
+
+//**************************************************************
+
+type ContextRank struct {
+
+	NPtr    NodePtr
+	Score   float64
+	Intent  []string // intended STM fragments found in the node's context
+	Ambient []string // ambient STM fragments found
+	Now     []string // time tags of the moment found
+	Why     string
+}
+
+//**************************************************************
+
+type RankFragment struct {
+
+	Text   string
+	Weight float64
+}
+
+//**************************************************************
+
+func RankByContext(sst PoSST,nptrs []NodePtr) ([]NodePtr,map[NodePtr]ContextRank) {
+
+	// Returns the nodes, most situationally relevant first
+
+	ranks := make(map[NodePtr]ContextRank)
+
+	if len(nptrs) == 0 {
+		return nptrs,ranks
+	}
+
+	ambient,_,now := GetTimeContext()
+
+	var intended,repeated,tags []RankFragment
+
+	forget := int64(STMForgetting().Seconds())
+
+	for _,e := range GetSTM(sst) {
+
+		age := now - e.Last
+
+		if e.Delta > forget || age > forget {
+			continue
+		}
+
+		fade := 1.0 - float64(age) / float64(2*forget)
+
+		if e.Intent {
+			intended = append(intended,RankFragment{ Text: e.Token, Weight: RANK_INTENT * fade })
+		} else {
+			repeated = append(repeated,RankFragment{ Text: e.Token, Weight: RANK_AMBIENT * fade })
+		}
+	}
+
+	for _,tag := range strings.Split(ambient,", ") {
+		tags = append(tags,RankFragment{ Text: tag, Weight: RANK_NOW })
+	}
+
+	for _,nptr := range nptrs {
+		ranks[nptr] = RankNodeContext(sst,nptr,intended,repeated,tags)
+	}
+
+	ranked := make([]NodePtr,len(nptrs))
+	copy(ranked,nptrs)
+
+	sort.SliceStable(ranked,func(i,j int) bool {
+		return ranks[ranked[i]].Score > ranks[ranked[j]].Score
+	})
+
+	return ranked,ranks
+}
+
+//**************************************************************
+
+func RankNodeContext(sst PoSST,nptr NodePtr,intended,repeated,tags []RankFragment) ContextRank {
+
+	var rank ContextRank
+	var why []string
+
+	rank.NPtr = nptr
+
+	node := GetDBNodeByNodePtr(sst,nptr)
+	words := ContextWords(GetNodeContext(sst,node))
+
+	why = MatchFragments(&rank,&rank.Intent,"intended",intended,words,node.Chap,why)
+	why = MatchFragments(&rank,&rank.Ambient,"ambient",repeated,words,node.Chap,why)
+	why = MatchFragments(&rank,&rank.Now,"now",tags,words,node.Chap,why)
+
+	if why == nil {
+		rank.Why = "no overlap with the current context"
+	} else {
+		rank.Why = fmt.Sprintf("score %.2f: %s",rank.Score,strings.Join(why,"; "))
+	}
+
+	return rank
+}
+
+//**************************************************************
+
+func MatchFragments(rank *ContextRank,found *[]string,class string,frags []RankFragment,words map[string]bool,chapter string,why []string) []string {
+
+	var parts []string
+
+	for _,frag := range frags {
+		if FragmentInContext(frag.Text,words,chapter) {
+			*found = append(*found,frag.Text)
+			rank.Score += frag.Weight
+			parts = append(parts,fmt.Sprintf("%s +%.2f",frag.Text,frag.Weight))
+		}
+	}
+
+	if parts != nil {
+		why = append(why,class+" "+strings.Join(parts,", "))
+	}
+
+	return why
+}
+
+//**************************************************************
+
+func ContextWords(context []string) map[string]bool {
+
+	// Context parts can be compound, e.g. Day3.September or a|b
+
+	var words = make(map[string]bool)
+
+	for _,part := range context {
+		for _,w := range SplitContextWords(part) {
+			words[w] = true
+		}
+	}
+
+	return words
+}
+
+//**************************************************************
+
+func SplitContextWords(s string) []string {
+
+	return strings.FieldsFunc(strings.ToLower(s),func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+//**************************************************************
+
+func FragmentInContext(frag string,words map[string]bool,chapter string) bool {
+
+	// The STM remembers \chapter searches as Chapter:name
+
+	if strings.HasPrefix(frag,"Chapter:") {
+		name := strings.ToLower(strings.TrimPrefix(frag,"Chapter:"))
+		return name != "" && strings.Contains(strings.ToLower(chapter),name)
+	}
+
+	fragwords := SplitContextWords(frag)
+
+	if len(fragwords) == 0 {
+		return false
+	}
+
+	for _,w := range fragwords {
+		if !words[w] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,1793 @@
+//**************************************************************
+//
+// RDF exchange: reading Turtle/N-Triples into SST, and writing
+// chapters back out as Turtle
+//
+// RDF predicates become arrows. Each needs an ST type, which is
+// either declared with the sst:sttype annotation (as written by
+// ChapterToTurtle), or guessed from the words in its name, and
+// an inverse, either from owl:inverseOf or made up. Predicates
+// whose names match an existing arrow use that arrow
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//**************************************************************
+
+const (
+	RDF_IRI = iota
+	RDF_BLANK
+	RDF_LITERAL
+
+	RDF_NS = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	RDFS_NS = "http://www.w3.org/2000/01/rdf-schema#"
+	OWL_NS = "http://www.w3.org/2002/07/owl#"
+	XSD_NS = "http://www.w3.org/2001/XMLSchema#"
+	SKOS_NS = "http://www.w3.org/2004/02/skos/core#"
+
+	SST_NS = "https://github.com/markburgess/SSTorytime/ns#"
+	SST_ARROW_NS = "https://github.com/markburgess/SSTorytime/arrow#"
+	SST_NODE_NS = "https://github.com/markburgess/SSTorytime/node#"
+)
+
+//**************************************************************
+
+type RDFTerm struct {
+
+	Kind     int
+	Value    string // IRI, blank node label or lexical form
+	Lang     string
+	Datatype string
+}
+
+//**************************************************************
+
+type Triple struct {
+
+	S,P,O RDFTerm
+}
+
+//**************************************************************
+
+type ImportArrow struct {
+
+	STType   int    // of the forward arrow
+	Long     string
+	Short    string
+	InvLong  string
+	InvShort string
+	Exists   bool   // already in the arrow directory
+}
+
+//**************************************************************
+
+type ImportLink struct {
+
+	From,To string // node texts
+	Arrow   string // short name
+	Context []string
+	Weight  float32
+}
+
+//**************************************************************
+
+type GraphImport struct {
+
+	Origin string            // e.g. RDF, JSON
+	Arrows []*ImportArrow    // pairs needed, new or existing
+	Using  map[string]string // predicate IRI or key -> arrow short name
+	Links  []ImportLink
+}
+
+//**************************************************************
+
+func (t RDFTerm) Key() string {
+
+	switch t.Kind {
+	case RDF_BLANK:
+		return "_:"+t.Value
+	case RDF_LITERAL:
+		return "\""+t.Value+"\"@"+t.Lang+"^^"+t.Datatype
+	}
+
+	return t.Value
+}
+
+//**************************************************************
+// Turtle parser, also reads N-Triples
+//**************************************************************
+
+type turtleParser struct {
+
+	src      []rune
+	pos      int
+	line     int
+	base     string
+	prefixes map[string]string
+	bnodes   int
+	triples  []Triple
+}
+
+//**************************************************************
+
+func ParseTurtle(text string) ([]Triple,error) {
+
+	var p turtleParser
+
+	p.src = []rune(text)
+	p.line = 1
+	p.prefixes = make(map[string]string)
+
+	for {
+		p.skip()
+
+		if p.pos >= len(p.src) {
+			break
+		}
+
+		if err := p.statement(); err != nil {
+			return p.triples,fmt.Errorf("line %d: %v",p.line,err)
+		}
+	}
+
+	return p.triples,nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) skip() {
+
+	// White space and comments
+
+	for p.pos < len(p.src) {
+
+		switch {
+		case p.src[p.pos] == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case p.src[p.pos] == '\n':
+			p.line++
+			p.pos++
+		case unicode.IsSpace(p.src[p.pos]):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+//**************************************************************
+
+func (p *turtleParser) peek() rune {
+
+	p.skip()
+
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+
+	return 0
+}
+
+//**************************************************************
+
+func (p *turtleParser) expect(r rune) error {
+
+	if p.peek() != r {
+		if p.pos >= len(p.src) {
+			return fmt.Errorf("expected '%c' at end of input",r)
+		}
+		return fmt.Errorf("expected '%c' but found '%c'",r,p.src[p.pos])
+	}
+
+	p.pos++
+	return nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) keyword(word string) bool {
+
+	// Case insensitive SPARQL-style PREFIX and BASE, followed by space
+
+	end := p.pos+len(word)
+
+	if end >= len(p.src) || !strings.EqualFold(string(p.src[p.pos:end]),word) || !unicode.IsSpace(p.src[end]) {
+		return false
+	}
+
+	p.pos = end
+	return true
+}
+
+//**************************************************************
+
+func (p *turtleParser) statement() error {
+
+	switch {
+
+	case p.keyword("@prefix"),p.keyword("prefix"):
+		return p.prefix()
+
+	case p.keyword("@base"),p.keyword("base"):
+		iri,err := p.iriref()
+		if err != nil {
+			return err
+		}
+		p.base = iri
+		if p.peek() == '.' {
+			p.pos++
+		}
+		return nil
+	}
+
+	subject,err := p.subject()
+
+	if err != nil {
+		return err
+	}
+
+	// A [ ... ] subject may stand alone
+
+	if !(subject.Kind == RDF_BLANK && p.peek() == '.') {
+		if err = p.predicateObjectList(subject); err != nil {
+			return err
+		}
+	}
+
+	return p.expect('.')
+}
+
+//**************************************************************
+
+func (p *turtleParser) prefix() error {
+
+	p.skip()
+	start := p.pos
+
+	for p.pos < len(p.src) && p.src[p.pos] != ':' && !unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+
+	if p.pos >= len(p.src) || p.src[p.pos] != ':' {
+		return fmt.Errorf("expected prefix name ending in ':'")
+	}
+
+	name := string(p.src[start:p.pos])
+	p.pos++
+
+	p.skip()
+	iri,err := p.iriref()
+
+	if err != nil {
+		return err
+	}
+
+	p.prefixes[name] = iri
+
+	if p.peek() == '.' {
+		p.pos++
+	}
+
+	return nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) iriref() (string,error) {
+
+	if err := p.expect('<'); err != nil {
+		return "",err
+	}
+
+	var iri []rune
+
+	for p.pos < len(p.src) && p.src[p.pos] != '>' {
+
+		if p.src[p.pos] == '\\' {
+			r,err := p.escape()
+			if err != nil {
+				return "",err
+			}
+			iri = append(iri,r)
+			continue
+		}
+
+		iri = append(iri,p.src[p.pos])
+		p.pos++
+	}
+
+	if p.pos >= len(p.src) {
+		return "",fmt.Errorf("unterminated <IRI>")
+	}
+
+	p.pos++
+
+	return p.resolve(string(iri)),nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) resolve(iri string) string {
+
+	if p.base == "" || strings.Contains(iri,":") {
+		return iri
+	}
+
+	base,err := url.Parse(p.base)
+
+	if err != nil {
+		return p.base+iri
+	}
+
+	ref,err := url.Parse(iri)
+
+	if err != nil {
+		return p.base+iri
+	}
+
+	return base.ResolveReference(ref).String()
+}
+
+//**************************************************************
+
+func (p *turtleParser) escape() (rune,error) {
+
+	// At a backslash: \n \t etc, \uXXXX or \UXXXXXXXX
+
+	p.pos++
+
+	if p.pos >= len(p.src) {
+		return 0,fmt.Errorf("backslash at end of input")
+	}
+
+	c := p.src[p.pos]
+	p.pos++
+
+	switch c {
+	case 't':
+		return '\t',nil
+	case 'n':
+		return '\n',nil
+	case 'r':
+		return '\r',nil
+	case 'b':
+		return '\b',nil
+	case 'f':
+		return '\f',nil
+	case 'u','U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.src) {
+			return 0,fmt.Errorf("short \\%c escape",c)
+		}
+		code,err := strconv.ParseUint(string(p.src[p.pos:p.pos+size]),16,32)
+		if err != nil {
+			return 0,fmt.Errorf("bad \\%c escape",c)
+		}
+		p.pos += size
+		return rune(code),nil
+	}
+
+	return c,nil // \" \' \\ and the like stand for themselves
+}
+
+//**************************************************************
+
+func (p *turtleParser) subject() (RDFTerm,error) {
+
+	switch p.peek() {
+	case '[':
+		return p.blankNodePropertyList()
+	case '(':
+		return p.collection()
+	}
+
+	term,err := p.iriOrBlank()
+
+	if err == nil && term.Kind == RDF_LITERAL {
+		err = fmt.Errorf("a literal can't be a subject")
+	}
+
+	return term,err
+}
+
+//**************************************************************
+
+func (p *turtleParser) predicateObjectList(subject RDFTerm) error {
+
+	for {
+		predicate,err := p.verb()
+
+		if err != nil {
+			return err
+		}
+
+		for {
+			object,err := p.object()
+
+			if err != nil {
+				return err
+			}
+
+			p.triples = append(p.triples,Triple{S: subject, P: predicate, O: object})
+
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+
+		// Any number of ; and possibly a trailing one
+
+		if p.peek() != ';' {
+			return nil
+		}
+
+		for p.peek() == ';' {
+			p.pos++
+		}
+
+		if next := p.peek(); next == '.' || next == ']' || next == 0 {
+			return nil
+		}
+	}
+}
+
+//**************************************************************
+
+func (p *turtleParser) verb() (RDFTerm,error) {
+
+	p.skip()
+
+	if p.pos+1 < len(p.src) && p.src[p.pos] == 'a' && (unicode.IsSpace(p.src[p.pos+1]) || p.src[p.pos+1] == '<') {
+		p.pos++
+		return RDFTerm{Kind: RDF_IRI, Value: RDF_NS+"type"},nil
+	}
+
+	term,err := p.iriOrBlank()
+
+	if err == nil && term.Kind != RDF_IRI {
+		err = fmt.Errorf("a predicate must be an IRI")
+	}
+
+	return term,err
+}
+
+//**************************************************************
+
+func (p *turtleParser) object() (RDFTerm,error) {
+
+	switch r := p.peek(); {
+
+	case r == '[':
+		return p.blankNodePropertyList()
+
+	case r == '(':
+		return p.collection()
+
+	case r == '"' || r == '\'':
+		return p.literal()
+
+	case r == '+' || r == '-' || r == '.' || unicode.IsDigit(r):
+		return p.number()
+	}
+
+	for _,b := range []string{"true","false"} {
+
+		end := p.pos+len(b)
+
+		if end <= len(p.src) && string(p.src[p.pos:end]) == b && (end == len(p.src) || !IsPNChar(p.src[end])) {
+			p.pos = end
+			return RDFTerm{Kind: RDF_LITERAL, Value: b, Datatype: XSD_NS+"boolean"},nil
+		}
+	}
+
+	return p.iriOrBlank()
+}
+
+//**************************************************************
+
+func (p *turtleParser) iriOrBlank() (RDFTerm,error) {
+
+	if p.peek() == '<' {
+		iri,err := p.iriref()
+		return RDFTerm{Kind: RDF_IRI, Value: iri},err
+	}
+
+	if p.pos+1 < len(p.src) && p.src[p.pos] == '_' && p.src[p.pos+1] == ':' {
+		p.pos += 2
+		return RDFTerm{Kind: RDF_BLANK, Value: p.localName()},nil
+	}
+
+	// A prefixed name, prefix:local
+
+	start := p.pos
+
+	for p.pos < len(p.src) && p.src[p.pos] != ':' && IsPNChar(p.src[p.pos]) {
+		p.pos++
+	}
+
+	if p.pos >= len(p.src) || p.src[p.pos] != ':' {
+		p.pos = start
+		return RDFTerm{},fmt.Errorf("expected an IRI, prefixed name or blank node near \"%s\"",p.context())
+	}
+
+	prefix := string(p.src[start:p.pos])
+	p.pos++
+
+	ns,ok := p.prefixes[prefix]
+
+	if !ok {
+		return RDFTerm{},fmt.Errorf("undeclared prefix \"%s:\"",prefix)
+	}
+
+	return RDFTerm{Kind: RDF_IRI, Value: ns+p.localName()},nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) localName() string {
+
+	var local []rune
+
+	for p.pos < len(p.src) {
+
+		r := p.src[p.pos]
+
+		if r == '\\' && p.pos+1 < len(p.src) {
+			local = append(local,p.src[p.pos+1])
+			p.pos += 2
+			continue
+		}
+
+		if !IsPNChar(r) && r != ':' && r != '%' {
+			break
+		}
+
+		local = append(local,r)
+		p.pos++
+	}
+
+	// A name can't end with '.', which ends the statement instead
+
+	for len(local) > 0 && local[len(local)-1] == '.' {
+		local = local[:len(local)-1]
+		p.pos--
+	}
+
+	return string(local)
+}
+
+//**************************************************************
+
+func IsPNChar(r rune) bool {
+
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == 0xB7
+}
+
+//**************************************************************
+
+func (p *turtleParser) context() string {
+
+	end := min(p.pos+20,len(p.src))
+	return string(p.src[p.pos:end])
+}
+
+//**************************************************************
+
+func (p *turtleParser) literal() (RDFTerm,error) {
+
+	quote := p.src[p.pos]
+	long := p.pos+2 < len(p.src) && p.src[p.pos+1] == quote && p.src[p.pos+2] == quote
+
+	if long {
+		p.pos += 3
+	} else {
+		p.pos++
+	}
+
+	var text []rune
+
+	for {
+		if p.pos >= len(p.src) {
+			return RDFTerm{},fmt.Errorf("unterminated string")
+		}
+
+		r := p.src[p.pos]
+
+		if r == '\\' {
+			esc,err := p.escape()
+			if err != nil {
+				return RDFTerm{},err
+			}
+			text = append(text,esc)
+			continue
+		}
+
+		if r == quote {
+			if !long {
+				p.pos++
+				break
+			}
+			if p.pos+2 < len(p.src) && p.src[p.pos+1] == quote && p.src[p.pos+2] == quote {
+				p.pos += 3
+				break
+			}
+		}
+
+		if r == '\n' {
+			if !long {
+				return RDFTerm{},fmt.Errorf("newline in a short string")
+			}
+			p.line++
+		}
+
+		text = append(text,r)
+		p.pos++
+	}
+
+	term := RDFTerm{Kind: RDF_LITERAL, Value: string(text)}
+
+	if p.pos < len(p.src) && p.src[p.pos] == '@' {
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.src) && (unicode.IsLetter(p.src[p.pos]) || unicode.IsDigit(p.src[p.pos]) || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		term.Lang = string(p.src[start:p.pos])
+	} else if p.pos+1 < len(p.src) && p.src[p.pos] == '^' && p.src[p.pos+1] == '^' {
+		p.pos += 2
+		dt,err := p.iriOrBlank()
+		if err != nil {
+			return RDFTerm{},err
+		}
+		term.Datatype = dt.Value
+	}
+
+	return term,nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) number() (RDFTerm,error) {
+
+	start := p.pos
+	datatype := "integer"
+
+	for p.pos < len(p.src) {
+
+		r := p.src[p.pos]
+		sign := (r == '+' || r == '-') && (p.pos == start || p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')
+
+		if r == '.' && p.pos+1 < len(p.src) && unicode.IsDigit(p.src[p.pos+1]) {
+			datatype = "decimal"
+		} else if r == 'e' || r == 'E' {
+			datatype = "double"
+		} else if !unicode.IsDigit(r) && !sign {
+			break
+		}
+
+		p.pos++
+	}
+
+	if p.pos == start {
+		return RDFTerm{},fmt.Errorf("unexpected \"%s\"",p.context())
+	}
+
+	return RDFTerm{Kind: RDF_LITERAL, Value: string(p.src[start:p.pos]), Datatype: XSD_NS+datatype},nil
+}
+
+//**************************************************************
+
+func (p *turtleParser) newBlank() RDFTerm {
+
+	p.bnodes++
+	return RDFTerm{Kind: RDF_BLANK, Value: fmt.Sprintf("genid%d",p.bnodes)}
+}
+
+//**************************************************************
+
+func (p *turtleParser) blankNodePropertyList() (RDFTerm,error) {
+
+	p.pos++ // [
+
+	node := p.newBlank()
+
+	if p.peek() != ']' {
+		if err := p.predicateObjectList(node); err != nil {
+			return node,err
+		}
+	}
+
+	return node,p.expect(']')
+}
+
+//**************************************************************
+
+func (p *turtleParser) collection() (RDFTerm,error) {
+
+	// ( a b c ) as an rdf:first/rdf:rest list
+
+	p.pos++ // (
+
+	head := RDFTerm{Kind: RDF_IRI, Value: RDF_NS+"nil"}
+	var last RDFTerm
+
+	for p.peek() != ')' {
+
+		if p.pos >= len(p.src) {
+			return head,fmt.Errorf("unterminated collection")
+		}
+
+		item,err := p.object()
+
+		if err != nil {
+			return head,err
+		}
+
+		cell := p.newBlank()
+
+		if head.Kind == RDF_IRI {
+			head = cell
+		} else {
+			p.triples = append(p.triples,Triple{S: last, P: RDFTerm{Kind: RDF_IRI, Value: RDF_NS+"rest"}, O: cell})
+		}
+
+		p.triples = append(p.triples,Triple{S: cell, P: RDFTerm{Kind: RDF_IRI, Value: RDF_NS+"first"}, O: item})
+		last = cell
+	}
+
+	p.pos++ // )
+
+	if head.Kind == RDF_BLANK {
+		p.triples = append(p.triples,Triple{S: last, P: RDFTerm{Kind: RDF_IRI, Value: RDF_NS+"rest"}, O: RDFTerm{Kind: RDF_IRI, Value: RDF_NS+"nil"}})
+	}
+
+	return head,nil
+}
+
+//**************************************************************
+// Mapping RDF onto nodes and arrows
+//**************************************************************
+
+func RDFLocalName(iri string) string {
+
+	// The part after the last # or /, made readable
+
+	cut := max(strings.LastIndex(iri,"#"),strings.LastIndex(iri,"/"))
+
+	local := iri[cut+1:]
+
+	if decoded,err := url.PathUnescape(local); err == nil {
+		local = decoded
+	}
+
+	if local == "" {
+		return iri
+	}
+
+	return strings.ReplaceAll(local,"_"," ")
+}
+
+//**************************************************************
+
+func SplitCamelCase(s string) []string {
+
+	// hasPart -> has part, wasDerivedFrom -> was derived from
+
+	var words []string
+	var word []rune
+
+	runes := []rune(s)
+
+	for i,r := range runes {
+
+		if r == '_' || r == '-' || r == ' ' || r == '.' {
+			if len(word) > 0 {
+				words = append(words,strings.ToLower(string(word)))
+				word = nil
+			}
+			continue
+		}
+
+		if unicode.IsUpper(r) && len(word) > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			words = append(words,strings.ToLower(string(word)))
+			word = nil
+		}
+
+		word = append(word,r)
+	}
+
+	if len(word) > 0 {
+		words = append(words,strings.ToLower(string(word)))
+	}
+
+	return words
+}
+
+//**************************************************************
+
+func ClassifyPredicate(words []string) int {
+
+	// Guess the ST type of a relation from its name. Negative types
+	// are read in reverse, e.g. "part of" is the inverse of "contains"
+
+	has := func(list ...string) bool {
+		for _,w := range words {
+			for _,l := range list {
+				if w == l {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	last := ""
+
+	if len(words) > 0 {
+		last = words[len(words)-1]
+	}
+
+	switch {
+
+	case has("same","similar","equivalent","synonym","related","match","near","like","sibling","also","alias"):
+		return NEAR
+
+	case has("after","follows","following","previous","prior","caused","derived","generated","preceded"):
+		return -LEADSTO
+
+	case has("causes","cause","leads","next","then","precedes","before","produces","results","triggers","enables","becomes","generates","succeeded"):
+		return LEADSTO
+
+	}
+
+	part := has("part","parts","member","members","element","elements","component","subset","instance","class")
+
+	switch {
+
+	case has("type","within","inside","broader") || (part && (last == "of" || last == "in")):
+		return -CONTAINS
+
+	case part || has("contains","includes","narrower","consists"):
+		return CONTAINS
+	}
+
+	return EXPRESS
+}
+
+//**************************************************************
+
+func InverseArrowName(long string) string {
+
+	words := strings.Fields(long)
+	n := len(words)
+
+	switch {
+
+	case n > 2 && words[0] == "is" && words[n-1] == "of":
+		return "has "+strings.Join(words[1:n-1]," ")   // is part of -> has part
+
+	case n > 1 && words[0] == "has":
+		return "is "+strings.Join(words[1:]," ")+" of" // has author -> is author of
+
+	case n > 1 && words[n-1] == "of":
+		return "has "+strings.Join(words[:n-1]," ")    // member of -> has member
+	}
+
+	return "inverse of "+long
+}
+
+//**************************************************************
+
+func ArrowShortName(long string) string {
+
+	// Short names appear as (short) in N4L, so no commas or brackets
+
+	short := strings.Join(strings.FieldsFunc(long,func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("(),",r)
+	}),"-")
+
+	return short
+}
+
+//**************************************************************
+
+func UnusedArrowShortName(short string,taken map[string]bool) string {
+
+	name := short
+
+	for n := 2; ; n++ {
+		if _,exists := LookupArrowShort(name); !exists && !taken[name] {
+			taken[name] = true
+			return name
+		}
+		name = fmt.Sprintf("%s-%d",short,n)
+	}
+}
+
+//**************************************************************
+
+func ImportRDF(triples []Triple) GraphImport {
+
+	// Decide on arrows and node names. Labels, arrow declarations
+	// and reified statements describe the rest, and don't become
+	// nodes of their own
+
+	var imp GraphImport
+
+	imp.Origin = "RDF"
+	imp.Using = make(map[string]string)
+
+	triples = FlattenRDFLists(triples)
+
+	const (
+		label = RDFS_NS+"label"
+		preflabel = SKOS_NS+"prefLabel"
+		rdftype = RDF_NS+"type"
+		inverse = OWL_NS+"inverseOf"
+		statement = RDF_NS+"Statement"
+	)
+
+	names := make(map[string]string)
+	described := make(map[string]map[string][]RDFTerm) // subject -> predicate -> objects
+	predicates := make(map[string]bool)
+	var order []string
+
+	for _,t := range triples {
+
+		s := t.S.Key()
+
+		if described[s] == nil {
+			described[s] = make(map[string][]RDFTerm)
+		}
+
+		described[s][t.P.Value] = append(described[s][t.P.Value],t.O)
+
+		if !predicates[t.P.Value] {
+			predicates[t.P.Value] = true
+			order = append(order,t.P.Value)
+		}
+
+		if (t.P.Value == label || t.P.Value == preflabel) && t.O.Kind == RDF_LITERAL && names[s] == "" {
+			names[s] = t.O.Value
+		}
+	}
+
+	// Properties declared but not used are still properties
+
+	for s,props := range described {
+		for _,o := range props[rdftype] {
+			switch o.Value {
+			case RDF_NS+"Property",OWL_NS+"ObjectProperty",OWL_NS+"DatatypeProperty",OWL_NS+"AnnotationProperty",OWL_NS+"SymmetricProperty",OWL_NS+"TransitiveProperty":
+				if !predicates[s] {
+					predicates[s] = true
+				}
+			}
+		}
+	}
+
+	isschema := func(p string) bool {
+		return p == label || p == preflabel || p == inverse || strings.HasPrefix(p,SST_NS) ||
+			(strings.HasPrefix(p,RDF_NS) && p != rdftype)
+	}
+
+	reified := func(s string) bool {
+		for _,o := range described[s][rdftype] {
+			if o.Value == statement {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only predicates that relate things need arrows, not those
+	// describing the vocabulary itself
+
+	linking := func(t Triple) bool {
+		if isschema(t.P.Value) || predicates[t.S.Value] || reified(t.S.Key()) {
+			return false
+		}
+		return t.P.Value != rdftype || (t.O.Value != statement && !predicates[t.O.Value])
+	}
+
+	used := make(map[string]bool)
+
+	for _,t := range triples {
+		if linking(t) {
+			used[t.P.Value] = true
+		}
+	}
+
+	// Arrows, one pair per predicate or pair of inverse predicates
+
+	taken := make(map[string]bool)
+
+	for _,p := range order {
+
+		if !used[p] || imp.Using[p] != "" {
+			continue
+		}
+
+		decl := described[p]
+
+		var arrow ImportArrow
+
+		long := names[p]
+
+		if long == "" {
+			long = strings.Join(SplitCamelCase(RDFLocalName(p))," ")
+		}
+
+		short := ArrowShortName(RDFLocalName(p))
+
+		if s := decl[SST_NS+"short"]; len(s) > 0 {
+			short = s[0].Value
+		}
+
+		sttype := ClassifyPredicate(SplitCamelCase(RDFLocalName(p)))
+
+		if p == rdftype {
+			long,short,sttype = "is an instance of","instance-of",-CONTAINS
+		}
+
+		if st := decl[SST_NS+"sttype"]; len(st) > 0 {
+			if v,err := strconv.Atoi(st[0].Value); err == nil && v >= -EXPRESS && v <= EXPRESS {
+				sttype = v
+			}
+		}
+
+		// An existing arrow of the same name, e.g. then, contains
+
+		if ptr,ok := LookupArrowShort(short); ok {
+			imp.Using[p] = ArrowDirectoryEntry(ptr).Short
+			continue
+		}
+
+		if ptr,ok := LookupArrowLong(long); ok {
+			imp.Using[p] = ArrowDirectoryEntry(ptr).Short
+			continue
+		}
+
+		short = UnusedArrowShortName(short,taken)
+
+		// The other half, declared or made up
+
+		invlong := InverseArrowName(long)
+		invshort := ""
+		var invp string
+
+		if inv := decl[inverse]; len(inv) > 0 {
+			invp = inv[0].Value
+		} else {
+			for q,props := range described {
+				for _,o := range props[inverse] {
+					if o.Value == p && predicates[q] {
+						invp = q
+					}
+				}
+			}
+		}
+
+		if invp != "" {
+			if l := names[invp]; l != "" {
+				invlong = l
+			} else {
+				invlong = strings.Join(SplitCamelCase(RDFLocalName(invp))," ")
+			}
+			invshort = ArrowShortName(RDFLocalName(invp))
+			if s := described[invp][SST_NS+"short"]; len(s) > 0 {
+				invshort = s[0].Value
+			}
+		}
+
+		if invshort == "" {
+			invshort = ArrowShortName(invlong)
+		}
+
+		// An existing arrow for the other way round, e.g. has member
+
+		if ptr,ok := LookupArrowLong(invlong); ok && invp == "" && sttype != NEAR {
+			if inv,ok := LookupInverseArrow(ptr); ok {
+				imp.Using[p] = ArrowDirectoryEntry(inv).Short
+				continue
+			}
+		}
+
+		if sttype == NEAR {
+			invlong,invshort = long,short
+		} else {
+			invshort = UnusedArrowShortName(invshort,taken)
+		}
+
+		// Keep the forward arrow positive
+
+		if sttype < 0 {
+			arrow = ImportArrow{STType: -sttype, Long: invlong, Short: invshort, InvLong: long, InvShort: short}
+		} else {
+			arrow = ImportArrow{STType: sttype, Long: long, Short: short, InvLong: invlong, InvShort: invshort}
+		}
+
+		imp.Arrows = append(imp.Arrows,&arrow)
+		imp.Using[p] = short
+
+		if invp != "" {
+			imp.Using[invp] = invshort
+		}
+	}
+
+	// Contexts and weights from reified statements
+
+	type spo struct{ s,p,o string }
+	annotations := make(map[spo]ImportLink)
+
+	for s := range described {
+
+		if !reified(s) {
+			continue
+		}
+
+		d := described[s]
+
+		if len(d[RDF_NS+"subject"]) == 0 || len(d[RDF_NS+"predicate"]) == 0 || len(d[RDF_NS+"object"]) == 0 {
+			continue
+		}
+
+		key := spo{d[RDF_NS+"subject"][0].Key(),d[RDF_NS+"predicate"][0].Value,d[RDF_NS+"object"][0].Key()}
+
+		var ann ImportLink
+
+		for _,c := range d[SST_NS+"context"] {
+			ann.Context = append(ann.Context,c.Value)
+		}
+
+		if w := d[SST_NS+"weight"]; len(w) > 0 {
+			if v,err := strconv.ParseFloat(w[0].Value,32); err == nil && v > 0 {
+				ann.Weight = float32(v)
+			}
+		}
+
+		annotations[key] = ann
+	}
+
+	// Links between the remaining subjects and objects
+
+	var nodename func(t RDFTerm) string
+
+	named := func(t RDFTerm) string {
+		if t.Kind == RDF_LITERAL {
+			return strings.Join(strings.Fields(t.Value)," ")
+		}
+		if n := names[t.Key()]; n != "" {
+			return strings.Join(strings.Fields(n)," ")
+		}
+		if t.Kind == RDF_BLANK {
+			return ""
+		}
+		return RDFLocalName(t.Value)
+	}
+
+	// Blank nodes without a label are named after what refers to
+	// them, e.g. "alice address", or their type, e.g. "anonymous Person"
+
+	nodenames := make(map[string]bool)
+	blanknames := make(map[string]string)
+	referrer := make(map[string]Triple)
+
+	for _,t := range triples {
+		if linking(t) {
+			for _,term := range []RDFTerm{t.S,t.O} {
+				if n := named(term); n != "" {
+					nodenames[n] = true
+				}
+			}
+			if _,ok := referrer[t.O.Key()]; t.O.Kind == RDF_BLANK && !ok {
+				referrer[t.O.Key()] = t
+			}
+		}
+	}
+
+	blankname := func(t RDFTerm) string {
+
+		name := "anonymous"
+
+		if ref,ok := referrer[t.Key()]; ok {
+			blanknames[t.Key()] = name // in case of a cycle of blank nodes
+			words := SplitCamelCase(RDFLocalName(ref.P.Value))
+			if len(words) > 1 && words[0] == "has" {
+				words = words[1:]
+			}
+			name = nodename(ref.S)+" "+strings.Join(words," ")
+		} else if types := described[t.Key()][rdftype]; len(types) > 0 {
+			name = "anonymous "+RDFLocalName(types[0].Value)
+		}
+
+		unique := name
+
+		for n := 2; nodenames[unique]; n++ {
+			unique = fmt.Sprintf("%s %d",name,n)
+		}
+
+		nodenames[unique] = true
+		return unique
+	}
+
+	nodename = func(t RDFTerm) string {
+		if n := named(t); n != "" || t.Kind != RDF_BLANK {
+			return n
+		}
+		if n,ok := blanknames[t.Key()]; ok {
+			return n
+		}
+		blanknames[t.Key()] = blankname(t)
+		return blanknames[t.Key()]
+	}
+
+	for _,t := range triples {
+
+		if !linking(t) {
+			continue
+		}
+
+		link := annotations[spo{t.S.Key(),t.P.Value,t.O.Key()}]
+		link.From = nodename(t.S)
+		link.To = nodename(t.O)
+		link.Arrow = imp.Using[t.P.Value]
+
+		if link.Weight == 0 {
+			link.Weight = 1
+		}
+
+		if link.From == "" || link.To == "" || link.From == link.To || link.Arrow == "" {
+			continue
+		}
+
+		imp.Links = append(imp.Links,link)
+	}
+
+	// Mark the arrows already defined, e.g. by an earlier import
+
+	for _,a := range imp.Arrows {
+		_,a.Exists = LookupArrowShort(a.Short)
+	}
+
+	return imp
+}
+
+//**************************************************************
+
+func FlattenRDFLists(triples []Triple) []Triple {
+
+	// A list (a b c) as the object of s p becomes s p a, s p b, s p c.
+	// A list as a subject is a node with its items as rdfs:member
+
+	first := make(map[string]RDFTerm)
+	rest := make(map[string]string)
+
+	for _,t := range triples {
+		switch t.P.Value {
+		case RDF_NS+"first":
+			first[t.S.Key()] = t.O
+		case RDF_NS+"rest":
+			rest[t.S.Key()] = t.O.Key()
+		}
+	}
+
+	if len(first) == 0 {
+		return triples
+	}
+
+	items := func(head string) []RDFTerm {
+		var list []RDFTerm
+		for cell,n := head,0; n < len(first); n++ {
+			item,ok := first[cell]
+			if !ok {
+				break
+			}
+			list = append(list,item)
+			cell = rest[cell]
+		}
+		return list
+	}
+
+	member := RDFTerm{Kind: RDF_IRI, Value: RDFS_NS+"member"}
+	done := make(map[string]bool)
+
+	var retval []Triple
+
+	for _,t := range triples {
+
+		switch {
+
+		case t.P.Value == RDF_NS+"first" || t.P.Value == RDF_NS+"rest":
+			continue
+
+		case t.O.Kind == RDF_BLANK && first[t.O.Key()] != (RDFTerm{}):
+			for _,item := range items(t.O.Key()) {
+				retval = append(retval,Triple{S: t.S, P: t.P, O: item})
+			}
+
+		case t.S.Kind == RDF_BLANK && first[t.S.Key()] != (RDFTerm{}) && !done[t.S.Key()]:
+			done[t.S.Key()] = true
+			for _,item := range items(t.S.Key()) {
+				retval = append(retval,Triple{S: t.S, P: member, O: item})
+			}
+			retval = append(retval,t)
+
+		default:
+			retval = append(retval,t)
+		}
+	}
+
+	return retval
+}
+
+//**************************************************************
+
+func STTypeSection(sttype int) string {
+
+	// The section names used in SSTconfig
+
+	switch sttype {
+	case NEAR:
+		return "similarity"
+	case LEADSTO,-LEADSTO:
+		return "leadsto"
+	case CONTAINS,-CONTAINS:
+		return "contains"
+	}
+
+	return "properties"
+}
+
+//**************************************************************
+
+func DefineImportArrows(sst PoSST,imp GraphImport) {
+
+	// Unlike Vertex/Edge users, an import may bring its own vocabulary
+
+	for _,a := range imp.Arrows {
+
+		if a.Exists {
+			continue
+		}
+
+		section := STTypeSection(a.STType)
+
+		if a.STType == NEAR {
+			ptr := InsertArrowDirectory(section,a.Short,a.Long,"both")
+			InsertInverseArrowDirectory(ptr,ptr)
+			UploadArrowToDB(sst,ptr)
+			UploadInverseArrowToDB(sst,ptr)
+			continue
+		}
+
+		fwd := InsertArrowDirectory(section,a.Short,a.Long,"+")
+		bwd := InsertArrowDirectory(section,a.InvShort,a.InvLong,"-")
+
+		if fwd < 0 || bwd < 0 {
+			fmt.Println("Arrow name clash, unable to define",a.Long,"/",a.InvLong)
+			continue
+		}
+
+		InsertInverseArrowDirectory(fwd,bwd)
+		UploadArrowToDB(sst,fwd)
+		UploadArrowToDB(sst,bwd)
+		UploadInverseArrowToDB(sst,fwd)
+		UploadInverseArrowToDB(sst,bwd)
+	}
+}
+
+//**************************************************************
+
+func UploadImport(sst PoSST,imp GraphImport,chapter string) int {
+
+	// Straight into the database through the Vertex/Edge API
+
+	DefineImportArrows(sst,imp)
+
+	nodes := make(map[string]Node)
+	count := 0
+
+	// As in N4L, an empty link makes each node findable by chapter and context
+
+	var empty Link
+	empty.Arr = 0
+	empty.Wgt = 1
+
+	vertex := func(name string) Node {
+		n,ok := nodes[name]
+		if !ok {
+			n = Vertex(sst,name,chapter)
+			AppendDBLinkToNode(sst,n.NPtr,empty,STIndexToSTType(ArrowDirectoryEntry(0).STAindex))
+			nodes[name] = n
+		}
+		return n
+	}
+
+	for _,lnk := range imp.Links {
+
+		from := vertex(lnk.From)
+		to := vertex(lnk.To)
+
+		if from.NPtr == to.NPtr {
+			continue
+		}
+
+		Edge(sst,from,lnk.Arrow,to,lnk.Context,lnk.Weight)
+		count++
+	}
+
+	return count
+}
+
+//**************************************************************
+
+func ReplaceImport(sst PoSST,imp GraphImport,chapter string) (int,int) {
+
+	// Upload an import as the whole of a chapter, e.g. from a program that
+	// re-imports its own data: links between the chapter's nodes that the
+	// import no longer makes are removed first, as N4L does for a changed file
+
+	DefineImportArrows(sst,imp)
+
+	type half struct {
+		from string
+		arr  ArrowPtr
+		ctx  ContextPtr
+		to   string
+	}
+
+	var wanted = make(map[half]bool)
+	var names = make(map[string]bool)
+
+	for _,lnk := range imp.Links {
+
+		if lnk.From == lnk.To {
+			continue
+		}
+
+		arr,_ := GetDBArrowsWithArrowName(sst,lnk.Arrow)
+		ctx := TryContext(sst,lnk.Context)
+
+		wanted[half{lnk.From,arr,ctx,lnk.To}] = true
+		wanted[half{lnk.To,InverseArrow(arr),ctx,lnk.From}] = true
+		names[lnk.From] = true
+		names[lnk.To] = true
+	}
+
+	stored := GetDBChapterNodes(sst,[]string{chapter})
+
+	var text = make(map[NodePtr]string)
+
+	for _,n := range stored {
+		text[n.NPtr] = n.S
+	}
+
+	var delta GraphDelta
+
+	delta.Chapters = []string{chapter}
+
+	for _,n := range stored {
+
+		// Nodes the import has dropped leave the chapter, and are deleted if it was their only one
+
+		if !names[n.S] {
+
+			var chaps []string
+
+			for _,c := range SplitChapters(n.Chap) {
+				if c != chapter {
+					chaps = append(chaps,c)
+				}
+			}
+
+			if len(chaps) == 0 {
+				delta.DelNodes = append(delta.DelNodes,n)
+				continue
+			}
+
+			upd := n
+			upd.Chap = strings.Join(chaps,",")
+			delta.UpdNodes = append(delta.UpdNodes,upd)
+		}
+
+		// Links leading out of the chapter belong to someone else
+
+		for st := range n.I {
+			for _,lnk := range n.I[st] {
+
+				to,inside := text[lnk.Dst]
+
+				if lnk.Arr == 0 || !inside {
+					continue
+				}
+
+				if !wanted[half{n.S,lnk.Arr,lnk.Ctx,to}] {
+					delta.DelLinks = append(delta.DelLinks,DeltaLink{From: n.NPtr,STindex: st,Lnk: lnk})
+				}
+			}
+		}
+	}
+
+	if len(delta.DelNodes) > 0 || len(delta.UpdNodes) > 0 || len(delta.DelLinks) > 0 {
+
+		err := ApplyGraphDelta(sst,delta,false)
+
+		if err != nil {
+			fmt.Println("Unable to remove old links from chapter",chapter,err)
+		}
+	}
+
+	count := UploadImport(sst,imp,chapter)
+
+	return count,len(delta.DelLinks)
+}
+
+//**************************************************************
+
+func ImportToN4L(imp GraphImport,chapter string) (string,string) {
+
+	// Returns the N4L notes, and SSTconfig lines for the arrows
+	// that aren't already defined
+
+	var notes,config strings.Builder
+
+	notes.WriteString(fmt.Sprintf("\n- %s\n\n",chapter))
+
+	var last string
+
+	for _,lnk := range imp.Links {
+
+		from := N4LQuote(lnk.From)
+
+		if lnk.From == last {
+			from = "\""
+		}
+
+		arrow := lnk.Arrow
+
+		if lnk.Weight != 1 {
+			arrow += fmt.Sprintf(", %g",lnk.Weight)
+		}
+
+		for _,c := range lnk.Context {
+			arrow += ", "+c
+		}
+
+		notes.WriteString(fmt.Sprintf("%s (%s) %s\n",from,arrow,N4LQuote(lnk.To)))
+		last = lnk.From
+	}
+
+	for _,section := range []string{"leadsto","contains","properties","similarity"} {
+
+		var lines []string
+
+		for _,a := range imp.Arrows {
+
+			if a.Exists || STTypeSection(a.STType) != section {
+				continue
+			}
+
+			if section == "similarity" {
+				lines = append(lines,fmt.Sprintf(" %s (%s)",a.Long,a.Short))
+			} else {
+				lines = append(lines,fmt.Sprintf(" + %s (%s) - %s (%s)",a.Long,a.Short,a.InvLong,a.InvShort))
+			}
+		}
+
+		if len(lines) > 0 {
+			config.WriteString(fmt.Sprintf("- %s\n\n :: imported from %s ::\n\n%s\n\n",section,imp.Origin,strings.Join(lines,"\n")))
+		}
+	}
+
+	return notes.String(),config.String()
+}
+
+//**************************************************************
+
+func N4LQuote(s string) string {
+
+	// Quote an item so that N4L reads it back verbatim. Inside single
+	// quotes N4L expects double quotes in pairs, so an odd one out
+	// has to be softened
+
+	if !strings.ContainsAny(s,"\"") {
+		return "\""+s+"\""
+	}
+
+	if !strings.ContainsAny(s,"'") && strings.Count(s,"\"") % 2 == 0 {
+		return "'"+s+"'"
+	}
+
+	return "\""+strings.ReplaceAll(s,"\"","'")+"\""
+}
+
+//**************************************************************
+// Export
+//**************************************************************
+
+func ChapterToTurtle(sst PoSST,chapter string,limit int) string {
+
+	// Nodes, their forward links and the arrows used. The ST type
+	// of each arrow is an annotation, so the inverse can be
+	// recovered on the way back in
+
+	var body strings.Builder
+
+	nptrs := GetDBNodePtrMatchingNCCS(sst,"any",chapter,nil,nil,false,limit)
+
+	inchapter := make(map[NodePtr]bool)
+
+	for _,nptr := range nptrs {
+		inchapter[nptr] = true
+	}
+
+	arrows := make(map[ArrowPtr]bool)
+	outside := make(map[NodePtr]bool)
+
+	for _,nptr := range nptrs {
+
+		// Dynamic functions are labelled as written, not as last evaluated
+
+		node := GetDBNodeByNodePtr(sst,nptr)
+		text := GetDBNodeTextByNodePtr(sst,nptr)
+
+		body.WriteString(fmt.Sprintf("%s rdfs:label %s ;\n    sst:chapter %s .\n",TurtleNode(nptr),TurtleString(text),TurtleString(node.Chap)))
+
+		for st := ST_ZERO; st < ST_TOP; st++ {
+
+			for _,lnk := range node.I[st] {
+
+				// Each link is stored at both ends, so write it from one
+
+				if st == ST_ZERO+NEAR && inchapter[lnk.Dst] && NodePtrLess(lnk.Dst,nptr) {
+					continue
+				}
+
+				// Arrow 0 only records context membership
+
+				if lnk.Arr == 0 {
+					continue
+				}
+
+				arrows[lnk.Arr] = true
+
+				if !inchapter[lnk.Dst] {
+					outside[lnk.Dst] = true
+				}
+
+				body.WriteString(fmt.Sprintf("%s %s %s .\n",TurtleNode(nptr),TurtleArrow(sst,lnk.Arr),TurtleNode(lnk.Dst)))
+
+				ctx,_ := GetDBContextByPtr(sst,lnk.Ctx)
+
+				if (ctx != "" && ctx != "any") || lnk.Wgt != 1 {
+
+					body.WriteString(fmt.Sprintf("[] a rdf:Statement ;\n    rdf:subject %s ;\n    rdf:predicate %s ;\n    rdf:object %s",TurtleNode(nptr),TurtleArrow(sst,lnk.Arr),TurtleNode(lnk.Dst)))
+
+					for _,c := range strings.Split(ctx,",") {
+						if c = strings.TrimSpace(c); c != "" && c != "any" {
+							body.WriteString(fmt.Sprintf(" ;\n    sst:context %s",TurtleString(c)))
+						}
+					}
+
+					body.WriteString(fmt.Sprintf(" ;\n    sst:weight %g .\n",lnk.Wgt))
+				}
+			}
+		}
+
+		body.WriteString("\n")
+	}
+
+	// Names of nodes in other chapters that links lead to
+
+	for nptr := range outside {
+		node := GetDBNodeByNodePtr(sst,nptr)
+		text := GetDBNodeTextByNodePtr(sst,nptr)
+		body.WriteString(fmt.Sprintf("%s rdfs:label %s ;\n    sst:chapter %s .\n",TurtleNode(nptr),TurtleString(text),TurtleString(node.Chap)))
+	}
+
+	// Arrow declarations, with both halves of each pair
+
+	var used []ArrowPtr
+
+	for arr := range arrows {
+		used = append(used,arr)
+	}
+
+	for _,arr := range used {
+		if inv,ok := LookupInverseArrow(arr); ok && !arrows[inv] {
+			arrows[inv] = true
+			used = append(used,inv)
+		}
+	}
+
+	sort.Slice(used,func(i,j int) bool { return used[i] < used[j] })
+
+	var decl strings.Builder
+
+	for _,arr := range used {
+
+		a := GetDBArrowByPtr(sst,arr)
+
+		decl.WriteString(fmt.Sprintf("%s a owl:ObjectProperty ;\n    rdfs:label %s ;\n    sst:short %s ;\n    sst:sttype %d",TurtleArrow(sst,arr),TurtleString(a.Long),TurtleString(a.Short),STIndexToSTType(a.STAindex)))
+
+		if inv,ok := LookupInverseArrow(arr); ok && inv != arr {
+			decl.WriteString(fmt.Sprintf(" ;\n    owl:inverseOf %s",TurtleArrow(sst,inv)))
+		}
+
+		decl.WriteString(" .\n\n")
+	}
+
+	var header strings.Builder
+
+	header.WriteString(fmt.Sprintf("# SSTorytime chapter \"%s\"\n\n",chapter))
+	header.WriteString(fmt.Sprintf("@prefix rdf: <%s> .\n@prefix rdfs: <%s> .\n@prefix owl: <%s> .\n",RDF_NS,RDFS_NS,OWL_NS))
+	header.WriteString(fmt.Sprintf("@prefix sst: <%s> .\n@prefix arrow: <%s> .\n@prefix node: <%s> .\n\n",SST_NS,SST_ARROW_NS,SST_NODE_NS))
+
+	header.WriteString("sst:sttype a owl:AnnotationProperty ;\n    rdfs:comment \"Semantic spacetime type of an arrow: 0 near, 1 leads to, 2 contains, 3 expresses, negative for the inverse\" .\n")
+	header.WriteString("sst:short a owl:AnnotationProperty ;\n    rdfs:comment \"Short name of an arrow, as used in N4L\" .\n")
+	header.WriteString("sst:chapter a owl:AnnotationProperty .\nsst:context a owl:AnnotationProperty .\nsst:weight a owl:AnnotationProperty .\n\n")
+
+	return header.String()+decl.String()+body.String()
+}
+
+//**************************************************************
+
+func NodePtrLess(a,b NodePtr) bool {
+
+	if a.Class != b.Class {
+		return a.Class < b.Class
+	}
+
+	return a.CPtr < b.CPtr
+}
+
+//**************************************************************
+
+func TurtleNode(nptr NodePtr) string {
+
+	return fmt.Sprintf("node:n%d_%d",nptr.Class,nptr.CPtr)
+}
+
+//**************************************************************
+
+func TurtleArrow(sst PoSST,arr ArrowPtr) string {
+
+	// Arrow short names may contain anything, so encode them
+
+	var local strings.Builder
+
+	for _,b := range []byte(GetDBArrowByPtr(sst,arr).Short) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_' || b == '-' {
+			local.WriteByte(b)
+		} else {
+			local.WriteString(fmt.Sprintf("%%%02X",b))
+		}
+	}
+
+	return "arrow:"+local.String()
+}
+
+//**************************************************************
+
+func TurtleString(s string) string {
+
+	r := strings.NewReplacer("\\","\\\\","\"","\\\"","\n","\\n","\r","\\r","\t","\\t")
+
+	return "\""+r.Replace(s)+"\""
+}
@@ -0,0 +1,256 @@
+//**************************************************************
+//
+// Spaced repetition review, after the SM-2 algorithm
+//
+// Every node a user has looked at (see LastSeen) is a candidate
+// for review. A card remembers how easily it was recalled: good
+// answers raise its ease factor and stretch the interval until
+// the next review, lapses start it over. Nodes that were seen
+// but never reviewed get a first interval from their LastSeen
+// access statistics, so frequently revisited notes wait longer
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//**************************************************************
+
+const (
+	REVIEW_BLACKOUT = 0 // SM-2 grades 0-5, below REVIEW_HARD counts as forgotten
+	REVIEW_FAIL = 1
+	REVIEW_HARD = 3
+	REVIEW_PASS = 4
+	REVIEW_EASY = 5
+
+	SM2_EASE = 2.5
+	SM2_MIN_EASE = 1.3
+)
+
+const REVIEW_TABLE = "CREATE TABLE IF NOT EXISTS Review " +
+	"(    " +
+	"Username text NOT NULL DEFAULT ''," +
+	"NPtr     NodePtr," +
+	"Chap     text," +
+	"Ease     real," +
+	"Days     real," +
+	"Reps     int," +
+	"Lapses   int," +
+	"Due      timestamptz," + // to_timestamp() gives an absolute time, not a local one
+	"Last     timestamptz," +
+	"PRIMARY KEY (Username,NPtr)" +
+	")"
+
+//**************************************************************
+
+type ReviewCard struct {
+
+	User   string
+	NPtr   NodePtr
+	Chap   string
+	Ease   float64 // SM-2 easiness factor
+	Days   float64 // interval until the next review
+	Reps   int     // successful reviews in a row
+	Lapses int     // times forgotten
+	Due    int64
+	Last   int64   // time of the last review, 0 if never reviewed
+}
+
+//**************************************************************
+
+func ParseReviewGrade(s string) (int,bool) {
+
+	// Either a number 0-5, or a word
+
+	switch strings.ToLower(strings.TrimSpace(s)) {
+
+	case "f","fail","again","no","wrong":
+		return REVIEW_FAIL,true
+	case "h","hard":
+		return REVIEW_HARD,true
+	case "p","pass","good","yes","ok":
+		return REVIEW_PASS,true
+	case "e","easy":
+		return REVIEW_EASY,true
+	}
+
+	grade,err := strconv.Atoi(strings.TrimSpace(s))
+
+	if err != nil || grade < REVIEW_BLACKOUT || grade > REVIEW_EASY {
+		return 0,false
+	}
+
+	return grade,true
+}
+
+//**************************************************************
+
+func ScheduleReview(card ReviewCard,grade int,now int64) ReviewCard {
+
+	// SM-2: intervals of 1 and 6 days, then multiplied by the ease
+
+	if grade < REVIEW_HARD {
+		card.Reps = 0
+		card.Lapses++
+		card.Days = 1
+	} else {
+		switch card.Reps {
+		case 0:
+			card.Days = 1
+		case 1:
+			card.Days = 6
+		default:
+			card.Days = math.Round(card.Days * card.Ease)
+		}
+		card.Reps++
+	}
+
+	q := float64(REVIEW_EASY - grade)
+
+	card.Ease += 0.1 - q * (0.08 + q * 0.02)
+
+	if card.Ease < SM2_MIN_EASE {
+		card.Ease = SM2_MIN_EASE
+	}
+
+	card.Last = now
+	card.Due = now + int64(card.Days * SECONDS_PER_DAY)
+
+	return card
+}
+
+//**************************************************************
+
+func NewReviewCard(sst PoSST,ls LastSeen) ReviewCard {
+
+	// A node seen but never reviewed. If it has been revisited, the
+	// average gap between visits is a fair first guess at how long
+	// it stays in mind
+
+	var card ReviewCard
+
+	card.User = sst.User
+	card.NPtr = ls.NPtr
+	card.Chap = GetDBNodeByNodePtr(sst,ls.NPtr).Chap
+	card.Ease = SM2_EASE
+	card.Days = 1
+
+	if ls.Freq > 1 && ls.Pdelta > SECONDS_PER_DAY {
+		card.Days = math.Round(ls.Pdelta / SECONDS_PER_DAY)
+	}
+
+	if ls.Last == 0 {
+		ls.Last = time.Now().Unix()
+	}
+
+	card.Due = ls.Last + int64(card.Days * SECONDS_PER_DAY)
+
+	return card
+}
+
+//**************************************************************
+
+func GetDueReviews(sst PoSST,chapter string,limit int) []ReviewCard {
+
+	// Cards past their due time, most overdue (relative to their
+	// interval) first
+
+	now := time.Now().Unix()
+	carded := make(map[NodePtr]bool)
+
+	var due []ReviewCard
+
+	for _,card := range GetReviewCards(sst) {
+
+		carded[card.NPtr] = true
+
+		if card.Due <= now && MatchChapterPattern(card.Chap,chapter) {
+			due = append(due,card)
+		}
+	}
+
+	for _,ls := range GetLastSawSection(sst) {
+
+		if ls.NPtr.CPtr < 0 || carded[ls.NPtr] {
+			continue // a section, or already reviewed
+		}
+
+		carded[ls.NPtr] = true
+		card := NewReviewCard(sst,ls)
+
+		if card.Due <= now && MatchChapterPattern(card.Chap,chapter) {
+			due = append(due,card)
+		}
+	}
+
+	sort.SliceStable(due, func(i,j int) bool {
+		return Overdue(due[i],now) > Overdue(due[j],now)
+	})
+
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	return due
+}
+
+//**************************************************************
+
+func Overdue(card ReviewCard,now int64) float64 {
+
+	return float64(now - card.Due) / (card.Days * SECONDS_PER_DAY)
+}
+
+//**************************************************************
+
+func RecordReview(sst PoSST,nptr NodePtr,grade int) ReviewCard {
+
+	// Grade an answer and schedule the next review. Reviewing also
+	// counts as seeing the node
+
+	card,found := GetReviewCard(sst,nptr)
+
+	if !found {
+		ls := GetLastSawNPtr(sst,nptr)
+		ls.NPtr = nptr
+		card = NewReviewCard(sst,ls)
+	}
+
+	card = ScheduleReview(card,grade,time.Now().Unix())
+
+	SaveReviewCard(sst,card)
+	UpdateLastSawNPtr(sst,nptr.Class,int(nptr.CPtr),card.Chap)
+
+	return card
+}
+
+//**************************************************************
+// Storage
+//**************************************************************
+
+func GetReviewCard(sst PoSST,nptr NodePtr) (ReviewCard,bool) {
+
+	return sst.Store.GetReviewCard(sst.User,nptr)
+}
+
+//**************************************************************
+
+func GetReviewCards(sst PoSST) []ReviewCard {
+
+	return sst.Store.GetReviewCards(sst.User)
+}
+
+//**************************************************************
+
+func SaveReviewCard(sst PoSST,card ReviewCard) {
+
+	card.User = sst.User
+	sst.Store.SaveReviewCard(card)
+}
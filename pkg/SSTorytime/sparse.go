@@ -0,0 +1,431 @@
+//**************************************************************
+//
+// Sparse matrices for graph analytics
+//
+// The adjacency matrix of a real graph is mostly zeros, so a
+// dense [][]float32 runs out of memory long before the graph is
+// large. SparseMatrix keeps only the links, in compressed sparse
+// row (CSR) form: the entries of row r are Col[k],Val[k] for
+// Row[r] <= k < Row[r+1], in column order
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"sort"
+)
+
+//**************************************************************
+
+const (
+	EVC_MAX_ITERATIONS = 100
+	EVC_TOLERANCE = 0.001
+)
+
+//**************************************************************
+
+type SparseMatrix struct {
+
+	Dim int
+	Row []int     // len Dim+1, start of each row in Col and Val
+	Col []int
+	Val []float32
+}
+
+//**************************************************************
+
+type SparseEntry struct {
+
+	Row int
+	Col int
+	Val float32
+}
+
+//**************************************************************
+
+func MakeSparseMatrix(dim int,entries []SparseEntry) SparseMatrix {
+
+	// Entries may come in any order. Repeated entries are added
+	// together, as when two arrows join the same pair of nodes
+
+	var m SparseMatrix
+
+	m.Dim = dim
+	m.Row = make([]int,dim+1)
+
+	sort.Slice(entries,func(i,j int) bool {
+		if entries[i].Row != entries[j].Row {
+			return entries[i].Row < entries[j].Row
+		}
+		return entries[i].Col < entries[j].Col
+	})
+
+	lastrow,lastcol := -1,-1
+
+	for _,e := range entries {
+
+		if e.Val == 0 || e.Row < 0 || e.Row >= dim || e.Col < 0 || e.Col >= dim {
+			continue
+		}
+
+		if e.Row == lastrow && e.Col == lastcol {
+			m.Val[len(m.Val)-1] += e.Val
+			continue
+		}
+
+		m.Col = append(m.Col,e.Col)
+		m.Val = append(m.Val,e.Val)
+		m.Row[e.Row+1]++
+		lastrow,lastcol = e.Row,e.Col
+	}
+
+	for r := 0; r < dim; r++ {
+		m.Row[r+1] += m.Row[r]
+	}
+
+	return m
+}
+
+//**************************************************************
+
+func SparseEntries(m SparseMatrix) []SparseEntry {
+
+	var entries = make([]SparseEntry,0,len(m.Val))
+
+	for r := 0; r < m.Dim; r++ {
+		for k := m.Row[r]; k < m.Row[r+1]; k++ {
+			entries = append(entries,SparseEntry{Row: r, Col: m.Col[k], Val: m.Val[k]})
+		}
+	}
+
+	return entries
+}
+
+//**************************************************************
+
+func SparseGet(m SparseMatrix,r,c int) float32 {
+
+	if r < 0 || r >= m.Dim {
+		return 0
+	}
+
+	row := m.Col[m.Row[r]:m.Row[r+1]]
+	k := sort.SearchInts(row,c)
+
+	if k < len(row) && row[k] == c {
+		return m.Val[m.Row[r]+k]
+	}
+
+	return 0
+}
+
+//**************************************************************
+
+func DenseToSparse(m [][]float32) SparseMatrix {
+
+	var entries []SparseEntry
+
+	for r := range m {
+		for c := range m[r] {
+			if m[r][c] != 0 {
+				entries = append(entries,SparseEntry{Row: r, Col: c, Val: m[r][c]})
+			}
+		}
+	}
+
+	return MakeSparseMatrix(len(m),entries)
+}
+
+//**************************************************************
+
+func SparseToDense(m SparseMatrix) [][]float32 {
+
+	// Only for small graphs
+
+	var dense = make([][]float32,m.Dim)
+
+	for r := 0; r < m.Dim; r++ {
+
+		dense[r] = make([]float32,m.Dim)
+
+		for k := m.Row[r]; k < m.Row[r+1]; k++ {
+			dense[r][m.Col[k]] = m.Val[k]
+		}
+	}
+
+	return dense
+}
+
+//**************************************************************
+
+func SparseTranspose(m SparseMatrix) SparseMatrix {
+
+	entries := SparseEntries(m)
+
+	for e := range entries {
+		entries[e].Row,entries[e].Col = entries[e].Col,entries[e].Row
+	}
+
+	return MakeSparseMatrix(m.Dim,entries)
+}
+
+//**************************************************************
+
+func SparseSymmetrize(m SparseMatrix) SparseMatrix {
+
+	// m + transpose(m), as SymmetrizeMatrix
+
+	entries := SparseEntries(m)
+	n := len(entries)
+
+	for e := 0; e < n; e++ {
+		entries = append(entries,SparseEntry{Row: entries[e].Col, Col: entries[e].Row, Val: entries[e].Val})
+	}
+
+	return MakeSparseMatrix(m.Dim,entries)
+}
+
+//**************************************************************
+
+func SparseMatrixOpVector(m SparseMatrix,v []float32) []float32 {
+
+	var vp = make([]float32,m.Dim)
+
+	for r := 0; r < m.Dim; r++ {
+		for k := m.Row[r]; k < m.Row[r+1]; k++ {
+			vp[r] += m.Val[k] * v[m.Col[k]]
+		}
+	}
+
+	return vp
+}
+
+//**************************************************************
+
+func SparseComputeEVC(adj SparseMatrix) []float32 {
+
+	// Power iteration, normalizing as we go so that large graphs
+	// don't overflow before they converge
+
+	v := MakeInitVector(adj.Dim,1.0)
+
+	for i := 0; i < EVC_MAX_ITERATIONS; i++ {
+
+		vnext := SparseMatrixOpVector(adj,v)
+		maxval,_ := GetVecMax(vnext)
+		vnext = NormalizeVec(vnext,maxval)
+
+		converged := CompareVec(vnext,v) < EVC_TOLERANCE
+		v = vnext
+
+		if converged {
+			break
+		}
+	}
+
+	return v
+}
+
+//**************************************************************
+
+func SparseGradientFieldTop(sadj SparseMatrix,evc []float32) (map[int][]int,[]int,[][]int) {
+
+	// Hill climbing gradient search, as FindGradientFieldTop
+
+	var localtop []int
+	var paths [][]int
+	var regions = make(map[int][]int)
+
+	for index := 0; index < sadj.Dim; index++ {
+
+		ltop,path := SparseHillTop(index,sadj,evc)
+
+		regions[ltop] = append(regions[ltop],index)
+		localtop = append(localtop,ltop)
+		paths = append(paths,path)
+	}
+
+	return regions,localtop,paths
+}
+
+//**************************************************************
+
+func SparseHillTop(index int,sadj SparseMatrix,evc []float32) (int,[]int) {
+
+	topnode := index
+	visited := make(map[int]bool)
+	visited[index] = true
+
+	var path = []int{ index }
+
+	for {
+		winner := topnode
+
+		for k := sadj.Row[topnode]; k < sadj.Row[topnode+1]; k++ {
+
+			ngh := sadj.Col[k]
+
+			if sadj.Val[k] > 0 && !visited[ngh] {
+				visited[ngh] = true
+
+				if evc[ngh] > evc[winner] {
+					winner = ngh
+				}
+			}
+		}
+
+		if winner == topnode {
+			break
+		}
+
+		topnode = winner
+		path = append(path,topnode)
+	}
+
+	return topnode,path
+}
+
+//**************************************************************
+
+func SparseSymbolMatrix(m SparseMatrix) []string {
+
+	// Symbols for each entry in m.Val, as SymbolMatrix
+
+	var sym = make([]string,len(m.Val))
+
+	for r := 0; r < m.Dim; r++ {
+		for k := m.Row[r]; k < m.Row[r+1]; k++ {
+			sym[k] = fmt.Sprintf("%d*%d",r,m.Col[k])
+		}
+	}
+
+	return sym
+}
+
+//**************************************************************
+
+func SparseSymbolicMultiply(m1,m2 SparseMatrix,s1,s2 []string) (SparseMatrix,[]string) {
+
+	// Trace the elements in a multiplication for path mapping, as
+	// SymbolicMultiply. Row by row, only visiting the non-zero
+	// entries, so the cost is in the number of paths not dim^3
+
+	var m SparseMatrix
+	var sym []string
+
+	m.Dim = m1.Dim
+	m.Row = make([]int,m.Dim+1)
+
+	value := make([]float32,m2.Dim)
+	symbols := make([]string,m2.Dim)
+	used := make([]bool,m2.Dim)
+
+	for r := 0; r < m1.Dim; r++ {
+
+		var cols []int
+
+		for k := m1.Row[r]; k < m1.Row[r+1]; k++ {
+
+			j := m1.Col[k]
+
+			for l := m2.Row[j]; l < m2.Row[j+1]; l++ {
+
+				c := m2.Col[l]
+
+				if !used[c] {
+					used[c] = true
+					cols = append(cols,c)
+				}
+
+				value[c] += m1.Val[k] * m2.Val[l]
+				symbols[c] += fmt.Sprintf("%s*%s",s1[k],s2[l])
+			}
+		}
+
+		sort.Ints(cols)
+
+		for _,c := range cols {
+			m.Col = append(m.Col,c)
+			m.Val = append(m.Val,value[c])
+			sym = append(sym,symbols[c])
+			value[c],symbols[c],used[c] = 0,"",false
+		}
+
+		m.Row[r+1] = len(m.Col)
+	}
+
+	return m,sym
+}
+
+//**************************************************************
+
+func SparseCycles(adj SparseMatrix,maxlen,limit int) [][]int {
+
+	// Elementary directed cycles of up to maxlen links, each found
+	// once from its lowest numbered node. A depth limited search,
+	// instead of looking at the diagonals of matrix powers
+
+	var cycles [][]int
+	var path []int
+
+	onpath := make([]bool,adj.Dim)
+
+	var search func(start,node int) bool
+
+	search = func(start,node int) bool {
+
+		for k := adj.Row[node]; k < adj.Row[node+1]; k++ {
+
+			next := adj.Col[k]
+
+			if adj.Val[k] == 0 || next < start {
+				continue
+			}
+
+			if next == start {
+				cycles = append(cycles,append([]int{},path...))
+
+				if limit > 0 && len(cycles) >= limit {
+					return false
+				}
+				continue
+			}
+
+			if onpath[next] || len(path) >= maxlen {
+				continue
+			}
+
+			onpath[next] = true
+			path = append(path,next)
+
+			more := search(start,next)
+
+			path = path[:len(path)-1]
+			onpath[next] = false
+
+			if !more {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	for start := 0; start < adj.Dim; start++ {
+
+		path = append(path[:0],start)
+		onpath[start] = true
+
+		more := search(start,start)
+
+		onpath[start] = false
+
+		if !more {
+			break
+		}
+	}
+
+	return cycles
+}
@@ -0,0 +1,287 @@
+//**************************************************************
+//
+// stm.go - keeping the short term memory (STM) of search context
+//
+// AddContext accumulates the fragments of each user's searches
+// as intentional (seen once) or ambient (repeated), and forgets
+// them after a while. The fragments are kept per user and per
+// session, and written through to the store, so that they outlive
+// a restart of the http_server. The forgetting horizon is
+// FORGOTTEN seconds, unless SST_STM_FORGET or SetSTMForgetting
+// say otherwise
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+//**************************************************************
+
+const STM_FORGET_ENV = "SST_STM_FORGET" // a duration, e.g. 3h or 90m
+
+const STM_TABLE = "CREATE TABLE IF NOT EXISTS STM " +
+	"(    " +
+	"Username text NOT NULL DEFAULT ''," +
+	"Session  text NOT NULL DEFAULT ''," +
+	"Token    text," +
+	"Intent   boolean," +
+	"Freq     real," +
+	"Last     timestamptz," + // to_timestamp() gives an absolute time, not a local one
+	"Delta    bigint," +
+	"Slot     text," +
+	"PRIMARY KEY (Username,Session,Token)" +
+	")"
+
+//**************************************************************
+
+type STMEntry struct {
+
+	Token  string
+	Intent bool    // intentional, else ambient
+	History
+}
+
+//**************************************************************
+
+var STM_FORGET int64 = STMForgetFromEnv() // seconds, guarded by STM_MUTEX
+var STM_SWEPT int64                        // last eviction sweep, guarded by STM_MUTEX
+
+const STM_SWEEP_INTERVAL = 60 // seconds between looking for idle sessions
+
+//**************************************************************
+
+func STMForgetFromEnv() int64 {
+
+	setting := os.Getenv(STM_FORGET_ENV)
+
+	if setting == "" {
+		return FORGOTTEN
+	}
+
+	d,err := time.ParseDuration(setting)
+
+	if err != nil || d < time.Second {
+		fmt.Println("Ignoring",STM_FORGET_ENV,"=",setting,"- use a duration like 3h or 90m")
+		return FORGOTTEN
+	}
+
+	return int64(d.Seconds())
+}
+
+//**************************************************************
+
+func SetSTMForgetting(d time.Duration) {
+
+	STM_MUTEX.Lock()
+	defer STM_MUTEX.Unlock()
+
+	if d < time.Second {
+		STM_FORGET = FORGOTTEN
+		return
+	}
+
+	STM_FORGET = int64(d.Seconds())
+}
+
+//**************************************************************
+
+func STMForgetting() time.Duration {
+
+	STM_MUTEX.Lock()
+	defer STM_MUTEX.Unlock()
+
+	return time.Duration(STM_FORGET) * time.Second
+}
+
+//**************************************************************
+
+func ForSession(sst PoSST,session string) PoSST {
+
+	// The same user, with a separate short term memory
+
+	sst.Session = session
+	return sst
+}
+
+//**************************************************************
+
+func STMKey(user,session string) string {
+
+	// Names can't contain #, see ValidUserName
+
+	if session == "" {
+		return user
+	}
+
+	return user + "#" + session
+}
+
+//**************************************************************
+
+func Forgotten(h History,now int64) bool {
+
+	// Caller holds STM_MUTEX
+
+	return h.Delta > STM_FORGET || now - h.Last > STM_FORGET
+}
+
+//**************************************************************
+
+func EvictIdleSTM(now int64) {
+
+	// Caller holds STM_MUTEX. A session idle for longer than the
+	// forgetting horizon remembers nothing, so drop it from memory.
+	// The store still has it, should the session come back
+
+	if now - STM_SWEPT < STM_SWEEP_INTERVAL {
+		return
+	}
+
+	STM_SWEPT = now
+
+	for key,stm := range STM_USERS {
+		if key != DEFAULT_USER && now - stm.used > STM_FORGET {
+			delete(STM_USERS,key)
+		}
+	}
+}
+
+//**************************************************************
+
+func STMChanges(stm *STMState,tokens []string) []STMEntry {
+
+	// The current state of the tokens just seen. Caller holds STM_MUTEX
+
+	var entries []STMEntry
+	var done = make(map[string]bool)
+
+	for _,token := range tokens {
+
+		if done[token] {
+			continue
+		}
+
+		done[token] = true
+
+		if h,ok := stm.Int[token]; ok {
+			entries = append(entries,STMEntry{ Token: token, Intent: true, History: h })
+		} else if h,ok := stm.Amb[token]; ok {
+			entries = append(entries,STMEntry{ Token: token, Intent: false, History: h })
+		}
+	}
+
+	return entries
+}
+
+//**************************************************************
+
+func STMEntries(stm *STMState) []STMEntry {
+
+	var entries []STMEntry
+
+	for token,h := range stm.Int {
+		entries = append(entries,STMEntry{ Token: token, Intent: true, History: h })
+	}
+
+	for token,h := range stm.Amb {
+		entries = append(entries,STMEntry{ Token: token, Intent: false, History: h })
+	}
+
+	sort.Slice(entries,func(i,j int) bool {
+		if entries[i].Last != entries[j].Last {
+			return entries[i].Last > entries[j].Last
+		}
+		return entries[i].Token < entries[j].Token
+	})
+
+	return entries
+}
+
+//**************************************************************
+
+func InstallSTMEntries(stm *STMState,entries []STMEntry) {
+
+	for _,e := range entries {
+		if e.Intent {
+			stm.Int[e.Token] = e.History
+		} else {
+			stm.Amb[e.Token] = e.History
+		}
+	}
+}
+
+//**************************************************************
+
+func GetSTM(sst PoSST) []STMEntry {
+
+	// What the user's session remembers, most recent first
+
+	STM_MUTEX.Lock()
+	defer STM_MUTEX.Unlock()
+
+	return STMEntries(UserSTM(sst))
+}
+
+//**************************************************************
+
+func ResetSTM(sst PoSST) int {
+
+	// Forget the session's context, returns how many fragments
+
+	var forgotten []string
+
+	STM_MUTEX.Lock()
+
+	stm := UserSTM(sst)
+
+	// The default user's maps are the package globals, so clear in place
+
+	for token := range stm.Int {
+		delete(stm.Int,token)
+		forgotten = append(forgotten,token)
+	}
+
+	for token := range stm.Amb {
+		delete(stm.Amb,token)
+		forgotten = append(forgotten,token)
+	}
+
+	STM_MUTEX.Unlock()
+
+	SaveSTM(sst,nil,forgotten)
+
+	return len(forgotten)
+}
+
+//**************************************************************
+// Storage
+//**************************************************************
+
+func LoadSTM(sst PoSST) []STMEntry {
+
+	if sst.Store == nil {
+		return nil
+	}
+
+	return sst.Store.GetSTM(sst.User,sst.Session)
+}
+
+//**************************************************************
+
+func SaveSTM(sst PoSST,changed []STMEntry,forgotten []string) {
+
+	// Updates the stored tokens that changed and removes the forgotten
+	// ones. Called without STM_MUTEX
+
+	if sst.Store == nil || (len(changed) == 0 && len(forgotten) == 0) {
+		return
+	}
+
+	sst.Store.SaveSTM(sst.User,sst.Session,changed,forgotten)
+}
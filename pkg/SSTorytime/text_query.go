@@ -0,0 +1,504 @@
+//**************************************************************
+//
+// Boolean and phrase queries on node text
+//
+// A small query language translated into a Postgres tsquery,
+// so that matches can be ranked by ts_rank(), e.g.
+//
+//   \query brain and (wave or oscillat*)
+//   \query "range rover" not sport
+//   \query fox <-> crow
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//**************************************************************
+
+const (
+	TQ_WORD = iota
+	TQ_AND
+	TQ_OR
+	TQ_NOT
+	TQ_FOLLOWS // phrase proximity, a <N> b
+
+	TS_RANK_NORM = 1 // ts_rank() normalization: divide by 1 + log(length), favouring short names
+)
+
+//**************************************************************
+
+type TextQuery struct {
+
+	Op     int
+	Word   string
+	Prefix bool       // word:*
+	Dist   int        // for TQ_FOLLOWS
+	Left   *TextQuery // the only operand of TQ_NOT
+	Right  *TextQuery
+}
+
+//**************************************************************
+
+type queryParser struct {
+
+	tokens []string
+	pos    int
+}
+
+//**************************************************************
+
+func ParseTextQuery(query string) (*TextQuery,error) {
+
+	// Operators: and & +, or |, not ! -, <-> or <N> for "followed by
+	// within N words", word* for prefixes, "quoted phrases", (grouping).
+	// Words next to each other without an operator are ANDed
+
+	var p queryParser
+
+	p.tokens = TokenizeTextQuery(query)
+
+	if len(p.tokens) == 0 {
+		return nil,fmt.Errorf("empty query")
+	}
+
+	tq,err := p.parseOr()
+
+	if err != nil {
+		return nil,err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil,fmt.Errorf("unexpected \"%s\" in query",p.tokens[p.pos])
+	}
+
+	if !tq.HasPositive() {
+		return nil,fmt.Errorf("query \"%s\" only says what not to find",query)
+	}
+
+	return tq,nil
+}
+
+//**************************************************************
+
+func TokenizeTextQuery(query string) []string {
+
+	var tokens []string
+	var word []rune
+
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens,string(word))
+			word = nil
+		}
+	}
+
+	src := []rune(query)
+
+	for r := 0; r < len(src); r++ {
+
+		switch {
+
+		case IsQuote(src[r]):
+			flush()
+			end := r+1
+			for end < len(src) && !IsQuote(src[end]) {
+				end++
+			}
+			tokens = append(tokens,"\""+string(src[r+1:min(end,len(src))])+"\"")
+			r = end
+
+		case src[r] == '<':
+			flush()
+			end := r+1
+			for end < len(src) && src[end] != '>' {
+				end++
+			}
+			tokens = append(tokens,string(src[r:min(end+1,len(src))]))
+			r = end
+
+		case unicode.IsSpace(src[r]):
+			flush()
+
+		case strings.ContainsRune("()&|!+",src[r]):
+			flush()
+			tokens = append(tokens,string(src[r]))
+
+		case src[r] == '-' && len(word) == 0:
+			tokens = append(tokens,"!")
+
+		default:
+			word = append(word,src[r])
+		}
+	}
+
+	flush()
+
+	return tokens
+}
+
+//**************************************************************
+
+func (p *queryParser) peek() string {
+
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+
+	return ""
+}
+
+//**************************************************************
+
+func (p *queryParser) parseOr() (*TextQuery,error) {
+
+	left,err := p.parseAnd()
+
+	for err == nil && (p.peek() == "or" || p.peek() == "|") {
+
+		p.pos++
+
+		var right *TextQuery
+
+		if right,err = p.parseAnd(); err == nil {
+			left = &TextQuery{Op: TQ_OR, Left: left, Right: right}
+		}
+	}
+
+	return left,err
+}
+
+//**************************************************************
+
+func (p *queryParser) parseAnd() (*TextQuery,error) {
+
+	left,err := p.parseFollows()
+
+	for err == nil {
+
+		next := p.peek()
+
+		if next == "and" || next == "&" || next == "+" {
+			p.pos++
+		} else if next == "" || next == ")" || next == "or" || next == "|" {
+			break
+		}
+
+		// Otherwise implicit AND
+
+		var right *TextQuery
+
+		if right,err = p.parseFollows(); err == nil {
+			left = &TextQuery{Op: TQ_AND, Left: left, Right: right}
+		}
+	}
+
+	return left,err
+}
+
+//**************************************************************
+
+func (p *queryParser) parseFollows() (*TextQuery,error) {
+
+	left,err := p.parseNot()
+
+	for err == nil {
+
+		dist,ok := ProximityOperator(p.peek())
+
+		if !ok {
+			break
+		}
+
+		p.pos++
+
+		var right *TextQuery
+
+		if right,err = p.parseNot(); err == nil {
+			left = &TextQuery{Op: TQ_FOLLOWS, Dist: dist, Left: left, Right: right}
+		}
+	}
+
+	return left,err
+}
+
+//**************************************************************
+
+func (p *queryParser) parseNot() (*TextQuery,error) {
+
+	if p.peek() == "not" || p.peek() == "!" {
+
+		p.pos++
+		operand,err := p.parseNot()
+
+		if err != nil {
+			return nil,err
+		}
+
+		return &TextQuery{Op: TQ_NOT, Left: operand},nil
+	}
+
+	return p.parsePrimary()
+}
+
+//**************************************************************
+
+func (p *queryParser) parsePrimary() (*TextQuery,error) {
+
+	token := p.peek()
+
+	switch token {
+
+	case "":
+		return nil,fmt.Errorf("query ends where a search term was expected")
+
+	case "(":
+		p.pos++
+		tq,err := p.parseOr()
+
+		if err != nil {
+			return nil,err
+		}
+
+		if p.peek() != ")" {
+			return nil,fmt.Errorf("missing ) in query")
+		}
+
+		p.pos++
+		return tq,nil
+
+	case ")","and","&","+","or","|":
+		return nil,fmt.Errorf("unexpected \"%s\" in query",token)
+	}
+
+	if _,ok := ProximityOperator(token); ok {
+		return nil,fmt.Errorf("unexpected \"%s\" in query",token)
+	}
+
+	p.pos++
+
+	// A quoted phrase, or a word the text search would split anyway, e.g. rock-n-roll
+
+	prefix := strings.HasSuffix(token,"*") && !strings.HasPrefix(token,"\"")
+	token = strings.TrimRight(token,"*")
+
+	words := strings.FieldsFunc(token,func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	if len(words) == 0 {
+		return nil,fmt.Errorf("\"%s\" has nothing to search for",token)
+	}
+
+	tq := &TextQuery{Op: TQ_WORD, Word: words[0]}
+
+	for _,w := range words[1:] {
+		tq = &TextQuery{Op: TQ_FOLLOWS, Dist: 1, Left: tq, Right: &TextQuery{Op: TQ_WORD, Word: w}}
+	}
+
+	if prefix {
+		last := tq
+
+		for last.Op == TQ_FOLLOWS {
+			last = last.Right
+		}
+
+		last.Prefix = true
+	}
+
+	return tq,nil
+}
+
+//**************************************************************
+
+func ProximityOperator(token string) (int,bool) {
+
+	if token == "<->" {
+		return 1,true
+	}
+
+	if strings.HasPrefix(token,"<") && strings.HasSuffix(token,">") {
+
+		dist,err := strconv.Atoi(token[1:len(token)-1])
+
+		if err == nil && dist >= 0 {
+			return dist,true
+		}
+	}
+
+	return 0,false
+}
+
+//**************************************************************
+
+func (tq *TextQuery) HasPositive() bool {
+
+	// A tsquery that only negates matches nothing useful in an index
+
+	switch tq.Op {
+	case TQ_WORD:
+		return true
+	case TQ_NOT:
+		return false
+	case TQ_OR:
+		return tq.Left.HasPositive() && tq.Right.HasPositive()
+	default:
+		return tq.Left.HasPositive() || tq.Right.HasPositive()
+	}
+}
+
+//**************************************************************
+
+func (tq *TextQuery) TSQuery() string {
+
+	// The words contain only letters and digits, so need no escaping
+
+	switch tq.Op {
+
+	case TQ_WORD:
+		if tq.Prefix {
+			return strings.ToLower(tq.Word)+":*"
+		}
+		return strings.ToLower(tq.Word)
+
+	case TQ_NOT:
+		return "!"+tq.Left.TSQuery()
+
+	case TQ_AND:
+		return "("+tq.Left.TSQuery()+" & "+tq.Right.TSQuery()+")"
+
+	case TQ_OR:
+		return "("+tq.Left.TSQuery()+" | "+tq.Right.TSQuery()+")"
+
+	case TQ_FOLLOWS:
+		return fmt.Sprintf("(%s <%d> %s)",tq.Left.TSQuery(),tq.Dist,tq.Right.TSQuery())
+	}
+
+	return ""
+}
+
+//**************************************************************
+
+func (tq *TextQuery) String() string {
+
+	return tq.TSQuery()
+}
+
+//**************************************************************
+// Go stand-in for Search @@ to_tsquery() and ts_rank(), used
+// by the embedded store. No stemming beyond plurals
+//**************************************************************
+
+func TextQueryWords(text string) []string {
+
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+//**************************************************************
+
+func (tq *TextQuery) Match(words []string) bool {
+
+	ok,_ := tq.positions(words)
+	return ok
+}
+
+//**************************************************************
+
+func (tq *TextQuery) positions(words []string) (bool,[]int) {
+
+	// Where a match ends, so that phrases can be chained
+
+	switch tq.Op {
+
+	case TQ_WORD:
+		var pos []int
+		term := strings.ToLower(tq.Word)
+
+		for w := range words {
+			if words[w] == term || strings.TrimSuffix(words[w],"s") == strings.TrimSuffix(term,"s") {
+				pos = append(pos,w)
+			} else if tq.Prefix && strings.HasPrefix(words[w],term) {
+				pos = append(pos,w)
+			}
+		}
+		return len(pos) > 0,pos
+
+	case TQ_NOT:
+		ok,_ := tq.Left.positions(words)
+		return !ok,nil
+
+	case TQ_AND:
+		lok,lpos := tq.Left.positions(words)
+		rok,rpos := tq.Right.positions(words)
+		if lok && rok {
+			return true,append(lpos,rpos...)
+		}
+		return false,nil
+
+	case TQ_OR:
+		lok,lpos := tq.Left.positions(words)
+		rok,rpos := tq.Right.positions(words)
+		return lok || rok,append(lpos,rpos...)
+
+	case TQ_FOLLOWS:
+		_,lpos := tq.Left.positions(words)
+		_,rpos := tq.Right.positions(words)
+		var pos []int
+
+		for _,r := range rpos {
+			for _,l := range lpos {
+				if r-l == tq.Dist {
+					pos = append(pos,r)
+					break
+				}
+			}
+		}
+		return len(pos) > 0,pos
+	}
+
+	return false,nil
+}
+
+//**************************************************************
+
+func (tq *TextQuery) Rank(words []string) float32 {
+
+	// Roughly ts_rank(...,TS_RANK_NORM): 0.1 per matching occurrence
+	// of a positive term, divided by 1 + log(length)
+
+	if len(words) == 0 {
+		return 0
+	}
+
+	var hits int
+
+	for _,term := range tq.PositiveTerms() {
+		_,pos := term.positions(words)
+		hits += len(pos)
+	}
+
+	return float32(0.1 * float64(hits) / (1 + math.Log(float64(len(words)))))
+}
+
+//**************************************************************
+
+func (tq *TextQuery) PositiveTerms() []*TextQuery {
+
+	switch tq.Op {
+	case TQ_WORD:
+		return []*TextQuery{tq}
+	case TQ_NOT:
+		return nil
+	default:
+		return append(tq.Left.PositiveTerms(),tq.Right.PositiveTerms()...)
+	}
+}
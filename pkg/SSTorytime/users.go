@@ -0,0 +1,185 @@
+//**************************************************************
+//
+// Users: personal progress tracking, short term memory and
+// private overlays on shared chapters (see docs/namespaces.md)
+//
+// The graph is shared. What each user has seen, their recent
+// search context and the notes they add are kept apart by the
+// User in PoSST. The command line tools are DEFAULT_USER
+//
+//**************************************************************
+
+package SSTorytime
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//**************************************************************
+
+const DEFAULT_USER = ""
+const MAX_USERNAME = 64
+
+const USER_OVERLAY_TABLE = "CREATE TABLE IF NOT EXISTS UserOverlay " +
+	"(    " +
+	"Username text," +
+	"NPtr     NodePtr," +
+	"Chap     text," +
+	"Note     text," +
+	"Added    timestamp" +
+	")"
+
+//**************************************************************
+
+type Overlay struct {
+
+	User  string
+	NPtr  NodePtr
+	Chap  string   // of the node, for listing a user's notes by chapter
+	Note  string
+	Added int64
+}
+
+//**************************************************************
+
+type STMState struct {
+
+	Int map[string]History // intentional (exceptional) fragments
+	Amb map[string]History // ambient (repeated) fragments
+
+	loaded bool            // read back from the store, see stm.go
+	used   int64           // last use, for evicting idle sessions
+}
+
+//**************************************************************
+
+var STM_USERS = map[string]*STMState{ DEFAULT_USER: &STMState{ Int: STM_INT_FRAG, Amb: STM_AMB_FRAG } }
+var STM_MUTEX sync.Mutex
+
+//**************************************************************
+
+func ValidUserName(user string) bool {
+
+	// Names end up in SQL and file keys, so keep them plain
+
+	if len(user) == 0 || len(user) > MAX_USERNAME {
+		return false
+	}
+
+	for _,r := range user {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("._-@",r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func ForUser(sst PoSST,user string) PoSST {
+
+	// The same connection, acting on behalf of user
+
+	sst.User = user
+	return sst
+}
+
+//**************************************************************
+
+func UserSTM(sst PoSST) *STMState {
+
+	// Caller holds STM_MUTEX. The first use, e.g. after a restart,
+	// reads back what the store remembers
+
+	key := STMKey(sst.User,sst.Session)
+	now := time.Now().Unix()
+
+	EvictIdleSTM(now)
+
+	stm,ok := STM_USERS[key]
+
+	if !ok {
+		stm = &STMState{ Int: make(map[string]History), Amb: make(map[string]History) }
+		STM_USERS[key] = stm
+	}
+
+	if !stm.loaded {
+		InstallSTMEntries(stm,LoadSTM(sst))
+		stm.loaded = true
+	}
+
+	stm.used = now
+
+	return stm
+}
+
+//**************************************************************
+// Overlays
+//**************************************************************
+
+func AddUserOverlay(sst PoSST,nptr NodePtr,note string) bool {
+
+	// A private note on a shared node, seen only by sst.User
+
+	note = strings.TrimSpace(note)
+
+	if len(note) == 0 {
+		return false
+	}
+
+	node := GetDBNodeByNodePtr(sst,nptr)
+
+	if node.L == 0 {
+		fmt.Println("No such node to annotate",nptr)
+		return false
+	}
+
+	var ov Overlay
+
+	ov.User = sst.User
+	ov.NPtr = nptr
+	ov.Chap = node.Chap
+	ov.Note = note
+	ov.Added = time.Now().Unix()
+
+	return sst.Store.AddOverlay(ov)
+}
+
+//**************************************************************
+
+func GetUserOverlays(sst PoSST,chap string) []Overlay {
+
+	// All of this user's notes, optionally within a chapter
+
+	return sst.Store.GetOverlays(sst.User,chap)
+}
+
+//**************************************************************
+
+func GetNodeOverlays(sst PoSST,nptr NodePtr) []Overlay {
+
+	return sst.Store.GetNodeOverlays(sst.User,nptr)
+}
+
+//**************************************************************
+
+func GetNodesOverlays(sst PoSST,nptrs []NodePtr) map[NodePtr][]Overlay {
+
+	// This user's notes on several nodes, in one lookup
+
+	return sst.Store.GetNodesOverlays(sst.User,nptrs)
+}
+
+//**************************************************************
+
+func RemoveUserOverlays(sst PoSST,nptr NodePtr) int {
+
+	// Forget this user's notes on a node, returns how many
+
+	return sst.Store.RemoveOverlays(sst.User,nptr)
+}
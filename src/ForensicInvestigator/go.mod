@@ -7,6 +7,9 @@ require (
 	github.com/google/uuid v1.6.0
 )
 
-require github.com/lib/pq v1.10.9 // indirect
+require (
+	github.com/lib/pq v1.10.9 // indirect
+	golang.org/x/text v0.24.0 // indirect
+)
 
 replace SSTorytime => ../../pkg/SSTorytime
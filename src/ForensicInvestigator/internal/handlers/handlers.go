@@ -24,6 +24,7 @@ type Handler struct {
 	notebook      *services.NotebookService      // Service de gestion des notebooks
 	scenario      *services.ScenarioService      // Service de simulation What-If
 	anomaly       *services.AnomalyService       // Service de détection d'anomalies
+	sst           *services.SSTBridgeService     // Pont vers la base SSTorytime (optionnel)
 }
 
 // NewHandler crée un nouveau handler
@@ -44,6 +45,11 @@ func NewHandler(ollama *services.OllamaService, cases *services.CaseService, n4l
 	return h
 }
 
+// SetSSTBridge fait passer les recherches de cônes, de chemins et d'orbites par la base SSTorytime
+func (h *Handler) SetSSTBridge(sst *services.SSTBridgeService) {
+	h.sst = sst
+}
+
 // HandleCases gère les opérations sur les affaires
 func (h *Handler) HandleCases(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -3476,6 +3482,22 @@ func (h *Handler) HandleConeSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.sst != nil {
+		c, err := h.cases.GetCase(req.CaseID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result, err := h.sst.ConeSearch(c, req)
+		if err != nil {
+			log.Printf("[ConeSearch] Error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
 	graph, err := h.cases.BuildGraphData(req.CaseID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -3523,13 +3545,32 @@ func (h *Handler) HandleDiracPathSearch(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	var paths []services.ConePath
+	if h.sst != nil {
+		c, err := h.cases.GetCase(req.CaseID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		paths, err = h.sst.DiracPathSearch(c, req.StartNodes, req.EndNodes, req.MaxDepth)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"paths": paths,
+			"count": len(paths),
+		})
+		return
+	}
+
 	graph, err := h.cases.BuildGraphData(req.CaseID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	paths, err := h.search.DiracPathSearch(graph, req.StartNodes, req.EndNodes, req.MaxDepth)
+	paths, err = h.search.DiracPathSearch(graph, req.StartNodes, req.EndNodes, req.MaxDepth)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3987,6 +4028,21 @@ func (h *Handler) HandleOrbits(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.sst != nil {
+		c, err := h.cases.GetCase(req.CaseID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result, err := h.sst.AnalyzeOrbits(c, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
 	graph, err := h.cases.BuildGraphData(req.CaseID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"log"
 	"math"
 	"regexp"
 	"sort"
@@ -100,13 +101,62 @@ type AnomalyService struct {
 
 // NewAnomalyService crée un nouveau service d'anomalies
 func NewAnomalyService(cases *CaseService, ollama *OllamaService) *AnomalyService {
-	return &AnomalyService{
+	a := &AnomalyService{
 		anomalies: make(map[string]map[string]*models.Anomaly),
 		alerts:    make(map[string][]*models.AnomalyAlert),
 		configs:   make(map[string]*models.AnomalyDetectionConfig),
 		cases:     cases,
 		ollama:    ollama,
 	}
+
+	// Recharger l'état de détection persisté
+	if store := cases.Store(); store != nil {
+		for caseID, state := range store.LoadAnomalies() {
+			a.anomalies[caseID] = make(map[string]*models.Anomaly)
+			for _, anomaly := range state.Anomalies {
+				a.anomalies[caseID][anomaly.ID] = anomaly
+			}
+			a.alerts[caseID] = state.Alerts
+			if state.Config != nil {
+				a.configs[caseID] = state.Config
+			}
+		}
+	}
+	return a
+}
+
+// persist écrit l'état de détection d'une affaire dans le stockage (a.mu doit être verrouillé)
+func (a *AnomalyService) persist(caseID, op string) {
+	store := a.cases.Store()
+	if store == nil {
+		return
+	}
+
+	state := &AnomalyState{
+		Anomalies: make([]*models.Anomaly, 0, len(a.anomalies[caseID])),
+		Alerts:    a.alerts[caseID],
+		Config:    a.configs[caseID],
+	}
+	for _, anomaly := range a.anomalies[caseID] {
+		state.Anomalies = append(state.Anomalies, anomaly)
+	}
+	sort.Slice(state.Anomalies, func(i, j int) bool {
+		return state.Anomalies[i].DetectedAt.Before(state.Anomalies[j].DetectedAt)
+	})
+
+	if err := store.SaveAnomalies(caseID, state, op); err != nil {
+		log.Printf("Erreur sauvegarde anomalies %s: %v", caseID, err)
+	}
+}
+
+// findAnomaly retourne une anomalie sans verrouiller (a.mu doit être verrouillé)
+func (a *AnomalyService) findAnomaly(caseID, anomalyID string) (*models.Anomaly, error) {
+	if caseAnomalies, ok := a.anomalies[caseID]; ok {
+		if anomaly, ok := caseAnomalies[anomalyID]; ok {
+			return anomaly, nil
+		}
+	}
+	return nil, fmt.Errorf("anomalie non trouvée")
 }
 
 // DetectAnomalies lance une détection d'anomalies pour un cas
@@ -211,6 +261,7 @@ func (a *AnomalyService) DetectAnomalies(caseID string) (*models.AnomalyDetectio
 	result.MediumCount = a.countBySeverity(filteredAnomalies, models.SeverityMedium)
 	result.LowCount = a.countBySeverity(filteredAnomalies, models.SeverityLow)
 	result.Summary = a.generateSummary(result)
+	a.persist(caseID, "detect")
 
 	return result, nil
 }
@@ -260,6 +311,7 @@ func (a *AnomalyService) AcknowledgeAnomaly(caseID, anomalyID string) error {
 		if anomaly, ok := caseAnomalies[anomalyID]; ok {
 			anomaly.IsAcknowledged = true
 			anomaly.IsNew = false
+			a.persist(caseID, "acknowledge")
 			return nil
 		}
 	}
@@ -332,6 +384,7 @@ func (a *AnomalyService) MarkAlertRead(caseID, alertID string) error {
 		for _, alert := range caseAlerts {
 			if alert.ID == alertID {
 				alert.IsRead = true
+				a.persist(caseID, "alert_read")
 				return nil
 			}
 		}
@@ -345,6 +398,7 @@ func (a *AnomalyService) UpdateConfig(config *models.AnomalyDetectionConfig) err
 	defer a.mu.Unlock()
 
 	a.configs[config.CaseID] = config
+	a.persist(config.CaseID, "config")
 	return nil
 }
 
@@ -361,7 +415,7 @@ func (a *AnomalyService) ExplainAnomaly(caseID, anomalyID string) (string, error
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	anomaly, err := a.GetAnomaly(caseID, anomalyID)
+	anomaly, err := a.findAnomaly(caseID, anomalyID)
 	if err != nil {
 		return "", err
 	}
@@ -379,6 +433,7 @@ func (a *AnomalyService) ExplainAnomaly(caseID, anomalyID string) (string, error
 	}
 
 	anomaly.AIExplanation = explanation
+	a.persist(caseID, "explain")
 
 	return explanation, nil
 }
@@ -2563,7 +2618,7 @@ func (a *AnomalyService) RefineConfidenceWithFeedback(caseID string, anomalyID s
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	anomaly, err := a.GetAnomaly(caseID, anomalyID)
+	anomaly, err := a.findAnomaly(caseID, anomalyID)
 	if err != nil {
 		return err
 	}
@@ -2583,6 +2638,7 @@ func (a *AnomalyService) RefineConfidenceWithFeedback(caseID string, anomalyID s
 	}
 	anomaly.Details["user_feedback"] = wasCorrect
 	anomaly.Details["feedback_applied"] = true
+	a.persist(caseID, "feedback")
 
 	return nil
 }
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"log"
 	"strings"
 	"sync"
 	"time"
@@ -13,14 +14,46 @@ import (
 
 // CaseService gère les affaires et leurs données
 type CaseService struct {
-	cases    map[string]*models.Case
-	mu       sync.RWMutex
+	cases  map[string]*models.Case
+	mu     sync.RWMutex
+	store  *CaseStore      // Stockage persistant (nil = en mémoire uniquement)
+	stored map[string]bool // Affaires relues depuis le stockage
 }
 
 // NewCaseService crée une nouvelle instance du service
 func NewCaseService() *CaseService {
 	return &CaseService{
-		cases: make(map[string]*models.Case),
+		cases:  make(map[string]*models.Case),
+		stored: make(map[string]bool),
+	}
+}
+
+// SetStore attache un stockage persistant et charge les affaires qu'il contient
+func (s *CaseService) SetStore(store *CaseStore) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = store
+	cases := store.LoadCases()
+	for _, c := range cases {
+		s.cases[c.ID] = c
+		s.stored[c.ID] = true
+	}
+	return len(cases)
+}
+
+// Store retourne le stockage persistant (nil si aucun)
+func (s *CaseService) Store() *CaseStore {
+	return s.store
+}
+
+// persist écrit une affaire dans le stockage (s.mu doit être verrouillé)
+func (s *CaseService) persist(c *models.Case, op string) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveCase(c, op); err != nil {
+		log.Printf("Erreur sauvegarde affaire %s: %v", c.ID, err)
 	}
 }
 
@@ -44,6 +77,7 @@ func (s *CaseService) CreateCase(name, description, caseType string) (*models.Ca
 	}
 
 	s.cases[c.ID] = c
+	s.persist(c, "create")
 	return c, nil
 }
 
@@ -82,6 +116,7 @@ func (s *CaseService) UpdateCase(c *models.Case) error {
 
 	c.UpdatedAt = time.Now()
 	s.cases[c.ID] = c
+	s.persist(c, "update")
 	return nil
 }
 
@@ -95,6 +130,11 @@ func (s *CaseService) DeleteCase(id string) error {
 	}
 
 	delete(s.cases, id)
+	if s.store != nil {
+		if err := s.store.DeleteCase(id); err != nil {
+			log.Printf("Erreur suppression affaire %s: %v", id, err)
+		}
+	}
 	return nil
 }
 
@@ -120,6 +160,7 @@ func (s *CaseService) AddEntity(caseID string, entity models.Entity) (*models.En
 
 	c.Entities = append(c.Entities, entity)
 	c.UpdatedAt = time.Now()
+	s.persist(c, "add_entity")
 
 	return &entity, nil
 }
@@ -154,6 +195,7 @@ func (s *CaseService) AddRelation(caseID string, relation models.Relation) error
 		if e.ID == relation.FromID {
 			c.Entities[i].Relations = append(c.Entities[i].Relations, relation)
 			c.UpdatedAt = time.Now()
+			s.persist(c, "add_relation")
 			return nil
 		}
 	}
@@ -183,6 +225,7 @@ func (s *CaseService) AddEvidence(caseID string, evidence models.Evidence) (*mod
 
 	c.Evidence = append(c.Evidence, evidence)
 	c.UpdatedAt = time.Now()
+	s.persist(c, "add_evidence")
 
 	return &evidence, nil
 }
@@ -221,6 +264,7 @@ func (s *CaseService) AddEvent(caseID string, event models.Event) (*models.Event
 
 	c.Timeline = append(c.Timeline, event)
 	c.UpdatedAt = time.Now()
+	s.persist(c, "add_event")
 
 	return &event, nil
 }
@@ -264,6 +308,7 @@ func (s *CaseService) AddHypothesis(caseID string, hypothesis models.Hypothesis)
 
 	c.Hypotheses = append(c.Hypotheses, hypothesis)
 	c.UpdatedAt = time.Now()
+	s.persist(c, "add_hypothesis")
 
 	return &hypothesis, nil
 }
@@ -314,6 +359,7 @@ func (s *CaseService) UpdateHypothesis(caseID string, hypothesis models.Hypothes
 			hypothesis.UpdatedAt = time.Now()
 			c.Hypotheses[i] = hypothesis
 			c.UpdatedAt = time.Now()
+			s.persist(c, "update_hypothesis")
 			return nil
 		}
 	}
@@ -335,6 +381,7 @@ func (s *CaseService) DeleteHypothesis(caseID, hypothesisID string) error {
 		if h.ID == hypothesisID {
 			c.Hypotheses = append(c.Hypotheses[:i], c.Hypotheses[i+1:]...)
 			c.UpdatedAt = time.Now()
+			s.persist(c, "delete_hypothesis")
 			return nil
 		}
 	}
@@ -421,6 +468,7 @@ func (s *CaseService) UpdateN4LContent(caseID, content string) error {
 
 	c.N4LContent = content
 	c.UpdatedAt = time.Now()
+	s.persist(c, "update_n4l")
 	return nil
 }
 
@@ -429,15 +477,27 @@ func (s *CaseService) LoadDemoCases(demoCases []*models.Case) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Ne pas recharger une affaire de démonstration supprimée par l'utilisateur
+	deleted := map[string]bool{}
+	if s.store != nil {
+		deleted = s.store.DeletedCases()
+	}
+
 	count := 0
 	for _, c := range demoCases {
+		// Ni une affaire relue depuis le stockage, que l'utilisateur a pu modifier
+		if deleted[c.ID] || s.stored[c.ID] {
+			continue
+		}
 		if existing, exists := s.cases[c.ID]; !exists {
 			// Nouveau cas - ajouter
 			s.cases[c.ID] = c
+			s.persist(c, "load_demo")
 			count++
 		} else if c.N4LContent != "" && existing.N4LContent != c.N4LContent {
 			// Cas existant mais N4LContent différent - mettre à jour le contenu N4L
 			existing.N4LContent = c.N4LContent
+			s.persist(existing, "update_n4l")
 		}
 	}
 	return count
@@ -464,6 +524,7 @@ func (s *CaseService) DeleteEntity(caseID, entityID string) error {
 		if e.ID == entityID {
 			c.Entities = append(c.Entities[:i], c.Entities[i+1:]...)
 			c.UpdatedAt = time.Now()
+			s.persist(c, "delete_entity")
 			return nil
 		}
 	}
@@ -493,6 +554,7 @@ func (s *CaseService) UpdateEntity(caseID string, entity models.Entity) error {
 			}
 			c.Entities[i] = entity
 			c.UpdatedAt = time.Now()
+			s.persist(c, "update_entity")
 			return nil
 		}
 	}
@@ -514,6 +576,7 @@ func (s *CaseService) DeleteEvidence(caseID, evidenceID string) error {
 		if ev.ID == evidenceID {
 			c.Evidence = append(c.Evidence[:i], c.Evidence[i+1:]...)
 			c.UpdatedAt = time.Now()
+			s.persist(c, "delete_evidence")
 			return nil
 		}
 	}
@@ -535,6 +598,7 @@ func (s *CaseService) DeleteEvent(caseID, eventID string) error {
 		if evt.ID == eventID {
 			c.Timeline = append(c.Timeline[:i], c.Timeline[i+1:]...)
 			c.UpdatedAt = time.Now()
+			s.persist(c, "delete_event")
 			return nil
 		}
 	}
@@ -566,6 +630,7 @@ func (s *CaseService) UpdateEvent(caseID string, event models.Event) error {
 			}
 			c.Timeline[i] = event
 			c.UpdatedAt = time.Now()
+			s.persist(c, "update_event")
 			return nil
 		}
 	}
@@ -600,6 +665,7 @@ func (s *CaseService) UpdateEvidence(caseID string, evidence models.Evidence) er
 			evidence.CaseID = caseID
 			c.Evidence[i] = evidence
 			c.UpdatedAt = time.Now()
+			s.persist(c, "update_evidence")
 			return nil
 		}
 	}
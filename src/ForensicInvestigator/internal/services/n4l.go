@@ -5,32 +5,32 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"SSTorytime/n4l"
 	"forensicinvestigator/internal/models"
 )
 
+// aliasRefRegex reconnaît les références $alias.n dans le texte d'une ligne
+var aliasRefRegex = regexp.MustCompile(`\$(\w+)\.(\d+)`)
+
 // N4LService gère le parsing et l'export N4L - Support complet du langage SSTorytime N4L
+// Le découpage du N4L est fait par le paquet SSTorytime/n4l; le service est sans état
+// et peut être utilisé par plusieurs requêtes à la fois
 type N4LService struct {
-	// Contextes
+	// Contextes (lecture ligne à ligne de ParseForensicN4L)
 	contextRegex       *regexp.Regexp // :: contexte ::
 	extendContextRegex *regexp.Regexp // +:: ajouter ::
-	removeContextRegex *regexp.Regexp // -:: supprimer ::
 
-	// Relations
-	relationArrowRegex  *regexp.Regexp // A -> relation -> B
-	relationParenRegex  *regexp.Regexp // A (relation) B
-	chainedRelRegex     *regexp.Regexp // A (rel) B (rel) C
-	equivalenceRegex    *regexp.Regexp // A <-> B
-	groupRegex          *regexp.Regexp // A => {B, C, D}
+	// Formats propres au dashboard, hors grammaire N4L
+	relationArrowRegex *regexp.Regexp // A -> relation -> B
+	relationParenRegex *regexp.Regexp // A (relation) B
+	equivalenceRegex   *regexp.Regexp // A <-> B
+	groupRegex         *regexp.Regexp // A => {B, C, D}
 
 	// Références et alias
-	aliasDefRegex       *regexp.Regexp // @monalias texte
-	aliasRefRegex       *regexp.Regexp // $alias.1
-	continuationRegex   *regexp.Regexp // " (relation) B
-	varRefRegex         *regexp.Regexp // $1, $2, etc.
-	entityRefRegex      *regexp.Regexp // >entite
+	aliasDefRegex  *regexp.Regexp // @monalias texte
+	entityRefRegex *regexp.Regexp // >entite
 
 	// Modificateurs temporels
 	neverRegex *regexp.Regexp // \never
@@ -38,20 +38,6 @@ type N4LService struct {
 
 	// Marqueurs implicites N4L
 	implicitMarkerRegex *regexp.Regexp // =motcle, *motcle, .motcle
-	quotedStringRegex   *regexp.Regexp // "texte multi-ligne" ou 'texte'
-
-	// Séquences et sections
-	sectionRegex  *regexp.Regexp // -section/chapter
-	sequenceMode  bool
-	currentAlias  string
-	aliases       map[string][]string
-	previousItems []string
-
-	// Cache des références pour résolution $alias.n
-	aliasItemsCache map[string][]string // Cache alias -> liste d'items extraits
-
-	// Mutex pour protéger les accès concurrents aux maps
-	mu sync.Mutex
 }
 
 // NewN4LService crée une nouvelle instance du service N4L avec support complet
@@ -60,21 +46,16 @@ func NewN4LService() *N4LService {
 		// Contextes
 		contextRegex:       regexp.MustCompile(`^:{2,}\s*(.*?)\s*:{2,}$`),
 		extendContextRegex: regexp.MustCompile(`^\+:{2,}\s*(.*?)\s*:{2,}$`),
-		removeContextRegex: regexp.MustCompile(`^-:{2,}\s*(.*?)\s*:{2,}$`),
 
 		// Relations - formats multiples
-		relationArrowRegex:  regexp.MustCompile(`^(.+?)\s+->\s+(.+?)\s+->\s+(.+)$`),
-		relationParenRegex:  regexp.MustCompile(`^(.+?)\s+\(([^)]+)\)\s+(.+)$`),
-		chainedRelRegex:     regexp.MustCompile(`^(.+?)\s+\(([^)]+)\)\s+(.+?)\s+\(([^)]+)\)\s+(.+)$`),
-		equivalenceRegex:    regexp.MustCompile(`^(.+?)\s+<->\s+(.+)$`),
-		groupRegex:          regexp.MustCompile(`^(.+?)\s+=>\s+\{(.+)\}$`),
+		relationArrowRegex: regexp.MustCompile(`^(.+?)\s+->\s+(.+?)\s+->\s+(.+)$`),
+		relationParenRegex: regexp.MustCompile(`^(.+?)\s+\(([^)]+)\)\s+(.+)$`),
+		equivalenceRegex:   regexp.MustCompile(`^(.+?)\s+<->\s+(.+)$`),
+		groupRegex:         regexp.MustCompile(`^(.+?)\s+=>\s+\{(.+)\}$`),
 
 		// Références et alias
-		aliasDefRegex:     regexp.MustCompile(`^@(\w+)\s+(.+)$`),
-		aliasRefRegex:     regexp.MustCompile(`\$(\w+)\.(\d+)`),
-		continuationRegex: regexp.MustCompile(`^"\s+\(([^)]+)\)\s+(.+)$`),
-		varRefRegex:       regexp.MustCompile(`\$(\d+)`),
-		entityRefRegex:    regexp.MustCompile(`>(\w+)`),
+		aliasDefRegex:  regexp.MustCompile(`^@(\w+)\s+(.+)$`),
+		entityRefRegex: regexp.MustCompile(`>(\w+)`),
 
 		// Modificateurs
 		neverRegex: regexp.MustCompile(`^\\never\s+(.+)$`),
@@ -84,16 +65,6 @@ func NewN4LService() *N4LService {
 		// Note: on évite de matcher .N qui fait partie de $alias.N
 		// Utilise \p{L} pour matcher les lettres Unicode (accents français)
 		implicitMarkerRegex: regexp.MustCompile(`(?:^|[^$\p{L}\d_])([=*])([\p{L}_][\p{L}\d_]*)|(?:^|\s)(\.([\p{L}_][\p{L}\d_]*))`),
-		quotedStringRegex:   regexp.MustCompile(`^["'](.+?)["']$`),
-
-		// Sections
-		sectionRegex: regexp.MustCompile(`^-(\w+(?:/\w+)*)$`),
-
-		// État
-		sequenceMode:    false,
-		aliases:         make(map[string][]string),
-		previousItems:   []string{},
-		aliasItemsCache: make(map[string][]string),
 	}
 }
 
@@ -111,6 +82,14 @@ type ParsedN4L struct {
 	CausalChains    []CausalChain         `json:"causal_chains"`    // Chaînes A (rel) B (rel) C
 	ImplicitMarkers map[string][]string   `json:"implicit_markers"` // =def, *important, .ref
 	CrossRefs       []CrossReference      `json:"cross_refs"`       // $alias.n références
+	Errors          []N4LError            `json:"errors,omitempty"` // Erreurs et avertissements du parseur
+}
+
+// N4LError représente une erreur ou un avertissement du parseur N4L
+type N4LError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning"`
 }
 
 // CausalChain représente une chaîne de relations causales N4L
@@ -197,12 +176,9 @@ type HypothesisAttributes struct {
 	Questions             []string
 }
 
-// ParseN4L parse le contenu d'un fichier N4L avec support complet SSTorytime
+// ParseN4L parse le contenu d'un fichier N4L avec le parseur SSTorytime (paquet n4l)
+// puis le convertit en notes, sujets et graphe pour le dashboard
 func (s *N4LService) ParseN4L(content string) ParsedN4L {
-	// Protéger les accès concurrents aux maps partagées
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	result := ParsedN4L{
 		Notes:           make(map[string][]string),
 		Subjects:        []string{},
@@ -220,230 +196,162 @@ func (s *N4LService) ParseN4L(content string) ParsedN4L {
 		},
 	}
 
-	// Reset l'état du parser
-	s.aliases = make(map[string][]string)
-	s.aliasItemsCache = make(map[string][]string)
-	s.previousItems = []string{}
-	s.sequenceMode = false
-	s.currentAlias = ""
+	file, err := n4l.Parse("case.n4l", strings.NewReader(content), n4l.Config{})
+	if err != nil {
+		result.Errors = append(result.Errors, N4LError{Message: err.Error()})
+		return result
+	}
+
+	// Le parseur continue après une erreur, comme N4L en mode tolérant
+	for _, e := range file.Errors {
+		result.Errors = append(result.Errors, N4LError{Line: e.Pos.Line, Message: e.Msg, Warning: e.Warning})
+	}
 
+	// Alias locaux à cet appel: ParseN4L peut être appelé en parallèle
+	aliases := make(map[string][]string)
 	subjectsMap := make(map[string]bool)
-	currentContext := "general"
-	contextSet := make(map[string]bool)
-	contextSet["general"] = true
 	var currentSequence []string
 	var previousItem string
+	inSequence := false
 
-	lines := strings.Split(content, "\n")
-
-	for lineNum, line := range lines {
-		lineNum++ // 1-indexed pour les messages d'erreur
-		line = strings.TrimSpace(line)
-
-		// Ignorer lignes vides et commentaires
-		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
-			continue
-		}
-
-		// Détecter les TODO (lignes tout en majuscules)
-		if isAllCaps(line) && len(line) > 3 {
-			result.TodoItems = append(result.TodoItems, line)
-			continue
+	for _, chapter := range file.Chapters {
+		if chapter.Name != "" {
+			result.Sections = append(result.Sections, chapter.Name)
 		}
 
-		// Section: -section/chapter
-		if matches := s.sectionRegex.FindStringSubmatch(line); len(matches) == 2 {
-			section := matches[1]
-			result.Sections = append(result.Sections, section)
-			continue
-		}
+		for _, block := range chapter.Blocks {
+			currentContext := blockContextString(block.Context)
 
-		// Extension de contexte: +:: ajouter ::
-		if matches := s.extendContextRegex.FindStringSubmatch(line); len(matches) == 2 {
-			newContexts := strings.Split(matches[1], ",")
-			for _, ctx := range newContexts {
-				ctx = strings.TrimSpace(ctx)
-				if ctx != "" {
-					contextSet[ctx] = true
-					// Activer le mode séquence si _sequence_ est présent
-					if ctx == "_sequence_" || ctx == "_timeline_" {
-						s.sequenceMode = true
-						currentSequence = []string{}
-					}
+			if block.Op == '=' {
+				if !contains(result.Contexts, currentContext) {
+					result.Contexts = append(result.Contexts, currentContext)
+				}
+				if result.Notes[currentContext] == nil {
+					result.Notes[currentContext] = []string{}
 				}
 			}
-			currentContext = buildContextString(contextSet)
-			continue
-		}
 
-		// Suppression de contexte: -:: supprimer ::
-		if matches := s.removeContextRegex.FindStringSubmatch(line); len(matches) == 2 {
-			removeContexts := strings.Split(matches[1], ",")
-			for _, ctx := range removeContexts {
-				ctx = strings.TrimSpace(ctx)
-				delete(contextSet, ctx)
-				// Désactiver le mode séquence
-				if ctx == "_sequence_" || ctx == "_timeline_" {
-					s.sequenceMode = false
-					if len(currentSequence) > 0 {
-						result.Sequences = append(result.Sequences, currentSequence)
-					}
-					currentSequence = []string{}
-				}
+			// Mode séquence: _sequence_ ou _timeline_ dans le contexte
+			sequence := contains(block.Context, "_sequence_") || contains(block.Context, "_timeline_")
+			if sequence && !inSequence {
+				currentSequence = []string{}
 			}
-			currentContext = buildContextString(contextSet)
-			if currentContext == "" {
-				currentContext = "general"
-				contextSet["general"] = true
+			if !sequence && inSequence {
+				if len(currentSequence) > 0 {
+					result.Sequences = append(result.Sequences, currentSequence)
+				}
+				currentSequence = []string{}
 			}
-			continue
-		}
+			inSequence = sequence
 
-		// Changement de contexte: :: contexte ::
-		if matches := s.contextRegex.FindStringSubmatch(line); len(matches) == 2 {
-			// Réinitialiser le contexte
-			contextSet = make(map[string]bool)
-			newContexts := strings.Split(matches[1], ",")
-			for _, ctx := range newContexts {
-				ctx = strings.TrimSpace(ctx)
-				if ctx != "" {
-					contextSet[ctx] = true
-					if ctx == "_sequence_" || ctx == "_timeline_" {
-						s.sequenceMode = true
-						currentSequence = []string{}
-					}
+			for _, line := range block.Lines {
+				lineNum := line.Pos.Line
+				text := lineText(content, line)
+
+				if text == "" || len(line.Items) == 0 {
+					continue
 				}
-			}
-			currentContext = buildContextString(contextSet)
-			if currentContext == "" {
-				currentContext = "general"
-			}
-			if !contains(result.Contexts, currentContext) {
-				result.Contexts = append(result.Contexts, currentContext)
-			}
-			if result.Notes[currentContext] == nil {
-				result.Notes[currentContext] = []string{}
-			}
-			continue
-		}
 
-		// Définition d'alias: @alias texte
-		if matches := s.aliasDefRegex.FindStringSubmatch(line); len(matches) == 3 {
-			aliasName := matches[1]
-			aliasContent := matches[2]
-			s.currentAlias = aliasName
-
-			// Résoudre les références $alias.n dans le contenu de l'alias AVANT de le stocker
-			// Ceci permet de résoudre des lignes comme "@evt_09 29/08/2025 19:15 $victime.1 boit son thé"
-			resolvedContent := s.aliasRefRegex.ReplaceAllStringFunc(aliasContent, func(ref string) string {
-				refMatches := s.aliasRefRegex.FindStringSubmatch(ref)
-				if len(refMatches) == 3 {
-					refAlias := refMatches[1]
-					refIndex, _ := strconv.Atoi(refMatches[2])
-					if items, ok := s.aliases[refAlias]; ok && refIndex > 0 && refIndex <= len(items) {
-						return extractEntityName(items[refIndex-1])
-					}
+				// Détecter les TODO (lignes tout en majuscules)
+				if isAllCaps(text) && len(text) > 3 {
+					result.TodoItems = append(result.TodoItems, text)
+					continue
 				}
-				return ref // Garder la référence non résolue pour le second passage
-			})
 
-			s.aliases[aliasName] = []string{resolvedContent}
-			result.Aliases[aliasName] = []string{resolvedContent}
+				// Définition d'alias: @alias texte
+				if line.Alias != "" {
+					// Résoudre les références $alias.n dans le contenu de l'alias AVANT de le stocker
+					// Ceci permet de résoudre des lignes comme "@evt_09 29/08/2025 19:15 $victime.1 boit son thé"
+					aliasContent := strings.TrimSpace(strings.TrimPrefix(text, "@"+line.Alias))
+					resolvedContent := resolveReferences(aliasContent, aliases, nil, lineNum)
 
-			// Détecter les chaînes causales dans les définitions d'alias (ex: @chain_mobile A (rel) B (rel) C)
-			if chain := s.parseCausalChain(resolvedContent, currentContext); chain != nil {
-				chain.ID = aliasName // Utiliser le nom de l'alias comme ID de la chaîne
-				result.CausalChains = append(result.CausalChains, *chain)
-			}
+					aliases[line.Alias] = []string{resolvedContent}
+					result.Aliases[line.Alias] = []string{resolvedContent}
 
-			// Extraire juste le nom de l'entité (sans les attributs comme "(type) personne")
-			entityName := extractEntityName(resolvedContent)
-			if entityName != "" && !subjectsMap[entityName] {
-				subjectsMap[entityName] = true
-				result.Subjects = append(result.Subjects, entityName)
-			}
+					// Chaînes causales dans les définitions d'alias (ex: @chain_mobile A (rel) B (rel) C)
+					if chain := s.lineCausalChain(line, aliases, currentContext); chain != nil {
+						chain.ID = line.Alias
+						result.CausalChains = append(result.CausalChains, *chain)
+					}
 
-			// Mode séquence: créer des edges entre les alias consécutifs
-			if s.sequenceMode && entityName != "" {
-				currentSequence = append(currentSequence, entityName)
-				if previousItem != "" && previousItem != entityName {
-					seqEdge := models.GraphEdge{
-						From:    previousItem,
-						To:      entityName,
-						Label:   "puis",
-						Type:    "sequence",
-						Context: currentContext,
+					// Le premier item est le nom de l'entité, sans les attributs comme "(type) personne"
+					entityName := resolveReferences(line.Items[0].Text, aliases, nil, lineNum)
+					if entityName != "" && !subjectsMap[entityName] {
+						subjectsMap[entityName] = true
+						result.Subjects = append(result.Subjects, entityName)
 					}
-					result.Graph.Edges = append(result.Graph.Edges, seqEdge)
+
+					// Mode séquence: créer des edges entre les alias consécutifs
+					if inSequence && entityName != "" {
+						currentSequence = append(currentSequence, entityName)
+						if previousItem != "" && previousItem != entityName {
+							result.Graph.Edges = append(result.Graph.Edges, models.GraphEdge{
+								From:    previousItem,
+								To:      entityName,
+								Label:   "puis",
+								Type:    "sequence",
+								Context: currentContext,
+							})
+						}
+					}
+					previousItem = entityName
+					// Les attributs de l'alias ne sont pas des relations du graphe
+					continue
 				}
-			}
-			previousItem = entityName
-			// Ne PAS continuer à parser le contenu car les attributs ne sont pas des relations
-			continue
-		}
 
-		// Continuation: " (relation) B
-		// Les lignes qui commencent par " sont des attributs ou des relations
-		// On ne crée des edges QUE pour les vraies relations, pas pour les attributs
-		if strings.HasPrefix(line, "\"") {
-			// Extraire les marqueurs implicites même dans les lignes de continuation
-			// (ex: " (annotations) *Important)
-			s.extractImplicitMarkers(line, currentContext, &result)
-			// Les lignes de continuation sont des ATTRIBUTS, pas des relations du graphe
-			// Elles sont gérées par ParseForensicN4L pour les entités/preuves/etc.
-			// On ne les ajoute PAS au graphe ici.
-			continue
-		}
+				// Continuation: " (relation) B
+				// Ce sont des ATTRIBUTS gérés par ParseForensicN4L, pas des relations du graphe
+				if line.Items[0].Ref == "\"" {
+					s.extractImplicitMarkers(text, currentContext, &result)
+					continue
+				}
 
-		// Ajouter la note au contexte actuel
-		if result.Notes[currentContext] == nil {
-			result.Notes[currentContext] = []string{}
-		}
-		result.Notes[currentContext] = append(result.Notes[currentContext], line)
+				result.Notes[currentContext] = append(result.Notes[currentContext], text)
 
-		// Résoudre les références $alias.n et $n avant le parsing
-		resolvedLine := s.resolveReferences(line, &result, lineNum)
-		if resolvedLine != line {
-			line = resolvedLine
-		}
+				// Enregistrer les références croisées $alias.n de la ligne
+				resolvedLine := resolveReferences(text, aliases, &result, lineNum)
 
-		// Extraire les marqueurs implicites =def, *important, .ref
-		s.extractImplicitMarkers(line, currentContext, &result)
+				// Extraire les marqueurs implicites =def, *important, .ref
+				s.extractImplicitMarkers(resolvedLine, currentContext, &result)
 
-		// Parser la ligne pour extraire les arêtes et sujets
-		edges, subjects := s.parseNoteToEdges(line, currentContext)
-		for _, edge := range edges {
-			result.Graph.Edges = append(result.Graph.Edges, edge)
-		}
-		for _, subj := range subjects {
-			if !subjectsMap[subj] {
-				subjectsMap[subj] = true
-				result.Subjects = append(result.Subjects, subj)
-			}
-		}
+				// Les arêtes viennent des liens de l'AST; les formats propres au dashboard
+				// (A -> rel -> B, A <-> B, A => {B, C}) restent lus dans le texte
+				edges, subjects := s.lineToEdges(line, aliases, currentContext)
+				if len(edges) == 0 {
+					edges, subjects = s.parseNoteToEdges(resolvedLine, currentContext)
+				}
 
-		// Détecter et stocker les chaînes causales A (rel) B (rel) C
-		if chain := s.parseCausalChain(line, currentContext); chain != nil {
-			result.CausalChains = append(result.CausalChains, *chain)
-		}
+				result.Graph.Edges = append(result.Graph.Edges, edges...)
+				for _, subj := range subjects {
+					if !subjectsMap[subj] {
+						subjectsMap[subj] = true
+						result.Subjects = append(result.Subjects, subj)
+					}
+				}
 
-		// Mode séquence: lier les éléments consécutifs
-		if s.sequenceMode && len(subjects) > 0 {
-			firstSubject := subjects[0]
-			currentSequence = append(currentSequence, firstSubject)
-			if previousItem != "" && previousItem != firstSubject {
-				seqEdge := models.GraphEdge{
-					From:    previousItem,
-					To:      firstSubject,
-					Label:   "puis",
-					Type:    "sequence",
-					Context: currentContext,
+				// Chaînes causales A (rel) B (rel) C
+				if chain := s.lineCausalChain(line, aliases, currentContext); chain != nil {
+					result.CausalChains = append(result.CausalChains, *chain)
+				}
+
+				// Mode séquence: lier les éléments consécutifs
+				if inSequence && len(subjects) > 0 {
+					firstSubject := subjects[0]
+					currentSequence = append(currentSequence, firstSubject)
+					if previousItem != "" && previousItem != firstSubject {
+						result.Graph.Edges = append(result.Graph.Edges, models.GraphEdge{
+							From:    previousItem,
+							To:      firstSubject,
+							Label:   "puis",
+							Type:    "sequence",
+							Context: currentContext,
+						})
+					}
+					previousItem = firstSubject
+				} else if len(subjects) > 0 {
+					previousItem = subjects[0]
 				}
-				result.Graph.Edges = append(result.Graph.Edges, seqEdge)
 			}
-			previousItem = firstSubject
-		} else if len(subjects) > 0 {
-			previousItem = subjects[0]
 		}
 	}
 
@@ -466,7 +374,7 @@ func (s *N4LService) ParseN4L(content string) ParsedN4L {
 		if len(matches) == 3 {
 			aliasName := matches[1]
 			index, _ := strconv.Atoi(matches[2])
-			if items, ok := s.aliases[aliasName]; ok && index > 0 && index <= len(items) {
+			if items, ok := aliases[aliasName]; ok && index > 0 && index <= len(items) {
 				return extractEntityName(items[index-1])
 			}
 		}
@@ -474,7 +382,7 @@ func (s *N4LService) ParseN4L(content string) ParsedN4L {
 		simpleMatches := aliasRefSimplePattern.FindStringSubmatch(ref)
 		if len(simpleMatches) == 2 {
 			aliasName := simpleMatches[1]
-			if items, ok := s.aliases[aliasName]; ok && len(items) > 0 {
+			if items, ok := aliases[aliasName]; ok && len(items) > 0 {
 				return extractEntityName(items[0])
 			}
 		}
@@ -523,7 +431,7 @@ func (s *N4LService) ParseN4L(content string) ParsedN4L {
 		// Si la valeur résolue est encore un alias, utiliser le nom de l'alias
 		if result.CrossRefs[i].Resolved == "" || strings.HasPrefix(result.CrossRefs[i].Resolved, "$") {
 			// Essayer de résoudre via l'alias
-			if items, ok := s.aliases[result.CrossRefs[i].Alias]; ok && len(items) > 0 {
+			if items, ok := aliases[result.CrossRefs[i].Alias]; ok && len(items) > 0 {
 				result.CrossRefs[i].Resolved = extractEntityName(items[0])
 			}
 		}
@@ -551,6 +459,89 @@ func (s *N4LService) ParseN4L(content string) ParsedN4L {
 	return result
 }
 
+// lineText retourne le texte source d'une ligne de l'AST, sans commentaire final
+func lineText(content string, line *n4l.Line) string {
+	start := line.Pos.Offset
+	end := line.End.Offset
+	if end <= start || end > len(content) {
+		end = len(content)
+		if nl := strings.IndexByte(content[start:], '\n'); nl >= 0 {
+			end = start + nl
+		}
+	}
+	return strings.TrimSpace(content[start:end])
+}
+
+// blockContextString construit le nom de contexte d'un bloc N4L
+func blockContextString(context []string) string {
+	var contexts []string
+	for _, ctx := range context {
+		if ctx != "any" && ctx != "_sequence_" && ctx != "_timeline_" {
+			contexts = append(contexts, ctx)
+		}
+	}
+	if len(contexts) == 0 {
+		return "general"
+	}
+	return strings.Join(contexts, ", ")
+}
+
+// lineToEdges convertit les liens d'une ligne de l'AST en arêtes
+func (s *N4LService) lineToEdges(line *n4l.Line, aliases map[string][]string, context string) ([]models.GraphEdge, []string) {
+	edgeType := "relation"
+	var edges []models.GraphEdge
+	var subjects []string
+
+	name := func(item *n4l.Item) string {
+		text := resolveReferences(item.Text, aliases, nil, 0)
+		// Vérifier les modificateurs temporels
+		if item == line.Items[0] {
+			if matches := s.neverRegex.FindStringSubmatch(text); len(matches) == 2 {
+				edgeType = "never"
+				text = matches[1]
+			} else if matches := s.newRegex.FindStringSubmatch(text); len(matches) == 2 {
+				edgeType = "new"
+				text = matches[1]
+			}
+		}
+		// Nettoyer les références d'entité >nom
+		return strings.TrimSpace(s.entityRefRegex.ReplaceAllString(text, "$1"))
+	}
+
+	names := make(map[*n4l.Item]string)
+	for _, item := range line.Items {
+		names[item] = name(item)
+		if names[item] != "" && !contains(subjects, names[item]) {
+			subjects = append(subjects, names[item])
+		}
+	}
+
+	for _, l := range line.Links {
+		if l.Sequence || names[l.From] == "" || names[l.To] == "" {
+			continue
+		}
+		label := l.Arrow
+		if l.Weight != 1 {
+			label = fmt.Sprintf("%s (%g)", l.Arrow, l.Weight)
+		}
+		edges = append(edges, models.GraphEdge{
+			From:    names[l.From],
+			To:      names[l.To],
+			Label:   label,
+			Context: context,
+		})
+	}
+
+	for i := range edges {
+		edges[i].Type = edgeType
+	}
+
+	if len(edges) == 0 {
+		return nil, nil
+	}
+	return edges, subjects
+}
+
 // ParseForensicN4L parse le contenu N4L et extrait les structures forensiques complètes
 // Cette fonction permet d'utiliser N4L comme source unique de données pour le dashboard
 func (s *N4LService) ParseForensicN4L(content string, caseID string) ForensicParsedN4L {
@@ -2231,12 +2222,13 @@ func (s *N4LService) generateSTTypeInsights(analysis STTypeAnalysis) []string {
 // Nouvelles méthodes N4L avancées
 // ============================================
 
-// resolveReferences résout les références $alias.n et $n dans une ligne
-func (s *N4LService) resolveReferences(line string, result *ParsedN4L, lineNum int) string {
+// resolveReferences résout les références $alias.n dans une ligne
+// Si result n'est pas nil, chaque référence est enregistrée comme référence croisée
+func resolveReferences(line string, aliases map[string][]string, result *ParsedN4L, lineNum int) string {
 	resolved := line
 
 	// Résoudre $alias.n (ex: $victim.1 -> première entité de l'alias victim)
-	aliasMatches := s.aliasRefRegex.FindAllStringSubmatchIndex(resolved, -1)
+	aliasMatches := aliasRefRegex.FindAllStringSubmatchIndex(resolved, -1)
 	for i := len(aliasMatches) - 1; i >= 0; i-- {
 		match := aliasMatches[i]
 		fullMatch := resolved[match[0]:match[1]]
@@ -2245,22 +2237,20 @@ func (s *N4LService) resolveReferences(line string, result *ParsedN4L, lineNum i
 		index, _ := strconv.Atoi(indexStr)
 
 		// Chercher dans les alias
-		if items, ok := s.aliases[aliasName]; ok && index > 0 && index <= len(items) {
-			resolvedValue := items[index-1]
+		if items, ok := aliases[aliasName]; ok && index > 0 && index <= len(items) {
 			// Extraire uniquement le nom de l'entité (avant tout attribut comme "(type)")
-			// Ceci est nécessaire pour que les relations comme $alias.1 (relation) $alias2.1
-			// soient correctement parsées
-			resolvedValue = extractEntityName(resolvedValue)
+			resolvedValue := extractEntityName(items[index-1])
 			resolved = resolved[:match[0]] + resolvedValue + resolved[match[1]:]
 
-			// Enregistrer la référence croisée
-			result.CrossRefs = append(result.CrossRefs, CrossReference{
-				Alias:    aliasName,
-				Index:    index,
-				Resolved: resolvedValue,
-				Line:     lineNum,
-			})
-		} else {
+			if result != nil {
+				result.CrossRefs = append(result.CrossRefs, CrossReference{
+					Alias:    aliasName,
+					Index:    index,
+					Resolved: resolvedValue,
+					Line:     lineNum,
+				})
+			}
+		} else if result != nil {
 			// Garder la référence non résolue mais l'enregistrer
 			result.CrossRefs = append(result.CrossRefs, CrossReference{
 				Alias:    aliasName,
@@ -2271,20 +2261,6 @@ func (s *N4LService) resolveReferences(line string, result *ParsedN4L, lineNum i
 		}
 	}
 
-	// Résoudre $n (ex: $1 -> premier item précédent, $2 -> deuxième)
-	varMatches := s.varRefRegex.FindAllStringSubmatchIndex(resolved, -1)
-	for i := len(varMatches) - 1; i >= 0; i-- {
-		match := varMatches[i]
-		indexStr := resolved[match[2]:match[3]]
-		index, _ := strconv.Atoi(indexStr)
-
-		// Chercher dans les items précédents
-		if index > 0 && index <= len(s.previousItems) {
-			resolvedValue := s.previousItems[index-1]
-			resolved = resolved[:match[0]] + resolvedValue + resolved[match[1]:]
-		}
-	}
-
 	return resolved
 }
 
@@ -2329,64 +2305,48 @@ func (s *N4LService) extractImplicitMarkers(line, context string, result *Parsed
 	}
 }
 
-// parseCausalChain détecte et parse une chaîne causale A (rel) B (rel) C ...
-func (s *N4LService) parseCausalChain(line, context string) *CausalChain {
-	// Pattern pour chaînes avec 2+ relations: A (rel) B (rel) C
-	// On utilise une approche itérative pour supporter N relations
-	chainPattern := regexp.MustCompile(`^(.+?)\s+\(([^)]+)\)\s+(.+)$`)
-
-	parts := []string{}
-	relations := []string{}
-	remaining := line
-
-	// Extraire toutes les parties de la chaîne
-	for {
-		match := chainPattern.FindStringSubmatch(remaining)
-		if match == nil {
-			if remaining != "" && len(parts) > 0 {
-				parts = append(parts, strings.TrimSpace(remaining))
-			}
-			break
-		}
-
-		parts = append(parts, strings.TrimSpace(match[1]))
-		relations = append(relations, strings.TrimSpace(match[2]))
-		remaining = match[3]
-
-		// Vérifier si remaining contient encore une relation
-		if !strings.Contains(remaining, "(") {
-			parts = append(parts, strings.TrimSpace(remaining))
-			break
+// lineCausalChain construit une chaîne causale A (rel) B (rel) C ... à partir des liens d'une ligne
+func (s *N4LService) lineCausalChain(line *n4l.Line, aliases map[string][]string, context string) *CausalChain {
+	var links []*n4l.Link
+	for _, l := range line.Links {
+		if !l.Sequence {
+			links = append(links, l)
 		}
 	}
 
-	// Une chaîne causale nécessite au moins 3 éléments et 2 relations
-	if len(parts) < 3 || len(relations) < 2 {
+	// Une chaîne causale nécessite au moins 3 éléments et 2 relations, bout à bout
+	if len(links) < 2 {
 		return nil
 	}
+	for i := 1; i < len(links); i++ {
+		if links[i].From != links[i-1].To {
+			return nil
+		}
+	}
 
 	// Construire la chaîne
 	chain := &CausalChain{
 		ID:      fmt.Sprintf("chain-%d", time.Now().UnixNano()),
 		Context: context,
-		Steps:   make([]ChainStep, 0, len(parts)),
+		Steps:   make([]ChainStep, 0, len(links)+1),
 		STType:  STLeadsTo, // Par défaut, les chaînes sont causales
 	}
 
-	for i, part := range parts {
-		step := ChainStep{
-			Item:  part,
-			Index: i,
-		}
-		if i < len(relations) {
-			step.Relation = relations[i]
-		}
-		chain.Steps = append(chain.Steps, step)
+	for i, l := range links {
+		chain.Steps = append(chain.Steps, ChainStep{
+			Item:     resolveReferences(l.From.Text, aliases, nil, 0),
+			Relation: l.Arrow,
+			Index:    i,
+		})
 	}
+	chain.Steps = append(chain.Steps, ChainStep{
+		Item:  resolveReferences(links[len(links)-1].To.Text, aliases, nil, 0),
+		Index: len(links),
+	})
 
 	// Déterminer le STType dominant
-	for _, rel := range relations {
-		stType := InferSTTypeFromRelation(rel)
+	for _, l := range links {
+		stType := InferSTTypeFromRelation(l.Arrow)
 		if stType != STNear {
 			chain.STType = stType
 			break
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"log"
 	"sort"
 	"strings"
 	"sync"
@@ -22,11 +23,42 @@ type ScenarioService struct {
 
 // NewScenarioService crée un nouveau service de scénarios
 func NewScenarioService(cases *CaseService, ollama *OllamaService) *ScenarioService {
-	return &ScenarioService{
+	s := &ScenarioService{
 		scenarios: make(map[string]map[string]*models.Scenario),
 		cases:     cases,
 		ollama:    ollama,
 	}
+
+	// Recharger les scénarios persistés
+	if store := cases.Store(); store != nil {
+		for caseID, list := range store.LoadScenarios() {
+			s.scenarios[caseID] = make(map[string]*models.Scenario)
+			for _, scenario := range list {
+				s.scenarios[caseID][scenario.ID] = scenario
+			}
+		}
+	}
+	return s
+}
+
+// persist écrit les scénarios d'une affaire dans le stockage (s.mu doit être verrouillé)
+func (s *ScenarioService) persist(caseID, op string) {
+	store := s.cases.Store()
+	if store == nil {
+		return
+	}
+
+	scenarios := make([]*models.Scenario, 0, len(s.scenarios[caseID]))
+	for _, scenario := range s.scenarios[caseID] {
+		scenarios = append(scenarios, scenario)
+	}
+	sort.Slice(scenarios, func(i, j int) bool {
+		return scenarios[i].CreatedAt.Before(scenarios[j].CreatedAt)
+	})
+
+	if err := store.SaveScenarios(caseID, scenarios, op); err != nil {
+		log.Printf("Erreur sauvegarde scénarios %s: %v", caseID, err)
+	}
 }
 
 // findExistingScenario retourne l'ID d'un scénario similaire existant, ou "" si aucun
@@ -98,6 +130,7 @@ func (s *ScenarioService) CreateScenario(caseID string, req models.ScenarioSimul
 		s.scenarios[caseID] = make(map[string]*models.Scenario)
 	}
 	s.scenarios[caseID][scenario.ID] = scenario
+	s.persist(caseID, "create_scenario")
 
 	return scenario, nil
 }
@@ -143,6 +176,7 @@ func (s *ScenarioService) DeleteScenario(caseID, scenarioID string) error {
 	if caseScenarios, ok := s.scenarios[caseID]; ok {
 		if _, ok := caseScenarios[scenarioID]; ok {
 			delete(caseScenarios, scenarioID)
+			s.persist(caseID, "delete_scenario")
 			return nil
 		}
 	}
@@ -220,8 +254,11 @@ func (s *ScenarioService) SimulateWithAI(caseID, scenarioID string) (string, err
 	}
 
 	// Mettre à jour le scénario avec l'analyse
+	s.mu.Lock()
 	scenario.AIAnalysis = analysis
 	scenario.UpdatedAt = time.Now()
+	s.persist(caseID, "simulate_scenario")
+	s.mu.Unlock()
 
 	return analysis, nil
 }
@@ -269,6 +306,7 @@ func (s *ScenarioService) SimulateWithAIStream(caseID, scenarioID string, callba
 		if sc := caseScenarios[scenarioID]; sc != nil {
 			sc.AIAnalysis = fullAnalysis.String()
 			sc.UpdatedAt = time.Now()
+			s.persist(caseID, "simulate_scenario")
 		}
 	}
 	s.mu.Unlock()
@@ -0,0 +1,481 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	SST "SSTorytime"
+
+	"forensicinvestigator/internal/models"
+)
+
+// SSTBridgeService relie les affaires à la base SSTorytime : le contenu N4L de chaque
+// affaire est téléversé comme un chapitre à part, et les recherches de cônes, de chemins
+// et d'orbites passent par la bibliothèque plutôt que par les graphes en mémoire
+type SSTBridgeService struct {
+	sst      SST.PoSST
+	n4l      *N4LService
+	search   *SearchService
+	mu       sync.Mutex        // la bibliothèque n'est pas réentrante
+	uploaded map[string]string // caseID -> contenu N4L déjà téléversé
+}
+
+// NewSSTBridgeService ouvre la base SSTorytime (Postgres, ou le fichier désigné par SST_EMBEDDED_DB)
+func NewSSTBridgeService(n4l *N4LService, search *SearchService) *SSTBridgeService {
+	return &SSTBridgeService{
+		sst:      SST.Open(true),
+		n4l:      n4l,
+		search:   search,
+		uploaded: make(map[string]string),
+	}
+}
+
+// Close ferme la base SSTorytime
+func (b *SSTBridgeService) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	SST.Close(b.sst)
+}
+
+// CaseChapter retourne le nom du chapitre SST d'une affaire
+func CaseChapter(caseID string) string {
+	return "forensic " + caseID
+}
+
+// caseContent retourne le N4L d'une affaire, exporté depuis ses entités si elle n'en a pas
+func (b *SSTBridgeService) caseContent(c *models.Case) string {
+	if strings.TrimSpace(c.N4LContent) != "" {
+		return c.N4LContent
+	}
+	return b.n4l.ExportToN4L(c)
+}
+
+// CaseImport convertit le N4L d'une affaire en import SST : les relations deviennent
+// des flèches, avec le STType déclaré (relation:+L) ou déduit du libellé
+func (b *SSTBridgeService) CaseImport(c *models.Case) SST.GraphImport {
+	_, edges := b.n4l.ParseN4LWithSTTypes(b.caseContent(c))
+
+	imp := SST.GraphImport{
+		Origin: "ForensicInvestigator",
+		Using:  make(map[string]string),
+	}
+	taken := make(map[string]bool)
+
+	arrow := func(label string, st STType) string {
+		if short, ok := imp.Using[label]; ok {
+			return short
+		}
+
+		// Une flèche existante du même nom (puis, contient, ...)
+		if ptr, ok := SST.LookupArrowShort(label); ok {
+			imp.Using[label] = SST.ArrowDirectoryEntry(ptr).Short
+			return imp.Using[label]
+		}
+		if ptr, ok := SST.LookupArrowLong(label); ok {
+			imp.Using[label] = SST.ArrowDirectoryEntry(ptr).Short
+			return imp.Using[label]
+		}
+
+		short := SST.UnusedArrowShortName(SST.ArrowShortName(label), taken)
+		invlong := SST.InverseArrowName(label)
+		invshort := SST.UnusedArrowShortName(short+"-inv", taken)
+		sttype := int(st)
+
+		var a SST.ImportArrow
+		switch {
+		case sttype == SST.NEAR:
+			a = SST.ImportArrow{STType: SST.NEAR, Long: label, Short: short, InvLong: label, InvShort: short}
+		case sttype < 0:
+			// La flèche avant de la paire est toujours positive
+			a = SST.ImportArrow{STType: -sttype, Long: invlong, Short: invshort, InvLong: label, InvShort: short}
+		default:
+			a = SST.ImportArrow{STType: sttype, Long: label, Short: short, InvLong: invlong, InvShort: invshort}
+		}
+
+		imp.Arrows = append(imp.Arrows, &a)
+		imp.Using[label] = short
+		return short
+	}
+
+	for _, e := range edges {
+		if e.From == "" || e.To == "" || e.From == e.To || e.Label == "" {
+			continue
+		}
+
+		var context []string
+		if e.Context != "" && e.Context != "general" {
+			for _, ctx := range strings.Split(e.Context, ",") {
+				if ctx = strings.TrimSpace(ctx); ctx != "" {
+					context = append(context, ctx)
+				}
+			}
+		}
+
+		imp.Links = append(imp.Links, SST.ImportLink{
+			From:    e.From,
+			To:      e.To,
+			Arrow:   arrow(e.Label, e.STType),
+			Context: context,
+			Weight:  float32(e.Weight),
+		})
+	}
+
+	return imp
+}
+
+// SyncCase téléverse le chapitre d'une affaire si son contenu N4L a changé depuis le dernier envoi
+func (b *SSTBridgeService) SyncCase(c *models.Case) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncCase(c)
+}
+
+// syncCase fait le travail de SyncCase (b.mu doit être verrouillé)
+func (b *SSTBridgeService) syncCase(c *models.Case) {
+	content := b.caseContent(c)
+	if previous, ok := b.uploaded[c.ID]; ok && previous == content {
+		return
+	}
+
+	added, removed := SST.ReplaceImport(b.sst, b.CaseImport(c), CaseChapter(c.ID))
+	b.uploaded[c.ID] = content
+	log.Printf("[SST] Affaire %s téléversée dans le chapitre '%s': %d liens, %d retirés", c.ID, CaseChapter(c.ID), added, removed)
+}
+
+// caseNames associe les textes des nœuds aux entités de l'affaire
+type caseNames struct {
+	byID   map[string]models.Entity
+	byName map[string]models.Entity
+}
+
+func newCaseNames(c *models.Case) caseNames {
+	names := caseNames{
+		byID:   make(map[string]models.Entity),
+		byName: make(map[string]models.Entity),
+	}
+	for _, e := range c.Entities {
+		names.byID[e.ID] = e
+		names.byName[e.Name] = e
+	}
+	return names
+}
+
+// text retourne le texte du nœud SST pour un ID d'entité ou un libellé N4L
+func (n caseNames) text(id string) string {
+	if e, ok := n.byID[id]; ok {
+		return e.Name
+	}
+	return id
+}
+
+// id retourne l'ID d'entité d'un texte de nœud, ou le texte lui-même (compatibilité N4L)
+func (n caseNames) id(text string) string {
+	if e, ok := n.byName[text]; ok {
+		return e.ID
+	}
+	return text
+}
+
+// nodeType retourne le type d'entité d'un texte de nœud
+func (n caseNames) nodeType(text string) string {
+	if e, ok := n.byName[text]; ok {
+		return string(e.Type)
+	}
+	return "n4l"
+}
+
+// nodePtrs retrouve les nœuds SST des IDs ou libellés donnés (b.mu doit être verrouillé)
+func (b *SSTBridgeService) nodePtrs(names caseNames, ids []string) ([]SST.NodePtr, error) {
+	var texts []string
+	for _, id := range ids {
+		texts = append(texts, names.text(id))
+	}
+
+	found := make(map[string]SST.NodePtr)
+	for _, n := range SST.GetDBNodesByText(b.sst, texts) {
+		found[n.S] = n.NPtr
+	}
+
+	var nptrs []SST.NodePtr
+	for _, t := range texts {
+		nptr, ok := found[t]
+		if !ok {
+			return nil, fmt.Errorf("nœud '%s' non trouvé dans le chapitre SST", t)
+		}
+		nptrs = append(nptrs, nptr)
+	}
+	return nptrs, nil
+}
+
+// nodeText retourne le texte d'un nœud SST (b.mu doit être verrouillé)
+func (b *SSTBridgeService) nodeText(nptr SST.NodePtr) string {
+	return SST.GetDBNodeByNodePtr(b.sst, nptr).S
+}
+
+// coneSTTypes traduit la direction d'un cône en types spacetime SST
+func coneSTTypes(direction ConeDirection) []int {
+	switch direction {
+	case ConeForward:
+		return []int{SST.NEAR, SST.LEADSTO, SST.CONTAINS, SST.EXPRESS}
+	case ConeBackward:
+		return []int{SST.NEAR, -SST.LEADSTO, -SST.CONTAINS, -SST.EXPRESS}
+	}
+	return nil
+}
+
+// arrowPtrs traduit des noms de relations en flèches SST connues
+func arrowPtrs(names []string) []SST.ArrowPtr {
+	var ptrs []SST.ArrowPtr
+	for _, name := range names {
+		if ptr, ok := SST.LookupArrowShort(name); ok {
+			ptrs = append(ptrs, ptr)
+		} else if ptr, ok := SST.LookupArrowLong(name); ok {
+			ptrs = append(ptrs, ptr)
+		} else if ptr, ok := SST.LookupArrowShort(SST.ArrowShortName(name)); ok {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	return ptrs
+}
+
+// pathToCone convertit un chemin de liens SST en chemin de cône (b.mu doit être verrouillé)
+func (b *SSTBridgeService) pathToCone(names caseNames, path []SST.Link) ConePath {
+	var cp ConePath
+	for i, lnk := range path {
+		text := b.nodeText(lnk.Dst)
+		cp.Nodes = append(cp.Nodes, names.id(text))
+		cp.Labels = append(cp.Labels, text)
+		if i > 0 {
+			cp.Edges = append(cp.Edges, SST.GetDBArrowByPtr(b.sst, lnk.Arr).Long)
+		}
+	}
+	cp.Length = len(cp.Nodes)
+	return cp
+}
+
+// ConeSearch effectue une recherche par cône d'expansion avec GetConstraintConePathsAsLinks
+func (b *SSTBridgeService) ConeSearch(c *models.Case, req ConeSearchRequest) (*ConeSearchResult, error) {
+	if req.Depth <= 0 {
+		req.Depth = 3
+	}
+	if req.Limit <= 0 {
+		req.Limit = 100
+	}
+	if req.Direction == "" {
+		req.Direction = ConeBidirectional
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncCase(c)
+
+	names := newCaseNames(c)
+	start, err := b.nodePtrs(names, []string{req.StartNode})
+	if err != nil {
+		return nil, fmt.Errorf("nœud de départ '%s' non trouvé", req.StartNode)
+	}
+
+	paths, _ := SST.GetConstraintConePathsAsLinks(b.sst, start, req.Depth, CaseChapter(c.ID), req.Context, arrowPtrs(req.ArrowTypes), coneSTTypes(req.Direction), req.Limit)
+
+	startLabel := names.text(req.StartNode)
+	levelNodes := make(map[int][]ConeNode)
+	levelEdges := make(map[int][]ConeEdge)
+	levelNodes[0] = []ConeNode{{ID: names.id(startLabel), Label: startLabel, Type: names.nodeType(startLabel), Distance: 0, Weight: 1.0}}
+
+	seenNode := map[SST.NodePtr]bool{start[0]: true}
+	seenEdge := make(map[string]bool)
+	totalNodes, totalEdges := 1, 0
+	var allPaths []ConePath
+
+	for _, path := range paths {
+		weight := 1.0
+		for i := 1; i < len(path) && i <= req.Depth; i++ {
+			from := b.nodeText(path[i-1].Dst)
+			to := b.nodeText(path[i].Dst)
+			arrow := SST.GetDBArrowByPtr(b.sst, path[i].Arr)
+			weight *= 0.8 // Décroissance, comme pour les graphes en mémoire
+
+			key := fmt.Sprintf("%v>%d>%v", path[i-1].Dst, path[i].Arr, path[i].Dst)
+			if !seenEdge[key] {
+				seenEdge[key] = true
+				levelEdges[i] = append(levelEdges[i], ConeEdge{
+					From:    names.id(from),
+					To:      names.id(to),
+					Label:   arrow.Long,
+					Type:    SST.STTypeName(SST.STIndexToSTType(arrow.STAindex)),
+					Context: SST.GetContext(path[i].Ctx),
+					Level:   i,
+				})
+				totalEdges++
+			}
+
+			if !seenNode[path[i].Dst] && totalNodes < req.Limit {
+				seenNode[path[i].Dst] = true
+				levelNodes[i] = append(levelNodes[i], ConeNode{
+					ID:       names.id(to),
+					Label:    to,
+					Type:     names.nodeType(to),
+					Distance: i,
+					Weight:   weight,
+				})
+				totalNodes++
+			}
+		}
+
+		if len(path) > 2 {
+			allPaths = append(allPaths, b.pathToCone(names, path))
+		}
+	}
+
+	var levels []ConeLevel
+	for level := 0; level <= req.Depth; level++ {
+		if nodes := levelNodes[level]; len(nodes) > 0 {
+			levels = append(levels, ConeLevel{Level: level, Nodes: nodes, Edges: levelEdges[level]})
+		}
+	}
+
+	// Limiter les chemins retournés
+	if len(allPaths) > 20 {
+		allPaths = allPaths[:20]
+	}
+
+	return &ConeSearchResult{
+		StartNode:   names.id(startLabel),
+		StartLabel:  startLabel,
+		Direction:   string(req.Direction),
+		Depth:       req.Depth,
+		Levels:      levels,
+		TotalNodes:  totalNodes,
+		TotalEdges:  totalEdges,
+		Paths:       allPaths,
+		Suggestions: b.search.generateConeSuggestions(levels, totalNodes, totalEdges, req.Direction),
+	}, nil
+}
+
+// DiracPathSearch recherche les chemins <end|start> avec GetPathsAndSymmetries
+func (b *SSTBridgeService) DiracPathSearch(c *models.Case, startNodes, endNodes []string, maxDepth int) ([]ConePath, error) {
+	if maxDepth <= 0 {
+		maxDepth = 5
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncCase(c)
+
+	names := newCaseNames(c)
+	start, err := b.nodePtrs(names, startNodes)
+	if err != nil {
+		return nil, err
+	}
+	end, err := b.nodePtrs(names, endNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	solutions := SST.GetPathsAndSymmetries(b.sst, start, end, CaseChapter(c.ID), nil, nil, nil, 0, maxDepth)
+
+	paths := make([]ConePath, 0, len(solutions))
+	for _, path := range solutions {
+		paths = append(paths, b.pathToCone(names, path))
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		return paths[i].Length < paths[j].Length
+	})
+	return paths, nil
+}
+
+// AnalyzeOrbits analyse les orbites d'un nœud avec GetNodeOrbit (deux niveaux au plus)
+func (b *SSTBridgeService) AnalyzeOrbits(c *models.Case, req OrbitRequest) (*OrbitResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncCase(c)
+
+	names := newCaseNames(c)
+	center, err := b.nodePtrs(names, []string{req.NodeID})
+	if err != nil {
+		return nil, fmt.Errorf("nœud '%s' non trouvé", req.NodeID)
+	}
+
+	satellites := SST.GetNodeOrbit(b.sst, center[0], "", SST.CAUSAL_CONE_MAXLIMIT)
+
+	levelNodes := make(map[int]map[string]*OrbitNode)
+	levelEdges := make(map[int]map[string]int)
+	maxLevel := 0
+
+	for st := range satellites {
+		for _, orbit := range satellites[st] {
+			if orbit.Dst == center[0] || (req.MaxLevel > 0 && orbit.Radius > req.MaxLevel) {
+				continue
+			}
+			if levelNodes[orbit.Radius] == nil {
+				levelNodes[orbit.Radius] = make(map[string]*OrbitNode)
+				levelEdges[orbit.Radius] = make(map[string]int)
+			}
+			if orbit.Radius > maxLevel {
+				maxLevel = orbit.Radius
+			}
+
+			levelEdges[orbit.Radius][orbit.Arrow]++
+			if node, ok := levelNodes[orbit.Radius][orbit.Text]; ok {
+				node.Connections++
+				node.EdgeLabels = append(node.EdgeLabels, orbit.Arrow)
+				continue
+			}
+			levelNodes[orbit.Radius][orbit.Text] = &OrbitNode{
+				NodeID:      names.id(orbit.Text),
+				NodeLabel:   orbit.Text,
+				NodeType:    names.nodeType(orbit.Text),
+				Connections: 1,
+				EdgeLabels:  []string{orbit.Arrow},
+			}
+		}
+	}
+
+	var orbits []OrbitLevel
+	totalNodes := 0
+
+	for level := 1; level <= maxLevel; level++ {
+		if len(levelNodes[level]) == 0 {
+			continue
+		}
+		nodes := make([]OrbitNode, 0, len(levelNodes[level]))
+		typeBreakdown := make(map[string]int)
+		for _, node := range levelNodes[level] {
+			nodes = append(nodes, *node)
+			typeBreakdown[node.NodeType]++
+		}
+
+		// Trier par nombre de connexions
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].Connections != nodes[j].Connections {
+				return nodes[i].Connections > nodes[j].Connections
+			}
+			return nodes[i].NodeLabel < nodes[j].NodeLabel
+		})
+
+		orbits = append(orbits, OrbitLevel{
+			Level:         level,
+			Nodes:         nodes,
+			Count:         len(nodes),
+			TypeBreakdown: typeBreakdown,
+			EdgeTypes:     levelEdges[level],
+		})
+		totalNodes += len(nodes)
+	}
+
+	centerLabel := names.text(req.NodeID)
+
+	return &OrbitResult{
+		CenterNode:  names.id(centerLabel),
+		CenterLabel: centerLabel,
+		CenterType:  names.nodeType(centerLabel),
+		Orbits:      orbits,
+		TotalNodes:  totalNodes,
+		MaxReached:  len(orbits),
+		Insights:    b.search.generateOrbitInsights(orbits, centerLabel, totalNodes),
+	}, nil
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"forensicinvestigator/internal/models"
+)
+
+// CaseStore persiste les affaires sur disque en JSON, un répertoire par affaire :
+//
+//	data/cases/<caseID>/case.json       affaire, entités, preuves, événements, hypothèses
+//	data/cases/<caseID>/scenarios.json  scénarios "What-If"
+//	data/cases/<caseID>/anomalies.json  anomalies, alertes et configuration de détection
+//	data/cases/journal.jsonl            journal des modifications (une ligne par écriture)
+//
+// Chaque fichier est écrit de façon atomique (fichier temporaire puis rename),
+// si bien qu'un arrêt brutal laisse toujours l'ancienne ou la nouvelle version.
+type CaseStore struct {
+	dataDir string
+	mu      sync.Mutex
+	journal *os.File
+}
+
+// JournalEntry est une ligne du journal des modifications
+type JournalEntry struct {
+	Time   time.Time `json:"time"`
+	CaseID string    `json:"case_id"`
+	Kind   string    `json:"kind"` // case, scenarios, anomalies
+	Op     string    `json:"op"`   // nom de l'opération (add_entity, delete, ...)
+}
+
+// AnomalyState regroupe l'état de détection d'anomalies d'une affaire
+type AnomalyState struct {
+	Anomalies []*models.Anomaly              `json:"anomalies"`
+	Alerts    []*models.AnomalyAlert         `json:"alerts"`
+	Config    *models.AnomalyDetectionConfig `json:"config,omitempty"`
+}
+
+const (
+	caseFile      = "case.json"
+	scenariosFile = "scenarios.json"
+	anomaliesFile = "anomalies.json"
+	journalFile   = "journal.jsonl"
+)
+
+// NewCaseStore ouvre (ou crée) le stockage des affaires dans dataDir
+func NewCaseStore(dataDir string) (*CaseStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("erreur création répertoire affaires: %w", err)
+	}
+
+	journal, err := os.OpenFile(filepath.Join(dataDir, journalFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("erreur ouverture journal: %w", err)
+	}
+
+	return &CaseStore{
+		dataDir: dataDir,
+		journal: journal,
+	}, nil
+}
+
+// Close ferme le journal
+func (st *CaseStore) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.journal.Close()
+}
+
+// SaveCase écrit une affaire et journalise l'opération
+func (st *CaseStore) SaveCase(c *models.Case, op string) error {
+	return st.save(c.ID, caseFile, "case", op, c)
+}
+
+// SaveScenarios écrit les scénarios d'une affaire
+func (st *CaseStore) SaveScenarios(caseID string, scenarios []*models.Scenario, op string) error {
+	return st.save(caseID, scenariosFile, "scenarios", op, scenarios)
+}
+
+// SaveAnomalies écrit l'état de détection d'anomalies d'une affaire
+func (st *CaseStore) SaveAnomalies(caseID string, state *AnomalyState, op string) error {
+	return st.save(caseID, anomaliesFile, "anomalies", op, state)
+}
+
+// DeleteCase supprime le répertoire d'une affaire. La suppression est journalisée
+// pour qu'une affaire de démonstration supprimée ne soit pas rechargée au démarrage.
+func (st *CaseStore) DeleteCase(caseID string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := os.RemoveAll(st.caseDir(caseID)); err != nil {
+		return fmt.Errorf("erreur suppression affaire %s: %w", caseID, err)
+	}
+	return st.appendJournal(caseID, "case", "delete")
+}
+
+// LoadCases charge toutes les affaires stockées
+func (st *CaseStore) LoadCases() []*models.Case {
+	var cases []*models.Case
+	st.eachCase(caseFile, func(dir string, data []byte) {
+		var c models.Case
+		if err := json.Unmarshal(data, &c); err != nil {
+			log.Printf("Erreur parsing affaire %s: %v", dir, err)
+			return
+		}
+		cases = append(cases, &c)
+	})
+	return cases
+}
+
+// LoadScenarios charge les scénarios stockés, par affaire
+func (st *CaseStore) LoadScenarios() map[string][]*models.Scenario {
+	scenarios := make(map[string][]*models.Scenario)
+	st.eachCase(scenariosFile, func(dir string, data []byte) {
+		var list []*models.Scenario
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.Printf("Erreur parsing scénarios %s: %v", dir, err)
+			return
+		}
+		for _, sc := range list {
+			scenarios[sc.CaseID] = append(scenarios[sc.CaseID], sc)
+		}
+	})
+	return scenarios
+}
+
+// LoadAnomalies charge l'état de détection d'anomalies stocké, par affaire
+func (st *CaseStore) LoadAnomalies() map[string]*AnomalyState {
+	states := make(map[string]*AnomalyState)
+	st.eachCase(anomaliesFile, func(dir string, data []byte) {
+		var state AnomalyState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Printf("Erreur parsing anomalies %s: %v", dir, err)
+			return
+		}
+		if state.Config != nil {
+			states[state.Config.CaseID] = &state
+		} else if len(state.Anomalies) > 0 {
+			states[state.Anomalies[0].CaseID] = &state
+		} else if len(state.Alerts) > 0 {
+			states[state.Alerts[0].CaseID] = &state
+		}
+	})
+	return states
+}
+
+// DeletedCases rejoue le journal et retourne les affaires dont la dernière opération est une suppression
+func (st *CaseStore) DeletedCases() map[string]bool {
+	deleted := make(map[string]bool)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	f, err := os.Open(filepath.Join(st.dataDir, journalFile))
+	if err != nil {
+		return deleted
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Kind != "case" {
+			continue
+		}
+		deleted[entry.CaseID] = entry.Op == "delete"
+	}
+
+	for id, isDeleted := range deleted {
+		if !isDeleted {
+			delete(deleted, id)
+		}
+	}
+	return deleted
+}
+
+// save sérialise v et l'écrit de façon atomique dans le répertoire de l'affaire
+func (st *CaseStore) save(caseID, name, kind, op string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("erreur sérialisation %s: %w", kind, err)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	dir := st.caseDir(caseID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("erreur création répertoire %s: %w", dir, err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, name), data); err != nil {
+		return err
+	}
+	return st.appendJournal(caseID, kind, op)
+}
+
+// appendJournal ajoute une ligne au journal (st.mu doit être verrouillé)
+func (st *CaseStore) appendJournal(caseID, kind, op string) error {
+	line, err := json.Marshal(JournalEntry{Time: time.Now(), CaseID: caseID, Kind: kind, Op: op})
+	if err != nil {
+		return err
+	}
+	if _, err := st.journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("erreur écriture journal: %w", err)
+	}
+	return nil
+}
+
+// eachCase appelle fn avec le contenu du fichier name de chaque répertoire d'affaire
+func (st *CaseStore) eachCase(name string, fn func(dir string, data []byte)) {
+	dirs, err := os.ReadDir(st.dataDir)
+	if err != nil {
+		log.Printf("Erreur lecture répertoire affaires: %v", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(st.dataDir, dir.Name(), name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Erreur lecture %s/%s: %v", dir.Name(), name, err)
+			}
+			continue
+		}
+		fn(dir.Name(), data)
+	}
+}
+
+// caseDir retourne le répertoire d'une affaire, en neutralisant les caractères spéciaux de l'ID
+func (st *CaseStore) caseDir(caseID string) string {
+	dirName := strings.NewReplacer("/", "_", "\\", "_", ":", "_", "..", "_").Replace(caseID)
+	return filepath.Join(st.dataDir, dirName)
+}
+
+// writeFileAtomic écrit data dans un fichier temporaire puis le renomme en path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("erreur création fichier temporaire: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("erreur écriture %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("erreur synchronisation %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("erreur fermeture %s: %w", path, err)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("erreur permissions %s: %w", path, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("erreur renommage %s: %w", path, err)
+	}
+	return nil
+}
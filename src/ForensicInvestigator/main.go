@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -12,6 +13,9 @@ import (
 )
 
 func main() {
+	useSST := flag.Bool("sst", false, "Rechercher dans la base SSTorytime (Postgres, ou SST_EMBEDDED_DB) au lieu des graphes en mémoire")
+	flag.Parse()
+
 	log.Println("ForensicInvestigator - Démarrage du serveur...")
 
 	// Initialiser les services (vLLM sur serveur distant)
@@ -19,7 +23,17 @@ func main() {
 	caseService := services.NewCaseService()
 	n4lService := services.NewN4LService()
 
-	// Charger les données de démonstration
+	// Stockage persistant des affaires (JSON sur disque, écritures atomiques + journal)
+	caseStore, err := services.NewCaseStore("data/cases")
+	if err != nil {
+		log.Printf("Stockage des affaires indisponible, affaires en mémoire uniquement: %v", err)
+	} else {
+		defer caseStore.Close()
+		stored := caseService.SetStore(caseStore)
+		log.Printf("Chargement de %d affaires enregistrées", stored)
+	}
+
+	// Charger les données de démonstration (sans écraser les affaires enregistrées)
 	demoCases := data.GetDemoCases()
 	count := caseService.LoadDemoCases(demoCases)
 	log.Printf("Chargement de %d affaires de démonstration", count)
@@ -27,6 +41,14 @@ func main() {
 	// Créer le handler principal
 	handler := handlers.NewHandler(ollamaService, caseService, n4lService)
 
+	// Chaque affaire devient un chapitre SST ("forensic <id>"), téléversé à la première recherche
+	if *useSST {
+		sstBridge := services.NewSSTBridgeService(n4lService, services.NewSearchService("http://localhost:11434", "nomic-embed-text"))
+		defer sstBridge.Close()
+		handler.SetSSTBridge(sstBridge)
+		log.Println("Recherches de graphe via la base SSTorytime")
+	}
+
 	// Routes API
 	http.HandleFunc("/api/cases", handler.HandleCases)
 	http.HandleFunc("/api/cases/", handler.HandleCase)
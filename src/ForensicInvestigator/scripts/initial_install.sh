@@ -94,6 +94,7 @@ cp -r static "${INSTALL_DIR}/"
 cp -r config "${INSTALL_DIR}/" 2>/dev/null || mkdir -p "${INSTALL_DIR}/config"
 cp -r data "${INSTALL_DIR}/" 2>/dev/null || mkdir -p "${INSTALL_DIR}/data"
 mkdir -p "${INSTALL_DIR}/data/notebooks"
+mkdir -p "${INSTALL_DIR}/data/cases"
 
 # Copier hrm_server sans venv
 mkdir -p "${INSTALL_DIR}/hrm_server"
@@ -175,6 +176,7 @@ fi
 log_info "Création des répertoires..."
 $SUDO mkdir -p ${APP_DIR}/{bin,config,data,logs,static}
 $SUDO mkdir -p ${APP_DIR}/data/notebooks
+$SUDO mkdir -p ${APP_DIR}/data/cases
 $SUDO mkdir -p ${APP_DIR}/hrm_server
 $SUDO mkdir -p ${APP_DIR}/embedding_service
 
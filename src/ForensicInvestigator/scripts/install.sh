@@ -122,6 +122,7 @@ create_directories() {
 
     mkdir -p ${APP_DIR}/{bin,config,data,logs,static}
     mkdir -p ${APP_DIR}/data/notebooks
+    mkdir -p ${APP_DIR}/data/cases
     mkdir -p ${APP_DIR}/hrm_server
     mkdir -p ${APP_DIR}/embedding_service
 
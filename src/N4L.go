@@ -14,11 +14,15 @@ import (
 	"fmt"
 	"unicode/utf8"
 	"unicode"
-	"regexp"
 	"sort"
+	"math"
 	"strconv"
+	"time"
+	"os/exec"
+	"slices"
 
         SST "SSTorytime"
+	"SSTorytime/n4l"
 )
 
 //**************************************************************
@@ -33,6 +37,7 @@ const (
         HAVE_MINUS = 22
 	ROLE_ABBR = 33
 	LARGE_FILE = 500000
+	WATCH_INTERVAL = time.Second
 
 	SEQ_UNKNOWN = false
 	SEQ_START = true
@@ -50,26 +55,13 @@ const (
 	ROLE_COMPOSITION = 11
 	ROLE_RESULT = 12
 
-	WORD_MISTAKE_LEN = 2 // a string shorter than this is probably a mistake
-
-	WARN_NOTE_TO_SELF = "WARNING: Found a possible note to self in the text"
-	WARN_INADVISABLE_CONTEXT_EXPRESSION = "WARNING: Inadvisably complex/parenthetic context expression - simplify?"
-	WARN_CHAPTER_CLASS_MIXUP="WARNING: possible space between class cancellation -:: <class> :: ambiguous chapter name, in: "
-	ERR_CHAPTER_COMMA="You shouldn't use commas in the chapter title (ambiguous separator): "
-
 	ERR_NO_SUCH_FILE_FOUND = "No file found in the name "
 	ERR_MISSING_EVENT = "Missing item? Dangling section, relation, or context"
-	ERR_MISSING_SECTION = "Declarations outside a section or chapter"
-	ERR_NO_SUCH_ALIAS = "No such alias or \" reference exists to fill in - aborting"
 	ERR_MISSING_ITEM_SOMEWHERE = "Missing item, empty string, perhaps a missing ditto or variable reference"
-	ERR_MISSING_ITEM_RELN = "Missing item or double relation"
 	ERR_MISMATCH_QUOTE = "Apparent missing or mismatch in ', \" or ( )"
 	ERR_ILLEGAL_CONFIGURATION = "Error in configuration, no such section"
-	ERR_BAD_LABEL_OR_REF = "Badly formed label or reference (@label becomes $label.n) in "
-	ERR_ILLEGAL_QUOTED_STRING_OR_REF = "WARNING: Something wrong, bad quoted string or mistaken back reference. Double-quoted strings should not have a space after leading quote, as it can be confused with \" ditto symbol"
 	ERR_ANNOTATION_BAD = "Annotation marker should be short mark of non-space, non-alphanumeric character "
 	ERR_BAD_ABBRV = "abbreviation out of place"
-	ERR_BAD_ALIAS_REFERENCE = "Alias references start from $name.1"
 	ERR_ANNOTATION_MISSING = "Missing non-alphnumeric annotation marker or stray relation"
 	ERR_ANNOTATION_REDEFINE = "Redefinition of annotation character"
 	ERR_SIMILAR_NO_SIGN = "Arrows for similarity do not have signs, they are directionless"
@@ -78,9 +70,6 @@ const (
 	ERR_NEGATIVE_WEIGHT = "Arrow relation has a negative weight, which is disallowed. Use a NOT relation if you want to signify inhibition: "
 	ERR_TOO_MANY_WEIGHTS = "More than one weight value in the arrow relation "
         ERR_STRAY_PAREN="Stray ) in an event/item - illegal character"
-	ERR_MISSING_LINE_LABEL_IN_REFERENCE="Missing a line label in reference, should be in the form $label.n"
-	ERR_NON_WORD_WHITE="Non word (whitespace) character after an annotation: "
-	ERR_SHORT_WORD="Short word, possible mistake or mistaken annotation (try spaces around symbol): "
 	ERR_ILLEGAL_ANNOT_CHAR="Cannot use +/- reserved tokens for annotation"
 )
 
@@ -105,13 +94,10 @@ type Closure struct {
 
 var ( 
 	LINE_NUM int = 1
-	LINE_ITEM_CACHE = make(map[string][]string)  // contains current and labelled line elements
-	LINE_ITEM_REFS []SST.NodePtr                     // contains current line integer references
-	LINE_RELN_CACHE = make(map[string][]SST.Link)
+	LINE_ITEM_CACHE = make(map[string][]string)  // configuration tokens on this line
 	LINE_ITEM_STATE int = ROLE_BLANK_LINE
 	LINE_ALIAS string = ""
 	LINE_ITEM_COUNTER int = 1
-	LINE_RELN_COUNTER int = 0
 	LINE_PATH []SST.Link
 
 	FWD_ARROW string
@@ -123,10 +109,8 @@ var (
 	CONTEXT_STATE = make(map[string]bool)
 	SECTION_STATE string
 
-	// Sequence mode state
+	// Sequence arrows
 
-	SEQUENCE_MODE bool = false
-	SEQUENCE_START bool = false
 	SEQUENCE_RELN string = "then" 
 	SEQUENCE_RELN_INV string = "from"
 	SEQUENCE_RELN_LONG string = "then followed by" 
@@ -142,16 +126,19 @@ var (
 	DIAGNOSTIC bool = false
 	UPLOAD bool = false
 	FORCE_UPLOAD bool = false
+	WATCH bool = false
 	SUMMARIZE bool = false
 	CREATE_ADJACENCY bool = false
 	ADJ_LIST string
 
-	CONFIGURING bool
 	CURRENT_FILE string
 	TEST_DIAG_FILE string
 
 	RELN_BY_SST [4][]SST.ArrowPtr // From an EventItemNode
 
+	PROBLEMS []*n4l.Error            // from the parser, still to report, by position
+	ANNOTATION_PROBLEMS []*n4l.Error // about the item being stored
+
 	ARROW_CLOSURES []Closure
 )
 
@@ -165,6 +152,11 @@ func main() {
 
 	args := Init()
 
+	if WATCH {
+		Watch(args)
+		return
+	}
+
 	if UPLOAD {
 		load_arrows := true
 
@@ -181,22 +173,17 @@ func main() {
 
 	config := ReadConfig()
 
-	CONFIGURING = true
-
 	for input := 0; input < len(config); input++ {
 		NewFile(config[input])
 		con := ReadFile(CURRENT_FILE)
 		ParseConfig(con)
 	}
 
-	CONFIGURING = false
-
 	// Read the user inputs
 
 	for input := 0; input < len(args); input++ {
 		NewFile(args[input])
-		input := ReadFile(CURRENT_FILE)
-		ParseN4L(input)
+		ParseN4L(CURRENT_FILE)
 	}
 
 	// Post process, complete NEAR cliques
@@ -213,7 +200,7 @@ func main() {
 		dim, key, d_adj, u_adj := CreateAdjacencyMatrix(ADJ_LIST)
 		PrintMatrix("directed adjacency sub-matrix",dim,key,d_adj)
 		PrintMatrix("undirected adjacency sub-matrix",dim,key,u_adj)
-		evc := ComputeEVC(dim,u_adj)
+		evc := SST.SparseComputeEVC(u_adj)
 		PrintNZVector("Eigenvector centrality (EVC) score for symmetrized graph",dim,key,evc)
 	}
 
@@ -231,10 +218,11 @@ func Init() []string {
 	verbosePtr := flag.Bool("v", false,"verbose")
 	diagPtr := flag.Bool("d", false,"diagnostic mode")
 	uploadPtr := flag.Bool("u", false,"upload")
-	forcePtr := flag.Bool("force", false,"force upload")
+	forcePtr := flag.Bool("force", false,"append everything without comparing to existing chapters")
 	wipePtr := flag.Bool("wipe", false,"wipe and reset")
 	incidencePtr := flag.Bool("s", false,"summary (node,links...)")
 	adjacencyPtr := flag.String("adj", "none", "a quoted, comma-separated list of short link names")
+	watchPtr := flag.Bool("watch", false,"keep uploading the files (implies -u) whenever they or SSTconfig change")
 
 	flag.Parse()
 	args := flag.Args()
@@ -265,6 +253,11 @@ func Init() []string {
 		FORCE_UPLOAD = true
 	}
 
+	if *watchPtr {
+		WATCH = true
+		UPLOAD = true
+	}
+
 	if *incidencePtr {
 		SUMMARIZE = true
 	}
@@ -284,28 +277,309 @@ func Init() []string {
 func Upload(sst SST.PoSST) {
 
 	dbchapters := SST.GetDBChaptersMatchingName(sst,"")
+
+	// A fresh database takes the plain bulk path, otherwise we only
+	// apply the differences for the chapters we've just read
+
+	if len(dbchapters) == 0 || FORCE_UPLOAD {
+
+		// Big corpora (e.g. from text2N4L) are streamed with COPY
+
+		if SST.GraphSize() > SST.BULK_UPLOAD_THRESHOLD {
+			fmt.Println("\n\nBulk uploading",SST.GraphSize(),"items..")
+			err := SST.BulkGraphToDB(sst,true)
+			if err != nil {
+				fmt.Println("\nBulk upload failed, nothing was changed:",err)
+				os.Exit(-1)
+			}
+			return
+		}
+
+		fmt.Println("\n\nUploading nodes..")
+		SST.GraphToDB(sst,true)
+		return
+	}
+
 	memchapters := GetMemChapters()
-	
-	conflict := false
-	
+
 	for m := range memchapters {
 		for d := range dbchapters {
 			if memchapters[m] == dbchapters[d] {
-				
-				fmt.Println(" Database already contains a chapter: ",dbchapters[d])
-				conflict = true
+				fmt.Println(" Updating existing chapter: ",dbchapters[d])
 			}
 		}
 	}
-	
-	if conflict && !FORCE_UPLOAD {
-		
-		fmt.Println("\nUploading to a pre-existing chapter might corrupt the data. You can remove it first with removeN4L or force using -force. It's recommended to rebuilt everything unless replacing the last added chapter(s) for reminders.")
-		
-	} else {
-		fmt.Println("\n\nUploading nodes..")
-		SST.GraphToDB(sst,true)
+
+	if !SST.IncrementalGraphToDB(sst,true) {
+		os.Exit(-1)
+	}
+}
+
+//**************************************************************
+// Watch mode
+//**************************************************************
+
+func Watch(args []string) {
+
+	// Each change is parsed and uploaded by a fresh N4L -u, so a
+	// parse error can't stop the watcher and leaves the database as
+	// it was. Only the files for the affected chapters are read again,
+	// and the incremental upload applies only what differs. Chapters
+	// that are no longer in any file are deleted once the upload
+	// succeeds, so a failed save doesn't lose them
+
+	config := ReadConfig()
+
+	var stamps = make(map[string]time.Time)
+	var chapters = make(map[string][]string)
+	var orphans []string
+
+	for _,file := range append(config,args...) {
+		stamps[file] = ModTime(file)
+	}
+
+	for _,file := range args {
+		chapters[file] = FileChapters(file)
+	}
+
+	RunUpload(args,true)
+
+	for {
+		fmt.Println("\nWatching",len(args),"file(s) and SSTconfig for changes (ctrl-C to stop) ...")
+
+		var changed []string
+
+		for len(changed) == 0 {
+			time.Sleep(WATCH_INTERVAL)
+			changed = ChangedFiles(stamps)
+		}
+
+		// Let the editor finish writing before reading
+
+		for more := changed; len(more) > 0; {
+			time.Sleep(WATCH_INTERVAL)
+			more = ChangedFiles(stamps)
+
+			for _,file := range more {
+				if !slices.Contains(changed,file) {
+					changed = append(changed,file)
+				}
+			}
+		}
+
+		fmt.Println("\n["+time.Now().Format("15:04:05")+"] Changed:",strings.Join(changed,", "))
+
+		files,removed := AffectedFiles(args,config,changed,chapters)
+		orphans = append(orphans,removed...)
+
+		if RunUpload(files,false) {
+			DeleteOrphans(orphans,chapters)
+			orphans = nil
+		}
+	}
+}
+
+//**************************************************************
+
+func AffectedFiles(args,config,changed []string,chapters map[string][]string) ([]string,[]string) {
+
+	// A change of configuration can affect any file. Otherwise the
+	// changed files, and others that share a chapter with them before
+	// or after the change, since a chapter is uploaded as a whole.
+	// Also the chapters renamed or removed from the changed files
+
+	var touched = make(map[string]bool)
+	var renamed []string
+
+	for _,file := range changed {
+
+		before := chapters[file]
+		chapters[file] = FileChapters(file)
+
+		for _,chap := range before {
+			touched[chap] = true
+
+			if !slices.Contains(chapters[file],chap) {
+				renamed = append(renamed,chap)
+			}
+		}
+
+		for _,chap := range chapters[file] {
+			touched[chap] = true
+		}
+	}
+
+	for _,file := range changed {
+		if slices.Contains(config,file) {
+			return args,renamed
+		}
+	}
+
+	var files []string
+
+	for _,file := range args {
+
+		affected := false
+
+		for _,chap := range chapters[file] {
+			affected = affected || touched[chap]
+		}
+
+		if affected {
+			files = append(files,file)
+		}
+	}
+
+	return files,renamed
+}
+
+//**************************************************************
+
+func DeleteOrphans(orphans []string,chapters map[string][]string) {
+
+	// Only chapters that are still in no watched file, as one may
+	// have been renamed back since
+
+	var inuse = make(map[string]bool)
+
+	for _,names := range chapters {
+		for _,chap := range names {
+			inuse[chap] = true
+		}
+	}
+
+	var sst SST.PoSST
+	var opened bool
+
+	for _,chap := range orphans {
+
+		if chap == "" || inuse[chap] {
+			continue
+		}
+
+		// The upload ran in its own process, so open the store afresh
+
+		if !opened {
+			sst = SST.Open(false)
+			opened = true
+		}
+
+		if SST.DeleteChapter(sst,chap) {
+			fmt.Printf("Chapter \"%s\" is no longer in any file, deleted it\n",chap)
+		}
+
+		inuse[chap] = true
+	}
+
+	if opened {
+		SST.Close(sst)
+	}
+}
+
+//**************************************************************
+
+func RunUpload(files []string,first bool) bool {
+
+	// Nothing left to upload, e.g. the only chapter in a file was removed
+
+	if len(files) == 0 {
+		return true
+	}
+
+	self,err := os.Executable()
+
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	cmdargs := []string{"-u"}
+
+	if DIAGNOSTIC {
+		cmdargs = append(cmdargs,"-d")
+	} else if VERBOSE {
+		cmdargs = append(cmdargs,"-v")
+	}
+
+	// Wiping or forcing only makes sense the first time
+
+	if first && SST.WIPE_DB {
+		cmdargs = append(cmdargs,"-wipe")
+	}
+
+	if first && FORCE_UPLOAD {
+		cmdargs = append(cmdargs,"-force")
+	}
+
+	cmd := exec.Command(self,append(cmdargs,files...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		fmt.Println("\nN4L: nothing was uploaded, fix the error and save again")
+		return false
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func ChangedFiles(stamps map[string]time.Time) []string {
+
+	var changed []string
+
+	for file,last := range stamps {
+
+		now := ModTime(file)
+
+		// A file that is missing is probably being saved
+
+		if now.IsZero() || now.Equal(last) {
+			continue
+		}
+
+		stamps[file] = now
+		changed = append(changed,file)
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+//**************************************************************
+
+func ModTime(filename string) time.Time {
+
+	info,err := os.Stat(filename)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+//**************************************************************
+
+func FileChapters(filename string) []string {
+
+	// Every - name declaration in the file, as a file may hold several chapters
+
+	var names []string
+
+	file,err := n4l.ParseFile(filename,n4l.Config{Annotations: ANNOTATION})
+
+	if err != nil {
+		return names
+	}
+
+	for _,chap := range file.Chapters {
+		if !slices.Contains(names,chap.Name) {
+			names = append(names,chap.Name)
+		}
 	}
+
+	return names
 }
 
 //**************************************************************
@@ -337,19 +611,14 @@ func NewFile(filename string) {
 	LINE_ITEM_STATE = ROLE_BLANK_LINE
 	LINE_NUM = 1
 	LINE_ITEM_CACHE = make(map[string][]string)
-	LINE_RELN_CACHE = make(map[string][]SST.Link)
-	LINE_ITEM_REFS = nil
 	LINE_ITEM_COUNTER = 1
-	LINE_RELN_COUNTER = 0
 	LINE_ALIAS = ""
 	LAST_IN_SEQUENCE = ""
-	SEQUENCE_MODE = false
 	FWD_ARROW = ""
 	BWD_ARROW = ""
 	SECTION_STATE = ""
-	ResetContextState()
 	Box("Reset context","any")
-	ContextEval("any","=")
+	CONTEXT_STATE = map[string]bool{"any": true}
 }
 
 //**************************************************************
@@ -592,19 +861,19 @@ func GetLinkArrowByName(token string) SST.Link {
 
 	if strings.Contains(name,",") {
 		reln = strings.Split(name,",")
-		name = reln[0]
+		name = strings.TrimSpace(reln[0])
 
 		// look at any comma separated notes after the arrow name
 		for i := 1; i < len(reln); i++ {
 
-			v, err := strconv.ParseFloat(reln[i], 32)
+			v, err := strconv.ParseFloat(strings.TrimSpace(reln[i]), 32)
 
 			if err == nil {
-				if weight < 0 {
+				if v < 0 {
 					ParseError(ERR_NEGATIVE_WEIGHT+token)
 					os.Exit(-1)
 				}
-				if weightcount > 1 {
+				if weightcount >= 1 {
 					ParseError(ERR_TOO_MANY_WEIGHTS+token)
 					os.Exit(-1)
 				}
@@ -616,6 +885,13 @@ func GetLinkArrowByName(token string) SST.Link {
 		}
 	}
 
+	return ArrowLink(name,weight,ctx)
+}
+
+//**************************************************************
+
+func ArrowLink(name string,weight float32,ctx []string) SST.Link {
+
 	// First check if this is an alias/short name
 
 	ptr, ok := SST.ARROW_SHORT_DIR[name]
@@ -640,63 +916,6 @@ func GetLinkArrowByName(token string) SST.Link {
 
 //**************************************************************
 
-func LookupAlias(alias string, counter int) string {
-	
-	value,ok := LINE_ITEM_CACHE[alias]
-
-	if !ok || counter > len(value) {
-		ParseError(ERR_NO_SUCH_ALIAS)
-		os.Exit(1)
-	}
-
-	return LINE_ITEM_CACHE[alias][counter-1]
-
-}
-
-//**************************************************************
-
-func ResolveAliasedItem(token string) string {
-
-	// split $alias.n into (alias string,n int)
-
-	if! strings.Contains(token,".") {
-		// just a dollar amount
-		return token
-	}
-
-	var contig string
-	fmt.Sscanf(token,"%s",&contig)
-	
-	if len(contig) == 1 {
-		return token
-	}
-
-	if contig == "$$" {
-		return token
-	}
-
-	split := strings.Split(token[1:],".")
-
-	if len(split) < 2 {
-		ParseError(ERR_MISSING_LINE_LABEL_IN_REFERENCE)
-		os.Exit(-1)
-	}
-
-	name := strings.TrimSpace(split[0])
-
-	var number int = 0
-	fmt.Sscanf(split[1],"%d",&number)
-
-	if number < 1 {
-		ParseError(ERR_BAD_ALIAS_REFERENCE)
-		os.Exit(-1)
-	}
-
-	return LookupAlias(name,number)
-}
-
-//**************************************************************
-
 func AddArrowClosure(sequence []string,result string) {
 
 	var closure Closure
@@ -916,51 +1135,43 @@ func SummarizeGraph() {
 
 //**************************************************************
 
-func CreateAdjacencyMatrix(searchlist string) (int,[]SST.NodePtr,[][]float32,[][]float32) {
+func CreateAdjacencyMatrix(searchlist string) (int,[]SST.NodePtr,SST.SparseMatrix,SST.SparseMatrix) {
 
 	search_list := ValidateLinkArgs(searchlist)
 
-	// the matrix is dim x dim
+	// the matrix is dim x dim, but only the links are stored
 
 	filtered_node_list,path_weights := AssembleInvolvedNodes(search_list)
 
 	dim := len(filtered_node_list)
+	index := make(map[SST.NodePtr]int)
 
 	for f := 0; f < len(filtered_node_list); f++ {
+		index[filtered_node_list[f]] = f
 		Verbose("    - row/col key [",f,"/",dim,"]",SST.GetNodeTxtFromPtr(filtered_node_list[f]))
 	}
 
-	var subadj_matrix [][]float32 = make([][]float32,dim)
-	var symadj_matrix [][]float32 = make([][]float32,dim)
-
-	for row := 0; row < dim; row++ {
-		subadj_matrix [row] = make([]float32,dim)
-		symadj_matrix [row] = make([]float32,dim)
-	}
-
-	for row := 0; row < dim; row++ {
-		for col := 0; col < dim; col++ {
-
-			var rc, rcT RCtype
-			rc.Row = filtered_node_list[row]
-			rc.Col = filtered_node_list[col]
+	var entries []SST.SparseEntry
 
-			rcT.Row = filtered_node_list[col]
-			rcT.Col = filtered_node_list[row]
+	for rc,weight := range path_weights {
 
-			subadj_matrix[row][col] = path_weights[rc]
+		row,okr := index[rc.Row]
+		col,okc := index[rc.Col]
 
-			symadj_matrix[row][col] = path_weights[rc] + path_weights[rcT]
-			symadj_matrix[col][row] = path_weights[rc] + path_weights[rcT]
+		if okr && okc {
+			entries = append(entries,SST.SparseEntry{Row: row, Col: col, Val: weight})
 		}
 	}
 
+	subadj_matrix := SST.MakeSparseMatrix(dim,entries)
+	symadj_matrix := SST.SparseSymmetrize(subadj_matrix)
+
 	return dim, filtered_node_list, subadj_matrix, symadj_matrix
 }
 
 //**************************************************************
 
-func PrintMatrix(name string, dim int, key []SST.NodePtr, matrix [][]float32) {
+func PrintMatrix(name string, dim int, key []SST.NodePtr, matrix SST.SparseMatrix) {
 
 
 	s := fmt.Sprintln("\n",name,"...\n")
@@ -978,7 +1189,7 @@ func PrintMatrix(name string, dim int, key []SST.NodePtr, matrix [][]float32) {
 				s += fmt.Sprint("\t...")
 				break
 			} else {
-				s += fmt.Sprintf("  %4.1f",matrix[row][col])
+				s += fmt.Sprintf("  %4.1f",SST.SparseGet(matrix,row,col))
 			}
 			
 		}
@@ -1022,142 +1233,41 @@ func PrintNZVector(name string, dim int, key []SST.NodePtr, vector[]float32) {
 
 //**************************************************************
 
-func ComputeEVC(dim int,adj [][]float32) []float32 {
-
-	v := MakeInitVector(dim,1.0)
-	vlast := v
-
-	const several = 6
-
-	for i := 0; i < several; i++ {
-
-		v = MatrixOpVector(dim,adj,vlast)
+func FlatSTType(i int) int {
 
-		if CompareVec(v,vlast) < 0.1 {
-			break
-		}
-		vlast = v
+	n := i - SST.ST_ZERO
+	if n < 0 {
+		n = -n
 	}
 
-	maxval := GetVecMax(v)
-	v = NormalizeVec(v,maxval)
-
-	return v
+	return n
 }
 
 //**************************************************************
 
-func MakeInitVector(dim int, init_value float32) []float32 {
+func ValidateLinkArgs(s string) []SST.ArrowPtr {
 
-	var v = make([]float32,dim)
+	list := strings.Split(s,",")
+	var search_list []SST.ArrowPtr
 
-	for r := 0; r < dim; r++ {
-		v[r] = init_value
+	if s == "" || s == "all" {
+		return nil
 	}
 
-	return v
-}
+	for i := range list {
+		v,ok := SST.ARROW_SHORT_DIR[list[i]]
 
-//**************************************************************
+		if ok {
+			typ := SST.ARROW_DIRECTORY[v].STAindex - SST.ST_ZERO
+			if typ < 0 {
+				typ = -typ
+			}
 
-func MatrixOpVector(dim int,m [][]float32, v []float32) []float32 {
+			name := SST.ARROW_DIRECTORY[v].Long
+			ptr := SST.ARROW_DIRECTORY[v].Ptr
 
-	var vp = make([]float32,dim)
-
-	for r := 0; r < dim; r++ {
-		for c := 0; c < dim; c++ {
-			if m[r][c] != 0 {
-				vp[r] += m[r][c] * v[c]
-			}
-		}
-	}
-	return vp
-}
-
-//**************************************************************
-
-func GetVecMax(v []float32) float32 {
-
-	var max float32 = -1
-
-	for r := range v {
-		if v[r] > max {
-			max = v[r]
-		}
-	}
-
-	return max
-}
-
-//**************************************************************
-
-func NormalizeVec(v []float32, div float32) []float32 {
-
-	for r := range v {
-		v[r] = v[r] / div
-	}
-
-	return v
-}
-
-//**************************************************************
-
-func CompareVec(v1,v2 []float32) float32 {
-
-	var max float32 = -1
-
-	for r := range v1 {
-		diff := v1[r]-v2[r]
-
-		if diff < 0 {
-			diff = -diff
-		}
-
-		if diff > max {
-			max = diff
-		}
-	}
-
-	return max
-}
-
-//**************************************************************
-
-func FlatSTType(i int) int {
-
-	n := i - SST.ST_ZERO
-	if n < 0 {
-		n = -n
-	}
-
-	return n
-}
-
-//**************************************************************
-
-func ValidateLinkArgs(s string) []SST.ArrowPtr {
-
-	list := strings.Split(s,",")
-	var search_list []SST.ArrowPtr
-
-	if s == "" || s == "all" {
-		return nil
-	}
-
-	for i := range list {
-		v,ok := SST.ARROW_SHORT_DIR[list[i]]
-
-		if ok {
-			typ := SST.ARROW_DIRECTORY[v].STAindex - SST.ST_ZERO
-			if typ < 0 {
-				typ = -typ
-			}
-
-			name := SST.ARROW_DIRECTORY[v].Long
-			ptr := SST.ARROW_DIRECTORY[v].Ptr
-
-			fmt.Println(" - including search pathway STtype",SST.STTypeName(typ),"->",name)
-			search_list = append(search_list,ptr)
+			fmt.Println(" - including search pathway STtype",SST.STTypeName(typ),"->",name)
+			search_list = append(search_list,ptr)
 
 			if typ != SST.NEAR {
 				inverse := SST.INVERSE_ARROWS[ptr]
@@ -1178,6 +1288,7 @@ func ValidateLinkArgs(s string) []SST.ArrowPtr {
 func AssembleInvolvedNodes(search_list []SST.ArrowPtr) ([]SST.NodePtr,map[RCtype]float32) {
 
 	var node_list []SST.NodePtr
+	var in_list = make(map[SST.NodePtr]bool)
 	var weights = make(map[RCtype]float32)
 
 	for class := SST.N1GRAM; class <= SST.GT1024; class++ {
@@ -1185,27 +1296,27 @@ func AssembleInvolvedNodes(search_list []SST.ArrowPtr) ([]SST.NodePtr,map[RCtype
 		switch class {
 		case SST.N1GRAM:
 			for n := range SST.NODE_DIRECTORY.N1directory {
-				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.N1directory[n],search_list,node_list,weights)
+				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.N1directory[n],search_list,node_list,in_list,weights)
 			}
 		case SST.N2GRAM:
 			for n := range SST.NODE_DIRECTORY.N2directory {
-				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.N2directory[n],search_list,node_list,weights)
+				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.N2directory[n],search_list,node_list,in_list,weights)
 			}
 		case SST.N3GRAM:
 			for n := range SST.NODE_DIRECTORY.N3directory {
-				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.N3directory[n],search_list,node_list,weights)
+				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.N3directory[n],search_list,node_list,in_list,weights)
 			}
 		case SST.LT128:
 			for n := range SST.NODE_DIRECTORY.LT128 {
-				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.LT128[n],search_list,node_list,weights)
+				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.LT128[n],search_list,node_list,in_list,weights)
 			}
 		case SST.LT1024:
 			for n := range SST.NODE_DIRECTORY.LT1024 {
-				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.LT1024[n],search_list,node_list,weights)
+				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.LT1024[n],search_list,node_list,in_list,weights)
 			}
 		case SST.GT1024:
 			for n := range SST.NODE_DIRECTORY.GT1024 {
-				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.GT1024[n],search_list,node_list,weights)
+				node_list = SearchIncidentRowClass(SST.NODE_DIRECTORY.GT1024[n],search_list,node_list,in_list,weights)
 			}
 		}
 	}
@@ -1215,10 +1326,9 @@ func AssembleInvolvedNodes(search_list []SST.ArrowPtr) ([]SST.NodePtr,map[RCtype
 
 //**************************************************************
 
-func SearchIncidentRowClass(node SST.Node, searcharrows []SST.ArrowPtr,node_list []SST.NodePtr,ret_weights map[RCtype]float32) []SST.NodePtr {
+func SearchIncidentRowClass(node SST.Node, searcharrows []SST.ArrowPtr,node_list []SST.NodePtr,in_list map[SST.NodePtr]bool,ret_weights map[RCtype]float32) []SST.NodePtr {
 
 	var row_nodes = make(map[SST.NodePtr]bool)
-	var ret_nodes []SST.NodePtr
 
         var rc,cr RCtype
 
@@ -1269,14 +1379,15 @@ func SearchIncidentRowClass(node SST.Node, searcharrows []SST.ArrowPtr,node_list
 		row_nodes[node.NPtr] = true // Add the parent if it has children
 	}
 
-	for nptr := range node_list {
-		row_nodes[node_list[nptr]] = true
-	}
-	
-	// Merge idempotently
-	
+	// Merge idempotently, without copying the whole list for every row
+
+	ret_nodes := node_list
+
 	for nptr := range row_nodes {
-		ret_nodes = append(ret_nodes,nptr)
+		if !in_list[nptr] {
+			in_list[nptr] = true
+			ret_nodes = append(ret_nodes,nptr)
+		}
 	}
 
 	return ret_nodes
@@ -1286,21 +1397,237 @@ func SearchIncidentRowClass(node SST.Node, searcharrows []SST.ArrowPtr,node_list
 // N4L language
 //**************************************************************
 
-func ParseN4L(src []rune) {
+func ParseN4L(filename string) {
 
-	var token string
+	// The grammar is in the n4l package, here we turn its
+	// chapters, blocks, lines and items into nodes and links
 
-	for pos := 0; pos < len(src); {
+	config := n4l.Config{Annotations: ANNOTATION, Arrows: KnownArrow}
 
-		pos = SkipWhiteSpace(src,pos)
-		token,pos = GetToken(src,pos)
+	file,err := n4l.ParseFile(filename,config)
+
+	if err != nil {
+		ParseError(ERR_NO_SUCH_FILE_FOUND+filename)
+		os.Exit(-1)
+	}
+
+	// Problems are reported where they occur amongst the -v output,
+	// and N4L stops at the first error, having read up to it
+
+	PROBLEMS = append([]*n4l.Error{},file.Errors...)
+
+	sort.SliceStable(PROBLEMS,func(i,j int) bool {
+		return PROBLEMS[i].Pos.Offset < PROBLEMS[j].Pos.Offset
+	})
+
+	nodes := make(map[*n4l.Item]SST.NodePtr)
 
-		ClassifyTokenRole(token)
+	for _,block := range file.Contexts {
+		ReportProblems(block.Pos.Offset)
+		ContextBox(block)
+		ReportProblems(block.Pos.Offset+1)
 	}
 
-	if Dangler() {
-		ParseError(ERR_MISSING_EVENT)
+	for _,chapter := range file.Chapters {
+
+		ReportProblems(chapter.Pos.Offset)
+
+		if chapter.Name != "" {
+			Box("Set chapter/section: ->",chapter.Name)
+		}
+
+		SECTION_STATE = chapter.Name
+		sequence := false
+
+		ReportProblems(chapter.Pos.Offset+1)
+
+		for _,block := range chapter.Blocks {
+
+			ReportProblems(block.Pos.Offset)
+			LINE_NUM = block.Pos.Line
+
+			if block.Sequence && !sequence {
+				PVerbose("\nStart sequence mode for items")
+			}
+
+			if !block.Sequence && sequence {
+				PVerbose("End sequence mode for items\n")
+			}
+
+			sequence = block.Sequence
+
+			ContextBox(block)
+			ReportProblems(block.Pos.Offset+1)
+
+			CONTEXT_STATE = make(map[string]bool)
+
+			for _,c := range block.Context {
+				CONTEXT_STATE[c] = true
+			}
+
+			for _,line := range block.Lines {
+				HandleLine(line,nodes)
+			}
+		}
+	}
+
+	// Any left after the last line, e.g. at the end of the file
+
+	ReportProblems(math.MaxInt)
+}
+
+//**************************************************************
+
+func ContextBox(block *n4l.Block) {
+
+	// An empty context change goes unremarked
+
+	if block.Expression == "" {
+		return
+	}
+
+	switch block.Op {
+	case '=':
+		Box("Reset context: ->",block.Expression)
+	case '+':
+		Box("Add to context:",block.Expression)
+	case '-':
+		Box("Remove from context:",block.Expression)
+	}
+}
+
+//**************************************************************
+
+func ReportProblems(before int) {
+
+	// Report those found before the given offset
+
+	for len(PROBLEMS) > 0 && PROBLEMS[0].Pos.Offset < before {
+		ReportProblem(PROBLEMS[0])
+		PROBLEMS = PROBLEMS[1:]
+	}
+}
+
+//**************************************************************
+
+func ReportProblem(e *n4l.Error) {
+
+	// N4L stops at the first error
+
+	LINE_NUM = e.Pos.Line
+	ParseError(e.Msg)
+
+	if !e.Warning {
+		os.Exit(-1)
+	}
+}
+
+//**************************************************************
+
+func HandleLine(line *n4l.Line,nodes map[*n4l.Item]SST.NodePtr) {
+
+	LINE_ALIAS = line.Alias
+	LINE_PATH = nil
+
+	var aliased []string
+
+	for _,item := range line.Items {
+
+		ReportProblems(item.Pos.Offset)
+
+		// Multi-line quoted items are reported where they start
+
+		LINE_NUM = item.Pos.Line
+
+		// N4L took any $ as a reference, even one that doesn't resolve
+
+		ref := item.Ref
+
+		if ref == "" && strings.HasPrefix(item.Raw,"$") {
+			ref = item.Raw
+		}
+
+		if ref != "" && ref != "\"" {
+			PVerbose("fyi, line reference",ref,"resolved to",item.Raw)
+		} else if LINE_ALIAS != "" {
+			PVerbose("-- Storing alias",aliased,item.Raw,"as",LINE_ALIAS)
+			aliased = append(aliased,item.Raw)
+		}
+
+		// Then those about the item itself, except those that come up
+		// as it is stored: its annotations, and links to itself, which
+		// IdempAddLink reports
+
+		for len(PROBLEMS) > 0 && PROBLEMS[0].Pos.Offset == item.Pos.Offset {
+
+			switch {
+			case PROBLEMS[0].Msg == n4l.ERR_ARROW_SELFLOOP:
+			case strings.HasPrefix(PROBLEMS[0].Msg,n4l.ERR_SHORT_WORD):
+				ANNOTATION_PROBLEMS = append(ANNOTATION_PROBLEMS,PROBLEMS[0])
+			default:
+				ReportProblem(PROBLEMS[0])
+			}
+
+			PROBLEMS = PROBLEMS[1:]
+		}
+
+		nodes[item] = HandleNode(item)
+
+		for _,e := range ANNOTATION_PROBLEMS {
+			ReportProblem(e)
+		}
+
+		ANNOTATION_PROBLEMS = nil
+
+		for _,l := range line.Links {
+
+			if l.To != item {
+				continue
+			}
+
+			if l.Sequence {
+				LinkUpStorySequence(l,nodes)
+				continue
+			}
+
+			link := ArrowLink(l.Arrow,l.Weight,l.Context)
+			IdempAddLink(l.From.Raw,nodes[l.From],link,item.Raw,nodes[item])
+		}
 	}
+
+	// Those found later on the line, e.g. a dangling relation
+
+	ReportProblems(line.End.Offset+1)
+
+	PageMap(SECTION_STATE,CONTEXT_STATE,LINE_PATH,line.End.Line,LINE_ALIAS)
+}
+
+//**************************************************************
+
+func LinkUpStorySequence(l *n4l.Link,nodes map[*n4l.Item]SST.NodePtr) {
+
+	// Join together a sequence of nodes using default "(then)"
+
+	PVerbose("* ... Sequence addition: ",l.From.Raw,"-(",SEQUENCE_RELN,")->",l.To.Raw,"\n")
+
+	last_iptr := IdempAddNode(l.From.Raw,l.From.Text,l.Start)
+	this_iptr := nodes[l.To]
+
+	link := GetLinkArrowByName("(then)")
+	SST.AppendLinkToNode(last_iptr,link,this_iptr)
+
+	invlink := GetLinkArrowByName(SST.ARROW_DIRECTORY[SST.INVERSE_ARROWS[link.Arr]].Short)
+	SST.AppendLinkToNode(this_iptr,invlink,last_iptr)
+}
+
+//**************************************************************
+
+func KnownArrow(name string) bool {
+
+	_,short := SST.ARROW_SHORT_DIR[name]
+	_,long := SST.ARROW_LONG_DIR[name]
+
+	return short || long
 }
 
 //**************************************************************
@@ -1408,336 +1735,96 @@ func ReadConfig() []string {
 	return []string{"no configuration file"}
 }
 
+//**************************************************************
+// Memory representation
 //**************************************************************
 
-func GetToken(src []rune, pos int) (string,int) {
-
-	// Handle concatenation of words/lines and separation of types
+func IdempAddLink(from string, frptr SST.NodePtr, link SST.Link,to string, toptr SST.NodePtr) {
 
-	var token string
+	// Add a link index cache pointer directly to a from node
 
-	if pos >= len(src) {	    // end of file
-		return "", pos
+	if from == to {
+		ParseError(ERR_ARROW_SELFLOOP)
+		os.Exit(-1)
 	}
 
-	switch (src[pos]) {
-
-	case '+':  // could be +:: 
-
-		switch (src[pos+1]) {
+	if link.Wgt != 1 {
+		PVerbose("... Relation:",from,"--(",SST.ARROW_DIRECTORY[link.Arr].Long,",",link.Wgt,")->",to,SST.CONTEXT_DIRECTORY[link.Ctx])
+	} else {
+		PVerbose("... Relation:",from,"--",SST.ARROW_DIRECTORY[link.Arr].Long,"->",to,SST.CONTEXT_DIRECTORY[link.Ctx])
+	}
 
-		case ':':
-			token,pos = ReadToLast(src,pos,':')
-		default:
-			token,pos = ReadToLast(src,pos,ALPHATEXT)
-		}
+        // Build PageMap
 
-	case '-':  // could -:: or -section
+	link.Dst = toptr
+	LINE_PATH = append(LINE_PATH,link)
 
-		switch (src[pos+1]) {
+	if from == "" || to == "" {
+		ParseError(ERR_MISSING_ITEM_SOMEWHERE + " (adding link)")
+		os.Exit(-1)
+	}
 
-		case ':':
-			token,pos = ReadToLast(src,pos,':')
-		default:
-			token,pos = ReadToLast(src,pos,ALPHATEXT)
-		}
+	SST.AppendLinkToNode(frptr,link,toptr)
 
-	case ':':
-		token,pos = ReadToLast(src,pos,':')
+	// Double up the reverse definition for easy indexing of both in/out arrows
+	// But be careful not the make the graph undirected by mistake
 
-	case '(':
-		token,pos = ReadToLast(src,pos,')')
+	invlink := GetLinkArrowByName(SST.ARROW_DIRECTORY[SST.INVERSE_ARROWS[link.Arr]].Short)
+	invlink.Wgt = link.Wgt
 
-        case '"','\'':
-		quote := src[pos]
+	SST.AppendLinkToNode(toptr,invlink,frptr)
 
-		if IsQuote(quote) && IsBackReference(src,pos) {
-			token = "\""
-			pos++
-		} else {
-			if quote == '"' && pos+2 < len(src) && IsWhiteSpace(src[pos+1],src[pos+2]) {
-				ParseError(ERR_ILLEGAL_QUOTED_STRING_OR_REF)
-				os.Exit(-1)
-			}
-			token,pos = ReadToLast(src,pos,quote)
-			strip := strings.Split(token,string(quote))
-			token = strip[1]
-		}
+}
 
-	case '#':
-		return "",pos
+//**************************************************************
 
-	case '/':
-		if src[pos+1] == '/' {
-			return "",pos
-		}
+func HandleNode(item *n4l.Item) SST.NodePtr {
 
-	case '@':
-		token,pos = ReadToLast(src,pos,' ')
+	clean_ptr := IdempAddNode(item.Raw,item.Text,SEQ_UNKNOWN)
 
-	default: // a text item that could end with any of the above
-		token,pos = ReadToLast(src,pos,ALPHATEXT)
+	PVerbose("Event/item/node: \"",item.Text,"\" in chapter",SECTION_STATE)
 
+	if len(item.Annotations) > 0 {
+		AddBackAnnotations(item,clean_ptr)
 	}
 
-	return token, pos
+	IdempAddContextToNode(clean_ptr)
+
+	return clean_ptr
 }
 
 //**************************************************************
 
-func ClassifyTokenRole(token string) {
+func AddBackAnnotations(item *n4l.Item,cleanptr SST.NodePtr) {
 
-	if len(token) == 0 {
-		return
-	}
+	reminder := fmt.Sprintf("%.30s...",item.Text)
+	PVerbose("\n        Checking annotations from \""+reminder+"\"")
 
-	switch token[0] {
+	for _,a := range item.Annotations {
 
-	case ':':
-		expression := ExtractContextExpression(token)
-		CheckSequenceMode(expression,'+')
-		LINE_ITEM_STATE = ROLE_CONTEXT
-		AssessGrammarCompletions(expression,LINE_ITEM_STATE)
+		// A short word is remarked on as its link is made, up to
+		// the remark "after annotation", the last for this word
 
-	case '+':
-		expression := ExtractContextExpression(token)
-		CheckSequenceMode(expression,'+')
-		LINE_ITEM_STATE = ROLE_CONTEXT_ADD
-		AssessGrammarCompletions(expression,LINE_ITEM_STATE)
+		for len(ANNOTATION_PROBLEMS) > 0 && strings.Contains(ANNOTATION_PROBLEMS[0].Msg,"\""+a.Raw+"\"") {
 
-	case '-':
-		if token[len(token)-1:] == string(':') {
-			expression := ExtractContextExpression(token)
-			CheckSequenceMode(expression,'-')
-			LINE_ITEM_STATE = ROLE_CONTEXT_SUBTRACT
-			AssessGrammarCompletions(expression,LINE_ITEM_STATE)
-		} else if len(SECTION_STATE) == 0 {
-			section := strings.TrimSpace(token[1:])
-			LINE_ITEM_STATE = ROLE_SECTION
-			AssessGrammarCompletions(section,LINE_ITEM_STATE)
-		} else {
-			// The line starts with a -, but it's not a new chapter
-			LINE_ITEM_CACHE["THIS"] = append(LINE_ITEM_CACHE["THIS"],token)
-			StoreAlias(token)
-			AssessGrammarCompletions(token,LINE_ITEM_STATE)
-			
-			LINE_ITEM_STATE = ROLE_EVENT
-			LINE_ITEM_COUNTER++
-		}
-
-		// No quotes here in a string, we need to allow quoting in excerpts.
-
-	case '(':
-		if LINE_ITEM_STATE == ROLE_RELATION {
-			ParseError(ERR_MISSING_ITEM_RELN)
-			os.Exit(-1)
-		}
-		link := GetLinkArrowByName(token)
-		LINE_ITEM_STATE = ROLE_RELATION
-		LINE_RELN_CACHE["THIS"] = append(LINE_RELN_CACHE["THIS"],link)
-		LINE_RELN_COUNTER++
-
-	case '"': // prior reference
-		result := LookupAlias("PREV",LINE_ITEM_COUNTER)
-		LINE_ITEM_CACHE["THIS"] = append(LINE_ITEM_CACHE["THIS"],result)
-		StoreAlias(result)
-		AssessGrammarCompletions(result,LINE_ITEM_STATE)
-		LINE_ITEM_STATE = ROLE_EVENT
-		LINE_ITEM_COUNTER++
-
-	case '@':
-		LINE_ITEM_STATE = ROLE_LINE_ALIAS
-		token  = strings.TrimSpace(token)
-		LINE_ALIAS = token[1:]
-		CheckLineAlias(token)
-
-	case '$':
-		CheckLineAlias(token)
-		actual := ResolveAliasedItem(token)
-		LINE_ITEM_CACHE["THIS"] = append(LINE_ITEM_CACHE["THIS"],actual)
-		PVerbose("fyi, line reference",token,"resolved to",actual)
-		AssessGrammarCompletions(actual,LINE_ITEM_STATE)
-		LINE_ITEM_STATE = ROLE_LOOKUP
-		LINE_ITEM_COUNTER++
-
-	default:
-		LINE_ITEM_CACHE["THIS"] = append(LINE_ITEM_CACHE["THIS"],token)
-		StoreAlias(token)
-		AssessGrammarCompletions(token,LINE_ITEM_STATE)
-
-		LINE_ITEM_STATE = ROLE_EVENT
-		LINE_ITEM_COUNTER++
-	}
-}
-
-//**************************************************************
-
-func AssessGrammarCompletions(token string, prior_state int) {
-
-	if len(token) == 0 {
-		return
-	}
-
-	this_item := token
-
-	const BOM_UTF8 = "\xef\xbb\xbf"
-
-	if this_item == BOM_UTF8 {
-		// Skip a unicode header, needed for text editors
-		Verbose("Skipping embedded Unicode Header")
-		return
-	}
-
-	switch prior_state {
-
-	case ROLE_RELATION:
-
-		CheckNonNegative(LINE_ITEM_COUNTER-2)
-		last_item := LINE_ITEM_CACHE["THIS"][LINE_ITEM_COUNTER-2]
-		last_reln := LINE_RELN_CACHE["THIS"][LINE_RELN_COUNTER-1]
-		last_iptr := LINE_ITEM_REFS[LINE_ITEM_COUNTER-2]
-		this_iptr := HandleNode(this_item)
-		IdempAddLink(last_item,last_iptr,last_reln,this_item,this_iptr)
-		CheckSection(this_item)
+			e := ANNOTATION_PROBLEMS[0]
+			ANNOTATION_PROBLEMS = ANNOTATION_PROBLEMS[1:]
+			ReportProblem(e)
 
-	case ROLE_CONTEXT:
-		Box("Reset context: ->",this_item)
-		ContextEval(this_item,"=")
-		CheckSection(this_item)
-
-	case ROLE_CONTEXT_ADD:
-		Box("Add to context:",this_item)
-		ContextEval(this_item,"+")
-		CheckSection(this_item)
-
-	case ROLE_CONTEXT_SUBTRACT:
-		Box("Remove from context:",this_item)
-		ContextEval(this_item,"-")
-		CheckSection(this_item)
-
-	case ROLE_SECTION:
-		Box("Set chapter/section: ->",this_item)
-		CheckChapter(this_item)
-		SECTION_STATE = this_item
-
-	default:
-		CheckSection(this_item)
-
-		if NoteToSelf(token) {
-			ParseError(WARN_NOTE_TO_SELF+" ("+token+")")
+			if strings.Contains(e.Msg,"after annotation") {
+				break
+			}
 		}
 
-		HandleNode(this_item)
-		LinkUpStorySequence(this_item)
-	}
-}
-
-//**************************************************************
-
-func CheckLineAlias(token string) {
-
-	var contig string
-	fmt.Sscanf(token,"%s",&contig)
-	
-	if token[0] == '@' && len(contig) == 1 {
-		ParseError(ERR_BAD_LABEL_OR_REF+token)
-		os.Exit(-1)
-	}
-}
-
-//**************************************************************
-
-func CheckChapter(name string) {
-
-	if name[0] == ':' {
-		ParseError(WARN_CHAPTER_CLASS_MIXUP+name)
-		os.Exit(-1)
-	}
-
-	if strings.Contains(name,",") {
-		ParseError(ERR_CHAPTER_COMMA+name)
-		os.Exit(-1)
-	}
-
-	SEQUENCE_MODE = false
-	SEQUENCE_START = false
-}
-
-//**************************************************************
-
-func StoreAlias(name string) {
-
-	if LINE_ALIAS != "" {
-		PVerbose("-- Storing alias",LINE_ITEM_CACHE[LINE_ALIAS],name,"as",LINE_ALIAS)
-		LINE_ITEM_CACHE[LINE_ALIAS] = append(LINE_ITEM_CACHE[LINE_ALIAS],name)
-	}
-}
-
-
-//**************************************************************
-// Memory representation
-//**************************************************************
-
-func IdempAddLink(from string, frptr SST.NodePtr, link SST.Link,to string, toptr SST.NodePtr) {
-
-	// Add a link index cache pointer directly to a from node
-
-	if from == to {
-		ParseError(ERR_ARROW_SELFLOOP)
-		os.Exit(-1)
-	}
-
-	if link.Wgt != 1 {
-		PVerbose("... Relation:",from,"--(",SST.ARROW_DIRECTORY[link.Arr].Long,",",link.Wgt,")->",to,SST.CONTEXT_DIRECTORY[link.Ctx])
-	} else {
-		PVerbose("... Relation:",from,"--",SST.ARROW_DIRECTORY[link.Arr].Long,"->",to,SST.CONTEXT_DIRECTORY[link.Ctx])
-	}
-
-        // Build PageMap
-
-	link.Dst = toptr
-	LINE_PATH = append(LINE_PATH,link)
-
-	if from == "" || to == "" {
-		ParseError(ERR_MISSING_ITEM_SOMEWHERE + " (adding link)")
-		os.Exit(-1)
-	}
-
-	SST.AppendLinkToNode(frptr,link,toptr)
-
-	// Double up the reverse definition for easy indexing of both in/out arrows
-	// But be careful not the make the graph undirected by mistake
-
-	invlink := GetLinkArrowByName(SST.ARROW_DIRECTORY[SST.INVERSE_ARROWS[link.Arr]].Short)
-
-	SST.AppendLinkToNode(toptr,invlink,frptr)
-
-}
-
-//**************************************************************
-
-func HandleNode(annotated string) SST.NodePtr {
-
-	clean_ptr,clean_version := IdempAddNode(annotated,SEQ_UNKNOWN)
-
-	PVerbose("Event/item/node: \"",clean_version,"\" in chapter",SECTION_STATE)
-
-	LINE_ITEM_REFS = append(LINE_ITEM_REFS,clean_ptr)
-	
-	if len(clean_version) != len(annotated) {
-		AddBackAnnotations(clean_version,clean_ptr,annotated)
+		link := GetLinkArrowByName(a.Arrow)
+		this_iptr := IdempAddNode(a.Raw,a.Word,SEQ_UNKNOWN)
+		IdempAddLink(reminder,cleanptr,link,a.Raw,this_iptr)
 	}
-
-	IdempAddContextToNode(clean_ptr)
-
-	return clean_ptr
 }
 
 //**************************************************************
 
-func IdempAddNode(s string,intended_sequence bool) (SST.NodePtr,string) {
-
-	clean_version := StripAnnotations(s)
+func IdempAddNode(s,clean_version string,intended_sequence bool) SST.NodePtr {
 
 	l,c := SST.StorageClass(s)
 
@@ -1758,7 +1845,7 @@ func IdempAddNode(s string,intended_sequence bool) (SST.NodePtr,string) {
 		LINE_PATH = append(LINE_PATH,leg)
 	}
 
-	return iptr,clean_version
+	return iptr
 }
 
 //**************************************************************
@@ -1991,14 +2078,12 @@ func LastSpecialChar(src []rune,pos int, stop rune) bool {
 
 func UpdateLastLineCache() {
 
+	// Notes are parsed by the n4l package, this is only for SSTconfig
+
 	if Dangler() {
 		ParseError(ERR_MISSING_EVENT)
 	}
 
-	if !CONFIGURING {
-		PageMap(SECTION_STATE,CONTEXT_STATE,LINE_PATH,LINE_NUM,LINE_ALIAS)
-	}
-
 	LINE_NUM++
 
 	// If this line was not blank, overwrite previous settings and reset
@@ -2008,18 +2093,10 @@ func UpdateLastLineCache() {
 		if LINE_ITEM_CACHE["THIS"] != nil {
 			LINE_ITEM_CACHE["PREV"] = LINE_ITEM_CACHE["THIS"]
 		}
-		if LINE_RELN_CACHE["THIS"] != nil {
-			LINE_RELN_CACHE["PREV"] = LINE_RELN_CACHE["THIS"]
-		}
 	} 
 
 	LINE_ITEM_CACHE["THIS"] = nil
-	LINE_RELN_CACHE["THIS"] = nil
-	LINE_ITEM_REFS = nil
 	LINE_ITEM_COUNTER = 1
-	LINE_RELN_COUNTER = 0
-	LINE_ALIAS = ""
-	LINE_PATH = nil
 
 	LINE_ITEM_STATE = ROLE_BLANK_LINE
 
@@ -2061,40 +2138,6 @@ func PageMap(chapter string,ctxmap map[string]bool,path []SST.Link,line int,alia
 
 //**************************************************************
 
-func PageMap(chapter string,ctxmap map[string]bool,path []SST.Link,line int,alias string) {
-
-	if len(path) == 0 {
-		return
-	}
-
-	var page_event SST.PageMap;
-	var context []string
-	var contextstr string
-
-	for c := range ctxmap {
-		context = append(context,c)
-	}
-
-	sort.Strings(context)
-
-	for c := 0; c < len(context); c++ {
-		contextstr += context[c]
-		if c < len(context)-1 {
-			contextstr += ", "
-		}
-	}
-
-	page_event.Chapter = chapter
-	page_event.Alias = alias
-	page_event.Context = SST.RegisterContext(CONTEXT_STATE,nil)
-	page_event.Line = line
-	page_event.Path = path
-
-	SST.PAGE_MAP = append(SST.PAGE_MAP,page_event)
-}
-
-//**************************************************************
-
 func IsWhiteSpace(r,rn rune) bool {
 
 	return (unicode.IsSpace(r) || r == '#' || r == '/' && rn == '/')
@@ -2102,26 +2145,6 @@ func IsWhiteSpace(r,rn rune) bool {
 
 //**************************************************************
 
-func IsBackReference(src []rune,pos int) bool {
-
-	// Any non-whitespace before \n or ( means it's not a back reference
-
-	for pos++; pos < len(src); pos++ {
-
-		if src[pos] == '(' || src[pos] == '\n' || src[pos] == '#' {
-			return true
-		} else {
-			if !unicode.IsSpace(src[pos]) {
-				return false
-			}
-		}
-	}
-
-	return false
-}
-
-//**************************************************************
-
 func Dangler() bool {
 
 	switch LINE_ITEM_STATE {
@@ -2151,236 +2174,6 @@ func Dangler() bool {
 
 //**************************************************************
 
-func ExtractContextExpression(token string) string {
-
-	var expression string
-
-	s := strings.Split(token, ":")
-
-	for i := 1; i < len(s); i++ {
-		if len(s[i]) > 1 {
-			expression = strings.TrimSpace(s[i])
-			break
-		}
-	}
-	
-	return expression
-}
-
-//**************************************************************
-
-func CheckSequenceMode(context string, mode rune) {
-
-	if (strings.Contains(context,"_sequence_")) {
-
-		switch mode {
-		case '+':
-			PVerbose("\nStart sequence mode for items")
-			SEQUENCE_MODE = true
-			SEQUENCE_START = true
-			LAST_IN_SEQUENCE = ""
-
-		case '-':
-			PVerbose("End sequence mode for items\n")
-			SEQUENCE_MODE = false
-			SEQUENCE_START = false
-		}
-	}
-
-}
-
-//**************************************************************
-
-func LinkUpStorySequence(this string) {
-
-	// Join together a sequence of nodes using default "(then)"
-
-	if SEQUENCE_MODE && this != LAST_IN_SEQUENCE {
-
-		if LINE_ITEM_COUNTER == 1 && LAST_IN_SEQUENCE != "" {
-			
-			PVerbose("* ... Sequence addition: ",LAST_IN_SEQUENCE,"-(",SEQUENCE_RELN,")->",this,"\n")
-
-			var last_iptr SST.NodePtr
-
-			if SEQUENCE_START {
-				last_iptr,_ = IdempAddNode(LAST_IN_SEQUENCE,SEQ_START)
-				SEQUENCE_START = false
-			} else {
-				last_iptr,_ = IdempAddNode(LAST_IN_SEQUENCE,SEQ_UNKNOWN)
-			}
-
-			this_iptr,_ := IdempAddNode(this,SEQ_UNKNOWN)
-			link := GetLinkArrowByName("(then)")
-			SST.AppendLinkToNode(last_iptr,link,this_iptr)
-
-			invlink := GetLinkArrowByName(SST.ARROW_DIRECTORY[SST.INVERSE_ARROWS[link.Arr]].Short)
-			SST.AppendLinkToNode(this_iptr,invlink,last_iptr)
-
-		}
-		
-		LAST_IN_SEQUENCE = this
-	}
-}
-
-//**************************************************************
-
-func StripAnnotations(fulltext string) string {
-
-	var protected bool = false
-	var deloused []rune
-	var preserve_unicode = []rune(fulltext)
-
-	for r := 0; r < len(preserve_unicode); r++ {
-
-		if preserve_unicode[r] == '"' {
-			protected = !protected
-		}
-
-		if !protected {
-			skip,symb := EmbeddedSymbol(preserve_unicode,r)
-			if skip > 0 {
-				r += skip-1
-				if unicode.IsSpace(preserve_unicode[r]) {
-					ParseError(ERR_NON_WORD_WHITE+symb)
-				}
-				continue
-			}
-		}
-
-		deloused = append(deloused,preserve_unicode[r])
-	}
-
-	return string(deloused)
-}
-
-//**************************************************************
-
-func AddBackAnnotations(cleantext string,cleanptr SST.NodePtr,annotated string) {
-
-	var protected bool = false
-
-	reminder := fmt.Sprintf("%.30s...",cleantext)
-	PVerbose("\n        Checking annotations from \""+reminder+"\"")
-
-	for r := 0; r < len(annotated); r++ {
-
-		if annotated[r] == '"' {
-			protected = !protected
-		} else {
-			if !protected {
-				skip,symb := EmbeddedSymbol([]rune(annotated),r)
-
-				if skip > 0 {
-					link := GetLinkArrowByName(ANNOTATION[symb])
-					this_item := ExtractWord(annotated,r+skip)
-
-					if len(this_item) <= WORD_MISTAKE_LEN {
-						err := fmt.Sprintf("%s \"%s\"  after annotation %s, len %d",ERR_SHORT_WORD,this_item,symb,skip)
-						ParseError(err)
-					}
-
-					this_iptr,_ := IdempAddNode(this_item,SEQ_UNKNOWN)
-					IdempAddLink(reminder,cleanptr,link,this_item,this_iptr)
-					r += skip-1
-					continue
-				}
-			}
-		}
-	}
-}
-
-//**************************************************************
-
-func EmbeddedSymbol(runetext []rune,offset int) (int,string) {
-
-	if offset >= len(runetext) {
-		return 0,"end of string"
-	}
-
-	var found_len int
-	var found string
-
-	for an := range ANNOTATION {
-
-		// Careful of unicode, convert to runes
-
-		uni := []rune(an)
-		match := runetext[offset] == uni[0]
-
-		for r := 0; r < len(uni) && r+offset < len(runetext); r++ {
-
-			if uni[r] != runetext[offset+r] {
-				match = false
-				continue
-			}
-
-			if offset+r >= len(runetext)-1 {
-				match = false
-				continue
-			}
-
-			// No space between marker and text
-			if offset+r+1 < len(runetext) && unicode.IsSpace(runetext[offset+r+1]) {
-				match = false
-				continue
-			}
-		}
-
-		// There might still be another longer greedy match
-
-		if match && len(an) > found_len {
-			found = an
-			found_len = len(an)
-			match = false
-		}
-	}
-
-	if len(found) > 0 {
-		return found_len,found
-	}
-
-	return 0,"UNKNOWN SYMBOL"
-}
-
-//**************************************************************
-
-func ExtractWord(fulltext string,offset int) string {
-
-	var protected bool = false
-
-	runetext := []rune(fulltext)
-	var word []rune
-	var pair_quote string
-
-	for r := offset; r < len(runetext); r++ {
-
-		if runetext[r] == '"' || runetext[r] == '\'' {
-			protected = !protected
-			pair_quote = string(runetext[r]) + " "
-			continue
-		}
-
-		if !protected && !unicode.IsLetter(rune(runetext[r])) {
-
-			sword := strings.Trim(strings.TrimSpace(string(word)),pair_quote)
-			return sword
-		}
-
-		word = append(word,runetext[r])
-	}
-	
-	sword := strings.Trim(strings.TrimSpace(string(word)),pair_quote)
-	
-	if len(sword) <= WORD_MISTAKE_LEN {
-		ParseError(ERR_SHORT_WORD+"\""+sword+"\"")
-	}
-
-	return sword
-}
-
-//**************************************************************
-
 func GetMemChapters() []string {
 
 	var chapters = make(map[string]int)
@@ -2443,245 +2236,6 @@ func GetNodePointedTo(node SST.Node,sequence []SST.ArrowPtr) (SST.NodePtr,bool)
 	return node.NPtr,true
 }
 
-//**************************************************************
-// Context logic
-//**************************************************************
-
-func ResetContextState() {
-
-	CONTEXT_STATE = make(map[string]bool)
-}
-
-//**************************************************************
-
-func ContextEval(s,op string) {
-
-	expr := CleanExpression(s)
-
-	or_parts := SplitWithParensIntact(expr,'|')
-
-	if strings.Contains(s,"(") {
-		ParseError(WARN_INADVISABLE_CONTEXT_EXPRESSION)
-	}
-
-	// +,-,= on CONTEXT_STATE
-
-	switch op {
-		
-	case "=": 
-		ResetContextState()
-		ModContext(or_parts,"+")
-	default:
-		ModContext(or_parts,op)
-	}
-}
-
-//**************************************************************
-
-func CleanExpression(s string) string {
-
-	s = TrimParen(s)
-	r1 := regexp.MustCompile("[|,]+") 
-	s = r1.ReplaceAllString(s,"|") 
-	r2 := regexp.MustCompile("[&]+") 
-	s = r2.ReplaceAllString(s,".") 
-	r3 := regexp.MustCompile("[.]+") 
-	s = r3.ReplaceAllString(s,".") 
-
-	return s
-}
-
-// ***********************************************************************
-
-func SplitWithParensIntact(expr string,split_ch rune) []string {
-
-	var token string = ""
-	var set []string
-
-	unicode := []rune(expr)
-
-	for c := 0; c < len(unicode); c++ {
-
-		switch unicode[c] {
-
-		case split_ch:
-			set = append(set,token)
-			token = ""
-
-		case '(':
-			subtoken,offset := Paren(unicode,c)
-			token += subtoken
-			c = offset-1
-
-		default:
-			token += string(unicode[c])
-		}
-	}
-
-	if len(token) > 0 {
-		set = append(set,token)
-	}
-
-	return set
-} 
-
-// ***********************************************************************
-
-func Paren(s []rune, offset int) (string,int) {
-
-	var level int = 0
-
-	for c := offset; c < len(s); c++ {
-
-		if s[c] == '(' {
-			level++
-			continue
-		}
-
-		if s[c] == ')' {
-			level--
-			if level == 0 {
-				token := s[offset:c+1]
-				return string(token), c+1
-			}
-		}
-	}
-
-	return "bad expression", -1
-}
-
-// ***********************************************************************
-
-func TrimParen(s string) string {
-
-	var level int = 0
-	var trim = true
-
-	if len(s) == 0 {
-		return s
-	}
-
-	s = strings.TrimSpace(s)
-
-	if s[0] != '(' {
-		return s
-	}
-
-	for c := 0; c < len(s); c++ {
-
-		if s[c] == '(' {
-			level++
-			continue
-		}
-
-		if level == 0 && c < len(s)-1 {
-			trim = false
-		}
-		
-		if s[c] == ')' {
-			level--
-
-			if level == 0 && c == len(s)-1 {
-				
-				var token string
-				
-				if trim {
-					token = s[1:len(s)-1]
-				} else {
-					token = s
-				}
-				return token
-			}
-		}
-	}
-	
-	return s
-}
-
-//**************************************************************
-
-func ModContext(list []string,op string) {
-
-	for or_frag := range list {
-
-		frag := strings.TrimSpace(list[or_frag])
-
-		if len(frag) == 0 {
-			continue
-		}
-
-		switch op {
-		case "+":
-			CONTEXT_STATE[frag] = true
-
-		case "-": // to remove, we also need to look at children
-			for cand := range CONTEXT_STATE {
-				and_parts := SplitWithParensIntact(cand,'.') 
-		
-				for part := range and_parts {
-
-					if strings.Contains(and_parts[part],frag) {
-						delete(CONTEXT_STATE,cand)
-					}
-				}
-			}
-		}
-
-	}
-}
-
-//**************************************************************
-
-func CheckNonNegative(i int) {
-
-	if i < 0 {
-		ParseError(ERR_MISSING_ITEM_SOMEWHERE)
-		os.Exit(-1)
-	}
-}
-
-//**************************************************************
-
-func CheckSection(item string) {
-
-	if len(SECTION_STATE) == 0 {
-		ParseError(ERR_MISSING_SECTION)
-		os.Exit(-1)
-	}
-}
-
-//**************************************************************
-
-func NoteToSelf(s string) bool {
-
-	if len(s) <= 2 * WORD_MISTAKE_LEN {
-		return false
-	}
-
-	const intentionality_threshold = 50
-
-	if (len(s) > intentionality_threshold) && s[len(s)-1] == '.' {
-		return false
-	}
-
-	for _, r := range s {
-
-		if !unicode.IsUpper(r) && (unicode.IsLetter(r) || unicode.IsNumber(r)) {
-			return false
-		}
-	}
-
-	// Don't repeat the same message for multi-line dittos
-
-	if LINE_ITEM_CACHE["THIS"] != nil && LINE_ITEM_CACHE["PREV"] != nil {
-		if LINE_ITEM_CACHE["THIS"][0] == LINE_ITEM_CACHE["PREV"][0] {
-			return false
-		}
-	}
-
-	return true
-}
-
 //**************************************************************
 
 func StripParen(token string) string {
@@ -2794,7 +2348,7 @@ func ReadUTF8FileBuffered(filename string) []rune {
 
 func Usage() {
 	
-	fmt.Printf("usage: N4L [-v] [-u] [-s] [file].dat\n")
+	fmt.Printf("usage: N4L [-v] [-u] [-s] [-watch] [file].dat\n")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -0,0 +1,760 @@
+//
+// A language server (LSP) for N4L files, for editors. The checking
+// is done by the same n4l parser as N4L, in process, so the
+// diagnostics are N4L's own. See docs/N4Llsp.md
+//
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"flag"
+	"bufio"
+	"strings"
+	"strconv"
+	"regexp"
+	"net/url"
+	"path/filepath"
+	"unicode/utf16"
+	"encoding/json"
+        SST "SSTorytime"
+        "SSTorytime/n4l"
+)
+
+//**************************************************************
+
+var DOCUMENTS = make(map[string]*Document)
+var ARROWS []SST.N4LReport
+
+var ALIAS_REF = regexp.MustCompile(`\$([^.$\s()"]+)(\.[0-9]+)?`)
+var ALIAS_DEF = regexp.MustCompile(`@([^\s()"]+)`)
+
+var OUT = bufio.NewWriter(os.Stdout)
+
+//**************************************************************
+
+type Document struct {
+
+	URI      string
+	Text     string
+	Chapters []SST.N4LReport
+	Aliases  []SST.N4LReport
+}
+
+type Message struct {
+
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *ResponseError  `json:"error,omitempty"`
+}
+
+type ResponseError struct {
+
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type Position struct {
+
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type Range struct {
+
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+type Location struct {
+
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+type Diagnostic struct {
+
+	Range    Range  `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+type CompletionItem struct {
+
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type DocumentSymbol struct {
+
+	Name           string           `json:"name"`
+	Kind           int              `json:"kind"`
+	Range          Range            `json:"range"`
+	SelectionRange Range            `json:"selectionRange"`
+	Children       []DocumentSymbol `json:"children,omitempty"`
+}
+
+type TextDocumentPosition struct {
+
+	TextDocument struct { URI string `json:"uri"` } `json:"textDocument"`
+	Position     Position `json:"position"`
+}
+
+// LSP enumerations used here
+
+const (
+	SEVERITY_ERROR = 1
+	SEVERITY_WARNING = 2
+
+	COMPLETION_VARIABLE = 6
+	COMPLETION_REFERENCE = 18
+
+	SYMBOL_NAMESPACE = 3
+	SYMBOL_VARIABLE = 13
+)
+
+//**************************************************************
+// BEGIN
+//**************************************************************
+
+func main() {
+
+	GetArgs()
+
+	// The library prints its complaints on stdout, which is ours,
+	// so they go to the editor's log instead
+
+	os.Stdout = os.Stderr
+
+	in := bufio.NewReader(os.Stdin)
+
+	for {
+		msg,err := ReadMessage(in)
+
+		if err == io.EOF {
+			os.Exit(1) // exit without shutdown
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr,"N4Llsp:",err)
+			continue
+		}
+
+		if msg.Method == "exit" {
+			os.Exit(0)
+		}
+
+		HandleMessage(msg)
+	}
+}
+
+//**************************************************************
+
+func GetArgs() {
+
+	flag.Usage = Usage
+	flag.Parse()
+}
+
+//**************************************************************
+
+func Usage() {
+
+	fmt.Println("usage: N4Llsp")
+	fmt.Println("A language server for N4L, talking LSP on stdin/stdout, to be started by an editor")
+	flag.PrintDefaults()
+
+	os.Exit(2)
+}
+
+//**************************************************************
+// JSON-RPC
+//**************************************************************
+
+func ReadMessage(in *bufio.Reader) (Message,error) {
+
+	var msg Message
+	var length int = -1
+
+	for {
+		line,err := in.ReadString('\n')
+
+		if err != nil {
+			return msg,err
+		}
+
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			break
+		}
+
+		name,value,found := strings.Cut(line,":")
+
+		if found && strings.EqualFold(name,"Content-Length") {
+			length,_ = strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+
+	if length < 0 {
+		return msg,fmt.Errorf("message without Content-Length")
+	}
+
+	body := make([]byte,length)
+
+	if _,err := io.ReadFull(in,body); err != nil {
+		return msg,err
+	}
+
+	err := json.Unmarshal(body,&msg)
+
+	return msg,err
+}
+
+//**************************************************************
+
+func Send(msg Message) {
+
+	msg.JSONRPC = "2.0"
+
+	body,err := json.Marshal(msg)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"N4Llsp:",err)
+		return
+	}
+
+	fmt.Fprintf(OUT,"Content-Length: %d\r\n\r\n",len(body))
+	OUT.Write(body)
+	OUT.Flush()
+}
+
+//**************************************************************
+
+func Reply(id json.RawMessage,result any) {
+
+	// A null result must still be sent as null
+
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+
+	Send(Message{ID: id, Result: result})
+}
+
+//**************************************************************
+
+func Notify(method string,params any) {
+
+	p,_ := json.Marshal(params)
+	Send(Message{Method: method, Params: p})
+}
+
+//**************************************************************
+
+func HandleMessage(msg Message) {
+
+	switch msg.Method {
+
+	case "initialize":
+		Reply(msg.ID,map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": 1, // full text on each change
+				"completionProvider": map[string]any{ "triggerCharacters": []string{"(","$"} },
+				"hoverProvider": true,
+				"definitionProvider": true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]any{ "name": "N4Llsp" },
+		})
+
+	case "shutdown":
+		Reply(msg.ID,nil)
+
+	case "textDocument/didOpen":
+		var p struct { TextDocument struct { URI, Text string } `json:"textDocument"` }
+		json.Unmarshal(msg.Params,&p)
+		Update(p.TextDocument.URI,p.TextDocument.Text)
+
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct { URI string } `json:"textDocument"`
+			ContentChanges []struct { Text string } `json:"contentChanges"`
+		}
+		json.Unmarshal(msg.Params,&p)
+		if n := len(p.ContentChanges); n > 0 {
+			Update(p.TextDocument.URI,p.ContentChanges[n-1].Text)
+		}
+
+	case "textDocument/didSave":
+
+		// SSTconfig may have changed in the meantime
+
+		var p struct { TextDocument struct { URI string } `json:"textDocument"` }
+		json.Unmarshal(msg.Params,&p)
+		if doc,ok := DOCUMENTS[p.TextDocument.URI]; ok {
+			Update(doc.URI,doc.Text)
+		}
+
+	case "textDocument/didClose":
+		var p struct { TextDocument struct { URI string } `json:"textDocument"` }
+		json.Unmarshal(msg.Params,&p)
+		delete(DOCUMENTS,p.TextDocument.URI)
+		Notify("textDocument/publishDiagnostics",map[string]any{ "uri": p.TextDocument.URI, "diagnostics": []Diagnostic{} })
+
+	case "textDocument/completion":
+		var p TextDocumentPosition
+		json.Unmarshal(msg.Params,&p)
+		Reply(msg.ID,Completion(p))
+
+	case "textDocument/hover":
+		var p TextDocumentPosition
+		json.Unmarshal(msg.Params,&p)
+		Reply(msg.ID,Hover(p))
+
+	case "textDocument/definition":
+		var p TextDocumentPosition
+		json.Unmarshal(msg.Params,&p)
+		Reply(msg.ID,Definition(p))
+
+	case "textDocument/documentSymbol":
+		var p struct { TextDocument struct { URI string } `json:"textDocument"` }
+		json.Unmarshal(msg.Params,&p)
+		Reply(msg.ID,Symbols(p.TextDocument.URI))
+
+	default:
+
+		// Requests need an answer, notifications don't
+
+		if len(msg.ID) > 0 && msg.Method != "" {
+			Send(Message{ID: msg.ID, Error: &ResponseError{Code: -32601, Message: "method not supported: "+msg.Method}})
+		}
+	}
+}
+
+//**************************************************************
+// Checking with the N4L parser
+//**************************************************************
+
+func Update(uri,text string) {
+
+	doc := &Document{URI: uri, Text: text}
+	DOCUMENTS[uri] = doc
+
+	reports,err := RunN4L(uri,text)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"N4Llsp:",err)
+	}
+
+	lines := strings.Split(text,"\n")
+	diagnostics := []Diagnostic{}
+	var arrows []SST.N4LReport
+
+	for _,r := range reports {
+
+		switch r.Kind {
+
+		case SST.N4L_REPORT_ARROW:
+			arrows = append(arrows,r)
+
+		case SST.N4L_REPORT_CHAPTER:
+			doc.Chapters = append(doc.Chapters,r)
+
+		case SST.N4L_REPORT_ALIAS:
+			doc.Aliases = append(doc.Aliases,r)
+
+		case SST.N4L_REPORT_ERROR,SST.N4L_REPORT_WARNING:
+
+			d := Diagnostic{Severity: SEVERITY_ERROR, Source: "N4L", Message: r.Text}
+
+			if r.Kind == SST.N4L_REPORT_WARNING {
+				d.Severity = SEVERITY_WARNING
+			}
+
+			if r.Line == 0 {
+
+				// A problem with SSTconfig, not in this file
+
+				d.Range = LineRange(lines,0)
+			} else {
+				d.Range = LineRange(lines,r.Line-1)
+			}
+
+			diagnostics = append(diagnostics,d)
+		}
+	}
+
+	// Keep the last good set of arrows if the configuration failed
+
+	if len(arrows) > 0 {
+		ARROWS = arrows
+	}
+
+	Notify("textDocument/publishDiagnostics",map[string]any{ "uri": uri, "diagnostics": diagnostics })
+}
+
+//**************************************************************
+
+func RunN4L(uri,text string) ([]SST.N4LReport,error) {
+
+	// Read SSTconfig afresh, from the document's own directory so
+	// that it is found as usual, since it may have changed
+
+	path := URIToPath(uri)
+
+	if path != "" {
+		os.Chdir(filepath.Dir(path))
+	}
+
+	var reports []SST.N4LReport
+
+	if SST.FindConfigDir() == "" {
+		reports = append(reports,SST.N4LReport{Kind: SST.N4L_REPORT_WARNING, Text: "No SSTconfig directory found, only the built-in arrows are known"})
+	}
+
+	SST.InstallArrowDirectory(nil,nil)
+	SST.ReadArrowConfig()
+
+	for _,arr := range SST.ARROW_DIRECTORY {
+
+		r := SST.N4LReport{Kind: SST.N4L_REPORT_ARROW, Name: arr.Short, Text: arr.Long, STType: SST.STIndexToSTType(arr.STAindex)}
+
+		if inv,ok := SST.INVERSE_ARROWS[arr.Ptr]; ok {
+			r.InvName = SST.ARROW_DIRECTORY[inv].Short
+			r.InvText = SST.ARROW_DIRECTORY[inv].Long
+		}
+
+		reports = append(reports,r)
+	}
+
+	config := n4l.Config{Annotations: SST.ReadAnnotationConfig(), Arrows: KnownArrow}
+
+	file,err := n4l.Parse(path,strings.NewReader(text),config)
+
+	if err != nil {
+		return reports,err
+	}
+
+	for _,chapter := range file.Chapters {
+
+		if chapter.Name != "" {
+			reports = append(reports,SST.N4LReport{Kind: SST.N4L_REPORT_CHAPTER, File: path, Line: chapter.Pos.Line, Name: chapter.Name})
+		}
+	}
+
+	for _,line := range file.Lines() {
+
+		if line.Alias != "" {
+			reports = append(reports,SST.N4LReport{Kind: SST.N4L_REPORT_ALIAS, File: path, Line: line.Pos.Line, Name: line.Alias})
+		}
+	}
+
+	// Unlike N4L, which stops at the first error, report them all
+
+	for _,e := range file.Errors {
+
+		r := SST.N4LReport{Kind: SST.N4L_REPORT_ERROR, File: path, Line: e.Pos.Line, Text: e.Msg}
+
+		if e.Warning || strings.HasPrefix(strings.ToUpper(e.Msg),"WARNING") {
+			r.Kind = SST.N4L_REPORT_WARNING
+		}
+
+		reports = append(reports,r)
+	}
+
+	return reports,nil
+}
+
+//**************************************************************
+
+func KnownArrow(name string) bool {
+
+	_,short := SST.ARROW_SHORT_DIR[name]
+	_,long := SST.ARROW_LONG_DIR[name]
+
+	return short || long
+}
+
+//**************************************************************
+// Editor requests
+//**************************************************************
+
+func Completion(p TextDocumentPosition) []CompletionItem {
+
+	items := []CompletionItem{}
+
+	doc,ok := DOCUMENTS[p.TextDocument.URI]
+
+	if !ok {
+		return items
+	}
+
+	before := LineBefore(doc.Text,p.Position)
+
+	// Inside an unclosed (arrow)
+
+	if strings.LastIndex(before,"(") > strings.LastIndex(before,")") {
+
+		for _,a := range ARROWS {
+			detail := a.Text+"  "+SST.STTypeName(a.STType)
+			items = append(items,CompletionItem{Label: a.Name, Kind: COMPLETION_REFERENCE, Detail: detail})
+			items = append(items,CompletionItem{Label: a.Text, Kind: COMPLETION_REFERENCE, Detail: "("+a.Name+")  "+SST.STTypeName(a.STType)})
+		}
+
+		return items
+	}
+
+	// After $, an alias
+
+	if i := strings.LastIndex(before,"$"); i >= 0 && !strings.ContainsAny(before[i:]," \t.") {
+
+		for _,a := range doc.Aliases {
+			items = append(items,CompletionItem{Label: a.Name, Kind: COMPLETION_VARIABLE, Detail: "line "+strconv.Itoa(a.Line)})
+		}
+	}
+
+	return items
+}
+
+//**************************************************************
+
+func Hover(p TextDocumentPosition) any {
+
+	doc,ok := DOCUMENTS[p.TextDocument.URI]
+
+	if !ok {
+		return nil
+	}
+
+	line := Line(doc.Text,p.Position.Line)
+	col := RuneColumn(line,p.Position.Character)
+	runes := []rune(line)
+
+	// Find the (arrow) around the cursor
+
+	open,close := -1,-1
+
+	for i := min(col,len(runes)-1); i >= 0; i-- {
+		if runes[i] == ')' && i < col {
+			return nil
+		}
+		if runes[i] == '(' {
+			open = i
+			break
+		}
+	}
+
+	for i := max(col,open+1); open >= 0 && i < len(runes); i++ {
+		if runes[i] == ')' {
+			close = i
+			break
+		}
+	}
+
+	if open < 0 || close < 0 {
+		return nil
+	}
+
+	name := strings.TrimSpace(string(runes[open+1:close]))
+
+	for _,a := range ARROWS {
+
+		if a.Name != name && a.Text != name {
+			continue
+		}
+
+		text := fmt.Sprintf("**%s** (%s)\n\nST type: %d, %s",a.Text,a.Name,a.STType,SST.STTypeName(a.STType))
+
+		if a.InvName != "" {
+			text += fmt.Sprintf("\n\nInverse: **%s** (%s)",a.InvText,a.InvName)
+		}
+
+		return map[string]any{ "contents": map[string]string{ "kind": "markdown", "value": text } }
+	}
+
+	return nil
+}
+
+//**************************************************************
+
+func Definition(p TextDocumentPosition) any {
+
+	doc,ok := DOCUMENTS[p.TextDocument.URI]
+
+	if !ok {
+		return nil
+	}
+
+	line := Line(doc.Text,p.Position.Line)
+	col := RuneColumn(line,p.Position.Character)
+
+	for _,m := range ALIAS_REF.FindAllStringSubmatchIndex(line,-1) {
+
+		from := len([]rune(line[:m[0]]))
+		to := len([]rune(line[:m[1]]))
+
+		if col < from || col > to {
+			continue
+		}
+
+		name := line[m[2]:m[3]]
+		lines := strings.Split(doc.Text,"\n")
+
+		for _,a := range doc.Aliases {
+			if a.Name == name {
+				return Location{URI: doc.URI, Range: AliasRange(lines,a)}
+			}
+		}
+	}
+
+	return nil
+}
+
+//**************************************************************
+
+func Symbols(uri string) []DocumentSymbol {
+
+	symbols := []DocumentSymbol{}
+
+	doc,ok := DOCUMENTS[uri]
+
+	if !ok {
+		return symbols
+	}
+
+	lines := strings.Split(doc.Text,"\n")
+	last := len(lines)-1
+
+	for c,ch := range doc.Chapters {
+
+		// A chapter runs until the next one, or the end
+
+		end := last
+
+		if c+1 < len(doc.Chapters) {
+			end = doc.Chapters[c+1].Line-2
+		}
+
+		s := DocumentSymbol{Name: ch.Name, Kind: SYMBOL_NAMESPACE}
+		s.SelectionRange = LineRange(lines,ch.Line-1)
+		s.Range = Range{Start: s.SelectionRange.Start, End: LineRange(lines,end).End}
+
+		for _,a := range doc.Aliases {
+			if a.Line >= ch.Line && a.Line-1 <= end {
+				r := AliasRange(lines,a)
+				s.Children = append(s.Children,DocumentSymbol{Name: "@"+a.Name, Kind: SYMBOL_VARIABLE, Range: r, SelectionRange: r})
+			}
+		}
+
+		symbols = append(symbols,s)
+	}
+
+	return symbols
+}
+
+//**************************************************************
+// Positions: LSP counts lines from 0 and characters in UTF-16
+//**************************************************************
+
+func URIToPath(uri string) string {
+
+	u,err := url.Parse(uri)
+
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+
+	return filepath.FromSlash(u.Path)
+}
+
+//**************************************************************
+
+func Line(text string,n int) string {
+
+	lines := strings.Split(text,"\n")
+
+	if n < 0 || n >= len(lines) {
+		return ""
+	}
+
+	return strings.TrimRight(lines[n],"\r")
+}
+
+//**************************************************************
+
+func LineBefore(text string,pos Position) string {
+
+	runes := []rune(Line(text,pos.Line))
+
+	return string(runes[:RuneColumn(string(runes),pos.Character)])
+}
+
+//**************************************************************
+
+func RuneColumn(line string,utf16col int) int {
+
+	n := 0
+
+	for i,r := range []rune(line) {
+		if n >= utf16col {
+			return i
+		}
+		n += len(utf16.Encode([]rune{r}))
+	}
+
+	return len([]rune(line))
+}
+
+//**************************************************************
+
+func UTF16Len(s string) int {
+
+	return len(utf16.Encode([]rune(s)))
+}
+
+//**************************************************************
+
+func LineRange(lines []string,n int) Range {
+
+	if n < 0 || n >= len(lines) {
+		n = 0
+	}
+
+	length := 0
+
+	if n < len(lines) {
+		length = UTF16Len(strings.TrimRight(lines[n],"\r"))
+	}
+
+	return Range{Start: Position{n,0}, End: Position{n,length}}
+}
+
+//**************************************************************
+
+func AliasRange(lines []string,a SST.N4LReport) Range {
+
+	// Just the @name, if it can be found on the line
+
+	n := a.Line-1
+	r := LineRange(lines,n)
+
+	if n < 0 || n >= len(lines) {
+		return r
+	}
+
+	for _,m := range ALIAS_DEF.FindAllStringSubmatchIndex(lines[n],-1) {
+		if lines[n][m[2]:m[3]] == a.Name {
+			return Range{Start: Position{n,UTF16Len(lines[n][:m[0]])}, End: Position{n,UTF16Len(lines[n][:m[1]])}}
+		}
+	}
+
+	return r
+}
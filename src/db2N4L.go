@@ -0,0 +1,76 @@
+//
+// Reconstruct N4L notes for a chapter from the database, so that
+// N4L can compile them again. See docs/db2N4L.md
+//
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"strings"
+        SST "SSTorytime"
+)
+
+var LIMIT int
+
+//**************************************************************
+// BEGIN
+//**************************************************************
+
+func main() {
+
+	chapter,output := GetArgs()
+
+	load_arrows := true
+	sst := SST.Open(load_arrows)
+
+	SST.DownloadArrowsFromDB(sst)
+
+	notes := SST.ChapterToN4L(sst,chapter,LIMIT)
+
+	SST.Close(sst)
+
+	if output == "" {
+		fmt.Print(notes)
+		return
+	}
+
+	if err := os.WriteFile(output,[]byte(notes),0644); err != nil {
+		fmt.Println("Failed to open file for writing: ",output)
+		os.Exit(-1)
+	}
+}
+
+//**************************************************************
+
+func GetArgs() (string,string) {
+
+	flag.Usage = Usage
+
+	outputPtr := flag.String("o", "", "output file (default: standard output)")
+	limitPtr := flag.Int("limit", 100000, "maximum number of nodes")
+
+	flag.Parse()
+	args := flag.Args()
+
+	LIMIT = *limitPtr
+
+	if len(args) == 0 {
+		fmt.Println("Missing chapter to export")
+		os.Exit(-2)
+	} 
+
+	return strings.Join(args," "),*outputPtr
+}
+
+//**************************************************************
+
+func Usage() {
+	
+	fmt.Println("usage: db2N4L [-o file.n4l] [-limit n] chapter")
+	flag.PrintDefaults()
+
+	os.Exit(2)
+}
@@ -0,0 +1,126 @@
+//******************************************************************
+//
+// Run the same searches from many goroutines at once, as the
+// http_server does for simultaneous requests, and check that they
+// agree with a single threaded run. Build with -race to check the
+// library's shared state (see the Makefile). The same test runs
+// without a database on the embedded store, in
+// pkg/SSTorytime/concurrent_test.go
+//
+// Prepare:
+// cd examples
+// ../src/N4L -u doors.n4l
+//
+//******************************************************************
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+        SST "SSTorytime"
+)
+
+const WORKERS = 16
+const ROUNDS = 10
+
+//******************************************************************
+
+func main() {
+
+	load_arrows := true
+	sst := SST.Open(load_arrows)
+
+	expected := Search(sst)
+
+	if expected == "" {
+		fmt.Println("No paths found - upload examples/doors.n4l first")
+		os.Exit(-1)
+	}
+
+	var wg sync.WaitGroup
+	var failures = make(chan string,WORKERS*ROUNDS)
+
+	for w := 0; w < WORKERS; w++ {
+
+		wg.Add(1)
+
+		go func(w int) {
+
+			defer wg.Done()
+
+			// One user per worker, as the server does per request
+
+			usst := SST.ForUser(sst,fmt.Sprintf("tester%d",w))
+
+			for r := 0; r < ROUNDS; r++ {
+
+				if got := Search(usst); got != expected {
+					failures <- fmt.Sprintf("worker %d round %d:\n got %s\n expected %s",w,r,got,expected)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(failures)
+
+	failed := false
+
+	for f := range failures {
+		fmt.Println(f)
+		failed = true
+	}
+
+	SST.Close(sst)
+
+	if failed {
+		os.Exit(-1)
+	}
+
+	fmt.Println("Concurrent searches agree:",expected)
+}
+
+//******************************************************************
+
+func Search(sst SST.PoSST) string {
+
+	search := SST.DecodeSearchField("\\from start \\to target 1")
+
+	// The short term memory is kept per user
+
+	ambient,key,now := SST.GetTimeContext()
+	SST.UpdateSTMContext(sst,ambient,key,now,search)
+
+	// Refreshes the arrow directory from the database
+
+	SST.GetDBArrowBySTType(sst,SST.LEADSTO)
+
+	arrowptrs,sttypes := SST.ArrowPtrFromArrowsNames(sst,search.Arrows)
+
+	left := SST.SolveNodePtrs(sst,search.From,search,arrowptrs,10)
+	right := SST.SolveNodePtrs(sst,search.To,search,arrowptrs,10)
+
+	if left == nil || right == nil {
+		return ""
+	}
+
+	cone,_ := SST.GetEntireNCConePathsAsLinks(sst,"fwd",left,4,"",nil,30)
+	paths := SST.GetPathsAndSymmetries(sst,left,right,"",nil,arrowptrs,sttypes,1,6)
+
+	var nodes = make(map[string]bool)
+	var arrows = make(map[string]bool)
+
+	for _,path := range cone {
+		for _,lnk := range path {
+			nodes[SST.GetDBNodeByNodePtr(sst,lnk.Dst).S] = true
+			arr := SST.GetDBArrowByPtr(sst,lnk.Arr)
+			inv := SST.GetDBArrowByPtr(sst,SST.InverseArrow(lnk.Arr))
+			arrows[arr.Long+"/"+inv.Long+"/"+SST.GetContext(lnk.Ctx)] = true
+		}
+	}
+
+	return fmt.Sprintf("%d cone paths, %d nodes, %d arrows, %d paths start -> target 1",len(cone),len(nodes),len(arrows),len(paths))
+}
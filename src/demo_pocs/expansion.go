@@ -20,8 +20,10 @@ func main() {
 		"Dynamic: Time to regular coordination meeting {TimeUntil Hr11} at 11:00",
 		"Dynamic: Time to Monday week start {TimeUntil Monday} Monday Morning"}
 
+	var sst SST.PoSST // the time functions don't need a database
+
 	for i,s := range str {
-		fmt.Println("\n",i,SST.ExpandDynamicFunctions(s))
+		fmt.Println("\n",i,SST.ExpandDynamicFunctions(sst,s))
 	}
 
 	fmt.Println("\n\n")
@@ -9,7 +9,6 @@ package main
 import (
 	"fmt"
 	"strings"
-	"sort"
 	"flag"
 	"os"
         SST "SSTorytime"
@@ -114,9 +113,8 @@ func Init() []string {
 func AnalyzeGraph(sst SST.PoSST,chapter string,context []string,sttypes []int,depth int) {
 
 
-	adj,nodekey := SST.GetDBAdjacentNodePtrBySTType(sst,sttypes,chapter,context,false)
-	symb := SST.SymbolMatrix(adj)
-	sadj := SST.SymmetrizeMatrix(adj)
+	adj,nodekey := SST.GetDBSparseAdjacencyBySTType(sst,sttypes,chapter,context,false)
+	sadj := SST.SparseSymmetrize(adj)
 	num := GetNumberOfLinks(adj)
 	distribution := GetNameDistribution(nodekey)
 	total := len(nodekey)
@@ -160,30 +158,20 @@ func AnalyzeGraph(sst SST.PoSST,chapter string,context []string,sttypes []int,de
 	fmt.Println("* DIRECTED LOOPS AND CYCLES (max depth < ",depth,"):\n")
 	fmt.Println("\n")
 
-	// Find power matrices
+	// Search for cycles directly, as powers of the adjacency matrix fill up
 
-	an := make([][][]float32,depth+1)
-	sn := make([][][]string,depth+1)
-
-	an[1] = adj
-	sn[1] = symb
 	acyclic := true
 
-	for power := 2; power <= depth; power++ {
-
-		if power % 2 == 0 {
-			an[power],sn[power] = SST.SymbolicMultiply(an[power-1],adj,sn[power-1],symb)
-		} else {
-			an[power],sn[power] = SST.SymbolicMultiply(an[power-1],adj,sn[power-1],symb)
-		}
+	for _,cycle := range SST.SparseCycles(adj,depth,0) {
 
-		loop,_ := AnalyzePowerMatrix(sst,sn[power])
+		acyclic = false
+		var members string
 
-		for m := range loop {
-			acyclic = false
-			length := len(strings.Split(m,")("))
-			fmt.Println("  - Cycle of length",length,"with members",m)
+		for _,m := range cycle {
+			members += fmt.Sprintf("(%d)",m)
 		}
+
+		fmt.Println("  - Cycle of length",len(cycle),"with members",members)
 	}
 
 	if acyclic {
@@ -227,13 +215,13 @@ func AnalyzeGraph(sst SST.PoSST,chapter string,context []string,sttypes []int,de
 	// Now find the undirected graph properties 
 
 	fmt.Println("")
-	evc := SST.ComputeEVC(sadj)
+	evc := SST.SparseComputeEVC(sadj)
 
 	fmt.Println("* SYMMETRIZED EIGENVECTOR CENTRALITY = FLOW RESERVOIR CAPACITANCE AT EQUILIBRIUM = \n")
 
 	PrintVector(sst,evc,nodekey)
 
-	regions,evctop,path := SST.FindGradientFieldTop(sadj,evc)
+	regions,evctop,path := SST.SparseGradientFieldTop(sadj,evc)
 
 	fmt.Println("")
 	if len(regions) == 1 {
@@ -257,14 +245,12 @@ func AnalyzeGraph(sst SST.PoSST,chapter string,context []string,sttypes []int,de
 
 //**************************************************************
 
-func GetNumberOfLinks(a [][]float32) int {
+func GetNumberOfLinks(a SST.SparseMatrix) int {
 
 	count := 0
-	for i := range a {
-		for j := range a[i] {
-			if a[i][j] > 0 {
-				count++
-			}
+	for k := range a.Val {
+		if a.Val[k] > 0 {
+			count++
 		}
 	}
 	return count
@@ -285,59 +271,6 @@ func GetNameDistribution(nodeptr []SST.NodePtr) [7]int {
 
 //**************************************************************
 
-func AnalyzePowerMatrix(sst SST.PoSST,symbolic [][]string) (map[string]int,map[string][]int) {
-
-	var loop = make(map[string]int)
-	var memberlist = make(map[string][]int)
-
-	for r := 0; r < len(symbolic); r++ {
-
-		// check the diagonal
-
-		if len(symbolic[r][r]) == 0 {
-			continue
-		}
-
-		var distrib = make(map[string]int)
-		var nodes []string
-
-		vec := strings.Split(symbolic[r][r],"*")
-		
-		for i := 0; i < len(vec); i++ {
-			distrib[vec[i]]++
-		}
-
-		var degeneracy int
-
-		for d := range distrib {
-			degeneracy = distrib[d] / 2
-			break
-		}
-
-		for r := range distrib {
-			nodes = append(nodes,r)
-		}
-
-		sort.Strings(nodes)
-		var members string
-		var membindex []int
-		var v int
-
-		for n := 0; n < len(nodes); n++ {
-			members += fmt.Sprintf("(%s)",nodes[n])
-			fmt.Sscanf(nodes[n],"%d",&v)
-			membindex = append(membindex,v)
-		}
-
-		loop[members] = degeneracy
-		memberlist[members] = membindex
-	}
-
-	return loop,memberlist
-}
-
-//**************************************************************
-
 func PrintNodes(sst SST.PoSST,nptrs []SST.NodePtr) {
 
 	for n := range nptrs {
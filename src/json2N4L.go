@@ -0,0 +1,134 @@
+//
+// Transcribe a JSON document into N4L notes, using the arrows
+// declared in SSTconfig where the keys match. See docs/json2N4L.md
+//
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"path/filepath"
+	"strings"
+        SST "SSTorytime"
+)
+
+var CHAPTER string
+var MODE int
+var ORDER bool
+
+//**************************************************************
+// BEGIN
+//**************************************************************
+
+func main() {
+
+	input := GetArgs()
+
+	text,err := os.ReadFile(input)
+
+	if err != nil {
+		fmt.Println("Unable to read JSON file",input,err)
+		os.Exit(-1)
+	}
+
+	doc,err := SST.ParseJSON(text)
+
+	if err != nil {
+		fmt.Println("Error in",input,err)
+		os.Exit(-1)
+	}
+
+	base := strings.TrimSuffix(filepath.Base(input),filepath.Ext(input))
+
+	if CHAPTER == "" {
+		CHAPTER = base
+	}
+
+	SST.MemoryInit()
+	SST.ReadArrowConfig()
+
+	imp := SST.ImportJSON(doc,CHAPTER,MODE,ORDER)
+
+	fmt.Println("Read",input,"giving",len(imp.Links),"links")
+
+	for _,a := range imp.Arrows {
+		fmt.Printf(" new     %-12s + %s (%s)  - %s (%s)\n",SST.STTypeSection(a.STType),a.Long,a.Short,a.InvLong,a.InvShort)
+	}
+
+	WriteOutput(input,imp)
+}
+
+//**************************************************************
+
+func GetArgs() string {
+
+	flag.Usage = Usage
+
+	collapsePtr := flag.Bool("collapse", false, "write \"key = value\" items contained in each object, instead of an arrow per key")
+	orderPtr := flag.Bool("order", false, "join the elements of arrays in sequence with (then)")
+	chapterPtr := flag.String("chapter", "", "chapter name for the notes (default: the file name)")
+
+	flag.Parse()
+	args := flag.Args()
+
+	CHAPTER = *chapterPtr
+	ORDER = *orderPtr
+	MODE = SST.JSON_NAIVE
+
+	if *collapsePtr {
+		MODE = SST.JSON_COLLAPSED
+	}
+
+	if len(args) != 1 {
+		fmt.Println("Missing JSON filename to convert")
+		os.Exit(-2)
+	}
+
+	return args[0]
+}
+
+//**************************************************************
+
+func Usage() {
+
+	fmt.Println("usage: json2N4L [-collapse] [-order] [-chapter name] filename.json")
+	flag.PrintDefaults()
+
+	os.Exit(2)
+}
+
+//*******************************************************************
+
+func WriteOutput(filename string,imp SST.GraphImport) {
+
+	notes,config := SST.ImportToN4L(imp,CHAPTER)
+
+	base := strings.TrimSuffix(filename,filepath.Ext(filename))
+
+	outputfile := base + "_edit_me.n4l"
+
+	if err := os.WriteFile(outputfile,[]byte(notes),0644); err != nil {
+		fmt.Println("Failed to open file for writing: ",outputfile)
+		os.Exit(-1)
+	}
+
+	fmt.Println("Wrote",outputfile)
+
+	configfile := base + "_arrows.sst"
+
+	// Don't leave the arrows of an earlier run lying around
+
+	if config == "" {
+		os.Remove(configfile)
+		return
+	}
+
+	if err := os.WriteFile(configfile,[]byte(config),0644); err != nil {
+		fmt.Println("Failed to open file for writing: ",configfile)
+		os.Exit(-1)
+	}
+
+	fmt.Println("Wrote",configfile,"- add each section to the matching SSTconfig/arrows-*.sst file before running N4L")
+}
@@ -0,0 +1,708 @@
+//
+// Rewrite N4L files in a canonical layout, making sure the graph
+// they describe stays the same. See docs/n4lfmt.md
+//
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"sort"
+	"bytes"
+	"strings"
+	"strconv"
+	"unicode"
+        SST "SSTorytime"
+	"SSTorytime/n4l"
+)
+
+//**************************************************************
+
+const (
+	ELEM_CHAPTER = iota
+	ELEM_CONTEXT
+	ELEM_LINE
+	ELEM_COMMENT
+)
+
+//**************************************************************
+
+type Element struct {
+
+	Kind    int
+	Offset  int
+	First   int // first and last source lines
+	Last    int
+	Text    string
+	Line    *n4l.Line
+	Comment string // trailing comment on the same line
+}
+
+//**************************************************************
+
+var CHECK bool
+var ARROWS string // short, long, or empty to keep the names as written
+
+//**************************************************************
+// BEGIN
+//**************************************************************
+
+func main() {
+
+	files := GetArgs()
+
+	if ARROWS != "" {
+		SST.MemoryInit()
+		SST.ReadArrowConfig()
+	}
+
+	var failed,unformatted int
+
+	for _,filename := range files {
+
+		before,err := os.ReadFile(filename)
+
+		if err != nil {
+			fmt.Println("Unable to read",filename,err)
+			failed++
+			continue
+		}
+
+		after,ok := Format(filename,before)
+
+		if !ok {
+			failed++
+			continue
+		}
+
+		if bytes.Equal(before,after) {
+			continue
+		}
+
+		if CHECK {
+			fmt.Println(filename,"is not in canonical form")
+			unformatted++
+			continue
+		}
+
+		if err := os.WriteFile(filename,after,0644); err != nil {
+			fmt.Println("Failed to open file for writing: ",filename,err)
+			failed++
+			continue
+		}
+
+		fmt.Println("Formatted",filename)
+	}
+
+	if failed > 0 {
+		os.Exit(-1)
+	}
+
+	if unformatted > 0 {
+		os.Exit(1)
+	}
+}
+
+//**************************************************************
+
+func GetArgs() []string {
+
+	flag.Usage = Usage
+
+	checkPtr := flag.Bool("check", false, "only report files that are not in canonical form, exiting with 1 if there are any")
+	arrowsPtr := flag.String("arrows", "", "write arrows by their \"short\" or \"long\" names from SSTconfig (default: as written)")
+
+	flag.Parse()
+	args := flag.Args()
+
+	CHECK = *checkPtr
+	ARROWS = *arrowsPtr
+
+	if ARROWS != "" && ARROWS != "short" && ARROWS != "long" {
+		fmt.Println("The -arrows option should be short or long, not",ARROWS)
+		os.Exit(-2)
+	}
+
+	if len(args) < 1 {
+		fmt.Println("Missing N4L filename(s) to format")
+		os.Exit(-2)
+	}
+
+	return args
+}
+
+//**************************************************************
+
+func Usage() {
+
+	fmt.Println("usage: n4lfmt [-check] [-arrows short|long] file.n4l ...")
+	flag.PrintDefaults()
+
+	os.Exit(2)
+}
+
+//**************************************************************
+
+func Format(filename string,src []byte) ([]byte,bool) {
+
+	file,err := n4l.Parse(filename,bytes.NewReader(src),n4l.Config{})
+
+	if err != nil {
+		fmt.Println("Unable to read",filename,err)
+		return nil,false
+	}
+
+	if !Formattable(file,src) {
+		return nil,false
+	}
+
+	out := Layout(file,src)
+
+	// Only hand back the new layout if it reads as the same graph
+
+	again,_ := n4l.Parse(filename,strings.NewReader(out),n4l.Config{})
+
+	if again.Failed() || !SameGraph(file,again) {
+		fmt.Println(filename,": the canonical layout would change the graph, so leaving it as it is")
+		return nil,false
+	}
+
+	return []byte(out),true
+}
+
+//**************************************************************
+
+func Formattable(file *n4l.File,src []byte) bool {
+
+	// Errors, and warnings where N4L drops part of a line, mean
+	// we can't know that a new layout says the same thing
+
+	var ok = true
+
+	for _,e := range file.Errors {
+
+		if e.Warning && !strings.HasPrefix(e.Msg,n4l.ERR_MISSING_EVENT) {
+			continue
+		}
+
+		fmt.Printf("%s:%d: %s\n",file.Name,e.Pos.Line,e.Msg)
+		ok = false
+	}
+
+	// N4L reads +text or -text after the chapter as an empty context
+	// change, so the text would be lost from a new layout
+
+	for _,chapter := range file.Chapters {
+		for _,b := range chapter.Blocks {
+
+			if b.Op != '+' && b.Op != '-' {
+				continue
+			}
+
+			if !bytes.HasPrefix(bytes.TrimLeft(src[b.Pos.Offset+1:]," \t"),[]byte(":")) {
+				fmt.Printf("%s:%d: %c without :: is not a context change\n",file.Name,b.Pos.Line,b.Op)
+				ok = false
+			}
+		}
+	}
+
+	if !ok {
+		fmt.Println(file.Name,": fix the notes before formatting")
+	}
+
+	return ok
+}
+
+//**************************************************************
+
+func Layout(file *n4l.File,src []byte) string {
+
+	var elements []*Element
+
+	for _,ch := range file.Chapters {
+
+		if ch.Name != "" {
+			elements = append(elements,&Element{Kind: ELEM_CHAPTER, Offset: ch.Pos.Offset, First: ch.Pos.Line, Last: ch.Pos.Line, Text: "- "+ch.Name})
+		}
+
+		var context []string
+
+		for i,b := range ch.Blocks {
+
+			if b.Op != 0 && !Redundant(ch.Blocks,i,context) {
+
+				var comment string
+
+				if b.Op != '-' {
+					comment = ContextComment(src,b.Pos.Offset)
+				}
+
+				elements = append(elements,&Element{Kind: ELEM_CONTEXT, Offset: b.Pos.Offset, First: b.Pos.Line, Last: b.Pos.Line, Text: ContextLine(b), Comment: comment})
+				context = b.Context
+			}
+
+			if b.Op == 0 {
+				context = b.Context
+			}
+
+			for _,line := range b.Lines {
+				elements = append(elements,&Element{Kind: ELEM_LINE, Offset: line.Pos.Offset, First: line.Pos.Line, Last: line.End.Line, Line: line})
+			}
+		}
+	}
+
+	for _,c := range file.Comments {
+		elements = append(elements,&Element{Kind: ELEM_COMMENT, Offset: c.Pos.Offset, First: c.Pos.Line, Last: c.Pos.Line, Text: c.Text})
+	}
+
+	sort.SliceStable(elements,func(i,j int) bool { return elements[i].Offset < elements[j].Offset })
+
+	// Comments after something on the same line stay there
+
+	var kept []*Element
+
+	for _,e := range elements {
+
+		if len(kept) > 0 && e.Kind == ELEM_COMMENT {
+			prev := kept[len(kept)-1]
+			if prev.Kind != ELEM_COMMENT && prev.Last == e.First {
+				if IsSubtraction(prev) {
+					// N4L would read it as part of the -:: and make an item, so it goes above
+					kept = append(kept[:len(kept)-1],e,prev)
+					continue
+				}
+				if prev.Comment == "" {
+					prev.Comment = e.Text
+					continue
+				}
+				if prev.Comment == e.Text {
+					continue
+				}
+			}
+		}
+
+		kept = append(kept,e)
+	}
+
+	// Split into paragraphs at blank lines, aligning the arrows in each
+
+	var out []string
+	var para []*Element
+
+	for i,e := range kept {
+
+		if i > 0 && BlankBefore(kept[i-1],e) {
+			out = append(out,Paragraph(para)...)
+			out = append(out,"")
+			para = nil
+		}
+
+		para = append(para,e)
+	}
+
+	out = append(out,Paragraph(para)...)
+
+	return strings.Join(out,"\n") + "\n"
+}
+
+//**************************************************************
+
+func BlankBefore(prev,e *Element) bool {
+
+	switch {
+
+	case e.First > prev.Last+1:
+		return true
+
+	case prev.Kind == ELEM_CHAPTER || prev.Kind == ELEM_CONTEXT:
+		return true
+
+	case e.Kind == ELEM_CONTEXT && prev.Kind != ELEM_COMMENT:
+		return true
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func IsSubtraction(e *Element) bool {
+
+	return e.Kind == ELEM_CONTEXT && strings.HasPrefix(e.Text," -::")
+}
+
+//**************************************************************
+
+func Redundant(blocks []*n4l.Block,i int,context []string) bool {
+
+	// A context change that changes nothing, or is replaced before
+	// any line uses it. Sequence mode changes always matter
+
+	b := blocks[i]
+
+	if strings.Contains(b.Expression,"_sequence_") {
+		return false
+	}
+
+	if SameStrings(b.Context,context) {
+		return true
+	}
+
+	if len(b.Lines) == 0 && i+1 < len(blocks) {
+		next := blocks[i+1]
+		return next.Op == '=' && next.Expression != ""
+	}
+
+	return false
+}
+
+//**************************************************************
+
+func ContextLine(b *n4l.Block) string {
+
+	var op string
+
+	switch b.Op {
+	case '+':
+		op = "+"
+	case '-':
+		op = "-"
+	}
+
+	expr := NormalizeExpression(b.Expression)
+
+	if expr == "" {
+		return " " + op + ":: ::"
+	}
+
+	return " " + op + ":: " + expr + " ::"
+}
+
+//**************************************************************
+
+func ContextComment(src []byte,offset int) string {
+
+	// N4L reads a comment after a context change as part of it,
+	// so look for it in the source
+
+	line := string(src[offset:])
+
+	if nl := strings.IndexByte(line,'\n'); nl >= 0 {
+		line = line[:nl]
+	}
+
+	if i := strings.LastIndex(line,"::"); i >= 0 {
+		line = strings.TrimSpace(line[i+2:])
+	}
+
+	if strings.HasPrefix(line,"#") || strings.HasPrefix(line,"//") {
+		return line
+	}
+
+	return ""
+}
+
+//**************************************************************
+
+func NormalizeExpression(expr string) string {
+
+	// Sorted, without repeats, the way N4L stores contexts
+
+	if strings.Contains(expr,"(") {
+		return strings.TrimSpace(expr)
+	}
+
+	var list []string
+	var sequence bool
+
+	for _,part := range n4l.SplitWithParensIntact(n4l.CleanExpression(expr),'|') {
+
+		part = strings.TrimSpace(part)
+
+		if part == "_sequence_" {
+			sequence = true
+		}
+
+		if part != "" {
+			list = append(list,part)
+		}
+	}
+
+	var parts []string
+
+	if sequence {
+		parts = append(parts,"_sequence_")
+	}
+
+	if norm := SST.NormalizeContextString(nil,list); norm != "" {
+		parts = append(parts,strings.Split(norm,",")...)
+	}
+
+	return strings.Join(parts,", ")
+}
+
+//**************************************************************
+
+func Paragraph(para []*Element) []string {
+
+	var aliasw,subjw int
+
+	for _,e := range para {
+
+		if e.Kind != ELEM_LINE {
+			continue
+		}
+
+		if e.Line.Alias != "" {
+			aliasw = max(aliasw,Width("@"+e.Line.Alias))
+		}
+
+		first,rest := Tokens(e.Line)
+
+		if len(rest) > 0 && !strings.Contains(first,"\n") {
+			subjw = max(subjw,Width(first))
+		}
+	}
+
+	var out []string
+
+	for _,e := range para {
+
+		text := e.Text
+
+		if e.Kind == ELEM_LINE {
+
+			var prefix string
+
+			if aliasw > 0 {
+				prefix = Pad("@"+e.Line.Alias,aliasw+1)
+				if e.Line.Alias == "" {
+					prefix = strings.Repeat(" ",aliasw+1)
+				}
+			}
+
+			first,rest := Tokens(e.Line)
+
+			switch {
+			case len(rest) == 0:
+				text = prefix + first
+			case strings.Contains(first,"\n"):
+				text = prefix + first + " " + strings.Join(rest," ")
+			default:
+				text = prefix + Pad(first,subjw) + " " + strings.Join(rest," ")
+			}
+		}
+
+		if e.Comment != "" {
+			text += "   " + e.Comment
+		}
+
+		out = append(out,text)
+	}
+
+	return out
+}
+
+//**************************************************************
+
+func Tokens(line *n4l.Line) (string,[]string) {
+
+	// The items and written relations of a line, in their order
+
+	type token struct {
+		offset int
+		text   string
+	}
+
+	var tokens []token
+
+	for _,item := range line.Items {
+		tokens = append(tokens,token{item.Pos.Offset,ItemText(item)})
+	}
+
+	for _,l := range line.Links {
+		if !l.Sequence {
+			tokens = append(tokens,token{l.Pos.Offset,RelationText(l)})
+		}
+	}
+
+	sort.Slice(tokens,func(i,j int) bool { return tokens[i].offset < tokens[j].offset })
+
+	var rest []string
+
+	for _,t := range tokens[1:] {
+		rest = append(rest,t.text)
+	}
+
+	return tokens[0].text,rest
+}
+
+//**************************************************************
+
+func ItemText(item *n4l.Item) string {
+
+	switch {
+	case item.Ref != "":
+		return item.Ref
+	case item.Quote != 0:
+		return string(item.Quote) + item.Raw + string(item.Quote)
+	}
+
+	return item.Raw
+}
+
+//**************************************************************
+
+func RelationText(l *n4l.Link) string {
+
+	parts := []string{ArrowName(l.Arrow)}
+
+	if l.Weight != 1 {
+		parts = append(parts,strconv.FormatFloat(float64(l.Weight),'g',-1,32))
+	}
+
+	parts = append(parts,l.Context...)
+
+	return "(" + strings.Join(parts,", ") + ")"
+}
+
+//**************************************************************
+
+func ArrowName(name string) string {
+
+	ptr,ok := LookupArrow(name)
+
+	if !ok {
+		return name
+	}
+
+	preferred := name
+
+	switch ARROWS {
+	case "short":
+		preferred = SST.ARROW_DIRECTORY[ptr].Short
+	case "long":
+		preferred = SST.ARROW_DIRECTORY[ptr].Long
+	}
+
+	// The other name has to find the same arrow, and fit in brackets
+
+	if p,ok := LookupArrow(preferred); !ok || p != ptr || strings.ContainsAny(preferred,",()") {
+		return name
+	}
+
+	return preferred
+}
+
+//**************************************************************
+
+func LookupArrow(name string) (SST.ArrowPtr,bool) {
+
+	// Short names first, as N4L looks them up
+
+	if ptr,ok := SST.ARROW_SHORT_DIR[name]; ok {
+		return ptr,true
+	}
+
+	ptr,ok := SST.ARROW_LONG_DIR[name]
+	return ptr,ok
+}
+
+//**************************************************************
+
+func SameGraph(a,b *n4l.File) bool {
+
+	return SameStrings(Graph(a),Graph(b))
+}
+
+//**************************************************************
+
+func Graph(file *n4l.File) []string {
+
+	// Every node and link, as N4L would upload them
+
+	var set = make(map[string]bool)
+
+	for _,ch := range file.Chapters {
+		for _,b := range ch.Blocks {
+			for _,line := range b.Lines {
+
+				for _,item := range line.Items {
+					set[fmt.Sprintf("node %q %q",ch.Name,item.Text)] = true
+				}
+
+				for _,l := range line.Links {
+
+					context := append(append([]string{},b.Context...),l.Context...)
+					sort.Strings(context)
+
+					arrow := l.Arrow
+
+					if ptr,ok := LookupArrow(arrow); ok {
+						arrow = SST.ARROW_DIRECTORY[ptr].Short
+					}
+
+					set[fmt.Sprintf("link %q %q %q %q %g %q %v %v",ch.Name,l.From.Text,arrow,l.To.Text,l.Weight,context,l.Sequence,l.Start)] = true
+				}
+			}
+		}
+	}
+
+	var graph []string
+
+	for s := range set {
+		graph = append(graph,s)
+	}
+
+	sort.Strings(graph)
+	return graph
+}
+
+//**************************************************************
+
+func SameStrings(a,b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//**************************************************************
+
+func Width(s string) int {
+
+	// Columns on a terminal, where CJK characters take two
+
+	var w int
+
+	for _,r := range s {
+		if unicode.In(r,unicode.Han,unicode.Hangul,unicode.Hiragana,unicode.Katakana) || (r >= 0xff01 && r <= 0xff60) {
+			w += 2
+		} else {
+			w++
+		}
+	}
+
+	return w
+}
+
+//**************************************************************
+
+func Pad(s string,width int) string {
+
+	if n := width - Width(s); n > 0 {
+		return s + strings.Repeat(" ",n)
+	}
+
+	return s
+}
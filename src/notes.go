@@ -9,14 +9,17 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"flag"
 	"os"
+	"strings"
 
         SST "SSTorytime"
 )
 
 var PAGENR int = 1
+var REVIEW bool
 
 //******************************************************************
 
@@ -36,6 +39,12 @@ func main() {
 		}
 	}
 
+	if REVIEW {
+		Review(sst,chapter)
+		SST.Close(sst)
+		return
+	}
+
 	context := []string{""}
 
 	Page(sst,chapter,context,PAGENR)
@@ -48,7 +57,7 @@ func main() {
 
 func Usage() {
 	
-	fmt.Printf("usage: Notes [chapter or section]\n")
+	fmt.Printf("usage: Notes [-page n] [-review] [chapter or section]\n")
 	flag.PrintDefaults()
 
 	os.Exit(2)
@@ -59,6 +68,7 @@ func Usage() {
 func Init() []string {
 
 	pagePtr := flag.Int("page", 1, "page number for browsing")
+	reviewPtr := flag.Bool("review", false, "quiz the notes that are due for review")
 
 	flag.Usage = Usage
 
@@ -66,8 +76,9 @@ func Init() []string {
 	args := flag.Args()
 
 	PAGENR = *pagePtr
+	REVIEW = *reviewPtr
 
-	if len(args) == 0 {
+	if len(args) == 0 && !REVIEW {
 		fmt.Println("\nEnter a chapter to browse")
 		os.Exit(-1)
 	}
@@ -88,7 +99,7 @@ func Page(sst SST.PoSST,chapter string,context []string,page int) {
 
 	for n := 0; n < len(notes); n++ {
 
-		txtctx := SST.CONTEXT_DIRECTORY[notes[n].Context].Context
+		txtctx := SST.GetContext(notes[n].Context)
 	
 		if last != notes[n].Chapter || lastc != txtctx {
 			fmt.Println("\n---------------------------------------------")
@@ -113,10 +124,65 @@ func Page(sst SST.PoSST,chapter string,context []string,page int) {
 	}
 }
 
+//******************************************************************
+
+func Review(sst SST.PoSST,chapter string) {
+
+	// Show each due node, wait for the reader to recall what it
+	// links to, then reveal its orbit and ask how it went
+
+	const limit = 20
+
+	due := SST.GetDueReviews(sst,chapter,limit)
+
+	if len(due) == 0 {
+		fmt.Println("\nNothing is due for review",chapter)
+		fmt.Println("(notes you have looked at in the browser or with searchN4L become due over time)")
+		return
+	}
+
+	fmt.Printf("\n%d notes are due for review\n\n",len(due))
 
+	input := bufio.NewReader(os.Stdin)
 
+	for n := range due {
 
+		node := SST.GetDBNodeByNodePtr(sst,due[n].NPtr)
 
+		fmt.Println("---------------------------------------------")
+		fmt.Printf("%d/%d  (in chapter: %s)\n\n",n+1,len(due),node.Chap)
+		fmt.Print("\"")
+		SST.ShowText(node.S,SST.SCREENWIDTH)
+		fmt.Print("\"\n\nWhat do you recall about this? (press return to reveal)")
 
+		if _,err := input.ReadString('\n'); err != nil {
+			return
+		}
+
+		orbit := SST.GetNodeOrbit(sst,due[n].NPtr,"",limit)
+
+		fmt.Println()
+		SST.PrintLinkOrbit(orbit,SST.EXPRESS,0)
+		SST.PrintLinkOrbit(orbit,-SST.EXPRESS,0)
+		SST.PrintLinkOrbit(orbit,-SST.CONTAINS,0)
+		SST.PrintLinkOrbit(orbit,SST.LEADSTO,0)
+		SST.PrintLinkOrbit(orbit,-SST.LEADSTO,0)
+		SST.PrintLinkOrbit(orbit,SST.NEAR,0)
+
+		for {
+			fmt.Print("\nHow did you do? (p)ass, (f)ail, (h)ard, (e)asy, 0-5, or (q)uit: ")
+
+			answer,err := input.ReadString('\n')
 
+			if err != nil || strings.TrimSpace(answer) == "q" {
+				return
+			}
 
+			if grade,ok := SST.ParseReviewGrade(answer); ok {
+				card := SST.RecordReview(sst,due[n].NPtr,grade)
+				fmt.Printf("Next review in %.0f day(s)\n\n",card.Days)
+				break
+			}
+		}
+	}
+}
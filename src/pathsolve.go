@@ -149,14 +149,11 @@ func PathSolve(sst SST.PoSST, chapter,cntext,begin, end string) {
 
 	// Find the path matrix
 
-	var betweenness = make(map[string]int)
-
 	if len(solutions) > 0 {
 		
 		for s := 0; s < len(solutions); s++ {
 			prefix := fmt.Sprintf(" - story path: ")
 			SST.PrintLinkPath(sst,solutions,s,prefix,"",nil)
-			betweenness = TallyPath(sst,solutions[s],betweenness)
 		}
 		count++
 	}
@@ -182,6 +179,9 @@ func PathSolve(sst SST.PoSST, chapter,cntext,begin, end string) {
 
 	fmt.Println("\n *\n *\n * FLOW IMPORTANCE:\n *\n *\n")
 
+	// No \weight option here, so every path counts the same, as in the
+	// web server when no \weight is given
+
 	betw := SST.BetweenNessCentrality(sst,solutions)
 
 	for b := range betw {
@@ -193,20 +193,6 @@ func PathSolve(sst SST.PoSST, chapter,cntext,begin, end string) {
 
 // **********************************************************
 
-func TallyPath(sst SST.PoSST,path []SST.Link,between map[string]int) map[string]int {
-
-	// count how often each node appears in the different path solutions
-
-	for leg := range path {
-		n := SST.GetDBNodeByNodePtr(sst,path[leg].Dst)
-		between[n.S]++
-	}
-
-	return between
-}
-
-// **********************************************************
-
 func ShowNode(sst SST.PoSST,nptr []SST.NodePtr) string {
 
 	var ret string
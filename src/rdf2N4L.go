@@ -0,0 +1,156 @@
+//
+// Convert an RDF graph (Turtle or N-Triples) into SST, either as
+// N4L notes to edit and compile, or straight into the database.
+// See docs/rdf.md
+//
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"path/filepath"
+	"strings"
+        SST "SSTorytime"
+)
+
+var UPLOAD bool
+var CHAPTER string
+
+//**************************************************************
+// BEGIN
+//**************************************************************
+
+func main() {
+
+	input := GetArgs()
+
+	text,err := os.ReadFile(input)
+
+	if err != nil {
+		fmt.Println("Unable to read RDF file",input,err)
+		os.Exit(-1)
+	}
+
+	triples,err := SST.ParseTurtle(string(text))
+
+	if err != nil {
+		fmt.Println("Error in",input,err)
+		os.Exit(-1)
+	}
+
+	if CHAPTER == "" {
+		CHAPTER = strings.TrimSuffix(filepath.Base(input),filepath.Ext(input))
+	}
+
+	// Existing arrows are reused by name: for N4L notes those in
+	// SSTconfig, which N4L will read, for an upload those in the database
+
+	if !UPLOAD {
+		SST.MemoryInit()
+		SST.ReadArrowConfig()
+
+		imp := SST.ImportRDF(triples)
+
+		fmt.Println("Read",len(triples),"triples, giving",len(imp.Links),"links")
+		ShowArrows(imp)
+		WriteOutput(input,imp)
+		return
+	}
+
+	load_arrows := true
+	sst := SST.Open(load_arrows)
+
+	SST.DownloadArrowsFromDB(sst)
+
+	imp := SST.ImportRDF(triples)
+
+	fmt.Println("Read",len(triples),"triples, giving",len(imp.Links),"links")
+	ShowArrows(imp)
+
+	count := SST.UploadImport(sst,imp,CHAPTER)
+	fmt.Println("Uploaded",count,"links to chapter",CHAPTER)
+
+	SST.Close(sst)
+}
+
+//**************************************************************
+
+func GetArgs() string {
+
+	flag.Usage = Usage
+
+	uploadPtr := flag.Bool("u", false, "upload directly to the database instead of writing N4L")
+	chapterPtr := flag.String("chapter", "", "chapter name for the imported nodes (default: the file name)")
+
+	flag.Parse()
+	args := flag.Args()
+
+	UPLOAD = *uploadPtr
+	CHAPTER = *chapterPtr
+
+	if len(args) != 1 {
+		fmt.Println("Missing Turtle or N-Triples filename to convert")
+		os.Exit(-2)
+	} 
+
+	return args[0]
+}
+
+//**************************************************************
+
+func Usage() {
+	
+	fmt.Println("usage: rdf2N4L [-u] [-chapter name] filename.ttl")
+	flag.PrintDefaults()
+
+	os.Exit(2)
+}
+
+//**************************************************************
+
+func ShowArrows(imp SST.GraphImport) {
+
+	for _,a := range imp.Arrows {
+
+		state := "new"
+
+		if a.Exists {
+			state = "defined"
+		}
+
+		fmt.Printf(" %-7s %-12s + %s (%s)  - %s (%s)\n",state,SST.STTypeSection(a.STType),a.Long,a.Short,a.InvLong,a.InvShort)
+	}
+}
+
+//*******************************************************************
+
+func WriteOutput(filename string,imp SST.GraphImport) {
+
+	notes,config := SST.ImportToN4L(imp,CHAPTER)
+
+	base := strings.TrimSuffix(filename,filepath.Ext(filename))
+
+	outputfile := base + "_edit_me.n4l"
+
+	if err := os.WriteFile(outputfile,[]byte(notes),0644); err != nil {
+		fmt.Println("Failed to open file for writing: ",outputfile)
+		os.Exit(-1)
+	}
+
+	fmt.Println("Wrote",outputfile)
+
+	if config == "" {
+		return
+	}
+
+	configfile := base + "_arrows.sst"
+
+	if err := os.WriteFile(configfile,[]byte(config),0644); err != nil {
+		fmt.Println("Failed to open file for writing: ",configfile)
+		os.Exit(-1)
+	}
+
+	fmt.Println("Wrote",configfile,"- add each section to the matching SSTconfig/arrows-*.sst file before running N4L")
+}
@@ -83,26 +83,10 @@ func Usage() {
 
 func DeleteChapter(sst SST.PoSST,chapter string) {
 
-	escaped := SST.SQLEscape(chapter) 
-	qstr := fmt.Sprintf("select DeleteChapter('%s')",escaped)
-
-	row,err := sst.DB.Query(qstr)
-	
-	if err != nil {
-		fmt.Println("Error running deletechapter function:",qstr,err)
-	} else {
+	if SST.DeleteChapter(sst,chapter) {
 		fmt.Println("Deleted",chapter)
+	} else {
+		fmt.Println("No chapter",chapter,"to delete")
 	}
-
-	row.Close()
-
 }
 
-
-
-
-
-
-
-
-
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"flag"
 	"strings"
+	"time"
 
         SST "SSTorytime"
 )
@@ -19,6 +20,7 @@ import (
 //******************************************************************
 
 var VERBOSE bool = false
+var FORMAT string
 
 var TESTS = []string{ 
 	"range rover out of its depth",
@@ -77,15 +79,24 @@ func main() {
 
 	search_string := ""
 
+	raw := false
+
 	for a := 0; a < len(args); a++ {
-		if strings.Contains(args[a]," ") {
+
+		// A \query expression keeps its own quotes and parentheses
+
+		if strings.HasPrefix(args[a],"\\") {
+			raw = strings.HasPrefix(args[a],SST.CMD_QUERY)
+		}
+
+		if strings.Contains(args[a]," ") && !strings.Contains(args[a],"\"") && !raw {
 			search_string += fmt.Sprintf("\"%s\"",args[a]) + " "
 		} else {
 			search_string += args[a] + " "
 		}
 	}
 
-	if len(search_string) == 0 || search_string == "\\remind" {
+	if len(search_string) == 0 {
 		ambient,key,_ := SST.GetTimeContext()
 		search_string = "any \\chapter reminders \\context " + key + " " + ambient
 	}
@@ -137,6 +148,7 @@ func Usage() {
 	fmt.Println("searchN4L a1 to b6 arrows then")
 	fmt.Println("searchN4L paths a2 to b5 distance 10")
 	fmt.Println("searchN4L <b5|a2> distance 10")
+	fmt.Println("searchN4L from a1 to b6 weight \">0.5\"")
 
 	flag.PrintDefaults()
 
@@ -149,12 +161,15 @@ func GetArgs() []string {
 
 	flag.Usage = Usage
 	verbosePtr := flag.Bool("v", false,"verbose")
+	formatPtr := flag.String("format", "","export a chapter, cone or path solution as graphml, gexf or dot instead of text")
 	flag.Parse()
 
 	if *verbosePtr {
 		VERBOSE = true
 	}
 
+	FORMAT = *formatPtr
+
 	return flag.Args()
 }
 
@@ -164,7 +179,7 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 
 	// OPTIONS *********************************************
 
-	name := search.Name != nil
+	name := search.Name != nil || search.Query != ""
 	from := search.From != nil
 	to := search.To != nil
 	context := search.Context != nil
@@ -180,10 +195,12 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 	sttypes := sttype != nil
 
 	minlimit,maxlimit := SST.MinMaxPolicy(search)
+	minwgt,maxwgt := SST.WeightPolicy(search)
 
 	if VERBOSE {
 		fmt.Println("Your starting expression generated this set: ",line,"\n")
 		fmt.Println(" -         start set:",SL(search.Name))
+		fmt.Println(" -             query:",search.Query)
 		fmt.Println(" -           finding:",SL(search.Finds))
 		fmt.Println(" -              from:",SL(search.From))
 		fmt.Println(" -                to:",SL(search.To))
@@ -194,6 +211,9 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 		fmt.Println(" -    sequence/story:",search.Sequence)
 		fmt.Println(" - limit/range/depth:",maxlimit)
 		fmt.Println(" -  at least/minimum:",minlimit)
+		if search.Weighted {
+			fmt.Println(" -      link weights:",minwgt,"to",maxwgt)
+		}
 		fmt.Println()
 	}
 
@@ -207,8 +227,39 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 
 	nodeptrs = SST.SolveNodePtrs(sst,search.Name,search,arrowptrs,maxlimit)
 
+	// Most situationally relevant first, before any \query ranking
+
+	nodeptrs,ranks := SST.RankByContext(sst,nodeptrs)
+
+	if VERBOSE {
+		for _,nptr := range nodeptrs {
+			fmt.Printf(" - context rank of %v: %s\n",nptr,ranks[nptr].Why)
+		}
+	}
+
+	if search.Query != "" {
+		ranked,ranks := SST.SolveQueryNodePtrs(sst,search,arrowptrs,maxlimit)
+		nodeptrs = SST.MergeNodePtrs(ranked,nodeptrs)
+
+		if VERBOSE {
+			for r := range ranked {
+				fmt.Printf(" - relevance of %v: %.4f\n",ranked[r],ranks[r])
+			}
+		}
+	}
+
 	// SEARCH SELECTION *********************************************
 
+	if search.Remind {
+		ShowAgenda(sst,search)
+		return
+	}
+
+	if FORMAT != "" {
+		ExportSearch(sst,search,nodeptrs,leftptrs,rightptrs,arrowptrs,sttype)
+		return
+	}
+
 	fmt.Println()
 	fmt.Println("------------------------------------------------------------------")
 	fmt.Println(" Limiting to maximum of",maxlimit,"results")
@@ -227,7 +278,7 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 	if name && ! sequence && !pagenr {
 
 		fmt.Println("------------------------------------------------------------------")
-		FindOrbits(sst, nodeptrs, maxlimit)
+		FindOrbits(sst, nodeptrs, ranks, maxlimit)
 		ShowTime(sst,search)
 		return
 	}
@@ -243,7 +294,7 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 	if from && to {
 
 		fmt.Println("------------------------------------------------------------------")
-		PathSolve(sst,leftptrs,rightptrs,search.Chapter,search.Context,arrowptrs,sttype,minlimit,maxlimit)
+		PathSolve(sst,leftptrs,rightptrs,search.Chapter,search.Context,arrowptrs,sttype,minlimit,maxlimit,minwgt,maxwgt)
 		ShowTime(sst,search)
 		return
 	}
@@ -256,19 +307,19 @@ func Search(sst SST.PoSST, search SST.SearchParameters,line string) {
 		
 		if nodeptrs != nil {
 			fmt.Println("------------------------------------------------------------------")
-			CausalCones(sst,nodeptrs,search.Chapter,search.Context,arrowptrs,sttype,maxlimit)
+			CausalCones(sst,nodeptrs,search.Chapter,search.Context,arrowptrs,sttype,maxlimit,minwgt,maxwgt)
 			ShowTime(sst,search)
 			return
 		}
 		if leftptrs != nil {
 			fmt.Println("------------------------------------------------------------------")
-			CausalCones(sst,leftptrs,search.Chapter,search.Context,arrowptrs,sttype,maxlimit)
+			CausalCones(sst,leftptrs,search.Chapter,search.Context,arrowptrs,sttype,maxlimit,minwgt,maxwgt)
 			ShowTime(sst,search)
 			return
 		}
 		if rightptrs != nil {
 			fmt.Println("------------------------------------------------------------------")
-			CausalCones(sst,rightptrs,search.Chapter,search.Context,arrowptrs,sttype,maxlimit)
+			CausalCones(sst,rightptrs,search.Chapter,search.Context,arrowptrs,sttype,maxlimit,minwgt,maxwgt)
 			ShowTime(sst,search)
 			return
 		}
@@ -344,7 +395,7 @@ func SL(list []string) string {
 // SEARCH
 //******************************************************************
 
-func FindOrbits(sst SST.PoSST, nptrs []SST.NodePtr, limit int) {
+func FindOrbits(sst SST.PoSST, nptrs []SST.NodePtr, ranks map[SST.NodePtr]SST.ContextRank, limit int) {
 	
 	var count int
 
@@ -359,12 +410,16 @@ func FindOrbits(sst SST.PoSST, nptrs []SST.NodePtr, limit int) {
 		}
 		fmt.Print("\n",nptr,": ")
 		SST.PrintNodeOrbit(sst,nptrs[nptr],limit)
+
+		if rank,ok := ranks[nptrs[nptr]]; ok && rank.Score > 0 {
+			fmt.Println("     (ranked by context,",rank.Why+")")
+		}
 	}
 }
 
 //******************************************************************
 
-func CausalCones(sst SST.PoSST,nptrs []SST.NodePtr, chap string, context []string,arrows []SST.ArrowPtr, sttype []int,limit int) {
+func CausalCones(sst SST.PoSST,nptrs []SST.NodePtr, chap string, context []string,arrows []SST.ArrowPtr, sttype []int,limit int,minwgt,maxwgt float32) {
 
 	var total int = 1
 
@@ -381,6 +436,8 @@ func CausalCones(sst SST.PoSST,nptrs []SST.NodePtr, chap string, context []strin
 
 			const maxlimit = SST.CAUSAL_CONE_MAXLIMIT
 			fcone,_ := SST.GetFwdPathsAsLinks(sst,nptrs[n],sttype[st],limit, maxlimit)
+			fcone = SST.PruneConeByWeight(fcone,minwgt,maxwgt)
+			fcone = SST.PruneConeByArrows(fcone,arrows)
 
 			if fcone != nil {
 				fmt.Printf("%d. ",total)
@@ -393,6 +450,8 @@ func CausalCones(sst SST.PoSST,nptrs []SST.NodePtr, chap string, context []strin
 
 			if sttype[st] != 0 {
 				bcone,_ := SST.GetFwdPathsAsLinks(sst,nptrs[n],-sttype[st],limit, maxlimit)
+				bcone = SST.PruneConeByWeight(bcone,minwgt,maxwgt)
+				bcone = SST.PruneConeByArrows(bcone,arrows)
 				
 				if bcone != nil {
 					fmt.Printf("%d. ",total)
@@ -410,7 +469,7 @@ func CausalCones(sst SST.PoSST,nptrs []SST.NodePtr, chap string, context []strin
 
 //******************************************************************
 
-func PathSolve(sst SST.PoSST,leftptrs,rightptrs []SST.NodePtr,chapter string,context []string,arrowptrs []SST.ArrowPtr,sttype []int,mindepth,maxdepth int) {
+func PathSolve(sst SST.PoSST,leftptrs,rightptrs []SST.NodePtr,chapter string,context []string,arrowptrs []SST.ArrowPtr,sttype []int,mindepth,maxdepth int,minwgt,maxwgt float32) {
 	var count int
 
 	if leftptrs == nil || rightptrs == nil {
@@ -423,12 +482,14 @@ func PathSolve(sst SST.PoSST,leftptrs,rightptrs []SST.NodePtr,chapter string,con
 		fmt.Println("Solver/handler: PathSolve()")
 	}
 
-	solutions := SST.GetPathsAndSymmetries(sst,leftptrs,rightptrs,chapter,context,arrowptrs,sttype,mindepth,maxdepth)
+	// Ranked by accumulated link weight, lightest first
+
+	solutions := SST.GetWeightedPaths(sst,leftptrs,rightptrs,chapter,context,arrowptrs,sttype,mindepth,maxdepth,minwgt,maxwgt)
 
 	if len(solutions) > 0 {
 		
 		for s := 0; s < len(solutions); s++ {
-			prefix := fmt.Sprintf(" - story path: ")
+			prefix := fmt.Sprintf(" - story path (weight %.2f): ",SST.PathWeight(solutions[s]))
 			PrintConstrainedLinkPath(sst,solutions,s,prefix,chapter,context,arrowptrs,sttype)
 		}
 		count++
@@ -437,6 +498,34 @@ func PathSolve(sst SST.PoSST,leftptrs,rightptrs []SST.NodePtr,chapter string,con
 
 //******************************************************************
 
+func ExportSearch(sst SST.PoSST,search SST.SearchParameters,nodeptrs,leftptrs,rightptrs []SST.NodePtr,arrowptrs []SST.ArrowPtr,sttype []int) {
+
+	// The solvers report progress on stdout, so keep that out of the graph
+
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	graph,ok := SST.ExportSearchGraph(sst,search,nodeptrs,leftptrs,rightptrs,arrowptrs,sttype)
+
+	os.Stdout = stdout
+
+	if !ok {
+		fmt.Println("Only chapters, cones and paths can be exported as",FORMAT)
+		os.Exit(-1)
+	}
+
+	out,err := SST.FormatGraph(graph,FORMAT)
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	fmt.Print(out)
+}
+
+//******************************************************************
+
 func ShowMatchingArrows(sst SST.PoSST,arrowptrs []SST.ArrowPtr,sttype []int) {
 
 	if VERBOSE {
@@ -444,15 +533,22 @@ func ShowMatchingArrows(sst SST.PoSST,arrowptrs []SST.ArrowPtr,sttype []int) {
 	}
 
 	for a := range arrowptrs {
+
+		if arrowptrs[a] < 0 {
+			adir := SST.GetDBArrowByPtr(sst,-arrowptrs[a])
+			fmt.Printf("%3d. (st %d) %s -> %s,  excluded\n",-arrowptrs[a],SST.STIndexToSTType(adir.STAindex),adir.Short,adir.Long)
+			continue
+		}
+
 		adir := SST.GetDBArrowByPtr(sst,arrowptrs[a])
-		inv := SST.GetDBArrowByPtr(sst,SST.INVERSE_ARROWS[arrowptrs[a]])
+		inv := SST.GetDBArrowByPtr(sst,SST.InverseArrow(arrowptrs[a]))
 		fmt.Printf("%3d. (st %d) %s -> %s,  with inverse = %3d. (st %d) %s -> %s\n",arrowptrs[a],SST.STIndexToSTType(adir.STAindex),adir.Short,adir.Long,inv.Ptr,SST.STIndexToSTType(inv.STAindex),inv.Short,inv.Long)
 	}
 
 	for st := range sttype {
 		adirs := SST.GetDBArrowBySTType(sst,sttype[st])
 		for adir := range adirs {
-			inv := SST.GetDBArrowByPtr(sst,SST.INVERSE_ARROWS[adirs[adir].Ptr])
+			inv := SST.GetDBArrowByPtr(sst,SST.InverseArrow(adirs[adir].Ptr))
 			fmt.Printf("%3d. (st %d) %s -> %s,  with inverse = %3d. (st %d) %s -> %s\n",adirs[adir].Ptr,SST.STIndexToSTType(adirs[adir].STAindex),adirs[adir].Short,adirs[adir].Long,inv.Ptr,SST.STIndexToSTType(inv.STAindex),inv.Short,inv.Long)
 		}
 	}
@@ -661,11 +757,11 @@ func ArrowAllowed(sst SST.PoSST,arr SST.ArrowPtr, arrlist []SST.ArrowPtr, stlist
 
 	if arrlist != nil {
 		for a := range arrlist {
-			if arr == arrlist[a] {
-				arr_ok = true
-				break
+			if arrlist[a] == -arr {
+				return false // explicitly excluded
 			}
 		}
+		arr_ok = SST.MatchArrows(arrlist,arr)
 	} else {
 		arr_ok = true
 	}
@@ -697,7 +793,7 @@ func ShowNotes(sst SST.PoSST,notes []SST.PageMap) {
 
 	for n := 0; n < len(notes); n++ {
 
-		txtctx := SST.CONTEXT_DIRECTORY[notes[n].Context].Context
+		txtctx := SST.GetContext(notes[n].Context)
 		
 		if last != notes[n].Chapter || lastc != txtctx {
 
@@ -727,6 +823,73 @@ func ShowNotes(sst SST.PoSST,notes []SST.PageMap) {
 
 // **********************************************************
 
+func ShowAgenda(sst SST.PoSST,search SST.SearchParameters) {
+
+	// Upcoming notes from the reminders chapter, or as a calendar
+
+	now := time.Now()
+
+	if FORMAT != "" {
+
+		if strings.ToLower(FORMAT) != SST.EXPORT_ICS {
+			fmt.Println("Reminders can only be exported as",SST.EXPORT_ICS)
+			os.Exit(-1)
+		}
+
+		events := SST.GetDBCalendarEvents(sst,SST.RemindChapter(search),search.Context)
+		fmt.Print(SST.ICalendar(events,now))
+		return
+	}
+
+	agenda := SST.GetDBAgenda(sst,search,now)
+
+	horizon := search.Horizon
+
+	if horizon <= 0 {
+		horizon = SST.REMIND_HORIZON
+	}
+
+	fmt.Println("------------------------------------------------------------------")
+	fmt.Printf(" Reminders in \"%s\" for the next %d hours\n",SST.RemindChapter(search),horizon)
+	fmt.Println("------------------------------------------------------------------")
+
+	var day string
+
+	for _,item := range agenda {
+
+		heading := "Now"
+
+		if item.Start.After(now) {
+			heading = item.Start.Format("Monday 2 January 2006")
+		}
+
+		if heading != day {
+			fmt.Println("\n",heading,"\n")
+			day = heading
+		}
+
+		when := "all day"
+
+		if !item.AllDay {
+			when = item.Start.Format("15:04") + "-" + item.End.Format("15:04")
+		}
+
+		if item.Start.Before(now) && item.AllDay {
+			when = "until " + item.End.AddDate(0,0,-1).Format("2 Jan")
+		}
+
+		fmt.Printf("   %-12s  %s  (%s)\n",when,item.Text,item.Recurs)
+	}
+
+	if agenda == nil {
+		fmt.Println("\n Nothing due")
+	}
+
+	fmt.Println()
+}
+
+// **********************************************************
+
 func ShowTime(sst SST.PoSST,search SST.SearchParameters) {
 
 	ambient,key,now := SST.GetTimeContext()
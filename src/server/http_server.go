@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"bufio"
 	"sort"
 	"strings"
 	"syscall"
@@ -37,6 +38,23 @@ var content embed.FS
 
 var PSST SST.PoSST // just one persistent connection
 var VERBOSE bool
+var TOKENS map[string]string // token -> user, when -users is given
+
+// *********************************************************************
+
+type ReviewItem struct {
+	SST.ReviewCard
+	Text string
+}
+
+// *********************************************************************
+
+type STMReport struct {
+	User    string
+	Session string
+	Forget  int64 // seconds
+	Entries []SST.STMEntry
+}
 
 // *********************************************************************
 // Main
@@ -56,6 +74,8 @@ func Init() string {
 
 	verbosePtr := flag.Bool("v", false,"verbose")
 	resourcePtr := flag.String("resources", "/mnt", "Root directory for serving /Resources/ files")
+	usersPtr := flag.String("users", "", "file of \"user token\" lines, to require a token from each user")
+	forgetPtr := flag.Duration("forget", 0, "forget search context after this long, e.g. 90m (default $"+SST.STM_FORGET_ENV+" or 3h)")
 
 	flag.Parse()
 
@@ -63,6 +83,14 @@ func Init() string {
 		VERBOSE = true
 	}
 
+	if *forgetPtr > 0 {
+		SST.SetSTMForgetting(*forgetPtr)
+	}
+
+	if *usersPtr != "" {
+		TOKENS = ReadUserTokens(*usersPtr)
+	}
+
 	return *resourcePtr
 }
 
@@ -70,7 +98,7 @@ func Init() string {
 
 func Usage() {
 	
-	fmt.Printf("usage: http_server [-resources string]\n")
+	fmt.Printf("usage: http_server [-resources string] [-users file] [-forget duration]\n")
 	flag.PrintDefaults()
 	os.Exit(1)
 }
@@ -109,6 +137,9 @@ func Start(resources string) {
 
 	// Handle web requests from Javascript main.js
 	mux.HandleFunc("/searchN4L", SearchN4LHandler)
+	mux.HandleFunc("/overlay", OverlayHandler)
+	mux.HandleFunc("/review", ReviewHandler)
+	mux.HandleFunc("/stm", STMHandler)
 
 	// 3. Create an http.Server instance for graceful shutdown.
 
@@ -142,6 +173,10 @@ func Start(resources string) {
 		log.Fatalf("Server shutdown failed: %s\n", err)
 	}
 
+	// Writes out the embedded store, with the users' progress and context
+
+	SST.Close(PSST)
+
 	log.Println("Server exited properly")
 }
 
@@ -161,7 +196,7 @@ func EnableCORS(next http.Handler) http.Handler {
 
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-SST-User, X-SST-Token, X-SST-Session")
 
 		// Browsers send a pre-flight OPTIONS request for CORS. We need to handle it.
 		if r.Method == "OPTIONS" {
@@ -174,12 +209,123 @@ func EnableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// *********************************************************************
+// Users
+// *********************************************************************
+
+func ReadUserTokens(filename string) map[string]string {
+
+	// Lines of "user token", # for comments
+
+	file, err := os.Open(filename)
+
+	if err != nil {
+		log.Fatal("unable to read users file: ", err)
+	}
+
+	defer file.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 || !SST.ValidUserName(fields[0]) {
+			log.Fatal("bad line in users file (expecting \"user token\"): ", line)
+		}
+
+		tokens[fields[1]] = fields[0]
+	}
+
+	fmt.Println(" *  Requiring tokens for", len(tokens), "users")
+	return tokens
+}
+
+// *********************************************************************
+
+func Identify(r *http.Request) (string, bool) {
+
+	// With a users file, the user is whoever owns the token.
+	// Otherwise trust the header, as on a private network
+
+	if TOKENS != nil {
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if token == "" {
+			token = r.Header.Get("X-SST-Token")
+		}
+
+		if token == "" {
+			token = r.FormValue("token")
+		}
+
+		user, ok := TOKENS[token]
+		return user, ok
+	}
+
+	user := r.Header.Get("X-SST-User")
+
+	if user == "" {
+		user = r.FormValue("user")
+	}
+
+	if user == "" {
+		return SST.DEFAULT_USER, true
+	}
+
+	return user, SST.ValidUserName(user)
+}
+
+// *********************************************************************
+
+func Session(r *http.Request) (string, bool) {
+
+	// A user may keep separate search contexts, e.g. one per browser tab
+
+	session := r.Header.Get("X-SST-Session")
+
+	if session == "" {
+		session = r.FormValue("session")
+	}
+
+	if session == "" {
+		return "", true
+	}
+
+	return session, SST.ValidUserName(session)
+}
+
 // *********************************************************************
 // Handlers
 // *********************************************************************
 
 func SearchN4LHandler(w http.ResponseWriter, r *http.Request) {
 
+	user, ok := Identify(r)
+
+	if !ok {
+		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	session, ok := Session(r)
+
+	if !ok {
+		http.Error(w, "Bad session name", http.StatusBadRequest)
+		return
+	}
+
+	sst := SST.ForSession(SST.ForUser(PSST, user), session)
+
 	switch r.Method {
 
 	case "POST", "GET":
@@ -190,9 +336,9 @@ func SearchN4LHandler(w http.ResponseWriter, r *http.Request) {
 
 		if name == "\\lastnptr" {
 			if chapcontext != "" && chapcontext != "any" {
-				UpdateLastSawSection(w, r, chapcontext)
+				UpdateLastSawSection(w, r, sst, chapcontext)
 			}
-			UpdateLastSawNPtr(w, r, nclass, ncptr, chapcontext)
+			UpdateLastSawNPtr(w, r, sst, nclass, ncptr, chapcontext)
 			return
 		}
 
@@ -205,7 +351,7 @@ func SearchN4LHandler(w http.ResponseWriter, r *http.Request) {
 			name = name + nstr
 		}
 
-		if len(name) == 0 || name == "\\remind" {
+		if len(name) == 0 {
 			ambient, key, _ := SST.GetTimeContext()
 			name = "any \\chapter reminders \\context any, " + key + " " + ambient + " \\limit 20"
 		}
@@ -214,11 +360,11 @@ func SearchN4LHandler(w http.ResponseWriter, r *http.Request) {
 			name = "\\notes \\chapter \"help and search\" \\limit 40"
 		}
 
-		fmt.Println("\nReceived command:", name)
+		fmt.Println("\nReceived command:", name, "from user", user)
 
 		search := SST.DecodeSearchField(name)
 
-		HandleSearch(search, name, w, r)
+		HandleSearch(sst, search, name, w, r)
 
 	default:
 		http.Error(w, "Not supported", http.StatusMethodNotAllowed)
@@ -227,18 +373,18 @@ func SearchN4LHandler(w http.ResponseWriter, r *http.Request) {
 
 // *********************************************************************
 
-func UpdateLastSawSection(w http.ResponseWriter, r *http.Request, query string) {
+func UpdateLastSawSection(w http.ResponseWriter, r *http.Request, sst SST.PoSST, query string) {
 
 	// update lastseen db
 
 	fmt.Println("UPDATING STATS FOR section", query)
 
-	SST.UpdateLastSawSection(PSST, query)
+	SST.UpdateLastSawSection(sst, query)
 }
 
 // *********************************************************************
 
-func UpdateLastSawNPtr(w http.ResponseWriter, r *http.Request, class, cptr string, classifier string) {
+func UpdateLastSawNPtr(w http.ResponseWriter, r *http.Request, sst SST.PoSST, class, cptr string, classifier string) {
 
 	// update lastseen db
 
@@ -250,11 +396,11 @@ func UpdateLastSawNPtr(w http.ResponseWriter, r *http.Request, class, cptr strin
 	nptr.Class = nclass
 	nptr.CPtr = SST.ClassedNodePtr(ncptr)
 
-	SST.UpdateLastSawNPtr(PSST, nclass, ncptr, classifier)
+	SST.UpdateLastSawNPtr(sst, nclass, ncptr, classifier)
 
 	fmt.Println("UPDATING STATS FOR", nclass, ncptr, "WITHIN", classifier)
 
-	SST.UpdateLastSawSection(PSST, classifier)
+	SST.UpdateLastSawSection(sst, classifier)
 
 	response := fmt.Sprintf("{ \"Response\" : \"LastSaw\",\n \"Content\" : \"ack(%s,%s)\" }", class, cptr)
 	w.Write([]byte(response))
@@ -263,13 +409,199 @@ func UpdateLastSawNPtr(w http.ResponseWriter, r *http.Request, class, cptr strin
 
 // *********************************************************************
 
-func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWriter, r *http.Request) {
+func OverlayHandler(w http.ResponseWriter, r *http.Request) {
+
+	// A user's private notes on shared nodes:
+	//  GET    ?chapter=      list them
+	//  POST   nclass,ncptr,note   add one
+	//  DELETE nclass,ncptr   (or POST with remove=true) forget them
+
+	user, ok := Identify(r)
+
+	if !ok {
+		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	sst := SST.ForUser(PSST, user)
+
+	var nptr SST.NodePtr
+	var ncptr int
+	fmt.Sscanf(r.FormValue("nclass"), "%d", &nptr.Class)
+	fmt.Sscanf(r.FormValue("ncptr"), "%d", &ncptr)
+	nptr.CPtr = SST.ClassedNodePtr(ncptr)
+
+	switch r.Method {
+
+	case "GET":
+
+	case "POST":
+		if r.FormValue("remove") == "" {
+			if !SST.AddUserOverlay(sst, nptr, r.FormValue("note")) {
+				http.Error(w, "Unable to add note", http.StatusBadRequest)
+				return
+			}
+			break
+		}
+		fallthrough
+
+	case "DELETE":
+		fmt.Println("Removed", SST.RemoveUserOverlays(sst, nptr), "notes for user", user)
+
+	default:
+		http.Error(w, "Not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	overlays := SST.GetUserOverlays(sst, r.FormValue("chapter"))
+
+	if overlays == nil {
+		overlays = []SST.Overlay{}
+	}
+
+	data, _ := json.Marshal(overlays)
+	response := fmt.Sprintf("{ \"Response\" : \"Overlays\",\n \"Content\" : %s }", string(data))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response))
+}
+
+// *********************************************************************
+
+func ReviewHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Spaced repetition:
+	//  GET  ?chapter=&limit=        the nodes due for review
+	//  POST nclass,ncptr,grade      record pass/fail (or 0-5), returns the rescheduled card
+
+	user, ok := Identify(r)
+
+	if !ok {
+		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	sst := SST.ForUser(PSST, user)
+
+	var items []ReviewItem
+
+	switch r.Method {
+
+	case "GET":
+		limit := 20
+		fmt.Sscanf(r.FormValue("limit"), "%d", &limit)
+
+		for _, card := range SST.GetDueReviews(sst, r.FormValue("chapter"), limit) {
+			items = append(items, ReviewItem{card, SST.GetDBNodeByNodePtr(sst, card.NPtr).S})
+		}
+
+	case "POST":
+		grade, ok := SST.ParseReviewGrade(r.FormValue("grade"))
+
+		if !ok {
+			http.Error(w, "Grade should be pass, fail, hard, easy or 0-5", http.StatusBadRequest)
+			return
+		}
+
+		var nptr SST.NodePtr
+		var ncptr int
+		fmt.Sscanf(r.FormValue("nclass"), "%d", &nptr.Class)
+		fmt.Sscanf(r.FormValue("ncptr"), "%d", &ncptr)
+		nptr.CPtr = SST.ClassedNodePtr(ncptr)
+
+		node := SST.GetDBNodeByNodePtr(sst, nptr)
+
+		if node.L == 0 {
+			http.Error(w, "No such node", http.StatusNotFound)
+			return
+		}
+
+		card := SST.RecordReview(sst, nptr, grade)
+		items = append(items, ReviewItem{card, node.S})
+
+		fmt.Println("Review of", nptr, "graded", grade, "by user", user, "next in", card.Days, "days")
+
+	default:
+		http.Error(w, "Not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if items == nil {
+		items = []ReviewItem{}
+	}
+
+	data, _ := json.Marshal(items)
+	response := fmt.Sprintf("{ \"Response\" : \"Review\",\n \"Content\" : %s }", string(data))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response))
+}
+
+// *********************************************************************
+
+func STMHandler(w http.ResponseWriter, r *http.Request) {
+
+	// The short term memory of search context, per user and session:
+	//  GET                          what is remembered, most recent first
+	//  DELETE (or POST reset=true)  forget it
+
+	user, ok := Identify(r)
+
+	if !ok {
+		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	session, ok := Session(r)
+
+	if !ok {
+		http.Error(w, "Bad session name", http.StatusBadRequest)
+		return
+	}
+
+	sst := SST.ForSession(SST.ForUser(PSST, user), session)
+
+	switch r.Method {
+
+	case "GET":
+
+	case "POST":
+		if r.FormValue("reset") == "" {
+			http.Error(w, "Use reset=true to forget the context", http.StatusBadRequest)
+			return
+		}
+		fallthrough
+
+	case "DELETE":
+		fmt.Println("Forgot", SST.ResetSTM(sst), "context fragments for user", user, "session", session)
+
+	default:
+		http.Error(w, "Not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := STMReport{user, session, int64(SST.STMForgetting().Seconds()), SST.GetSTM(sst)}
+
+	if report.Entries == nil {
+		report.Entries = []SST.STMEntry{}
+	}
+
+	data, _ := json.Marshal(report)
+	response := fmt.Sprintf("{ \"Response\" : \"STM\",\n \"Content\" : %s }", string(data))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response))
+}
+
+// *********************************************************************
+
+func HandleSearch(sst SST.PoSST, search SST.SearchParameters, line string, w http.ResponseWriter, r *http.Request) {
 
 	// This is analogous to searchN4L
 
 	// OPTIONS *********************************************
 
-	name := search.Name != nil
+	name := search.Name != nil || search.Query != ""
 	from := search.From != nil
 	to := search.To != nil
 	context := search.Context != nil
@@ -279,7 +611,7 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 
 	// Now convert strings into NodePointers
 
-	arrowptrs, sttype := SST.ArrowPtrFromArrowsNames(PSST, search.Arrows)
+	arrowptrs, sttype := SST.ArrowPtrFromArrowsNames(sst, search.Arrows)
 
 	arrows := arrowptrs != nil
 	sttypes := sttype != nil
@@ -288,6 +620,7 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 
 	fmt.Println()
 	fmt.Println("        start set:", SL(search.Name))
+	fmt.Println("            query:", search.Query)
 	fmt.Println("          finding:", SL(search.Finds))
 	fmt.Println("             from:", SL(search.From))
 	fmt.Println("               to:", SL(search.To))
@@ -300,39 +633,59 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 	fmt.Println(" at least/minimum:", minlimit)
 	fmt.Println("       show stats:", search.Stats)
 	fmt.Println("   not seen hours:", search.Horizon)
+	fmt.Println("     link weights:", search.Weighted, search.MinWgt, search.MaxWgt)
 	fmt.Println()
 
 	var nodeptrs, leftptrs, rightptrs []SST.NodePtr
 
 	if (from || to) && !pagenr && !sequence {
-		leftptrs = SST.SolveNodePtrs(PSST, search.From, search, arrowptrs, maxlimit)
-		rightptrs = SST.SolveNodePtrs(PSST, search.To, search, arrowptrs, maxlimit)
+		leftptrs = SST.SolveNodePtrs(sst, search.From, search, arrowptrs, maxlimit)
+		rightptrs = SST.SolveNodePtrs(sst, search.To, search, arrowptrs, maxlimit)
 	}
 
-	if search.Sequence && len(search.Name) == 0 {
+	if search.Sequence && len(search.Name) == 0 && search.Query == "" {
 		search.Name = append(search.Name,"any")
 	}
 
-	nodeptrs = SST.SolveNodePtrs(PSST, search.Name, search, arrowptrs, maxlimit)
+	nodeptrs = SST.SolveNodePtrs(sst, search.Name, search, arrowptrs, maxlimit)
+
+	// Most situationally relevant first, before any \query ranking
+
+	nodeptrs, ranks := SST.RankByContext(sst, nodeptrs)
+
+	if search.Query != "" {
+		ranked, _ := SST.SolveQueryNodePtrs(sst, search, arrowptrs, maxlimit)
+		nodeptrs = SST.MergeNodePtrs(ranked, nodeptrs)
+	}
 
 	fmt.Println("Solved search nodes ...")
 
 	// SEARCH SELECTION *********************************************
 
+	if search.Remind {
+		HandleAgenda(w, r, sst, search)
+		return
+	}
+
+	if format := r.FormValue("format"); format != "" {
+		HandleExport(w, r, sst, search, format, nodeptrs, leftptrs, rightptrs, arrowptrs, sttype)
+		return
+	}
+
 	// Table of contents
 
 	if search.Stats {
-		ShowStats(w, r, PSST, search, nodeptrs)
+		ShowStats(w, r, sst, search, nodeptrs)
 		return
 	}
 
 	if (context || chapter) && !name && !sequence && !pagenr && !(from || to) {
-		ShowChapterContexts(w, r, PSST, search, maxlimit)
+		ShowChapterContexts(w, r, sst, search, maxlimit)
 		return
 	}
 
 	if name && !sequence && !pagenr {
-		HandleOrbit(w, r, PSST, search, nodeptrs, maxlimit)
+		HandleOrbit(w, r, sst, search, nodeptrs, ranks, maxlimit)
 		return
 	}
 
@@ -345,7 +698,7 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 	// if we have BOTH from/to (maybe with chapter/context) then we are looking for paths
 
 	if from && to {
-		HandlePathSolve(w, r, PSST, leftptrs, rightptrs, search, arrowptrs, sttype,minlimit,maxlimit)
+		HandlePathSolve(w, r, sst, leftptrs, rightptrs, search, arrowptrs, sttype,minlimit,maxlimit)
 		return
 	}
 
@@ -354,15 +707,15 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 	if (name || from || to) && !pagenr && !sequence {
 
 		if nodeptrs != nil {
-			HandleCausalCones(w, r, PSST, nodeptrs, search, arrowptrs, sttype, maxlimit)
+			HandleCausalCones(w, r, sst, nodeptrs, search, arrowptrs, sttype, maxlimit)
 			return
 		}
 		if leftptrs != nil {
-			HandleCausalCones(w, r, PSST, leftptrs, search, arrowptrs, sttype, maxlimit)
+			HandleCausalCones(w, r, sst, leftptrs, search, arrowptrs, sttype, maxlimit)
 			return
 		}
 		if rightptrs != nil {
-			HandleCausalCones(w, r, PSST, rightptrs, search, arrowptrs, sttype, maxlimit)
+			HandleCausalCones(w, r, sst, rightptrs, search, arrowptrs, sttype, maxlimit)
 			return
 		}
 	}
@@ -379,13 +732,13 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 		}
 
 		if chapter {
-			notes = SST.GetDBPageMap(PSST, search.Chapter, search.Context, search.PageNr)
-			HandlePageMap(w, r, PSST, search, notes)
+			notes = SST.GetDBPageMap(sst, search.Chapter, search.Context, search.PageNr)
+			HandlePageMap(w, r, sst, search, notes)
 			return
 		} else {
 			for n := range search.Name {
-				notes = SST.GetDBPageMap(PSST, search.Name[n], search.Context, search.PageNr)
-				HandlePageMap(w, r, PSST, search, notes)
+				notes = SST.GetDBPageMap(sst, search.Name[n], search.Context, search.PageNr)
+				HandlePageMap(w, r, sst, search, notes)
 			}
 			return
 		}
@@ -394,21 +747,21 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 	// Look for axial trails following a particular arrow, like _sequence_
 
 	if sequence {
-		HandleStories(w, r, PSST, search, nodeptrs, arrowptrs, sttype, maxlimit)
+		HandleStories(w, r, sst, search, nodeptrs, arrowptrs, sttype, maxlimit)
 		return
 	}
 
 	// if we have sequence with arrows, then we are looking for sequence context or stories
 
 	if arrows || sttypes {
-		HandleMatchingArrows(w, r, PSST, search, arrowptrs, sttype)
+		HandleMatchingArrows(w, r, sst, search, arrowptrs, sttype)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	data,_ := json.Marshal("No solver matched this search")
-	response := PackageResponse(PSST, search, "Error", string(data))
+	response := PackageResponse(sst, search, "Error", string(data))
 
 	w.Write(response)
 
@@ -417,7 +770,75 @@ func HandleSearch(search SST.SearchParameters, line string, w http.ResponseWrite
 
 // *********************************************************************
 
-func HandleOrbit(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search SST.SearchParameters, nptrs []SST.NodePtr, limit int) {
+func HandleExport(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search SST.SearchParameters, format string, nodeptrs, leftptrs, rightptrs []SST.NodePtr, arrowptrs []SST.ArrowPtr, sttype []int) {
+
+	// A chapter, cone or path solution as a graph file, instead of JSON
+
+	fmt.Println("HandleExport()", format)
+
+	graph, ok := SST.ExportSearchGraph(sst, search, nodeptrs, leftptrs, rightptrs, arrowptrs, sttype)
+
+	if !ok {
+		http.Error(w, "Only chapters, cones and paths can be exported", http.StatusBadRequest)
+		return
+	}
+
+	out, err := SST.FormatGraph(graph, format)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", SST.GraphFormatMIME(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sst.%s\"", strings.ToLower(format)))
+	w.Write([]byte(out))
+	fmt.Println("Done/sent export")
+}
+
+// *********************************************************************
+
+func HandleAgenda(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search SST.SearchParameters) {
+
+	// Upcoming notes from the reminders chapter, or ?format=ics for a calendar
+
+	fmt.Println("HandleAgenda()")
+
+	now := time.Now()
+
+	if format := r.FormValue("format"); format != "" {
+
+		if strings.ToLower(format) != SST.EXPORT_ICS {
+			http.Error(w, "Reminders can only be exported as "+SST.EXPORT_ICS, http.StatusBadRequest)
+			return
+		}
+
+		events := SST.GetDBCalendarEvents(sst, SST.RemindChapter(search), search.Context)
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"sst.ics\"")
+		w.Write([]byte(SST.ICalendar(events, now)))
+		fmt.Println("Done/sent calendar")
+		return
+	}
+
+	agenda := SST.GetDBAgenda(sst, search, now)
+
+	if agenda == nil {
+		agenda = []SST.AgendaItem{}
+	}
+
+	data, _ := json.Marshal(agenda)
+	response := PackageResponse(sst, search, "Agenda", string(data))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+	fmt.Println("Done/sent agenda")
+}
+
+// *********************************************************************
+
+func HandleOrbit(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search SST.SearchParameters, nptrs []SST.NodePtr, ranks map[SST.NodePtr]SST.ContextRank, limit int) {
 
 	var count int
 	var array []SST.NodeEvent
@@ -434,17 +855,24 @@ func HandleOrbit(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search S
 
 		fmt.Printf("Assembling Node Orbit(%v)\n", nptrs[n])
 
-		orb := SST.GetNodeOrbit(PSST, nptrs[n], "", limit)
+		orb := SST.GetNodeOrbit(sst, nptrs[n], "", limit)
 		// create a set of coords for len(nptrs) disconnected nodes
 
 		fmt.Printf("...Setting coordinates\n")
 		xyz := SST.RelativeOrbit(origin, SST.R0, n, len(nptrs))
 		orb = SST.SetOrbitCoords(xyz, orb)
 
-		nodeevent := SST.JSONNodeEvent(PSST, nptrs[n], xyz, orb)
+		nodeevent := SST.JSONNodeEvent(sst, nptrs[n], xyz, orb)
+
+		if rank, ok := ranks[nptrs[n]]; ok {
+			nodeevent.Rank = &rank
+		}
+
 		array = append(array, nodeevent)
 	}
 
+	SST.AddNodeEventNotes(sst, array)
+
 	data, _ := json.Marshal(array)
 	response := PackageResponse(sst, search, "Orbits", string(data))
 
@@ -459,9 +887,6 @@ func HandleOrbit(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search S
 
 func HandleCausalCones(w http.ResponseWriter, r *http.Request, sst SST.PoSST, nptrs []SST.NodePtr, search SST.SearchParameters, arrows []SST.ArrowPtr, sttype []int, limit int) {
 
-	chap := search.Chapter
-	context := search.Context
-
 	fmt.Println("HandleCausalCones()", nptrs)
 	var total int = 1
 
@@ -474,7 +899,7 @@ func HandleCausalCones(w http.ResponseWriter, r *http.Request, sst SST.PoSST, np
 	for n := range nptrs {
 		for st := range sttype {
 
-			subcone, count := PackageConeFromOrigin(sst, nptrs[n], n, sttype[st], chap, context, len(nptrs), limit)
+			subcone, count := PackageConeFromOrigin(sst, nptrs[n], n, sttype[st], search, arrows, len(nptrs), limit)
 			cones = append(cones, subcone)
 
 			total += count
@@ -501,18 +926,26 @@ func HandleCausalCones(w http.ResponseWriter, r *http.Request, sst SST.PoSST, np
 
 //******************************************************************
 
-func PackageConeFromOrigin(sst SST.PoSST, nptr SST.NodePtr, nth int, sttype int, chap string, context []string, dimnptr, limit int) (SST.WebConePaths, int) {
+func PackageConeFromOrigin(sst SST.PoSST, nptr SST.NodePtr, nth int, sttype int, search SST.SearchParameters, arrows []SST.ArrowPtr, dimnptr, limit int) (SST.WebConePaths, int) {
 
 	// Package a JSON object for the nth/dimnptr causal cone , assigning each nth the same width
 
+	chap := search.Chapter
+	context := search.Context
+	minwgt,maxwgt := SST.WeightPolicy(search)
+
 	var wpaths [][]SST.WebPath
 
-	fcone, count := SST.GetFwdPathsAsLinks(PSST, nptr, sttype, limit, limit)
-	wpaths = append(wpaths, SST.LinkWebPaths(PSST, fcone, nth, chap, context, dimnptr, limit)...)
+	fcone, count := SST.GetFwdPathsAsLinks(sst, nptr, sttype, limit, limit)
+	fcone = SST.PruneConeByWeight(fcone, minwgt, maxwgt)
+	fcone = SST.PruneConeByArrows(fcone, arrows)
+	wpaths = append(wpaths, SST.LinkWebPaths(sst, fcone, nth, chap, context, dimnptr, limit)...)
 
 	if sttype != 0 {
-		bcone, countb := SST.GetFwdPathsAsLinks(PSST, nptr, -sttype, limit, limit)
-		wpaths = append(wpaths, SST.LinkWebPaths(PSST, bcone, nth, chap, context, dimnptr, limit)...)
+		bcone, countb := SST.GetFwdPathsAsLinks(sst, nptr, -sttype, limit, limit)
+		bcone = SST.PruneConeByWeight(bcone, minwgt, maxwgt)
+		bcone = SST.PruneConeByArrows(bcone, arrows)
+		wpaths = append(wpaths, SST.LinkWebPaths(sst, bcone, nth, chap, context, dimnptr, limit)...)
 		count += countb
 	}
 
@@ -530,10 +963,11 @@ func HandlePathSolve(w http.ResponseWriter, r *http.Request, sst SST.PoSST, left
 
 	chapter := search.Chapter
 	context := search.Context
+	minwgt,maxwgt := SST.WeightPolicy(search)
 
 	fmt.Println("HandlePathSolve(", leftptrs, ",", rightptrs, ")")
 
-	solutions := SST.GetPathsAndSymmetries(sst,leftptrs,rightptrs,chapter,context,arrowptrs,sttype,mindepth,maxdepth)
+	solutions := SST.GetWeightedPaths(sst,leftptrs,rightptrs,chapter,context,arrowptrs,sttype,mindepth,maxdepth,minwgt,maxwgt)
 
 	if len(solutions) > 0 {
 		// format paths
@@ -543,8 +977,13 @@ func HandlePathSolve(w http.ResponseWriter, r *http.Request, sst SST.PoSST, left
 		
 		soln.RootNode = solutions[0][0].Dst
 		soln.Title = fmt.Sprintf("paths solutions from %v to %v",search.From,search.To)
-		soln.BTWC = SST.BetweenNessCentrality(sst, solutions)
+		if search.Weighted {
+			soln.BTWC = SST.WeightedBetweenNessCentrality(sst, solutions)
+		} else {
+			soln.BTWC = SST.BetweenNessCentrality(sst, solutions)
+		}
 		soln.SuperNodes = SST.SuperNodes(sst, solutions, maxdepth)
+		soln.Weights = SST.PathWeights(solutions)
 		
 		var wpaths [][]SST.WebPath
 		nth := 0
@@ -582,11 +1021,11 @@ func HandlePageMap(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search
 
 	displayset := FilterSeen(sst,notes,search)
 
-	jstr := SST.JSONPage(PSST,displayset)
+	jstr := SST.JSONPage(sst,displayset)
 	response := PackageResponse(sst, search, "PageMap", jstr)
 
 	if notes != nil {
-		UpdateLastSawSection(w, r, notes[0].Chapter)
+		UpdateLastSawSection(w, r, sst, notes[0].Chapter)
 	}
 
 	//fmt.Println("PAGEMAP NOTES",string(response))
@@ -637,7 +1076,7 @@ func FilterSeen(sst SST.PoSST,notes []SST.PageMap,search SST.SearchParameters) [
 func HandleStories(w http.ResponseWriter, r *http.Request, sst SST.PoSST, search SST.SearchParameters, nodeptrs []SST.NodePtr, arrowptrs []SST.ArrowPtr, sttypes []int, limit int) {
 
 	if arrowptrs == nil {
-		arrowptrs, sttypes = SST.ArrowPtrFromArrowsNames(PSST, []string{"!then!"})
+		arrowptrs, sttypes = SST.ArrowPtrFromArrowsNames(sst, []string{"!then!"})
 	}
 
 	fmt.Println("Solver/handler: HandleStories()")
@@ -685,8 +1124,15 @@ func HandleMatchingArrows(w http.ResponseWriter, r *http.Request, sst SST.PoSST,
 	var arrows []ArrowList
 
 	for a := range arrowptrs {
+
+		// Excluded arrows only filter searches, they are not matches
+
+		if arrowptrs[a] < 0 {
+			continue
+		}
+
 		adir := SST.GetDBArrowByPtr(sst, arrowptrs[a])
-		inv := SST.GetDBArrowByPtr(sst, SST.INVERSE_ARROWS[arrowptrs[a]])
+		inv := SST.GetDBArrowByPtr(sst, SST.InverseArrow(arrowptrs[a]))
 
 		var al ArrowList
 		al.ArrPtr = arrowptrs[a]
@@ -704,7 +1150,7 @@ func HandleMatchingArrows(w http.ResponseWriter, r *http.Request, sst SST.PoSST,
 		for st := range sttype {
 			adirs := SST.GetDBArrowBySTType(sst, sttype[st])
 			for adir := range adirs {
-				inv := SST.GetDBArrowByPtr(sst, SST.INVERSE_ARROWS[adirs[adir].Ptr])
+				inv := SST.GetDBArrowByPtr(sst, SST.InverseArrow(adirs[adir].Ptr))
 
 				var al ArrowList
 				al.ArrPtr = adirs[adir].Ptr
@@ -894,7 +1340,7 @@ func ShowNode(sst SST.PoSST, nptr []SST.NodePtr) string {
 func PackageResponse(sst SST.PoSST, search SST.SearchParameters, kind string, jstr string) []byte {
 
 	ambien, key, now := SST.GetTimeContext()
-	now_ctx := SST.UpdateSTMContext(PSST, ambien, key, now, search)
+	now_ctx := SST.UpdateSTMContext(sst, ambien, key, now, search)
 
 	intent, _ := json.Marshal(now_ctx)
 	ambient, _ := json.Marshal(ambien)
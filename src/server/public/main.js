@@ -209,10 +209,43 @@ document.documentElement.scrollTop = 0;
 
 /************************************************************/
 
+function AuthHeaders()
+{
+// Open the page once as ?user=name or ?token=secret to be remembered
+
+const params = new URLSearchParams(window.location.search);
+
+for (const key of ["user", "token"])
+   {
+   if (params.get(key))
+      {
+      localStorage.setItem("sst_" + key, params.get(key));
+      }
+   }
+
+const headers = {};
+const user = localStorage.getItem("sst_user");
+const token = localStorage.getItem("sst_token");
+
+if (user)
+   {
+   headers["X-SST-User"] = user;
+   }
+
+if (token)
+   {
+   headers["Authorization"] = "Bearer " + token;
+   }
+
+return headers;
+}
+
+/************************************************************/
+
 async function FetchPage()
 {
 let requestURL = "/searchN4L";
-let request = new Request(requestURL);
+let request = new Request(requestURL, { headers: AuthHeaders() });
 
 try
    {
@@ -380,6 +413,9 @@ switch (obj.Response)
    case "Arrows":
       title = "Arrow lookup";
       break;
+   case "Agenda":
+      title = "Reminders ahead";
+      break;
    case "Error":
      console.log(obj.Response);
      title = obj.Content;
@@ -845,6 +881,91 @@ for (let ls of obj.Content)
 
 /***********************************************************/
 
+function DoAgendaPanel(obj)
+{
+// Upcoming reminders, one card per day
+
+let section = document.querySelector("main");
+
+let panel = document.createElement("div");
+panel.id = "main_content_panel";
+section.appendChild(panel);
+
+let title = document.createElement("h3");
+title.textContent = "Agenda";
+panel.appendChild(title);
+
+if (obj.Content == null || obj.Content.length == 0)
+   {
+   let none = document.createElement("p");
+   none.textContent = "Nothing due";
+   panel.appendChild(none);
+   return;
+   }
+
+let now = new Date();
+let lastday = "";
+let card;
+
+for (let item of obj.Content)
+   {
+   let start = new Date(item.Start);
+   let end = new Date(item.End);
+   let day = "Now";
+
+   if (start > now)
+      {
+      day = start.toDateString();
+      }
+
+   if (day != lastday)
+      {
+      lastday = day;
+      card = document.createElement("div");
+      card.setAttribute("class", "card-view");
+      panel.appendChild(card);
+
+      let heading = document.createElement("strong");
+      heading.textContent = day;
+      card.appendChild(heading);
+      }
+
+   let line = document.createElement("p");
+   line.id = "toc-panel";
+
+   let when = document.createElement("i");
+
+   if (item.AllDay)
+      {
+      when.textContent = "all day ";
+      }
+   else
+      {
+      when.textContent = start.toTimeString().substring(0,5) + "-" + end.toTimeString().substring(0,5) + " ";
+      }
+
+   when.id = "statcount";
+   line.appendChild(when);
+
+   let link = document.createElement("a");
+   link.textContent = item.Text;
+   link.onclick = function ()
+      {
+      sendLinkSearch("(" + item.NPtr.Class + "," + item.NPtr.CPtr + ")");
+      };
+   line.appendChild(link);
+
+   let recurs = document.createElement("i");
+   recurs.textContent = " (" + item.Recurs + ")";
+   recurs.id = "statcount";
+   line.appendChild(recurs);
+
+   card.appendChild(line);
+   }
+}
+
+/***********************************************************/
+
 function DoArrowsPanel(obj)
 {
 let section = document.querySelector("main");
@@ -1507,6 +1628,17 @@ if (counter == 0)
    ProgressCheckBox(setting,event.NPtr.Class,event.NPtr.CPtr,event.Chap,event.Context);
    }
 
+// Why the search put it here, given the current context
+
+if (event.Rank != null && event.Rank.Score > 0)
+   {
+   let why = document.createElement("div");
+   let whytext = document.createElement("i");
+   whytext.textContent = "ranked by context, " + event.Rank.Why;
+   why.appendChild(whytext);
+   child.appendChild(why);
+   }
+
 // See what ST-vector pathways we are part of and add notes
 CheckSingleCone(child,"[LT]",event.NPtr.Class,event.NPtr.CPtr,1,event.Orbits[Im1],event.Orbits[Il1]);
 CheckSingleCone(child,"[CN]",event.NPtr.Class,event.NPtr.CPtr,2,event.Orbits[Im2],event.Orbits[Ic2]);
@@ -1832,7 +1964,7 @@ window.location.pathname + "?search=" + encodeURIComponent(searchQuery);
 pushStateSafe(state, title, url);
 startHipnotize();
 
-fetch("/searchN4L", { method: POST_METHOD, body: formData })
+fetch("/searchN4L", { method: POST_METHOD, headers: AuthHeaders(), body: formData })
 .then((response) =>
    {
    stopHipnotize();
@@ -1874,6 +2006,9 @@ fetch("/searchN4L", { method: POST_METHOD, body: formData })
       case "STAT":
          DoStatsPanel(resp);
          break;
+      case "Agenda":
+         DoAgendaPanel(resp);
+         break;
       }
 
    const indicator = document.getElementById("scroll-indicator");
@@ -1916,7 +2051,7 @@ searchfield.value = "(" + nclass + "," + ncptr + ")";
 topFunction();
 startHipnotize();
 
-fetch("/searchN4L", { method: POST_METHOD, body: formData })
+fetch("/searchN4L", { method: POST_METHOD, headers: AuthHeaders(), body: formData })
 .then((response) =>
    {
    stopHipnotize();
@@ -1953,7 +2088,7 @@ formData.set("ncptr", ncptr);
 formData.set("name", name);
 formData.set("chapcontext", chapcontext);
 
-fetch("/searchN4L", { method: POST_METHOD, body: formData })
+fetch("/searchN4L", { method: POST_METHOD, headers: AuthHeaders(), body: formData })
 
 .then((response) =>
    {
@@ -1989,7 +2124,7 @@ searchfield.value = search;
 
 startHipnotize();
 
-fetch("/searchN4L", { method: POST_METHOD, body: formData })
+fetch("/searchN4L", { method: POST_METHOD, headers: AuthHeaders(), body: formData })
 
 .then((response) =>
    {
@@ -2036,6 +2171,9 @@ fetch("/searchN4L", { method: POST_METHOD, body: formData })
       case "Arrows":
          DoArrowsPanel(resp);
          break;
+      case "Agenda":
+         DoAgendaPanel(resp);
+         break;
       case "Error":
 	console.log(resp.Response);
 	break;
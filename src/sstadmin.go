@@ -0,0 +1,145 @@
+//******************************************************************
+//
+// Database administration: schema version status and migration
+//
+// sstadmin status
+// sstadmin migrate [-logged]
+//
+//******************************************************************
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+
+        SST "SSTorytime"
+)
+
+//******************************************************************
+
+func main() {
+
+	args := Init()
+
+	if len(os.Getenv(SST.EMBEDDED_STORE_ENV)) > 0 {
+		fmt.Println("The embedded store has no schema to migrate, nothing to do")
+		os.Exit(0)
+	}
+
+	var sst SST.PoSST
+
+	// Connect without Open(), which refuses an outdated schema
+
+	sst.DB = SST.ConnectDB()
+	sst.Store = SST.NewPostgresStore(sst.DB)
+
+	switch args[0] {
+
+	case "status":
+		Status(sst)
+
+	case "migrate":
+		Migrate(sst)
+
+	default:
+		Usage()
+	}
+
+	SST.Close(sst)
+}
+
+//**************************************************************
+
+func Init() []string {
+
+	flag.Usage = Usage
+
+	loggedPtr := flag.Bool("logged", false,"create (or convert) the tables with write-ahead logging, for durable deployments")
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) != 1 {
+		Usage()
+		os.Exit(1);
+	}
+
+	if *loggedPtr {
+		SST.LOGGED_TABLES = true
+	}
+
+	SST.MemoryInit()
+
+	return args
+}
+
+//**************************************************************
+
+func Usage() {
+
+	fmt.Printf("\n\nusage: sstadmin [-logged] status|migrate\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+//**************************************************************
+
+func Status(sst SST.PoSST) {
+
+	version := SST.GetSchemaVersion(sst)
+	applied := SST.GetAppliedMigrations(sst)
+
+	fmt.Printf("\nDatabase schema version %d, this software expects version %d\n\n",version,SST.LatestSchemaVersion())
+
+	for _,m := range SST.MIGRATIONS {
+
+		when,done := applied[m.Version]
+
+		if done {
+			fmt.Printf(" %3d. %-45s applied %s\n",m.Version,m.Name,when.Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Printf(" %3d. %-45s PENDING\n",m.Version,m.Name)
+		}
+	}
+
+	fmt.Println()
+
+	if current,why := SST.SchemaIsCurrent(sst); !current {
+		fmt.Println(why)
+	}
+}
+
+//**************************************************************
+
+func Migrate(sst SST.PoSST) {
+
+	before := SST.GetSchemaVersion(sst)
+
+	if before > SST.LatestSchemaVersion() {
+		_,why := SST.SchemaIsCurrent(sst)
+		fmt.Println(why)
+		os.Exit(-1)
+	}
+
+	err := SST.MigrateDB(sst)
+
+	if err != nil {
+		fmt.Println("Migration failed:",err)
+		os.Exit(-1)
+	}
+
+	after := SST.GetSchemaVersion(sst)
+
+	if after == before {
+		fmt.Println("Schema already at version",after)
+	} else {
+		fmt.Printf("Schema migrated from version %d to %d\n",before,after)
+	}
+
+	if SST.LOGGED_TABLES {
+		fmt.Println("Tables are now logged")
+	}
+}